@@ -3,7 +3,9 @@ package main
 import (
 	"fmt"
 	"log"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
@@ -11,29 +13,123 @@ import (
 	"github.com/aws/aws-sdk-go/aws/ec2metadata"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/elb"
+	"github.com/aws/aws-sdk-go/service/elbv2"
 	"github.com/aws/aws-sdk-go/service/route53"
+	"golang.org/x/net/publicsuffix"
 )
 
+// How long the record sets listed for a hosted zone are trusted before listing
+// them again
+var recordSetsTTL = time.Minute
+
+// Maximum number of load balancers returned by DescribeLoadBalancers at once
+const describeLoadBalancersPageSize = 400
+
+// Maximum number of record sets returned by ListResourceRecordSets at once
+const listRecordSetsPageSize = "300"
+
 type AWSClientImpl struct {
 	route53 Route53Client
 	elb     ELBClient
+	elbv2   ELBV2Client
+
+	// Record sets listed for each hosted zone, keyed by hosted zone ID
+	recordSets map[string]*zoneRecordSets
+}
+
+// zoneRecordSets holds the record sets of a hosted zone by name and type,
+// several of them for a type when they have a routing policy (i.e. weighted
+// aliases).
+type zoneRecordSets struct {
+	listedAt time.Time
+	names    map[string]map[recordSetKey][]*route53.ResourceRecordSet
+}
+
+type recordSetKey struct {
+	name       string
+	recordType string
+}
+
+// recordSetKeys sorts record set keys by name, then type.
+type recordSetKeys []recordSetKey
+
+func (k recordSetKeys) Len() int      { return len(k) }
+func (k recordSetKeys) Swap(i, j int) { k[i], k[j] = k[j], k[i] }
+func (k recordSetKeys) Less(i, j int) bool {
+	if k[i].name != k[j].name {
+		return k[i].name < k[j].name
+	}
+	return k[i].recordType < k[j].recordType
+}
+
+// Route53Record describes the alias records of a domain to its load
+// balancers, its plain A and AAAA records to the IP addresses of a load
+// balancer, or its CNAME record to any other hostname, along with everything
+// needed to create or delete them.
+type Route53Record struct {
+	DomainName         string
+	DomainHostedZoneID string
+	LoadBalancers      []Route53LoadBalancer
+	IPs                []string
+	CNAME              string
+	TTL                int64
+	Owner              string
+}
+
+// Route53LoadBalancer is a load balancer alias records point to.
+type Route53LoadBalancer struct {
+	Hostname     string
+	HostedZoneID string
+}
+
+// targets returns the hostnames of the load balancers of the record, its IP
+// addresses or the target of its CNAME record.
+func (r Route53Record) targets() []string {
+	if r.CNAME != "" {
+		return []string{r.CNAME}
+	}
+
+	if len(r.LoadBalancers) == 0 {
+		return r.IPs
+	}
+
+	var hostnames []string
+	for _, loadBalancer := range r.LoadBalancers {
+		hostnames = append(hostnames, loadBalancer.Hostname)
+	}
+
+	return hostnames
+}
+
+// Route53Change is an UPSERT or DELETE of a Route53 record.
+type Route53Change struct {
+	Action string
+	Record Route53Record
 }
 
 type AWSClient interface {
 	GetHostedZoneID(domain string) (string, error)
 	GetLoadBalancerHostedZoneID(hostname string) (string, error)
-	UpdateDNS(elbHostname, elbHostedZoneID, domainName, domainHostedZoneID string) error
+	GetDNSOwner(domainName, domainHostedZoneID string) (string, bool, error)
+	ApplyDNSChanges(changes []Route53Change) []error
+	ListDNSRecords(hostedZoneIDs []string) ([]DNSRecord, error)
 }
 
 type Route53Client interface {
 	ListHostedZonesByName(input *route53.ListHostedZonesByNameInput) (*route53.ListHostedZonesByNameOutput, error)
 	ChangeResourceRecordSets(input *route53.ChangeResourceRecordSetsInput) (*route53.ChangeResourceRecordSetsOutput, error)
+	ListResourceRecordSets(input *route53.ListResourceRecordSetsInput) (*route53.ListResourceRecordSetsOutput, error)
 }
 
 type ELBClient interface {
 	DescribeLoadBalancers(input *elb.DescribeLoadBalancersInput) (*elb.DescribeLoadBalancersOutput, error)
 }
 
+// ELBV2Client describes network and application load balancers.
+type ELBV2Client interface {
+	DescribeLoadBalancers(input *elbv2.DescribeLoadBalancersInput) (*elbv2.DescribeLoadBalancersOutput, error)
+}
+
 func NewAWSClient() (*AWSClientImpl, error) {
 	metadata := ec2metadata.New(session.New())
 
@@ -58,6 +154,7 @@ func NewAWSClient() (*AWSClientImpl, error) {
 	return &AWSClientImpl{
 		route53: route53.New(sess),
 		elb:     elb.New(sess),
+		elbv2:   elbv2.New(sess),
 	}, nil
 }
 
@@ -67,18 +164,12 @@ func (c *AWSClientImpl) GetHostedZoneID(domain string) (string, error) {
 		return "", err
 	}
 
-	listHostedZoneInput := route53.ListHostedZonesByNameInput{
-		DNSName: &tld,
-	}
-
-	hzOut, err := c.route53.ListHostedZonesByName(&listHostedZoneInput)
+	hostedZones, err := c.listHostedZones(tld)
 	if err != nil {
-		return "", fmt.Errorf("No zone found for %s: %v", tld, err)
+		return "", err
 	}
 
-	// TODO: The AWS API may return multiple pages, we should parse them all
-
-	hostedZone, err := findMostSpecificZoneForDomain(domain, hzOut.HostedZones)
+	hostedZone, err := findMostSpecificZoneForDomain(domain, hostedZones)
 	if err != nil {
 		return "", err
 	}
@@ -89,123 +180,807 @@ func (c *AWSClientImpl) GetHostedZoneID(domain string) (string, error) {
 	return zoneId, nil
 }
 
+// listHostedZones returns the hosted zones for the given domain and all its
+// subdomains, going through as many pages as needed.
+func (c *AWSClientImpl) listHostedZones(tld string) ([]*route53.HostedZone, error) {
+	var hostedZones []*route53.HostedZone
+
+	listHostedZoneInput := &route53.ListHostedZonesByNameInput{
+		DNSName: aws.String(tld),
+	}
+
+	for {
+		hzOut, err := c.route53.ListHostedZonesByName(listHostedZoneInput)
+		if err != nil {
+			return nil, fmt.Errorf("No zone found for %s: %v", tld, err)
+		}
+
+		hostedZones = append(hostedZones, hzOut.HostedZones...)
+
+		if !aws.BoolValue(hzOut.IsTruncated) {
+			break
+		}
+
+		// Zones are sorted by name with labels reversed (i.e. com.example.www),
+		// so once a page goes past the zones for tld no later page can match
+		if len(hzOut.HostedZones) > 0 {
+			lastZoneName := aws.StringValue(hzOut.HostedZones[len(hzOut.HostedZones)-1].Name)
+			tldName := domainWithTrailingDot(tld)
+			if lastZoneName != tldName && !strings.HasSuffix(lastZoneName, "."+tldName) {
+				break
+			}
+		}
+
+		listHostedZoneInput = &route53.ListHostedZonesByNameInput{
+			DNSName:      hzOut.NextDNSName,
+			HostedZoneId: hzOut.NextHostedZoneId,
+		}
+	}
+
+	return hostedZones, nil
+}
+
+// GetLoadBalancerHostedZoneID returns the hosted zone of the load balancer
+// with the given DNS name, so any legal load balancer name is supported. The
+// hosted zone is taken from the canonical table for known regions, and only
+// looked up through the API otherwise.
 func (c *AWSClientImpl) GetLoadBalancerHostedZoneID(hostname string) (string, error) {
-	elbName, err := loadBalancerNameFromHostname(hostname)
+	dnsName := strings.ToLower(strings.TrimSuffix(hostname, "."))
+
+	if hostedZoneID, ok := canonicalLoadBalancerHostedZoneID(dnsName); ok {
+		return hostedZoneID, nil
+	}
+
+	if isNetworkLoadBalancerHostname(dnsName) {
+		return c.getLoadBalancerV2HostedZoneID(dnsName)
+	}
+
+	hostedZoneID, found, err := c.findClassicLoadBalancerHostedZoneID(dnsName)
 	if err != nil {
-		return "", fmt.Errorf("Could not parse ELB hostname: %v", err)
+		return "", err
 	}
 
+	if found {
+		return hostedZoneID, nil
+	}
+
+	// Application load balancers have hostnames just like classic ones
+	return c.getLoadBalancerV2HostedZoneID(dnsName)
+}
+
+func (c *AWSClientImpl) findClassicLoadBalancerHostedZoneID(dnsName string) (string, bool, error) {
 	lbInput := &elb.DescribeLoadBalancersInput{
-		LoadBalancerNames: []*string{
-			&elbName,
-		},
+		PageSize: aws.Int64(describeLoadBalancersPageSize),
+	}
+
+	for {
+		resp, err := c.elb.DescribeLoadBalancers(lbInput)
+		if err != nil {
+			return "", false, fmt.Errorf("Could not describe load balancers: %v", err)
+		}
+
+		for _, desc := range resp.LoadBalancerDescriptions {
+			if strings.ToLower(aws.StringValue(desc.DNSName)) == dnsName {
+				return aws.StringValue(desc.CanonicalHostedZoneNameID), true, nil
+			}
+		}
+
+		if aws.StringValue(resp.NextMarker) == "" {
+			return "", false, nil
+		}
+
+		lbInput = &elb.DescribeLoadBalancersInput{
+			Marker:   resp.NextMarker,
+			PageSize: aws.Int64(describeLoadBalancersPageSize),
+		}
 	}
+}
+
+func (c *AWSClientImpl) getLoadBalancerV2HostedZoneID(dnsName string) (string, error) {
+	lbInput := &elbv2.DescribeLoadBalancersInput{
+		PageSize: aws.Int64(describeLoadBalancersPageSize),
+	}
+
+	for {
+		resp, err := c.elbv2.DescribeLoadBalancers(lbInput)
+		if err != nil {
+			return "", fmt.Errorf("Could not describe load balancers: %v", err)
+		}
+
+		for _, lb := range resp.LoadBalancers {
+			if strings.ToLower(aws.StringValue(lb.DNSName)) == dnsName {
+				return aws.StringValue(lb.CanonicalHostedZoneId), nil
+			}
+		}
+
+		if aws.StringValue(resp.NextMarker) == "" {
+			break
+		}
 
-	resp, err := c.elb.DescribeLoadBalancers(lbInput)
+		lbInput = &elbv2.DescribeLoadBalancersInput{
+			Marker:   resp.NextMarker,
+			PageSize: aws.Int64(describeLoadBalancersPageSize),
+		}
+	}
+
+	return "", fmt.Errorf("No load balancer found with DNS name %s", dnsName)
+}
+
+// isNetworkLoadBalancerHostname returns whether the hostname belongs to a
+// network load balancer (i.e. name-id.elb.us-east-1.amazonaws.com), as
+// opposed to a classic or application one (name-id.us-east-1.elb.amazonaws.com).
+func isNetworkLoadBalancerHostname(hostname string) bool {
+	labels := strings.Split(strings.ToLower(hostname), ".")
+	return len(labels) > 2 && labels[1] == "elb"
+}
+
+// isLoadBalancerHostname returns whether the given hostname is the one of an
+// AWS load balancer of any kind, which can be the target of an alias record.
+func isLoadBalancerHostname(hostname string) bool {
+	labels := strings.Split(strings.ToLower(strings.TrimSuffix(hostname, ".")), ".")
+	if len(labels) < 5 {
+		return false
+	}
+
+	suffix := strings.Join(labels[3:], ".")
+	return (suffix == "amazonaws.com" || suffix == "amazonaws.com.cn") && (labels[1] == "elb" || labels[2] == "elb")
+}
+
+// GetDNSOwner returns the ownership marker stored in the TXT record for the
+// given domain, if any, and whether an address record already exists for it.
+func (c *AWSClientImpl) GetDNSOwner(domainName, domainHostedZoneID string) (string, bool, error) {
+	recordSets, err := c.domainRecordSets(domainHostedZoneID, domainName)
 	if err != nil {
-		return "", fmt.Errorf("Could not describe load balancer: %v", err)
+		return "", false, err
+	}
+
+	name := recordSetName(domainName)
+
+	exists := false
+	for _, recordType := range addressRecordTypes {
+		if len(recordSets[recordSetKey{name, recordType}]) > 0 {
+			exists = true
+		}
+	}
+
+	// The ownership marker is kept under the _owner prefix, or on the name
+	// itself by earlier versions, next to any TXT record of someone else
+	var txts []*route53.ResourceRecordSet
+	txts = append(txts, recordSets[recordSetKey{name, "TXT"}]...)
+	txts = append(txts, recordSets[recordSetKey{recordSetName(ownerRecordName(domainName)), "TXT"}]...)
+
+	return ownerFromTXT(recordSetsValues(txts)), exists, nil
+}
+
+// ApplyDNSChanges submits the changes grouped in as few batches per hosted
+// zone as Route53 allows, returning the outcome of each change.
+func (c *AWSClientImpl) ApplyDNSChanges(changes []Route53Change) []error {
+	errs := make([]error, len(changes))
+
+	var hostedZoneIDs []string
+	zoneChanges := map[string][]int{}
+
+	for i, change := range changes {
+		hostedZoneID := change.Record.DomainHostedZoneID
+		if _, ok := zoneChanges[hostedZoneID]; !ok {
+			hostedZoneIDs = append(hostedZoneIDs, hostedZoneID)
+		}
+		zoneChanges[hostedZoneID] = append(zoneChanges[hostedZoneID], i)
 	}
 
-	descs := resp.LoadBalancerDescriptions
-	if len(descs) < 1 {
-		return "", fmt.Errorf("No load balancer found")
+	for _, hostedZoneID := range hostedZoneIDs {
+		c.applyZoneChanges(hostedZoneID, changes, zoneChanges[hostedZoneID], errs)
 	}
-	if len(descs) > 1 {
-		return "", fmt.Errorf("Multiple load balancers found")
+
+	return errs
+}
+
+// applyZoneChanges submits the changes with the given indexes, all belonging
+// to the same hosted zone, splitting them into batches within Route53 limits.
+func (c *AWSClientImpl) applyZoneChanges(hostedZoneID string, changes []Route53Change, indexes []int, errs []error) {
+	batch := &changeBatch{}
+
+	for _, i := range indexes {
+		record := changes[i].Record
+
+		recordSets, err := c.domainRecordSets(hostedZoneID, record.DomainName)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+
+		route53Changes := route53ChangesForRecord(changes[i].Action, record, recordSets)
+		if len(route53Changes) == 0 {
+			logRecordUpToDate(record.DomainName, hostedZoneID)
+			continue
+		}
+
+		if dryRun {
+			logDryRunChange(changes[i].Action, record.DomainName, hostedZoneID, record.targets())
+			continue
+		}
+
+		if !batch.fits(route53Changes) {
+			c.submitBatch(hostedZoneID, batch, errs)
+			batch = &changeBatch{}
+		}
+
+		batch.add(i, route53Changes)
+	}
+
+	if len(batch.indexes) > 0 {
+		c.submitBatch(hostedZoneID, batch, errs)
 	}
-	return aws.StringValue(descs[0].CanonicalHostedZoneNameID), nil
 }
 
-func (c *AWSClientImpl) UpdateDNS(elbHostname, elbHostedZoneID, domainName, domainHostedZoneID string) error {
+// submitBatch submits all changes in the batch at once. If that fails, each
+// record is submitted on its own, so one bad record does not hold back the
+// others and errors are reported for the records that caused them.
+func (c *AWSClientImpl) submitBatch(hostedZoneID string, batch *changeBatch, errs []error) {
+	err := c.changeDNS(hostedZoneID, batch.changes())
+	if err == nil || len(batch.indexes) == 1 {
+		for _, i := range batch.indexes {
+			errs[i] = err
+		}
+		return
+	}
+
+	log.Printf("Failed to submit batch of %d record set changes, submitting them one by one: %v\n", len(batch.indexes), err)
+
+	for j, i := range batch.indexes {
+		errs[i] = c.changeDNS(hostedZoneID, batch.recordChanges[j])
+	}
+}
+
+// route53ChangesForRecord returns the changes needed to apply the action to
+// the record, leaving out the ones that would not change anything.
+func route53ChangesForRecord(action string, record Route53Record, recordSets map[recordSetKey][]*route53.ResourceRecordSet) []*route53.Change {
+	name := recordSetName(record.DomainName)
+
+	var desired []*route53.ResourceRecordSet
+	if action != "DELETE" {
+		desired = dnsRecordSets(record)
+	}
+
+	// The ownership record is kept under the _owner prefix, as a CNAME record
+	// cannot share its name with any other record. The one kept on the name
+	// itself by earlier versions is deleted, unless it is someone else's
+	keys := []recordSetKey{
+		recordSetKey{name, "A"},
+		recordSetKey{name, "AAAA"},
+		recordSetKey{name, "CNAME"},
+		recordSetKey{name, "TXT"},
+		recordSetKey{recordSetName(ownerRecordName(record.DomainName)), "TXT"},
+	}
+
+	var deletions, upserts []*route53.Change
+
+	for _, key := range keys {
+		current := recordSets[key]
+
+		// TXT records without an ownership marker (i.e. SPF or site
+		// verification ones) were never written by us, so they are left alone
+		if key.recordType == "TXT" && len(current) > 0 && ownerFromTXT(recordSetsValues(current)) == "" {
+			continue
+		}
+
+		var keyDesired []*route53.ResourceRecordSet
+		for _, recordSet := range desired {
+			if recordSetKeyOf(recordSet) == key {
+				keyDesired = append(keyDesired, recordSet)
+			}
+		}
+
+		// Route53 rejects the whole batch when deleting a record set that
+		// does not exist or does not match exactly, so only the ones still
+		// around are deleted, as they currently are. This includes the ones
+		// no longer desired, such as the address records of the other family
+		// when the load balancer switched between IPv4 and IPv6, or the
+		// aliases to load balancers that went away
+		for _, recordSet := range current {
+			if findRecordSet(keyDesired, aws.StringValue(recordSet.SetIdentifier)) == nil {
+				deletions = append(deletions, &route53.Change{
+					Action:            aws.String("DELETE"),
+					ResourceRecordSet: recordSet,
+				})
+			}
+		}
+
+		for _, recordSet := range keyDesired {
+			if recordSetsEqual(findRecordSet(current, aws.StringValue(recordSet.SetIdentifier)), recordSet) {
+				continue
+			}
+
+			upserts = append(upserts, &route53.Change{
+				Action:            aws.String(action),
+				ResourceRecordSet: recordSet,
+			})
+		}
+	}
+
+	// Deletions go first, so records can be replaced by ones of another type
+	// or routing policy with the same name in the same batch
+	return append(deletions, upserts...)
+}
+
+// recordSetsValues returns the values of all the given record sets.
+func recordSetsValues(recordSets []*route53.ResourceRecordSet) []string {
+	var values []string
+	for _, recordSet := range recordSets {
+		for _, record := range recordSet.ResourceRecords {
+			values = append(values, aws.StringValue(record.Value))
+		}
+	}
+	return values
+}
+
+// findRecordSet returns the record set with the given set identifier among
+// the given ones, if any.
+func findRecordSet(recordSets []*route53.ResourceRecordSet, setIdentifier string) *route53.ResourceRecordSet {
+	for _, recordSet := range recordSets {
+		if aws.StringValue(recordSet.SetIdentifier) == setIdentifier {
+			return recordSet
+		}
+	}
+	return nil
+}
+
+// Route53 limits for a single ChangeResourceRecordSets request, where UPSERT
+// changes count twice
+const (
+	maxBatchRecords     = 1000
+	maxBatchValueLength = 32000
+)
+
+// changeBatch accumulates the Route53 changes of several records, keeping
+// the changes of each record together so they are applied atomically.
+type changeBatch struct {
+	indexes       []int
+	recordChanges [][]*route53.Change
+
+	records     int
+	valueLength int
+}
+
+func (b *changeBatch) fits(changes []*route53.Change) bool {
+	records, valueLength := changesSize(changes)
+
+	return len(b.indexes) == 0 || (b.records+records <= maxBatchRecords && b.valueLength+valueLength <= maxBatchValueLength)
+}
+
+func (b *changeBatch) add(index int, changes []*route53.Change) {
+	records, valueLength := changesSize(changes)
+
+	b.indexes = append(b.indexes, index)
+	b.recordChanges = append(b.recordChanges, changes)
+	b.records += records
+	b.valueLength += valueLength
+}
+
+func (b *changeBatch) changes() []*route53.Change {
+	var changes []*route53.Change
+	for _, recordChanges := range b.recordChanges {
+		changes = append(changes, recordChanges...)
+	}
+
+	return changes
+}
+
+// changesSize returns how much the changes count towards the Route53 limits
+// on the number of records and the length of their values.
+func changesSize(changes []*route53.Change) (int, int) {
+	records := 0
+	valueLength := 0
+
+	for _, change := range changes {
+		recordSet := change.ResourceRecordSet
+
+		changeRecords := len(recordSet.ResourceRecords)
+		if changeRecords == 0 {
+			changeRecords = 1
+		}
+
+		changeValueLength := 0
+		for _, record := range recordSet.ResourceRecords {
+			changeValueLength += len(aws.StringValue(record.Value))
+		}
+
+		if aws.StringValue(change.Action) == "UPSERT" {
+			changeRecords *= 2
+			changeValueLength *= 2
+		}
+
+		records += changeRecords
+		valueLength += changeValueLength
+	}
+
+	return records, valueLength
+}
+
+// changeDNS submits the changes in a single batch and, if it succeeds, applies
+// them to the record sets listed for the hosted zone as well.
+func (c *AWSClientImpl) changeDNS(domainHostedZoneID string, changes []*route53.Change) error {
 	crrsInput := &route53.ChangeResourceRecordSetsInput{
 		ChangeBatch: &route53.ChangeBatch{
-			Changes: []*route53.Change{
-				&route53.Change{
-					Action: aws.String("UPSERT"),
-					ResourceRecordSet: &route53.ResourceRecordSet{
-						AliasTarget: &route53.AliasTarget{
-							DNSName:              aws.String("dualstack." + elbHostname),
-							EvaluateTargetHealth: aws.Bool(false),
-							HostedZoneId:         aws.String(elbHostedZoneID),
-						},
-						Name: aws.String(strings.TrimLeft(domainName, ".")),
-						Type: aws.String("A"),
-					},
-				},
-			},
+			Changes: changes,
 			Comment: aws.String("Kubernetes Update to Service"),
 		},
 		HostedZoneId: aws.String(domainHostedZoneID),
 	}
 
-	if dryRun {
-		log.Printf("DRY RUN: We normally would have updated %s to point to %s (%s)\n", domainHostedZoneID, elbHostedZoneID, elbHostname)
+	_, err := c.route53.ChangeResourceRecordSets(crrsInput)
+	if err != nil {
+		// Our view of the hosted zone is likely outdated, so list it again next time
+		delete(c.recordSets, domainHostedZoneID)
+		return err
+	}
+
+	listed, ok := c.recordSets[domainHostedZoneID]
+	if !ok {
 		return nil
 	}
 
-	_, err := c.route53.ChangeResourceRecordSets(crrsInput)
+	for _, change := range changes {
+		recordSet := change.ResourceRecordSet
+		key := recordSetKeyOf(recordSet)
+
+		nameSets, ok := listed.names[key.name]
+		if !ok {
+			nameSets = map[recordSetKey][]*route53.ResourceRecordSet{}
+			listed.names[key.name] = nameSets
+		}
+
+		var sets []*route53.ResourceRecordSet
+		for _, current := range nameSets[key] {
+			if aws.StringValue(current.SetIdentifier) != aws.StringValue(recordSet.SetIdentifier) {
+				sets = append(sets, current)
+			}
+		}
+
+		if aws.StringValue(change.Action) != "DELETE" {
+			sets = append(sets, recordSet)
+		}
 
-	return err
+		if len(sets) == 0 {
+			delete(nameSets, key)
+		} else {
+			nameSets[key] = sets
+		}
+	}
+
+	return nil
 }
 
-func getTLD(domain string) (string, error) {
-	domainParts := strings.Split(domain, ".")
-	segments := len(domainParts)
+// ListDNSRecords returns the records of the given hosted zones, with aliases to
+// load balancers as CNAME records pointing to their hostname. Each hosted zone
+// takes a request per page of record sets, which are then shared with the
+// syncs that follow, as listRecordSets keeps them for recordSetsTTL.
+func (c *AWSClientImpl) ListDNSRecords(hostedZoneIDs []string) ([]DNSRecord, error) {
+	var records []DNSRecord
+
+	for _, hostedZoneID := range hostedZoneIDs {
+		names, err := c.listRecordSets(hostedZoneID)
+		if err != nil {
+			return nil, err
+		}
 
-	if segments < 3 {
-		return "", fmt.Errorf("Domain %s is invalid - it should be a fully qualified domain name and subdomain (i.e. test.example.com)", domain)
+		var keys recordSetKeys
+		for _, nameSets := range names {
+			for key := range nameSets {
+				keys = append(keys, key)
+			}
+		}
+		sort.Sort(keys)
+
+		for _, key := range keys {
+			for _, recordSet := range names[key.name][key] {
+				records = append(records, dnsRecordFromRecordSet(recordSet))
+			}
+		}
 	}
 
-	return strings.Join(domainParts[segments-2:], "."), nil
+	return records, nil
 }
 
-func domainWithTrailingDot(withoutDot string) string {
-	if withoutDot[len(withoutDot)-1:] == "." {
-		return withoutDot
+// domainRecordSets returns the record sets of the given domain along with the
+// ones of its ownership record, by name and type.
+func (c *AWSClientImpl) domainRecordSets(hostedZoneID, domainName string) (map[recordSetKey][]*route53.ResourceRecordSet, error) {
+	names, err := c.listRecordSets(hostedZoneID)
+	if err != nil {
+		return nil, err
 	}
 
-	return fmt.Sprint(withoutDot, ".")
+	sets := map[recordSetKey][]*route53.ResourceRecordSet{}
+
+	for _, name := range []string{recordSetName(domainName), recordSetName(ownerRecordName(domainName))} {
+		for key, recordSets := range names[name] {
+			sets[key] = recordSets
+		}
+	}
+
+	return sets, nil
 }
 
-func findMostSpecificZoneForDomain(domain string, zones []*route53.HostedZone) (*route53.HostedZone, error) {
-	domain = domainWithTrailingDot(domain)
-	if len(zones) < 1 {
-		return nil, fmt.Errorf("No zone found for %s", domain)
+// listRecordSets returns the record sets of the given hosted zone by name,
+// listing them from Route53 only if the ones we know of are older than
+// recordSetsTTL. Listing the whole hosted zone at once takes a request per
+// page of record sets, rather than one per name, so a sync only takes a few
+// requests no matter how many names it looks at.
+func (c *AWSClientImpl) listRecordSets(hostedZoneID string) (map[string]map[recordSetKey][]*route53.ResourceRecordSet, error) {
+	if listed, ok := c.recordSets[hostedZoneID]; ok && time.Since(listed.listedAt) < recordSetsTTL {
+		return listed.names, nil
+	}
+
+	names := map[string]map[recordSetKey][]*route53.ResourceRecordSet{}
+
+	lrrsInput := &route53.ListResourceRecordSetsInput{
+		HostedZoneId: aws.String(hostedZoneID),
+		MaxItems:     aws.String(listRecordSetsPageSize),
+	}
+
+	for {
+		resp, err := c.route53.ListResourceRecordSets(lrrsInput)
+		if err != nil {
+			return nil, &listRecordSetsError{hostedZoneID, err}
+		}
+
+		for _, recordSet := range resp.ResourceRecordSets {
+			key := recordSetKeyOf(recordSet)
+
+			if _, ok := names[key.name]; !ok {
+				names[key.name] = map[recordSetKey][]*route53.ResourceRecordSet{}
+			}
+			names[key.name][key] = append(names[key.name][key], recordSet)
+		}
+
+		if !aws.BoolValue(resp.IsTruncated) {
+			break
+		}
+
+		lrrsInput = &route53.ListResourceRecordSetsInput{
+			HostedZoneId:          aws.String(hostedZoneID),
+			MaxItems:              aws.String(listRecordSetsPageSize),
+			StartRecordIdentifier: resp.NextRecordIdentifier,
+			StartRecordName:       resp.NextRecordName,
+			StartRecordType:       resp.NextRecordType,
+		}
+	}
+
+	if c.recordSets == nil {
+		c.recordSets = map[string]*zoneRecordSets{}
+	}
+
+	c.recordSets[hostedZoneID] = &zoneRecordSets{
+		listedAt: time.Now(),
+		names:    names,
+	}
+
+	return names, nil
+}
+
+// dnsRecordSets returns the address records for the domain (aliases to its
+// load balancers, plain records with its IP addresses or a CNAME record) along
+// with their companion TXT ownership record, named after ownerRecordName.
+// Several load balancers get equally weighted aliases, as Route53 does not
+// support multivalue answer aliases.
+func dnsRecordSets(record Route53Record) []*route53.ResourceRecordSet {
+	name := strings.TrimLeft(record.DomainName, ".")
+
+	ttl := record.TTL
+	if ttl == 0 {
+		ttl = defaultTTL
 	}
 
-	var mostSpecific *route53.HostedZone
-	curLen := 0
+	if record.CNAME != "" {
+		return []*route53.ResourceRecordSet{
+			&route53.ResourceRecordSet{
+				Name: aws.String(name),
+				ResourceRecords: []*route53.ResourceRecord{
+					&route53.ResourceRecord{
+						Value: aws.String(record.CNAME),
+					},
+				},
+				TTL:  aws.Int64(ttl),
+				Type: aws.String("CNAME"),
+			},
+			ownerRecordSet(ownerRecordName(name), record.Owner),
+		}
+	}
 
-	for _, zone := range zones {
-		zoneName := aws.StringValue(zone.Name)
+	var recordSets []*route53.ResourceRecordSet
 
-		if strings.HasSuffix(domain, zoneName) && curLen < len(zoneName) {
-			curLen = len(zoneName)
-			mostSpecific = zone
+	for _, loadBalancer := range record.LoadBalancers {
+		recordSet := aliasRecordSet(name, loadBalancer)
+		if len(record.LoadBalancers) > 1 {
+			recordSet.SetIdentifier = aws.String(loadBalancer.Hostname)
+			recordSet.Weight = aws.Int64(1)
 		}
+		recordSets = append(recordSets, recordSet)
+	}
+
+	if len(record.LoadBalancers) == 0 {
+		for _, recordType := range []string{"A", "AAAA"} {
+			var resourceRecords []*route53.ResourceRecord
+			for _, ip := range record.IPs {
+				if ipRecordType(ip) == recordType {
+					resourceRecords = append(resourceRecords, &route53.ResourceRecord{
+						Value: aws.String(ip),
+					})
+				}
+			}
+
+			if len(resourceRecords) > 0 {
+				recordSets = append(recordSets, &route53.ResourceRecordSet{
+					Name:            aws.String(name),
+					ResourceRecords: resourceRecords,
+					TTL:             aws.Int64(ttl),
+					Type:            aws.String(recordType),
+				})
+			}
+		}
+	}
+
+	return append(recordSets, ownerRecordSet(ownerRecordName(name), record.Owner))
+}
+
+func ownerRecordSet(name, owner string) *route53.ResourceRecordSet {
+	return &route53.ResourceRecordSet{
+		Name: aws.String(name),
+		ResourceRecords: []*route53.ResourceRecord{
+			&route53.ResourceRecord{
+				Value: aws.String(fmt.Sprintf("%q", owner)),
+			},
+		},
+		TTL:  aws.Int64(defaultTTL),
+		Type: aws.String("TXT"),
 	}
+}
 
-	if mostSpecific == nil {
-		return nil, fmt.Errorf("No zone matches domain %s", domain)
+func aliasRecordSet(name string, loadBalancer Route53LoadBalancer) *route53.ResourceRecordSet {
+	// Network load balancers only answer to the dualstack name if they were
+	// created with IPv6 support, so they are aliased by their own name
+	aliasDNSName := "dualstack." + loadBalancer.Hostname
+	if isNetworkLoadBalancerHostname(loadBalancer.Hostname) {
+		aliasDNSName = loadBalancer.Hostname
 	}
 
-	return mostSpecific, nil
+	return &route53.ResourceRecordSet{
+		AliasTarget: &route53.AliasTarget{
+			DNSName:              aws.String(aliasDNSName),
+			EvaluateTargetHealth: aws.Bool(false),
+			HostedZoneId:         aws.String(loadBalancer.HostedZoneID),
+		},
+		Name: aws.String(name),
+		Type: aws.String("A"),
+	}
 }
 
-func loadBalancerNameFromHostname(hostname string) (string, error) {
-	var name string
-	hostnameSegments := strings.Split(hostname, "-")
+// dnsRecordFromRecordSet returns the record of the given record set, as
+// opposed to dnsRecordSets. Aliases become CNAME records pointing to the
+// hostname of their load balancer.
+func dnsRecordFromRecordSet(recordSet *route53.ResourceRecordSet) DNSRecord {
+	record := DNSRecord{
+		Name: strings.Replace(strings.TrimSuffix(aws.StringValue(recordSet.Name), "."), "\\052", "*", -1),
+		Type: aws.StringValue(recordSet.Type),
+		TTL:  aws.Int64Value(recordSet.TTL),
+	}
+
+	if recordSet.AliasTarget != nil {
+		hostname := strings.TrimSuffix(aws.StringValue(recordSet.AliasTarget.DNSName), ".")
+
+		record.Type = "CNAME"
+		record.Values = []string{strings.TrimPrefix(hostname, "dualstack.")}
+		return record
+	}
+
+	for _, resourceRecord := range recordSet.ResourceRecords {
+		value := aws.StringValue(resourceRecord.Value)
+		if record.Type == "CNAME" {
+			value = strings.TrimSuffix(value, ".")
+		}
+		record.Values = append(record.Values, value)
+	}
+
+	return record
+}
+
+func recordSetKeyOf(recordSet *route53.ResourceRecordSet) recordSetKey {
+	return recordSetKey{recordSetName(aws.StringValue(recordSet.Name)), aws.StringValue(recordSet.Type)}
+}
+
+// recordSetName returns the domain name the way Route53 reports it in
+// record sets: lower case, with a trailing dot and with wildcards escaped.
+func recordSetName(domainName string) string {
+	name := strings.ToLower(strings.TrimLeft(domainName, "."))
+	name = strings.Replace(name, "*", "\\052", -1)
+
+	return domainWithTrailingDot(name)
+}
+
+func recordSetsEqual(current, desired *route53.ResourceRecordSet) bool {
+	if current == nil || desired == nil {
+		return current == desired
+	}
 
-	if len(hostnameSegments) < 2 {
-		return "", fmt.Errorf("%s is not a valid ELB hostname", hostname)
+	if (current.AliasTarget == nil) != (desired.AliasTarget == nil) {
+		return false
 	}
 
-	name = hostnameSegments[0]
+	if current.AliasTarget != nil {
+		if recordSetName(aws.StringValue(current.AliasTarget.DNSName)) != recordSetName(aws.StringValue(desired.AliasTarget.DNSName)) ||
+			aws.StringValue(current.AliasTarget.HostedZoneId) != aws.StringValue(desired.AliasTarget.HostedZoneId) ||
+			aws.BoolValue(current.AliasTarget.EvaluateTargetHealth) != aws.BoolValue(desired.AliasTarget.EvaluateTargetHealth) {
+			return false
+		}
+	}
+
+	if aws.Int64Value(current.Weight) != aws.Int64Value(desired.Weight) {
+		return false
+	}
+
+	if aws.Int64Value(current.TTL) != aws.Int64Value(desired.TTL) {
+		return false
+	}
+
+	// Route53 does not keep the values of multi-value record sets in order
+	return sameStrings(recordSetsValues([]*route53.ResourceRecordSet{current}), recordSetsValues([]*route53.ResourceRecordSet{desired}))
+}
+
+// listRecordSetsError keeps the error returned by Route53 when listing the
+// record sets of a hosted zone, so its code can still be checked.
+type listRecordSetsError struct {
+	hostedZoneID string
+	err          error
+}
+
+func (e *listRecordSetsError) Error() string {
+	return fmt.Sprintf("Could not list record sets for %s: %v", e.hostedZoneID, e.err)
+}
+
+// zoneNotFoundError is returned when no hosted zone matches a domain, as
+// opposed to failing to list the hosted zones.
+type zoneNotFoundError struct {
+	message string
+}
+
+func (e *zoneNotFoundError) Error() string {
+	return e.message
+}
+
+// getTLD returns the registrable domain (i.e. example.co.uk) the given domain
+// belongs to, according to the Public Suffix List embedded in the binary.
+func getTLD(domain string) (string, error) {
+	tld, err := publicsuffix.EffectiveTLDPlusOne(strings.ToLower(strings.Trim(domain, ".")))
+	if err != nil {
+		return "", fmt.Errorf("Domain %s is invalid - it should be a fully qualified domain name below a public suffix (i.e. example.com or test.example.com)", domain)
+	}
+
+	return tld, nil
+}
+
+func domainWithTrailingDot(withoutDot string) string {
+	if withoutDot[len(withoutDot)-1:] == "." {
+		return withoutDot
+	}
+
+	return fmt.Sprint(withoutDot, ".")
+}
+
+func findMostSpecificZoneForDomain(domain string, zones []*route53.HostedZone) (*route53.HostedZone, error) {
+	domain = domainWithTrailingDot(domain)
+	if len(zones) < 1 {
+		return nil, &zoneNotFoundError{fmt.Sprintf("No zone found for %s", domain)}
+	}
+
+	zoneNames := make([]string, len(zones))
+	for i, zone := range zones {
+		zoneNames[i] = aws.StringValue(zone.Name)
+	}
 
-	// handle internal load balancer naming
-	if name == "internal" {
-		name = hostnameSegments[1]
+	i := mostSpecificZone(domain, zoneNames)
+	if i < 0 {
+		return nil, &zoneNotFoundError{fmt.Sprintf("No zone matches domain %s", domain)}
 	}
 
-	return name, nil
+	return zones[i], nil
 }
@@ -2,429 +2,1907 @@ package main
 
 import (
 	"errors"
+	"fmt"
+	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awsutil"
 	"github.com/aws/aws-sdk-go/service/elb"
+	"github.com/aws/aws-sdk-go/service/elbv2"
 	"github.com/aws/aws-sdk-go/service/route53"
 )
 
 type DummyRoute53Client struct {
 	t *testing.T
 
-	listHostedZonesByNameInput  *route53.ListHostedZonesByNameInput
-	listHostedZonesByNameOutput *route53.ListHostedZonesByNameOutput
-	listHostedZonesByNameError  error
+	listHostedZonesByNamePages []DummyListHostedZonesByNamePage
 
-	changeResourceRecordSetsInput *route53.ChangeResourceRecordSetsInput
-	changeResourceRecordSetsError error
+	changeResourceRecordSetsCalls []DummyChangeResourceRecordSetsCall
+	changeResourceRecordSetsCount int
+
+	listResourceRecordSetsPages []DummyListResourceRecordSetsPage
+	listResourceRecordSetsCount int
+
+	// Record sets of the hosted zone, listed at once when no page matches
+	hostedZoneRecordSets []*route53.ResourceRecordSet
+}
+
+type DummyListHostedZonesByNamePage struct {
+	input  *route53.ListHostedZonesByNameInput
+	output *route53.ListHostedZonesByNameOutput
+	err    error
+}
+
+type DummyChangeResourceRecordSetsCall struct {
+	input *route53.ChangeResourceRecordSetsInput
+	err   error
+}
+
+type DummyListResourceRecordSetsPage struct {
+	input  *route53.ListResourceRecordSetsInput
+	output *route53.ListResourceRecordSetsOutput
+	err    error
 }
 
 type DummyELBClient struct {
 	t *testing.T
 
-	describeLoadBalancersInput  *elb.DescribeLoadBalancersInput
-	describeLoadBalancersOutput *elb.DescribeLoadBalancersOutput
-	describeLoadBalancersError  error
+	describeLoadBalancersPages []DummyDescribeLoadBalancersPage
+}
+
+type DummyDescribeLoadBalancersPage struct {
+	input  *elb.DescribeLoadBalancersInput
+	output *elb.DescribeLoadBalancersOutput
+	err    error
+}
+
+type DummyELBV2Client struct {
+	t *testing.T
+
+	describeLoadBalancersPages []DummyDescribeLoadBalancersV2Page
+}
+
+type DummyDescribeLoadBalancersV2Page struct {
+	input  *elbv2.DescribeLoadBalancersInput
+	output *elbv2.DescribeLoadBalancersOutput
+	err    error
 }
 
-func (c DummyRoute53Client) ListHostedZonesByName(input *route53.ListHostedZonesByNameInput) (*route53.ListHostedZonesByNameOutput, error) {
-	expectedInput := awsutil.StringValue(c.listHostedZonesByNameInput)
+func (c *DummyRoute53Client) ListHostedZonesByName(input *route53.ListHostedZonesByNameInput) (*route53.ListHostedZonesByNameOutput, error) {
 	actualInput := awsutil.StringValue(input)
 
-	if expectedInput != actualInput {
-		c.t.Errorf("Expected input to be '%s', was '%s'", expectedInput, actualInput)
+	for _, page := range c.listHostedZonesByNamePages {
+		if awsutil.StringValue(page.input) == actualInput {
+			return page.output, page.err
+		}
 	}
 
-	return c.listHostedZonesByNameOutput, c.listHostedZonesByNameError
+	c.t.Errorf("Unexpected input '%s'", actualInput)
+	return nil, errors.New("unexpected input")
 }
 
-func (c DummyRoute53Client) ChangeResourceRecordSets(input *route53.ChangeResourceRecordSetsInput) (*route53.ChangeResourceRecordSetsOutput, error) {
-	expectedInput := awsutil.StringValue(c.changeResourceRecordSetsInput)
+func (c *DummyRoute53Client) ChangeResourceRecordSets(input *route53.ChangeResourceRecordSetsInput) (*route53.ChangeResourceRecordSetsOutput, error) {
 	actualInput := awsutil.StringValue(input)
 
+	if c.changeResourceRecordSetsCount >= len(c.changeResourceRecordSetsCalls) {
+		c.t.Errorf("Unexpected input '%s'", actualInput)
+		return nil, errors.New("unexpected input")
+	}
+
+	call := c.changeResourceRecordSetsCalls[c.changeResourceRecordSetsCount]
+	c.changeResourceRecordSetsCount++
+
+	expectedInput := awsutil.StringValue(call.input)
 	if expectedInput != actualInput {
 		c.t.Errorf("Expected input to be '%s', was '%s'", expectedInput, actualInput)
 	}
 
-	return nil, c.changeResourceRecordSetsError
+	return nil, call.err
+}
+
+func (c *DummyRoute53Client) ListResourceRecordSets(input *route53.ListResourceRecordSetsInput) (*route53.ListResourceRecordSetsOutput, error) {
+	actualInput := awsutil.StringValue(input)
+	c.listResourceRecordSetsCount++
+
+	for _, page := range c.listResourceRecordSetsPages {
+		if awsutil.StringValue(page.input) == actualInput {
+			return page.output, page.err
+		}
+	}
+
+	if c.hostedZoneRecordSets != nil && awsutil.StringValue(testListResourceRecordSetsInput(aws.StringValue(input.HostedZoneId))) == actualInput {
+		return &route53.ListResourceRecordSetsOutput{
+			IsTruncated:        aws.Bool(false),
+			ResourceRecordSets: c.hostedZoneRecordSets,
+		}, nil
+	}
+
+	c.t.Errorf("Unexpected input '%s'", actualInput)
+	return nil, errors.New("unexpected input")
+}
+
+func testListResourceRecordSetsInput(hostedZoneID string) *route53.ListResourceRecordSetsInput {
+	return &route53.ListResourceRecordSetsInput{
+		HostedZoneId: aws.String(hostedZoneID),
+		MaxItems:     aws.String("300"),
+	}
 }
 
 func (c DummyELBClient) DescribeLoadBalancers(input *elb.DescribeLoadBalancersInput) (*elb.DescribeLoadBalancersOutput, error) {
-	expectedInput := awsutil.StringValue(c.describeLoadBalancersInput)
 	actualInput := awsutil.StringValue(input)
 
-	if expectedInput != actualInput {
-		c.t.Errorf("Expected input to be '%s', was '%s'", expectedInput, actualInput)
+	for _, page := range c.describeLoadBalancersPages {
+		if awsutil.StringValue(page.input) == actualInput {
+			return page.output, page.err
+		}
+	}
+
+	c.t.Errorf("Unexpected input '%s'", actualInput)
+	return nil, errors.New("unexpected input")
+}
+
+func (c DummyELBV2Client) DescribeLoadBalancers(input *elbv2.DescribeLoadBalancersInput) (*elbv2.DescribeLoadBalancersOutput, error) {
+	actualInput := awsutil.StringValue(input)
+
+	for _, page := range c.describeLoadBalancersPages {
+		if awsutil.StringValue(page.input) == actualInput {
+			return page.output, page.err
+		}
 	}
 
-	return c.describeLoadBalancersOutput, c.describeLoadBalancersError
+	c.t.Errorf("Unexpected input '%s'", actualInput)
+	return nil, errors.New("unexpected input")
 }
 
 func TestGetHostedZoneID(t *testing.T) {
 	scenarios := []struct {
 		domain string
 
-		listHostedZonesByNameInput  *route53.ListHostedZonesByNameInput
-		listHostedZonesByNameOutput *route53.ListHostedZonesByNameOutput
-		listHostedZonesByNameError  error
+		listHostedZonesByNamePages []DummyListHostedZonesByNamePage
+
+		expectedHostedZoneID string
+		expectedError        error
+	}{
+		// Valid destination zone
+		{
+			domain: "valid.domain.com",
+
+			listHostedZonesByNamePages: []DummyListHostedZonesByNamePage{
+				{
+					input: &route53.ListHostedZonesByNameInput{
+						DNSName: aws.String("domain.com"),
+					},
+					output: &route53.ListHostedZonesByNameOutput{
+						HostedZones: []*route53.HostedZone{
+							&route53.HostedZone{
+								Name: aws.String("domain.com."),
+								Id:   aws.String("/hostedzone/ABC123"),
+							},
+						},
+					},
+				},
+			},
+
+			expectedHostedZoneID: "ABC123",
+			expectedError:        nil,
+		},
+
+		// No zone found
+		{
+			domain: "valid.domain.com",
+
+			listHostedZonesByNamePages: []DummyListHostedZonesByNamePage{
+				{
+					input: &route53.ListHostedZonesByNameInput{
+						DNSName: aws.String("domain.com"),
+					},
+					err: errors.New("error"),
+				},
+			},
+
+			expectedHostedZoneID: "",
+			expectedError:        errors.New("No zone found for domain.com: error"),
+		},
+
+		// Valid apex domain
+		{
+			domain: "domain.com",
+
+			listHostedZonesByNamePages: []DummyListHostedZonesByNamePage{
+				{
+					input: &route53.ListHostedZonesByNameInput{
+						DNSName: aws.String("domain.com"),
+					},
+					output: &route53.ListHostedZonesByNameOutput{
+						HostedZones: []*route53.HostedZone{
+							&route53.HostedZone{
+								Name: aws.String("domain.com."),
+								Id:   aws.String("/hostedzone/ABC123"),
+							},
+						},
+					},
+				},
+			},
+
+			expectedHostedZoneID: "ABC123",
+			expectedError:        nil,
+		},
+
+		// Valid domain under a multi-label public suffix
+		{
+			domain: "app.domain.co.uk",
+
+			listHostedZonesByNamePages: []DummyListHostedZonesByNamePage{
+				{
+					input: &route53.ListHostedZonesByNameInput{
+						DNSName: aws.String("domain.co.uk"),
+					},
+					output: &route53.ListHostedZonesByNameOutput{
+						HostedZones: []*route53.HostedZone{
+							&route53.HostedZone{
+								Name: aws.String("domain.co.uk."),
+								Id:   aws.String("/hostedzone/ABC123"),
+							},
+						},
+					},
+				},
+			},
+
+			expectedHostedZoneID: "ABC123",
+			expectedError:        nil,
+		},
+
+		// Invalid domain according to getTLD
+		{
+			domain: "co.uk",
+
+			expectedHostedZoneID: "",
+			expectedError:        errors.New("Domain co.uk is invalid - it should be a fully qualified domain name below a public suffix (i.e. example.com or test.example.com)"),
+		},
+
+		// Invalid domain according to findMostSpecificZoneForDomain (sanity check)
+		{
+			domain: "valid.domain.com",
+
+			listHostedZonesByNamePages: []DummyListHostedZonesByNamePage{
+				{
+					input: &route53.ListHostedZonesByNameInput{
+						DNSName: aws.String("domain.com"),
+					},
+					output: &route53.ListHostedZonesByNameOutput{
+						HostedZones: []*route53.HostedZone{
+							&route53.HostedZone{
+								Name: aws.String("other.com."),
+								Id:   aws.String("/hostedzone/ABC123"),
+							},
+						},
+					},
+				},
+			},
+
+			expectedHostedZoneID: "",
+			expectedError:        errors.New("No zone matches domain valid.domain.com."),
+		},
+
+		// More specific zone on a later page
+		{
+			domain: "www.sub.domain.com",
+
+			listHostedZonesByNamePages: []DummyListHostedZonesByNamePage{
+				{
+					input: &route53.ListHostedZonesByNameInput{
+						DNSName: aws.String("domain.com"),
+					},
+					output: &route53.ListHostedZonesByNameOutput{
+						HostedZones: []*route53.HostedZone{
+							&route53.HostedZone{
+								Name: aws.String("domain.com."),
+								Id:   aws.String("/hostedzone/ABC123"),
+							},
+						},
+						IsTruncated:      aws.Bool(true),
+						NextDNSName:      aws.String("sub.domain.com."),
+						NextHostedZoneId: aws.String("DEF456"),
+					},
+				},
+				{
+					input: &route53.ListHostedZonesByNameInput{
+						DNSName:      aws.String("sub.domain.com."),
+						HostedZoneId: aws.String("DEF456"),
+					},
+					output: &route53.ListHostedZonesByNameOutput{
+						HostedZones: []*route53.HostedZone{
+							&route53.HostedZone{
+								Name: aws.String("sub.domain.com."),
+								Id:   aws.String("/hostedzone/DEF456"),
+							},
+						},
+					},
+				},
+			},
+
+			expectedHostedZoneID: "DEF456",
+			expectedError:        nil,
+		},
+
+		// Stops listing once past the zones for the domain
+		{
+			domain: "valid.domain.com",
+
+			listHostedZonesByNamePages: []DummyListHostedZonesByNamePage{
+				{
+					input: &route53.ListHostedZonesByNameInput{
+						DNSName: aws.String("domain.com"),
+					},
+					output: &route53.ListHostedZonesByNameOutput{
+						HostedZones: []*route53.HostedZone{
+							&route53.HostedZone{
+								Name: aws.String("domain.com."),
+								Id:   aws.String("/hostedzone/ABC123"),
+							},
+							&route53.HostedZone{
+								Name: aws.String("otherdomain.com."),
+								Id:   aws.String("/hostedzone/DEF456"),
+							},
+						},
+						IsTruncated:      aws.Bool(true),
+						NextDNSName:      aws.String("zzz.com."),
+						NextHostedZoneId: aws.String("GHI789"),
+					},
+				},
+			},
+
+			expectedHostedZoneID: "ABC123",
+			expectedError:        nil,
+		},
+
+		// Error on a later page
+		{
+			domain: "valid.domain.com",
+
+			listHostedZonesByNamePages: []DummyListHostedZonesByNamePage{
+				{
+					input: &route53.ListHostedZonesByNameInput{
+						DNSName: aws.String("domain.com"),
+					},
+					output: &route53.ListHostedZonesByNameOutput{
+						HostedZones: []*route53.HostedZone{
+							&route53.HostedZone{
+								Name: aws.String("domain.com."),
+								Id:   aws.String("/hostedzone/ABC123"),
+							},
+						},
+						IsTruncated:      aws.Bool(true),
+						NextDNSName:      aws.String("sub.domain.com."),
+						NextHostedZoneId: aws.String("DEF456"),
+					},
+				},
+				{
+					input: &route53.ListHostedZonesByNameInput{
+						DNSName:      aws.String("sub.domain.com."),
+						HostedZoneId: aws.String("DEF456"),
+					},
+					err: errors.New("error"),
+				},
+			},
+
+			expectedHostedZoneID: "",
+			expectedError:        errors.New("No zone found for domain.com: error"),
+		},
+	}
+
+	for _, scenario := range scenarios {
+		awsClient := &AWSClientImpl{
+			route53: &DummyRoute53Client{
+				t: t,
+
+				listHostedZonesByNamePages: scenario.listHostedZonesByNamePages,
+			},
+		}
+
+		hostedZoneID, err := awsClient.GetHostedZoneID(scenario.domain)
+
+		if err != nil && err.Error() != scenario.expectedError.Error() {
+			t.Errorf("Expected error to be '%v', was '%v'", scenario.expectedError, err)
+		} else if hostedZoneID != scenario.expectedHostedZoneID {
+			t.Errorf("Expected hosted zone to be '%s', was '%s'", scenario.expectedHostedZoneID, hostedZoneID)
+		}
+	}
+}
+
+func testLoadBalancerDescription(name, dnsName, hostedZoneID string) *elb.LoadBalancerDescription {
+	return &elb.LoadBalancerDescription{
+		LoadBalancerName:          aws.String(name),
+		DNSName:                   aws.String(dnsName),
+		CanonicalHostedZoneNameID: aws.String(hostedZoneID),
+	}
+}
+
+func TestGetLoadBalancerHostedZoneID(t *testing.T) {
+	firstPage := DummyDescribeLoadBalancersPage{
+		input: &elb.DescribeLoadBalancersInput{
+			PageSize: aws.Int64(400),
+		},
+		output: &elb.DescribeLoadBalancersOutput{
+			LoadBalancerDescriptions: []*elb.LoadBalancerDescription{
+				testLoadBalancerDescription("testpublic", "testpublic-1111111111.xx-unknown-1.elb.amazonaws.com", "ELBZONEID1"),
+				testLoadBalancerDescription("my-hyphenated-elb", "my-hyphenated-elb-3333333333.xx-unknown-1.elb.amazonaws.com", "ELBZONEID2"),
+			},
+			NextMarker: aws.String("MARKER"),
+		},
+	}
+
+	emptyPage := DummyDescribeLoadBalancersPage{
+		input: &elb.DescribeLoadBalancersInput{
+			PageSize: aws.Int64(400),
+		},
+		output: &elb.DescribeLoadBalancersOutput{},
+	}
+
+	v2Page := DummyDescribeLoadBalancersV2Page{
+		input: &elbv2.DescribeLoadBalancersInput{
+			PageSize: aws.Int64(400),
+		},
+		output: &elbv2.DescribeLoadBalancersOutput{
+			LoadBalancers: []*elbv2.LoadBalancer{
+				&elbv2.LoadBalancer{
+					LoadBalancerName:      aws.String("my-nlb"),
+					DNSName:               aws.String("my-nlb-0123456789abcdef.elb.xx-unknown-1.amazonaws.com"),
+					CanonicalHostedZoneId: aws.String("NLBZONEID"),
+					Type:                  aws.String("network"),
+				},
+				&elbv2.LoadBalancer{
+					LoadBalancerName:      aws.String("my-alb"),
+					DNSName:               aws.String("my-alb-4444444444.xx-unknown-1.elb.amazonaws.com"),
+					CanonicalHostedZoneId: aws.String("ALBZONEID"),
+					Type:                  aws.String("application"),
+				},
+			},
+		},
+	}
+
+	scenarios := []struct {
+		hostname string
+
+		describeLoadBalancersPages   []DummyDescribeLoadBalancersPage
+		describeLoadBalancersV2Pages []DummyDescribeLoadBalancersV2Page
+
+		expectedZoneID string
+		expectedError  error
+	}{
+		// Error when trying to describe the load balancers
+		{
+			hostname: "testpublic-1111111111.xx-unknown-1.elb.amazonaws.com",
+
+			describeLoadBalancersPages: []DummyDescribeLoadBalancersPage{
+				{
+					input: &elb.DescribeLoadBalancersInput{
+						PageSize: aws.Int64(400),
+					},
+					err: errors.New("error"),
+				},
+			},
+
+			expectedZoneID: "",
+			expectedError:  errors.New("Could not describe load balancers: error"),
+		},
+
+		// Load balancer found on the first page
+		{
+			hostname: "testpublic-1111111111.xx-unknown-1.elb.amazonaws.com",
+
+			describeLoadBalancersPages: []DummyDescribeLoadBalancersPage{firstPage},
+
+			expectedZoneID: "ELBZONEID1",
+			expectedError:  nil,
+		},
+
+		// Load balancer with hyphens in its name
+		{
+			hostname: "my-hyphenated-elb-3333333333.xx-unknown-1.elb.amazonaws.com",
+
+			describeLoadBalancersPages: []DummyDescribeLoadBalancersPage{firstPage},
+
+			expectedZoneID: "ELBZONEID2",
+			expectedError:  nil,
+		},
+
+		// Internal load balancer on a later page, hostname in a different case
+		{
+			hostname: "Internal-My-Internal-ELB-2222222222.xx-unknown-1.elb.amazonaws.com.",
+
+			describeLoadBalancersPages: []DummyDescribeLoadBalancersPage{
+				firstPage,
+				{
+					input: &elb.DescribeLoadBalancersInput{
+						Marker:   aws.String("MARKER"),
+						PageSize: aws.Int64(400),
+					},
+					output: &elb.DescribeLoadBalancersOutput{
+						LoadBalancerDescriptions: []*elb.LoadBalancerDescription{
+							testLoadBalancerDescription("my-internal-elb", "internal-my-internal-elb-2222222222.xx-unknown-1.elb.amazonaws.com", "ELBZONEID3"),
+						},
+					},
+				},
+			},
+
+			expectedZoneID: "ELBZONEID3",
+			expectedError:  nil,
+		},
+
+		// No load balancer found in any page
+		{
+			hostname: "internal-testpublic-1111111111.xx-unknown-1.elb.amazonaws.com",
+
+			describeLoadBalancersPages: []DummyDescribeLoadBalancersPage{
+				firstPage,
+				{
+					input: &elb.DescribeLoadBalancersInput{
+						Marker:   aws.String("MARKER"),
+						PageSize: aws.Int64(400),
+					},
+					output: &elb.DescribeLoadBalancersOutput{
+						LoadBalancerDescriptions: []*elb.LoadBalancerDescription{},
+					},
+				},
+			},
+			describeLoadBalancersV2Pages: []DummyDescribeLoadBalancersV2Page{v2Page},
+
+			expectedZoneID: "",
+			expectedError:  errors.New("No load balancer found with DNS name internal-testpublic-1111111111.xx-unknown-1.elb.amazonaws.com"),
+		},
+
+		// Error on a later page
+		{
+			hostname: "internal-testpublic-1111111111.xx-unknown-1.elb.amazonaws.com",
+
+			describeLoadBalancersPages: []DummyDescribeLoadBalancersPage{
+				firstPage,
+				{
+					input: &elb.DescribeLoadBalancersInput{
+						Marker:   aws.String("MARKER"),
+						PageSize: aws.Int64(400),
+					},
+					err: errors.New("error"),
+				},
+			},
+
+			expectedZoneID: "",
+			expectedError:  errors.New("Could not describe load balancers: error"),
+		},
+
+		// Network load balancer, looked up through elbv2 only
+		{
+			hostname: "my-nlb-0123456789abcdef.elb.xx-unknown-1.amazonaws.com",
+
+			describeLoadBalancersV2Pages: []DummyDescribeLoadBalancersV2Page{v2Page},
+
+			expectedZoneID: "NLBZONEID",
+			expectedError:  nil,
+		},
+
+		// Application load balancer, not found among the classic ones
+		{
+			hostname: "my-alb-4444444444.xx-unknown-1.elb.amazonaws.com",
+
+			describeLoadBalancersPages:   []DummyDescribeLoadBalancersPage{emptyPage},
+			describeLoadBalancersV2Pages: []DummyDescribeLoadBalancersV2Page{v2Page},
+
+			expectedZoneID: "ALBZONEID",
+			expectedError:  nil,
+		},
+
+		// Error when trying to describe the elbv2 load balancers
+		{
+			hostname: "my-nlb-0123456789abcdef.elb.xx-unknown-1.amazonaws.com",
+
+			describeLoadBalancersV2Pages: []DummyDescribeLoadBalancersV2Page{
+				{
+					input: &elbv2.DescribeLoadBalancersInput{
+						PageSize: aws.Int64(400),
+					},
+					err: errors.New("error"),
+				},
+			},
+
+			expectedZoneID: "",
+			expectedError:  errors.New("Could not describe load balancers: error"),
+		},
+
+		// Network load balancer on a later elbv2 page
+		{
+			hostname: "other-nlb-fedcba9876543210.elb.xx-unknown-1.amazonaws.com",
+
+			describeLoadBalancersV2Pages: []DummyDescribeLoadBalancersV2Page{
+				{
+					input:  v2Page.input,
+					output: &elbv2.DescribeLoadBalancersOutput{NextMarker: aws.String("MARKER")},
+				},
+				{
+					input: &elbv2.DescribeLoadBalancersInput{
+						Marker:   aws.String("MARKER"),
+						PageSize: aws.Int64(400),
+					},
+					output: &elbv2.DescribeLoadBalancersOutput{
+						LoadBalancers: []*elbv2.LoadBalancer{
+							&elbv2.LoadBalancer{
+								DNSName:               aws.String("other-nlb-fedcba9876543210.elb.xx-unknown-1.amazonaws.com"),
+								CanonicalHostedZoneId: aws.String("NLBZONEID2"),
+							},
+						},
+					},
+				},
+			},
+
+			expectedZoneID: "NLBZONEID2",
+			expectedError:  nil,
+		},
+	}
+
+	for _, scenario := range scenarios {
+		awsClient := &AWSClientImpl{
+			elb: &DummyELBClient{
+				t: t,
+
+				describeLoadBalancersPages: scenario.describeLoadBalancersPages,
+			},
+			elbv2: &DummyELBV2Client{
+				t: t,
+
+				describeLoadBalancersPages: scenario.describeLoadBalancersV2Pages,
+			},
+		}
+
+		zoneID, err := awsClient.GetLoadBalancerHostedZoneID(scenario.hostname)
+
+		if err != nil && (scenario.expectedError == nil || err.Error() != scenario.expectedError.Error()) {
+			t.Errorf("Expected error to be '%v', was '%v'", scenario.expectedError, err)
+		} else if err == nil && scenario.expectedError != nil {
+			t.Errorf("Expected error to be '%v', was nil", scenario.expectedError)
+		} else if zoneID != scenario.expectedZoneID {
+			t.Errorf("Expected hosted zone to be '%s', was '%s'", scenario.expectedZoneID, zoneID)
+		}
+	}
+}
+
+func TestGetDNSOwner(t *testing.T) {
+	owner := "heritage=kubernetes-service-dns-update,cluster=default,service=default/test"
+
+	scenarios := []struct {
+		domainName string
+
+		recordSets                  []*route53.ResourceRecordSet
+		listResourceRecordSetsPages []DummyListResourceRecordSetsPage
+
+		expectedOwner  string
+		expectedExists bool
+		expectedError  error
+	}{
+		// No record sets for the domain
+		{
+			domainName: "test.domain.com",
+
+			recordSets: []*route53.ResourceRecordSet{
+				&route53.ResourceRecordSet{
+					Name: aws.String("www.domain.com."),
+					Type: aws.String("A"),
+				},
+			},
+
+			expectedOwner:  "",
+			expectedExists: false,
+			expectedError:  nil,
+		},
+
+		// Record set without ownership marker
+		{
+			domainName: "test.domain.com",
+
+			recordSets: []*route53.ResourceRecordSet{
+				&route53.ResourceRecordSet{
+					Name: aws.String("test.domain.com."),
+					Type: aws.String("CNAME"),
+				},
+				&route53.ResourceRecordSet{
+					Name: aws.String("test.domain.com."),
+					ResourceRecords: []*route53.ResourceRecord{
+						&route53.ResourceRecord{
+							Value: aws.String("\"v=spf1 -all\""),
+						},
+					},
+					Type: aws.String("TXT"),
+				},
+			},
+
+			expectedOwner:  "",
+			expectedExists: true,
+			expectedError:  nil,
+		},
+
+		// Record set with ownership marker
+		{
+			domainName: ".domain.com",
+
+			recordSets: []*route53.ResourceRecordSet{
+				&route53.ResourceRecordSet{
+					Name: aws.String("domain.com."),
+					Type: aws.String("A"),
+				},
+				&route53.ResourceRecordSet{
+					Name: aws.String("domain.com."),
+					Type: aws.String("NS"),
+				},
+				&route53.ResourceRecordSet{
+					Name: aws.String("domain.com."),
+					ResourceRecords: []*route53.ResourceRecord{
+						&route53.ResourceRecord{
+							Value: aws.String("\"" + owner + "\""),
+						},
+					},
+					Type: aws.String("TXT"),
+				},
+			},
+
+			expectedOwner:  owner,
+			expectedExists: true,
+			expectedError:  nil,
+		},
+
+		// CNAME record with its ownership marker under the _owner prefix
+		{
+			domainName: "test.domain.com",
+
+			recordSets: []*route53.ResourceRecordSet{
+				&route53.ResourceRecordSet{
+					Name: aws.String("test.domain.com."),
+					Type: aws.String("CNAME"),
+				},
+				testOwnerRecordSet("_owner.test.domain.com.", owner),
+			},
+
+			expectedOwner:  owner,
+			expectedExists: true,
+			expectedError:  nil,
+		},
+
+		// Ownership marker under the _owner prefix, next to someone else's TXT record
+		{
+			domainName: "test.domain.com",
+
+			recordSets: []*route53.ResourceRecordSet{
+				testAliasRecordSet("test.domain.com."),
+				testSPFRecordSet("test.domain.com."),
+				testOwnerRecordSet("_owner.test.domain.com.", owner),
+			},
+
+			expectedOwner:  owner,
+			expectedExists: true,
+			expectedError:  nil,
+		},
+
+		// Ownership marker left behind without the alias
+		{
+			domainName: "Test.Domain.com",
+
+			recordSets: []*route53.ResourceRecordSet{
+				&route53.ResourceRecordSet{
+					Name: aws.String("test.domain.com."),
+					ResourceRecords: []*route53.ResourceRecord{
+						&route53.ResourceRecord{
+							Value: aws.String("\"" + owner + "\""),
+						},
+					},
+					Type: aws.String("TXT"),
+				},
+			},
+
+			expectedOwner:  owner,
+			expectedExists: false,
+			expectedError:  nil,
+		},
+
+		// Error when trying to list record sets
+		{
+			domainName: "test.domain.com",
+
+			listResourceRecordSetsPages: []DummyListResourceRecordSetsPage{
+				{testListResourceRecordSetsInput("DNS123"), nil, errors.New("error")},
+			},
+
+			expectedError: errors.New("Could not list record sets for DNS123: error"),
+		},
+	}
+
+	for _, scenario := range scenarios {
+		awsClient := &AWSClientImpl{
+			route53: &DummyRoute53Client{
+				t: t,
+
+				listResourceRecordSetsPages: scenario.listResourceRecordSetsPages,
+				hostedZoneRecordSets:        append([]*route53.ResourceRecordSet{}, scenario.recordSets...),
+			},
+		}
+
+		owner, exists, err := awsClient.GetDNSOwner(scenario.domainName, "DNS123")
+
+		if err != nil && err.Error() != scenario.expectedError.Error() {
+			t.Errorf("Expected error to be '%v', was '%v'", scenario.expectedError, err)
+		} else if owner != scenario.expectedOwner {
+			t.Errorf("Expected owner to be '%s', was '%s'", scenario.expectedOwner, owner)
+		} else if exists != scenario.expectedExists {
+			t.Errorf("Expected exists to be '%v', was '%v'", scenario.expectedExists, exists)
+		}
+	}
+}
+
+func TestListRecordSetsPagination(t *testing.T) {
+	weightedAliasRecordSet := func(setIdentifier string) *route53.ResourceRecordSet {
+		return &route53.ResourceRecordSet{
+			AliasTarget:   testAliasRecordSet("test.domain.com.").AliasTarget,
+			Name:          aws.String("test.domain.com."),
+			SetIdentifier: aws.String(setIdentifier),
+			Type:          aws.String("A"),
+			Weight:        aws.Int64(1),
+		}
+	}
+
+	route53Client := &DummyRoute53Client{
+		t: t,
+
+		listResourceRecordSetsPages: []DummyListResourceRecordSetsPage{
+			{
+				input: testListResourceRecordSetsInput("DNS123"),
+				output: &route53.ListResourceRecordSetsOutput{
+					IsTruncated:          aws.Bool(true),
+					ResourceRecordSets:   []*route53.ResourceRecordSet{testSPFRecordSet("domain.com."), weightedAliasRecordSet("first")},
+					NextRecordIdentifier: aws.String("second"),
+					NextRecordName:       aws.String("test.domain.com."),
+					NextRecordType:       aws.String("A"),
+				},
+			},
+			{
+				input: &route53.ListResourceRecordSetsInput{
+					HostedZoneId:          aws.String("DNS123"),
+					MaxItems:              aws.String("300"),
+					StartRecordIdentifier: aws.String("second"),
+					StartRecordName:       aws.String("test.domain.com."),
+					StartRecordType:       aws.String("A"),
+				},
+				output: &route53.ListResourceRecordSetsOutput{
+					IsTruncated: aws.Bool(true),
+					ResourceRecordSets: []*route53.ResourceRecordSet{
+						weightedAliasRecordSet("second"),
+						testAliasRecordSet("www.test.domain.com."),
+					},
+					NextRecordName: aws.String("_owner.test.domain.com."),
+					NextRecordType: aws.String("TXT"),
+				},
+			},
+			{
+				input: &route53.ListResourceRecordSetsInput{
+					HostedZoneId:    aws.String("DNS123"),
+					MaxItems:        aws.String("300"),
+					StartRecordName: aws.String("_owner.test.domain.com."),
+					StartRecordType: aws.String("TXT"),
+				},
+				output: &route53.ListResourceRecordSetsOutput{
+					IsTruncated: aws.Bool(false),
+					ResourceRecordSets: []*route53.ResourceRecordSet{
+						testOwnerRecordSet("_owner.test.domain.com.", "heritage=kubernetes-service-dns-update,cluster=default,service=default/test"),
+					},
+				},
+			},
+		},
+	}
+
+	awsClient := &AWSClientImpl{
+		route53: route53Client,
+	}
+
+	// Every page of the hosted zone is listed once, and shared by its names
+	for _, domainName := range []string{"test.domain.com", "Test.Domain.com"} {
+		recordSets, err := awsClient.domainRecordSets("DNS123", domainName)
+		if err != nil {
+			t.Error("Unexpected error: ", err)
+		}
+
+		expected := map[recordSetKey][]*route53.ResourceRecordSet{
+			recordSetKey{"test.domain.com.", "A"}:          []*route53.ResourceRecordSet{weightedAliasRecordSet("first"), weightedAliasRecordSet("second")},
+			recordSetKey{"_owner.test.domain.com.", "TXT"}: []*route53.ResourceRecordSet{testOwnerRecordSet("_owner.test.domain.com.", "heritage=kubernetes-service-dns-update,cluster=default,service=default/test")},
+		}
+
+		if !reflect.DeepEqual(recordSets, expected) {
+			t.Errorf("Expected record sets to be '%v', was '%v'", expected, recordSets)
+		}
+	}
+
+	recordSets, err := awsClient.domainRecordSets("DNS123", "www.test.domain.com")
+	if err != nil {
+		t.Error("Unexpected error: ", err)
+	}
+
+	expected := map[recordSetKey][]*route53.ResourceRecordSet{
+		recordSetKey{"www.test.domain.com.", "A"}: []*route53.ResourceRecordSet{testAliasRecordSet("www.test.domain.com.")},
+	}
+
+	if !reflect.DeepEqual(recordSets, expected) {
+		t.Errorf("Expected record sets to be '%v', was '%v'", expected, recordSets)
+	}
+
+	if route53Client.listResourceRecordSetsCount != 3 {
+		t.Errorf("Expected 3 pages of record sets to be listed, were %d", route53Client.listResourceRecordSetsCount)
+	}
+}
+
+func TestListDNSRecords(t *testing.T) {
+	owner := "heritage=kubernetes-service-dns-update,cluster=default,service=default/test"
+
+	route53Client := &DummyRoute53Client{
+		t: t,
+
+		listResourceRecordSetsPages: []DummyListResourceRecordSetsPage{
+			{
+				input: testListResourceRecordSetsInput("DNS123"),
+				output: &route53.ListResourceRecordSetsOutput{
+					IsTruncated:        aws.Bool(true),
+					ResourceRecordSets: []*route53.ResourceRecordSet{testSPFRecordSet("domain.com."), testAliasRecordSet("\\052.domain.com.")},
+					NextRecordName:     aws.String("_owner.\\052.domain.com."),
+					NextRecordType:     aws.String("TXT"),
+				},
+			},
+			{
+				input: &route53.ListResourceRecordSetsInput{
+					HostedZoneId:    aws.String("DNS123"),
+					MaxItems:        aws.String("300"),
+					StartRecordName: aws.String("_owner.\\052.domain.com."),
+					StartRecordType: aws.String("TXT"),
+				},
+				output: &route53.ListResourceRecordSetsOutput{
+					IsTruncated:        aws.Bool(false),
+					ResourceRecordSets: []*route53.ResourceRecordSet{testOwnerRecordSet("_owner.\\052.domain.com.", owner)},
+				},
+			},
+			{
+				input: testListResourceRecordSetsInput("DNS456"),
+				output: &route53.ListResourceRecordSetsOutput{
+					IsTruncated: aws.Bool(false),
+					ResourceRecordSets: []*route53.ResourceRecordSet{
+						&route53.ResourceRecordSet{
+							Name:            aws.String("www.otherdomain.com."),
+							ResourceRecords: []*route53.ResourceRecord{&route53.ResourceRecord{Value: aws.String("other.hostname.example.net.")}},
+							TTL:             aws.Int64(60),
+							Type:            aws.String("CNAME"),
+						},
+					},
+				},
+			},
+		},
+	}
+
+	awsClient := &AWSClientImpl{
+		route53: route53Client,
+	}
+
+	records, err := awsClient.ListDNSRecords([]string{"DNS123", "DNS456"})
+	if err != nil {
+		t.Error("Unexpected error: ", err)
+	}
+
+	expected := []DNSRecord{
+		DNSRecord{Name: "*.domain.com", Type: "CNAME", Values: []string{"testpublic-1111111111.us-east-1.elb.amazonaws.com"}},
+		DNSRecord{Name: "_owner.*.domain.com", Type: "TXT", TTL: 300, Values: []string{"\"" + owner + "\""}},
+		DNSRecord{Name: "domain.com", Type: "TXT", TTL: 3600, Values: []string{"\"v=spf1 -all\""}},
+		DNSRecord{Name: "www.otherdomain.com", Type: "CNAME", TTL: 60, Values: []string{"other.hostname.example.net"}},
+	}
+
+	if !reflect.DeepEqual(records, expected) {
+		t.Errorf("Expected records to be '%v', was '%v'", expected, records)
+	}
+}
+
+func testAliasRecordSet(name string) *route53.ResourceRecordSet {
+	return &route53.ResourceRecordSet{
+		AliasTarget: &route53.AliasTarget{
+			DNSName:              aws.String("dualstack.testpublic-1111111111.us-east-1.elb.amazonaws.com"),
+			EvaluateTargetHealth: aws.Bool(false),
+			HostedZoneId:         aws.String("ELB123"),
+		},
+		Name: aws.String(name),
+		Type: aws.String("A"),
+	}
+}
+
+func testOwnerRecordSet(name, owner string) *route53.ResourceRecordSet {
+	return &route53.ResourceRecordSet{
+		Name: aws.String(name),
+		ResourceRecords: []*route53.ResourceRecord{
+			&route53.ResourceRecord{
+				Value: aws.String("\"" + owner + "\""),
+			},
+		},
+		TTL:  aws.Int64(300),
+		Type: aws.String("TXT"),
+	}
+}
+
+func testSPFRecordSet(name string) *route53.ResourceRecordSet {
+	return &route53.ResourceRecordSet{
+		Name: aws.String(name),
+		ResourceRecords: []*route53.ResourceRecord{
+			&route53.ResourceRecord{
+				Value: aws.String("\"v=spf1 -all\""),
+			},
+		},
+		TTL:  aws.Int64(3600),
+		Type: aws.String("TXT"),
+	}
+}
+
+func testChangeResourceRecordSetsInput(hostedZoneID string, changes ...*route53.Change) *route53.ChangeResourceRecordSetsInput {
+	return &route53.ChangeResourceRecordSetsInput{
+		ChangeBatch: &route53.ChangeBatch{
+			Changes: changes,
+			Comment: aws.String("Kubernetes Update to Service"),
+		},
+		HostedZoneId: aws.String(hostedZoneID),
+	}
+}
+
+func testRoute53Change(action, domainName, domainHostedZoneID string) Route53Change {
+	return Route53Change{
+		Action: action,
+		Record: Route53Record{
+			DomainName:         domainName,
+			DomainHostedZoneID: domainHostedZoneID,
+			LoadBalancers: []Route53LoadBalancer{
+				Route53LoadBalancer{Hostname: "testpublic-1111111111.us-east-1.elb.amazonaws.com", HostedZoneID: "ELB123"},
+			},
+			Owner: "heritage=kubernetes-service-dns-update,cluster=default,service=default/test",
+		},
+	}
+}
+
+func TestApplyDNSChanges(t *testing.T) {
+	owner := "heritage=kubernetes-service-dns-update,cluster=default,service=default/test"
+
+	scenarios := []struct {
+		changes []Route53Change
+
+		currentRecordSets []*route53.ResourceRecordSet
+
+		changeResourceRecordSetsCalls []DummyChangeResourceRecordSetsCall
+
+		expectedErrors []error
+	}{
+		// Successful update for subdomain
+		{
+			changes: []Route53Change{
+				testRoute53Change("UPSERT", "test.domain.com", "DNS123"),
+			},
+
+			changeResourceRecordSetsCalls: []DummyChangeResourceRecordSetsCall{
+				{
+					input: testChangeResourceRecordSetsInput("DNS123",
+						&route53.Change{Action: aws.String("UPSERT"), ResourceRecordSet: testAliasRecordSet("test.domain.com")},
+						&route53.Change{Action: aws.String("UPSERT"), ResourceRecordSet: testOwnerRecordSet("_owner.test.domain.com", owner)},
+					),
+				},
+			},
+
+			expectedErrors: []error{nil},
+		},
+
+		// Successful update for top-level domain
+		{
+			changes: []Route53Change{
+				testRoute53Change("UPSERT", ".domain.com", "DNS123"),
+			},
+
+			changeResourceRecordSetsCalls: []DummyChangeResourceRecordSetsCall{
+				{
+					input: testChangeResourceRecordSetsInput("DNS123",
+						&route53.Change{Action: aws.String("UPSERT"), ResourceRecordSet: testAliasRecordSet("domain.com")},
+						&route53.Change{Action: aws.String("UPSERT"), ResourceRecordSet: testOwnerRecordSet("_owner.domain.com", owner)},
+					),
+				},
+			},
+
+			expectedErrors: []error{nil},
+		},
+
+		// Records already up to date, as reported by Route53
+		{
+			changes: []Route53Change{
+				testRoute53Change("UPSERT", "test.domain.com", "DNS123"),
+			},
+
+			currentRecordSets: []*route53.ResourceRecordSet{
+				&route53.ResourceRecordSet{
+					AliasTarget: &route53.AliasTarget{
+						DNSName:              aws.String("dualstack.testpublic-1111111111.us-east-1.elb.amazonaws.com."),
+						EvaluateTargetHealth: aws.Bool(false),
+						HostedZoneId:         aws.String("ELB123"),
+					},
+					Name: aws.String("test.domain.com."),
+					Type: aws.String("A"),
+				},
+				testOwnerRecordSet("_owner.test.domain.com.", owner),
+			},
+
+			expectedErrors: []error{nil},
+		},
+
+		// Only the record that differs is changed
+		{
+			changes: []Route53Change{
+				testRoute53Change("UPSERT", "test.domain.com", "DNS123"),
+			},
+
+			currentRecordSets: []*route53.ResourceRecordSet{
+				testAliasRecordSet("test.domain.com."),
+				testOwnerRecordSet("_owner.test.domain.com.", "heritage=kubernetes-service-dns-update,cluster=default,service=default/other"),
+			},
+
+			changeResourceRecordSetsCalls: []DummyChangeResourceRecordSetsCall{
+				{
+					input: testChangeResourceRecordSetsInput("DNS123",
+						&route53.Change{Action: aws.String("UPSERT"), ResourceRecordSet: testOwnerRecordSet("_owner.test.domain.com", owner)},
+					),
+				},
+			},
+
+			expectedErrors: []error{nil},
+		},
 
-		expectedHostedZoneID string
-		expectedError        error
-	}{
-		// Valid destination zone
+		// Load balancer switched to an IPv6 address, replacing the alias
 		{
-			domain: "valid.domain.com",
+			changes: []Route53Change{
+				Route53Change{
+					Action: "UPSERT",
+					Record: Route53Record{
+						DomainName:         "test.domain.com",
+						DomainHostedZoneID: "DNS123",
+						IPs:                []string{"2001:db8::10"},
+						TTL:                60,
+						Owner:              owner,
+					},
+				},
+			},
 
-			listHostedZonesByNameInput: &route53.ListHostedZonesByNameInput{
-				DNSName: aws.String("domain.com"),
+			currentRecordSets: []*route53.ResourceRecordSet{
+				testAliasRecordSet("test.domain.com."),
+				testOwnerRecordSet("_owner.test.domain.com.", owner),
 			},
-			listHostedZonesByNameOutput: &route53.ListHostedZonesByNameOutput{
-				HostedZones: []*route53.HostedZone{
-					&route53.HostedZone{
-						Name: aws.String("domain.com."),
-						Id:   aws.String("/hostedzone/ABC123"),
-					},
+
+			changeResourceRecordSetsCalls: []DummyChangeResourceRecordSetsCall{
+				{
+					input: testChangeResourceRecordSetsInput("DNS123",
+						&route53.Change{Action: aws.String("DELETE"), ResourceRecordSet: testAliasRecordSet("test.domain.com.")},
+						&route53.Change{Action: aws.String("UPSERT"), ResourceRecordSet: &route53.ResourceRecordSet{
+							Name: aws.String("test.domain.com"),
+							ResourceRecords: []*route53.ResourceRecord{
+								&route53.ResourceRecord{Value: aws.String("2001:db8::10")},
+							},
+							TTL:  aws.Int64(60),
+							Type: aws.String("AAAA"),
+						}},
+					),
 				},
 			},
-			listHostedZonesByNameError: nil,
 
-			expectedHostedZoneID: "ABC123",
-			expectedError:        nil,
+			expectedErrors: []error{nil},
 		},
 
-		// No zone found
+		// Several load balancers replacing a single one (i.e. the alias written
+		// before multiple ingress points were supported), with weighted aliases
+		// replacing it in the same batch
 		{
-			domain: "valid.domain.com",
+			changes: []Route53Change{
+				Route53Change{
+					Action: "UPSERT",
+					Record: Route53Record{
+						DomainName:         "test.domain.com",
+						DomainHostedZoneID: "DNS123",
+						LoadBalancers: []Route53LoadBalancer{
+							Route53LoadBalancer{Hostname: "first-1111111111.us-east-1.elb.amazonaws.com", HostedZoneID: "ELB123"},
+							Route53LoadBalancer{Hostname: "second-2222222222.us-east-1.elb.amazonaws.com", HostedZoneID: "ELB123"},
+						},
+						Owner: owner,
+					},
+				},
+			},
 
-			listHostedZonesByNameInput: &route53.ListHostedZonesByNameInput{
-				DNSName: aws.String("domain.com"),
+			currentRecordSets: []*route53.ResourceRecordSet{
+				testAliasRecordSet("test.domain.com."),
+				testOwnerRecordSet("_owner.test.domain.com.", owner),
 			},
-			listHostedZonesByNameOutput: nil,
-			listHostedZonesByNameError:  errors.New("error"),
 
-			expectedHostedZoneID: "",
-			expectedError:        errors.New("No zone found for domain.com: error"),
+			changeResourceRecordSetsCalls: []DummyChangeResourceRecordSetsCall{
+				{
+					input: testChangeResourceRecordSetsInput("DNS123",
+						&route53.Change{Action: aws.String("DELETE"), ResourceRecordSet: testAliasRecordSet("test.domain.com.")},
+						&route53.Change{Action: aws.String("UPSERT"), ResourceRecordSet: &route53.ResourceRecordSet{
+							AliasTarget: &route53.AliasTarget{
+								DNSName:              aws.String("dualstack.first-1111111111.us-east-1.elb.amazonaws.com"),
+								EvaluateTargetHealth: aws.Bool(false),
+								HostedZoneId:         aws.String("ELB123"),
+							},
+							Name:          aws.String("test.domain.com"),
+							SetIdentifier: aws.String("first-1111111111.us-east-1.elb.amazonaws.com"),
+							Type:          aws.String("A"),
+							Weight:        aws.Int64(1),
+						}},
+						&route53.Change{Action: aws.String("UPSERT"), ResourceRecordSet: &route53.ResourceRecordSet{
+							AliasTarget: &route53.AliasTarget{
+								DNSName:              aws.String("dualstack.second-2222222222.us-east-1.elb.amazonaws.com"),
+								EvaluateTargetHealth: aws.Bool(false),
+								HostedZoneId:         aws.String("ELB123"),
+							},
+							Name:          aws.String("test.domain.com"),
+							SetIdentifier: aws.String("second-2222222222.us-east-1.elb.amazonaws.com"),
+							Type:          aws.String("A"),
+							Weight:        aws.Int64(1),
+						}},
+					),
+				},
+			},
+
+			expectedErrors: []error{nil},
 		},
 
-		// Invalid domain according to getTLD
+		// Single load balancer replacing weighted aliases
 		{
-			domain: "top-level-domain.com",
+			changes: []Route53Change{
+				testRoute53Change("UPSERT", "test.domain.com", "DNS123"),
+			},
 
-			expectedHostedZoneID: "",
-			expectedError:        errors.New("Domain top-level-domain.com is invalid - it should be a fully qualified domain name and subdomain (i.e. test.example.com)"),
+			currentRecordSets: []*route53.ResourceRecordSet{
+				&route53.ResourceRecordSet{
+					AliasTarget:   testAliasRecordSet("test.domain.com.").AliasTarget,
+					Name:          aws.String("test.domain.com."),
+					SetIdentifier: aws.String("testpublic-1111111111.us-east-1.elb.amazonaws.com"),
+					Type:          aws.String("A"),
+					Weight:        aws.Int64(1),
+				},
+				&route53.ResourceRecordSet{
+					AliasTarget:   testAliasRecordSet("test.domain.com.").AliasTarget,
+					Name:          aws.String("test.domain.com."),
+					SetIdentifier: aws.String("second-2222222222.us-east-1.elb.amazonaws.com"),
+					Type:          aws.String("A"),
+					Weight:        aws.Int64(1),
+				},
+				testOwnerRecordSet("_owner.test.domain.com.", owner),
+			},
+
+			changeResourceRecordSetsCalls: []DummyChangeResourceRecordSetsCall{
+				{
+					input: testChangeResourceRecordSetsInput("DNS123",
+						&route53.Change{Action: aws.String("DELETE"), ResourceRecordSet: &route53.ResourceRecordSet{
+							AliasTarget:   testAliasRecordSet("test.domain.com.").AliasTarget,
+							Name:          aws.String("test.domain.com."),
+							SetIdentifier: aws.String("testpublic-1111111111.us-east-1.elb.amazonaws.com"),
+							Type:          aws.String("A"),
+							Weight:        aws.Int64(1),
+						}},
+						&route53.Change{Action: aws.String("DELETE"), ResourceRecordSet: &route53.ResourceRecordSet{
+							AliasTarget:   testAliasRecordSet("test.domain.com.").AliasTarget,
+							Name:          aws.String("test.domain.com."),
+							SetIdentifier: aws.String("second-2222222222.us-east-1.elb.amazonaws.com"),
+							Type:          aws.String("A"),
+							Weight:        aws.Int64(1),
+						}},
+						&route53.Change{Action: aws.String("UPSERT"), ResourceRecordSet: testAliasRecordSet("test.domain.com")},
+					),
+				},
+			},
+
+			expectedErrors: []error{nil},
 		},
 
-		// Invalid domain according to findMostSpecificZoneForDomain (sanity check)
+		// Deletion of weighted aliases, along with the ownership record
 		{
-			domain: "valid.domain.com",
+			changes: []Route53Change{
+				testRoute53Change("DELETE", "test.domain.com", "DNS123"),
+			},
 
-			listHostedZonesByNameInput: &route53.ListHostedZonesByNameInput{
-				DNSName: aws.String("domain.com"),
+			currentRecordSets: []*route53.ResourceRecordSet{
+				&route53.ResourceRecordSet{
+					AliasTarget:   testAliasRecordSet("test.domain.com.").AliasTarget,
+					Name:          aws.String("test.domain.com."),
+					SetIdentifier: aws.String("first"),
+					Type:          aws.String("A"),
+					Weight:        aws.Int64(1),
+				},
+				&route53.ResourceRecordSet{
+					AliasTarget:   testAliasRecordSet("test.domain.com.").AliasTarget,
+					Name:          aws.String("test.domain.com."),
+					SetIdentifier: aws.String("second"),
+					Type:          aws.String("A"),
+					Weight:        aws.Int64(1),
+				},
+				testOwnerRecordSet("_owner.test.domain.com.", owner),
 			},
-			listHostedZonesByNameOutput: &route53.ListHostedZonesByNameOutput{
-				HostedZones: []*route53.HostedZone{
-					&route53.HostedZone{
-						Name: aws.String("other.com."),
-						Id:   aws.String("/hostedzone/ABC123"),
-					},
+
+			changeResourceRecordSetsCalls: []DummyChangeResourceRecordSetsCall{
+				{
+					input: testChangeResourceRecordSetsInput("DNS123",
+						&route53.Change{Action: aws.String("DELETE"), ResourceRecordSet: &route53.ResourceRecordSet{
+							AliasTarget:   testAliasRecordSet("test.domain.com.").AliasTarget,
+							Name:          aws.String("test.domain.com."),
+							SetIdentifier: aws.String("first"),
+							Type:          aws.String("A"),
+							Weight:        aws.Int64(1),
+						}},
+						&route53.Change{Action: aws.String("DELETE"), ResourceRecordSet: &route53.ResourceRecordSet{
+							AliasTarget:   testAliasRecordSet("test.domain.com.").AliasTarget,
+							Name:          aws.String("test.domain.com."),
+							SetIdentifier: aws.String("second"),
+							Type:          aws.String("A"),
+							Weight:        aws.Int64(1),
+						}},
+						&route53.Change{Action: aws.String("DELETE"), ResourceRecordSet: testOwnerRecordSet("_owner.test.domain.com.", owner)},
+					),
 				},
 			},
-			listHostedZonesByNameError: nil,
 
-			expectedHostedZoneID: "",
-			expectedError:        errors.New("No zone matches domain valid.domain.com."),
+			expectedErrors: []error{nil},
 		},
-	}
 
-	for _, scenario := range scenarios {
-		awsClient := &AWSClientImpl{
-			route53: &DummyRoute53Client{
-				t: t,
+		// Alias replaced by a CNAME record, moving the ownership record kept on the
+		// name by earlier versions
+		{
+			changes: []Route53Change{
+				Route53Change{
+					Action: "UPSERT",
+					Record: Route53Record{
+						DomainName:         "test.domain.com",
+						DomainHostedZoneID: "DNS123",
+						CNAME:              "api.saas.example.net",
+						Owner:              owner,
+					},
+				},
+			},
 
-				listHostedZonesByNameInput:  scenario.listHostedZonesByNameInput,
-				listHostedZonesByNameOutput: scenario.listHostedZonesByNameOutput,
-				listHostedZonesByNameError:  scenario.listHostedZonesByNameError,
+			currentRecordSets: []*route53.ResourceRecordSet{
+				testAliasRecordSet("test.domain.com."),
+				testOwnerRecordSet("test.domain.com.", owner),
 			},
-		}
 
-		hostedZoneID, err := awsClient.GetHostedZoneID(scenario.domain)
+			changeResourceRecordSetsCalls: []DummyChangeResourceRecordSetsCall{
+				{
+					input: testChangeResourceRecordSetsInput("DNS123",
+						&route53.Change{Action: aws.String("DELETE"), ResourceRecordSet: testAliasRecordSet("test.domain.com.")},
+						&route53.Change{Action: aws.String("DELETE"), ResourceRecordSet: testOwnerRecordSet("test.domain.com.", owner)},
+						&route53.Change{Action: aws.String("UPSERT"), ResourceRecordSet: &route53.ResourceRecordSet{
+							Name: aws.String("test.domain.com"),
+							ResourceRecords: []*route53.ResourceRecord{
+								&route53.ResourceRecord{Value: aws.String("api.saas.example.net")},
+							},
+							TTL:  aws.Int64(300),
+							Type: aws.String("CNAME"),
+						}},
+						&route53.Change{Action: aws.String("UPSERT"), ResourceRecordSet: testOwnerRecordSet("_owner.test.domain.com", owner)},
+					),
+				},
+			},
 
-		if err != nil && err.Error() != scenario.expectedError.Error() {
-			t.Errorf("Expected error to be '%v', was '%v'", scenario.expectedError, err)
-		} else if hostedZoneID != scenario.expectedHostedZoneID {
-			t.Errorf("Expected hosted zone to be '%s', was '%s'", scenario.expectedHostedZoneID, hostedZoneID)
-		}
-	}
-}
+			expectedErrors: []error{nil},
+		},
 
-func TestGetLoadBalancerHostedZoneID(t *testing.T) {
-	scenarios := []struct {
-		hostname string
+		// TXT record of someone else on the name is left alone
+		{
+			changes: []Route53Change{
+				testRoute53Change("UPSERT", "test.domain.com", "DNS123"),
+			},
 
-		describeLoadBalancersInput  *elb.DescribeLoadBalancersInput
-		describeLoadBalancersOutput *elb.DescribeLoadBalancersOutput
-		describeLoadBalancersError  error
+			currentRecordSets: []*route53.ResourceRecordSet{
+				testSPFRecordSet("test.domain.com."),
+			},
 
-		expectedZoneID string
-		expectedError  error
-	}{
-		// Invalid load balancer name
-		{
-			hostname: "invalid.elb.amazonaws.com",
+			changeResourceRecordSetsCalls: []DummyChangeResourceRecordSetsCall{
+				{
+					input: testChangeResourceRecordSetsInput("DNS123",
+						&route53.Change{Action: aws.String("UPSERT"), ResourceRecordSet: testAliasRecordSet("test.domain.com")},
+						&route53.Change{Action: aws.String("UPSERT"), ResourceRecordSet: testOwnerRecordSet("_owner.test.domain.com", owner)},
+					),
+				},
+			},
 
-			expectedZoneID: "",
-			expectedError:  errors.New("Could not parse ELB hostname: invalid.elb.amazonaws.com is not a valid ELB hostname"),
+			expectedErrors: []error{nil},
 		},
 
-		// No load balancers found
+		// TXT record of someone else on the name is not deleted with a CNAME record
 		{
-			hostname: "testpublic-1111111111.us-east-1.elb.amazonaws.com",
-
-			describeLoadBalancersInput: &elb.DescribeLoadBalancersInput{
-				LoadBalancerNames: []*string{
-					aws.String("testpublic"),
+			changes: []Route53Change{
+				Route53Change{
+					Action: "DELETE",
+					Record: Route53Record{
+						DomainName:         "test.domain.com",
+						DomainHostedZoneID: "DNS123",
+						CNAME:              "api.saas.example.net",
+						Owner:              owner,
+					},
 				},
 			},
-			describeLoadBalancersOutput: &elb.DescribeLoadBalancersOutput{
-				LoadBalancerDescriptions: []*elb.LoadBalancerDescription{},
+
+			currentRecordSets: []*route53.ResourceRecordSet{
+				testAliasRecordSet("test.domain.com."),
+				testSPFRecordSet("test.domain.com."),
+				testOwnerRecordSet("_owner.test.domain.com.", owner),
 			},
-			describeLoadBalancersError: nil,
 
-			expectedZoneID: "",
-			expectedError:  errors.New("No load balancer found"),
+			changeResourceRecordSetsCalls: []DummyChangeResourceRecordSetsCall{
+				{
+					input: testChangeResourceRecordSetsInput("DNS123",
+						&route53.Change{Action: aws.String("DELETE"), ResourceRecordSet: testAliasRecordSet("test.domain.com.")},
+						&route53.Change{Action: aws.String("DELETE"), ResourceRecordSet: testOwnerRecordSet("_owner.test.domain.com.", owner)},
+					),
+				},
+			},
+
+			expectedErrors: []error{nil},
 		},
 
-		// Error when trying to describe the load balancers
+		// TXT record of someone else under the _owner prefix is not replaced
 		{
-			hostname: "testpublic-1111111111.us-east-1.elb.amazonaws.com",
+			changes: []Route53Change{
+				testRoute53Change("UPSERT", "test.domain.com", "DNS123"),
+			},
 
-			describeLoadBalancersInput: &elb.DescribeLoadBalancersInput{
-				LoadBalancerNames: []*string{
-					aws.String("testpublic"),
+			currentRecordSets: []*route53.ResourceRecordSet{
+				testSPFRecordSet("_owner.test.domain.com."),
+			},
+
+			changeResourceRecordSetsCalls: []DummyChangeResourceRecordSetsCall{
+				{
+					input: testChangeResourceRecordSetsInput("DNS123",
+						&route53.Change{Action: aws.String("UPSERT"), ResourceRecordSet: testAliasRecordSet("test.domain.com")},
+					),
 				},
 			},
-			describeLoadBalancersOutput: nil,
-			describeLoadBalancersError:  errors.New("error"),
 
-			expectedZoneID: "",
-			expectedError:  errors.New("Could not describe load balancer: error"),
+			expectedErrors: []error{nil},
 		},
 
-		// More than one load balancer found
+		// Plain record with the default TTL already up to date
 		{
-			hostname: "testpublic-1111111111.us-east-1.elb.amazonaws.com",
-
-			describeLoadBalancersInput: &elb.DescribeLoadBalancersInput{
-				LoadBalancerNames: []*string{
-					aws.String("testpublic"),
+			changes: []Route53Change{
+				Route53Change{
+					Action: "UPSERT",
+					Record: Route53Record{
+						DomainName:         "test.domain.com",
+						DomainHostedZoneID: "DNS123",
+						IPs:                []string{"203.0.113.10"},
+						Owner:              owner,
+					},
 				},
 			},
-			describeLoadBalancersOutput: &elb.DescribeLoadBalancersOutput{
-				LoadBalancerDescriptions: []*elb.LoadBalancerDescription{
-					&elb.LoadBalancerDescription{},
-					&elb.LoadBalancerDescription{},
+
+			currentRecordSets: []*route53.ResourceRecordSet{
+				&route53.ResourceRecordSet{
+					Name: aws.String("test.domain.com."),
+					ResourceRecords: []*route53.ResourceRecord{
+						&route53.ResourceRecord{Value: aws.String("203.0.113.10")},
+					},
+					TTL:  aws.Int64(300),
+					Type: aws.String("A"),
 				},
+				testOwnerRecordSet("_owner.test.domain.com.", owner),
 			},
-			describeLoadBalancersError: nil,
 
-			expectedZoneID: "",
-			expectedError:  errors.New("Multiple load balancers found"),
+			expectedErrors: []error{nil},
 		},
 
-		// One load balancer found
+		// Multi-value record set listed by Route53 in another order
 		{
-			hostname: "testpublic-1111111111.us-east-1.elb.amazonaws.com",
-
-			describeLoadBalancersInput: &elb.DescribeLoadBalancersInput{
-				LoadBalancerNames: []*string{
-					aws.String("testpublic"),
+			changes: []Route53Change{
+				Route53Change{
+					Action: "UPSERT",
+					Record: Route53Record{
+						DomainName:         "test.domain.com",
+						DomainHostedZoneID: "DNS123",
+						IPs:                []string{"203.0.113.10", "203.0.113.20"},
+						Owner:              owner,
+					},
 				},
 			},
-			describeLoadBalancersOutput: &elb.DescribeLoadBalancersOutput{
-				LoadBalancerDescriptions: []*elb.LoadBalancerDescription{
-					&elb.LoadBalancerDescription{
-						CanonicalHostedZoneNameID: aws.String("DOMAINZONEID"),
+
+			currentRecordSets: []*route53.ResourceRecordSet{
+				&route53.ResourceRecordSet{
+					Name: aws.String("test.domain.com."),
+					ResourceRecords: []*route53.ResourceRecord{
+						&route53.ResourceRecord{Value: aws.String("203.0.113.20")},
+						&route53.ResourceRecord{Value: aws.String("203.0.113.10")},
 					},
+					TTL:  aws.Int64(300),
+					Type: aws.String("A"),
 				},
+				testOwnerRecordSet("_owner.test.domain.com.", owner),
 			},
-			describeLoadBalancersError: nil,
 
-			expectedZoneID: "DOMAINZONEID",
-			expectedError:  nil,
+			expectedErrors: []error{nil},
 		},
-	}
 
-	for _, scenario := range scenarios {
-		awsClient := &AWSClientImpl{
-			elb: &DummyELBClient{
-				t: t,
+		// Failed update
+		{
+			changes: []Route53Change{
+				testRoute53Change("UPSERT", "test.domain.com", "DNS123"),
+			},
 
-				describeLoadBalancersInput:  scenario.describeLoadBalancersInput,
-				describeLoadBalancersOutput: scenario.describeLoadBalancersOutput,
-				describeLoadBalancersError:  scenario.describeLoadBalancersError,
+			changeResourceRecordSetsCalls: []DummyChangeResourceRecordSetsCall{
+				{
+					input: testChangeResourceRecordSetsInput("DNS123",
+						&route53.Change{Action: aws.String("UPSERT"), ResourceRecordSet: testAliasRecordSet("test.domain.com")},
+						&route53.Change{Action: aws.String("UPSERT"), ResourceRecordSet: testOwnerRecordSet("_owner.test.domain.com", owner)},
+					),
+					err: errors.New("error"),
+				},
 			},
-		}
 
-		zoneID, err := awsClient.GetLoadBalancerHostedZoneID(scenario.hostname)
+			expectedErrors: []error{errors.New("error")},
+		},
 
-		if err != nil && err.Error() != scenario.expectedError.Error() {
-			t.Errorf("Expected error to be '%v', was '%v'", scenario.expectedError, err)
-		} else if zoneID != scenario.expectedZoneID {
-			t.Errorf("Expected hosted zone to be '%s', was '%s'", scenario.expectedZoneID, zoneID)
-		}
-	}
-}
+		// Successful delete
+		{
+			changes: []Route53Change{
+				testRoute53Change("DELETE", "test.domain.com", "DNS123"),
+			},
 
-func TestUpdateDNS(t *testing.T) {
-	scenarios := []struct {
-		elbHostname          string
-		elbHostedZoneID      string
-		domainHostedZoneName string
-		domainHostedZoneID   string
+			currentRecordSets: []*route53.ResourceRecordSet{
+				testAliasRecordSet("test.domain.com."),
+				testOwnerRecordSet("_owner.test.domain.com.", owner),
+			},
+
+			changeResourceRecordSetsCalls: []DummyChangeResourceRecordSetsCall{
+				{
+					input: testChangeResourceRecordSetsInput("DNS123",
+						&route53.Change{Action: aws.String("DELETE"), ResourceRecordSet: testAliasRecordSet("test.domain.com.")},
+						&route53.Change{Action: aws.String("DELETE"), ResourceRecordSet: testOwnerRecordSet("_owner.test.domain.com.", owner)},
+					),
+				},
+			},
 
-		changeResourceRecordSetsInput *route53.ChangeResourceRecordSetsInput
+			expectedErrors: []error{nil},
+		},
 
-		expectedError error
-	}{
-		// Successful update for subdomain
+		// Records are deleted as they currently are
 		{
-			elbHostname:          "testpublic-1111111111.us-east-1.elb.amazonaws.com",
-			elbHostedZoneID:      "ELB123",
-			domainHostedZoneName: "test.domain.com",
-			domainHostedZoneID:   "DNS123",
+			changes: []Route53Change{
+				testRoute53Change("DELETE", "test.domain.com", "DNS123"),
+			},
+
+			currentRecordSets: []*route53.ResourceRecordSet{
+				&route53.ResourceRecordSet{
+					AliasTarget: &route53.AliasTarget{
+						DNSName:              aws.String("dualstack.testold-2222222222.us-east-1.elb.amazonaws.com."),
+						EvaluateTargetHealth: aws.Bool(false),
+						HostedZoneId:         aws.String("ELB123"),
+					},
+					Name: aws.String("test.domain.com."),
+					Type: aws.String("A"),
+				},
+			},
 
-			changeResourceRecordSetsInput: &route53.ChangeResourceRecordSetsInput{
-				ChangeBatch: &route53.ChangeBatch{
-					Changes: []*route53.Change{
+			changeResourceRecordSetsCalls: []DummyChangeResourceRecordSetsCall{
+				{
+					input: testChangeResourceRecordSetsInput("DNS123",
 						&route53.Change{
-							Action: aws.String("UPSERT"),
+							Action: aws.String("DELETE"),
 							ResourceRecordSet: &route53.ResourceRecordSet{
 								AliasTarget: &route53.AliasTarget{
-									DNSName:              aws.String("dualstack.testpublic-1111111111.us-east-1.elb.amazonaws.com"),
+									DNSName:              aws.String("dualstack.testold-2222222222.us-east-1.elb.amazonaws.com."),
 									EvaluateTargetHealth: aws.Bool(false),
 									HostedZoneId:         aws.String("ELB123"),
 								},
-								Name: aws.String("test.domain.com"),
+								Name: aws.String("test.domain.com."),
 								Type: aws.String("A"),
 							},
 						},
-					},
-					Comment: aws.String("Kubernetes Update to Service"),
+					),
 				},
-				HostedZoneId: aws.String("DNS123"),
 			},
 
-			expectedError: nil,
+			expectedErrors: []error{nil},
 		},
 
-		// Successful update for top-level domain
+		// Only the records still around are deleted
 		{
-			elbHostname:          "testpublic-1111111111.us-east-1.elb.amazonaws.com",
-			elbHostedZoneID:      "ELB123",
-			domainHostedZoneName: ".domain.com",
-			domainHostedZoneID:   "DNS123",
+			changes: []Route53Change{
+				testRoute53Change("DELETE", "test.domain.com", "DNS123"),
+			},
 
-			changeResourceRecordSetsInput: &route53.ChangeResourceRecordSetsInput{
-				ChangeBatch: &route53.ChangeBatch{
-					Changes: []*route53.Change{
-						&route53.Change{
-							Action: aws.String("UPSERT"),
-							ResourceRecordSet: &route53.ResourceRecordSet{
-								AliasTarget: &route53.AliasTarget{
-									DNSName:              aws.String("dualstack.testpublic-1111111111.us-east-1.elb.amazonaws.com"),
-									EvaluateTargetHealth: aws.Bool(false),
-									HostedZoneId:         aws.String("ELB123"),
-								},
-								Name: aws.String("domain.com"),
-								Type: aws.String("A"),
-							},
-						},
-					},
-					Comment: aws.String("Kubernetes Update to Service"),
+			currentRecordSets: []*route53.ResourceRecordSet{
+				testOwnerRecordSet("_owner.test.domain.com.", owner),
+			},
+
+			changeResourceRecordSetsCalls: []DummyChangeResourceRecordSetsCall{
+				{
+					input: testChangeResourceRecordSetsInput("DNS123",
+						&route53.Change{Action: aws.String("DELETE"), ResourceRecordSet: testOwnerRecordSet("_owner.test.domain.com.", owner)},
+					),
 				},
-				HostedZoneId: aws.String("DNS123"),
 			},
 
-			expectedError: nil,
+			expectedErrors: []error{nil},
 		},
 
-		// Failed update
+		// Records already deleted
 		{
-			elbHostname:          "testpublic-1111111111.us-east-1.elb.amazonaws.com",
-			elbHostedZoneID:      "ELB123",
-			domainHostedZoneName: "test.domain.com",
-			domainHostedZoneID:   "DNS123",
+			changes: []Route53Change{
+				testRoute53Change("DELETE", "test.domain.com", "DNS123"),
+			},
 
-			changeResourceRecordSetsInput: &route53.ChangeResourceRecordSetsInput{
-				ChangeBatch: &route53.ChangeBatch{
-					Changes: []*route53.Change{
-						&route53.Change{
-							Action: aws.String("UPSERT"),
-							ResourceRecordSet: &route53.ResourceRecordSet{
-								AliasTarget: &route53.AliasTarget{
-									DNSName:              aws.String("dualstack.testpublic-1111111111.us-east-1.elb.amazonaws.com"),
-									EvaluateTargetHealth: aws.Bool(false),
-									HostedZoneId:         aws.String("ELB123"),
-								},
-								Name: aws.String("test.domain.com"),
-								Type: aws.String("A"),
-							},
-						},
-					},
-					Comment: aws.String("Kubernetes Update to Service"),
+			expectedErrors: []error{nil},
+		},
+
+		// Changes in the same hosted zone are submitted in a single batch
+		{
+			changes: []Route53Change{
+				testRoute53Change("UPSERT", "first.domain.com", "DNS123"),
+				testRoute53Change("DELETE", "second.domain.com", "DNS123"),
+			},
+
+			currentRecordSets: []*route53.ResourceRecordSet{
+				testAliasRecordSet("second.domain.com."),
+				testOwnerRecordSet("_owner.second.domain.com.", owner),
+			},
+
+			changeResourceRecordSetsCalls: []DummyChangeResourceRecordSetsCall{
+				{
+					input: testChangeResourceRecordSetsInput("DNS123",
+						&route53.Change{Action: aws.String("UPSERT"), ResourceRecordSet: testAliasRecordSet("first.domain.com")},
+						&route53.Change{Action: aws.String("UPSERT"), ResourceRecordSet: testOwnerRecordSet("_owner.first.domain.com", owner)},
+						&route53.Change{Action: aws.String("DELETE"), ResourceRecordSet: testAliasRecordSet("second.domain.com.")},
+						&route53.Change{Action: aws.String("DELETE"), ResourceRecordSet: testOwnerRecordSet("_owner.second.domain.com.", owner)},
+					),
+				},
+			},
+
+			expectedErrors: []error{nil, nil},
+		},
+
+		// Failed batch is submitted again record by record
+		{
+			changes: []Route53Change{
+				testRoute53Change("UPSERT", "first.domain.com", "DNS123"),
+				testRoute53Change("UPSERT", "second.domain.com", "DNS123"),
+			},
+
+			changeResourceRecordSetsCalls: []DummyChangeResourceRecordSetsCall{
+				{
+					input: testChangeResourceRecordSetsInput("DNS123",
+						&route53.Change{Action: aws.String("UPSERT"), ResourceRecordSet: testAliasRecordSet("first.domain.com")},
+						&route53.Change{Action: aws.String("UPSERT"), ResourceRecordSet: testOwnerRecordSet("_owner.first.domain.com", owner)},
+						&route53.Change{Action: aws.String("UPSERT"), ResourceRecordSet: testAliasRecordSet("second.domain.com")},
+						&route53.Change{Action: aws.String("UPSERT"), ResourceRecordSet: testOwnerRecordSet("_owner.second.domain.com", owner)},
+					),
+					err: errors.New("batch error"),
+				},
+				{
+					input: testChangeResourceRecordSetsInput("DNS123",
+						&route53.Change{Action: aws.String("UPSERT"), ResourceRecordSet: testAliasRecordSet("first.domain.com")},
+						&route53.Change{Action: aws.String("UPSERT"), ResourceRecordSet: testOwnerRecordSet("_owner.first.domain.com", owner)},
+					),
+				},
+				{
+					input: testChangeResourceRecordSetsInput("DNS123",
+						&route53.Change{Action: aws.String("UPSERT"), ResourceRecordSet: testAliasRecordSet("second.domain.com")},
+						&route53.Change{Action: aws.String("UPSERT"), ResourceRecordSet: testOwnerRecordSet("_owner.second.domain.com", owner)},
+					),
+					err: errors.New("error"),
 				},
-				HostedZoneId: aws.String("DNS123"),
 			},
 
-			expectedError: errors.New("error"),
+			expectedErrors: []error{nil, errors.New("error")},
 		},
 	}
 
 	for _, scenario := range scenarios {
+		route53Client := &DummyRoute53Client{
+			t: t,
+
+			changeResourceRecordSetsCalls: scenario.changeResourceRecordSetsCalls,
+
+			hostedZoneRecordSets: append([]*route53.ResourceRecordSet{}, scenario.currentRecordSets...),
+		}
+
 		awsClient := &AWSClientImpl{
-			route53: &DummyRoute53Client{
-				t: t,
+			route53: route53Client,
+		}
+
+		errs := awsClient.ApplyDNSChanges(scenario.changes)
+
+		if !reflect.DeepEqual(errs, scenario.expectedErrors) {
+			t.Errorf("Expected errors to be '%v', was '%v'", scenario.expectedErrors, errs)
+		}
 
-				changeResourceRecordSetsInput: scenario.changeResourceRecordSetsInput,
-				changeResourceRecordSetsError: scenario.expectedError,
+		if route53Client.changeResourceRecordSetsCount != len(scenario.changeResourceRecordSetsCalls) {
+			t.Errorf("Expected %d change batches to be submitted, were %d", len(scenario.changeResourceRecordSetsCalls), route53Client.changeResourceRecordSetsCount)
+		}
+	}
+}
+
+func TestApplyDNSChangesAcrossHostedZones(t *testing.T) {
+	owner := "heritage=kubernetes-service-dns-update,cluster=default,service=default/test"
+
+	route53Client := &DummyRoute53Client{
+		t: t,
+
+		changeResourceRecordSetsCalls: []DummyChangeResourceRecordSetsCall{
+			{
+				input: testChangeResourceRecordSetsInput("DNS123",
+					&route53.Change{Action: aws.String("UPSERT"), ResourceRecordSet: testAliasRecordSet("first.domain.com")},
+					&route53.Change{Action: aws.String("UPSERT"), ResourceRecordSet: testOwnerRecordSet("_owner.first.domain.com", owner)},
+					&route53.Change{Action: aws.String("UPSERT"), ResourceRecordSet: testAliasRecordSet("second.domain.com")},
+					&route53.Change{Action: aws.String("UPSERT"), ResourceRecordSet: testOwnerRecordSet("_owner.second.domain.com", owner)},
+				),
+			},
+			{
+				input: testChangeResourceRecordSetsInput("DNS456",
+					&route53.Change{Action: aws.String("UPSERT"), ResourceRecordSet: testAliasRecordSet("test.other.com")},
+					&route53.Change{Action: aws.String("UPSERT"), ResourceRecordSet: testOwnerRecordSet("_owner.test.other.com", owner)},
+				),
+				err: errors.New("error"),
+			},
+		},
+
+		hostedZoneRecordSets: []*route53.ResourceRecordSet{},
+	}
+
+	awsClient := &AWSClientImpl{
+		route53: route53Client,
+	}
+
+	errs := awsClient.ApplyDNSChanges([]Route53Change{
+		testRoute53Change("UPSERT", "first.domain.com", "DNS123"),
+		testRoute53Change("UPSERT", "test.other.com", "DNS456"),
+		testRoute53Change("UPSERT", "second.domain.com", "DNS123"),
+	})
+
+	expectedErrors := []error{nil, errors.New("error"), nil}
+	if !reflect.DeepEqual(errs, expectedErrors) {
+		t.Errorf("Expected errors to be '%v', was '%v'", expectedErrors, errs)
+	}
+
+	if route53Client.changeResourceRecordSetsCount != 2 {
+		t.Errorf("Expected 2 change batches to be submitted, were %d", route53Client.changeResourceRecordSetsCount)
+	}
+}
+
+func TestApplyDNSChangesKeepsRecordSetsUpToDate(t *testing.T) {
+	owner := "heritage=kubernetes-service-dns-update,cluster=default,service=default/test"
+
+	route53Client := &DummyRoute53Client{
+		t: t,
+
+		changeResourceRecordSetsCalls: []DummyChangeResourceRecordSetsCall{
+			{
+				input: testChangeResourceRecordSetsInput("DNS123",
+					&route53.Change{Action: aws.String("UPSERT"), ResourceRecordSet: testAliasRecordSet("test.domain.com")},
+					&route53.Change{Action: aws.String("UPSERT"), ResourceRecordSet: testOwnerRecordSet("_owner.test.domain.com", owner)},
+				),
 			},
+		},
+
+		hostedZoneRecordSets: []*route53.ResourceRecordSet{},
+	}
+
+	awsClient := &AWSClientImpl{
+		route53: route53Client,
+	}
+
+	awsClient.ApplyDNSChanges([]Route53Change{
+		testRoute53Change("UPSERT", "test.domain.com", "DNS123"),
+	})
+
+	currentOwner, exists, err := awsClient.GetDNSOwner("test.domain.com", "DNS123")
+	if err != nil {
+		t.Error("Unexpected error: ", err)
+	}
+	if currentOwner != owner || !exists {
+		t.Errorf("Expected record set to be owned by '%s', was '%s' (exists: %v)", owner, currentOwner, exists)
+	}
+
+	// Nothing left to change, so no further batch is submitted
+	awsClient.ApplyDNSChanges([]Route53Change{
+		testRoute53Change("UPSERT", "test.domain.com", "DNS123"),
+	})
+
+	if route53Client.changeResourceRecordSetsCount != 1 {
+		t.Errorf("Expected 1 change batch to be submitted, were %d", route53Client.changeResourceRecordSetsCount)
+	}
+}
+
+func TestChangeBatchLimits(t *testing.T) {
+	// Alias records have no values, so they are limited by their number
+	batch := &changeBatch{}
+	aliasChange := &route53.Change{
+		Action:            aws.String("DELETE"),
+		ResourceRecordSet: testAliasRecordSet("test.domain.com"),
+	}
+
+	for i := 0; i < maxBatchRecords; i++ {
+		if !batch.fits([]*route53.Change{aliasChange}) {
+			t.Fatalf("Expected record %d to fit in the batch", i)
 		}
+		batch.add(i, []*route53.Change{aliasChange})
+	}
+
+	if batch.fits([]*route53.Change{aliasChange}) {
+		t.Errorf("Expected batch with %d records to be full", batch.records)
+	}
 
-		err := awsClient.UpdateDNS(scenario.elbHostname, scenario.elbHostedZoneID, scenario.domainHostedZoneName, scenario.domainHostedZoneID)
+	// UPSERT changes count twice, and the TXT records are limited by the
+	// length of their values
+	batch = &changeBatch{}
+	recordSets := map[recordSetKey][]*route53.ResourceRecordSet{}
 
-		if scenario.expectedError != nil && err.Error() != scenario.expectedError.Error() {
-			t.Errorf("Expected error to be '%v', was '%v'", scenario.expectedError, err)
+	for i := 0; ; i++ {
+		changes := route53ChangesForRecord("UPSERT", testRoute53Change("UPSERT", fmt.Sprintf("test%d.domain.com", i), "DNS123").Record, recordSets)
+		if !batch.fits(changes) {
+			break
 		}
+		batch.add(i, changes)
+	}
+
+	if len(batch.indexes) < 2 || batch.records > maxBatchRecords || batch.valueLength > maxBatchValueLength {
+		t.Errorf("Expected batch to hold as many records as allowed, holds %d (%d records, values of length %d)", len(batch.indexes), batch.records, batch.valueLength)
+	}
+
+	// A record exceeding the limits on its own still gets a batch
+	batch = &changeBatch{}
+	longValue := &route53.Change{
+		Action: aws.String("DELETE"),
+		ResourceRecordSet: &route53.ResourceRecordSet{
+			ResourceRecords: []*route53.ResourceRecord{
+				&route53.ResourceRecord{
+					Value: aws.String(strings.Repeat("a", maxBatchValueLength+1)),
+				},
+			},
+		},
+	}
+
+	if !batch.fits([]*route53.Change{longValue}) {
+		t.Error("Expected empty batch to fit any record")
 	}
 }
 
-func TestLoadBalancerNameFromHostname(t *testing.T) {
+func TestDNSRecordSetsAliasTarget(t *testing.T) {
 	scenarios := map[string]string{
-		"testpublic-1111111111.us-east-1.elb.amazonaws.com":            "testpublic",
-		"internal-testinternal-2222222222.us-east-1.elb.amazonaws.com": "testinternal",
+		"testpublic-1111111111.us-east-1.elb.amazonaws.com":   "dualstack.testpublic-1111111111.us-east-1.elb.amazonaws.com",
+		"my-alb-4444444444.us-east-1.elb.amazonaws.com":       "dualstack.my-alb-4444444444.us-east-1.elb.amazonaws.com",
+		"my-nlb-0123456789abcdef.elb.us-east-1.amazonaws.com": "my-nlb-0123456789abcdef.elb.us-east-1.amazonaws.com",
 	}
 
-	for hostname, elbName := range scenarios {
-		extractedName, err := loadBalancerNameFromHostname(hostname)
-		if err != nil {
-			t.Errorf("Expected %s to parse to %s, but got %v", hostname, elbName, err)
-		}
-		if extractedName != elbName {
-			t.Errorf("Expected %s but got %s for hostname %s", elbName, extractedName, hostname)
+	for hostname, expectedDNSName := range scenarios {
+		alias := dnsRecordSets(Route53Record{
+			DomainName:    "some.domain.com",
+			LoadBalancers: []Route53LoadBalancer{Route53LoadBalancer{Hostname: hostname, HostedZoneID: "ELB123"}},
+			Owner:         "owner",
+		})[0]
+
+		if dnsName := aws.StringValue(alias.AliasTarget.DNSName); dnsName != expectedDNSName {
+			t.Errorf("Expected alias target to be %s, was %s", expectedDNSName, dnsName)
 		}
 	}
+}
 
-	invalid := []string{
-		"nodashes",
-		"internal",
+func TestIsLoadBalancerHostname(t *testing.T) {
+	scenarios := map[string]bool{
+		"testpublic-1111111111.us-east-1.elb.amazonaws.com":            true,
+		"internal-testprivate-2222222222.us-east-1.elb.amazonaws.com.": true,
+		"my-nlb-0123456789abcdef.elb.us-east-1.amazonaws.com":          true,
+		"my-nlb-0123456789abcdef.elb.cn-north-1.amazonaws.com.cn":      true,
+		"my-bucket.s3.us-east-1.amazonaws.com":                         false,
+		"elb.hostname.amazonaws.com":                                   false,
+		"api.saas.example.net":                                         false,
 	}
 
-	for _, bad := range invalid {
-		extractedName, err := loadBalancerNameFromHostname(bad)
-		if err == nil {
-			t.Errorf("Expected %s to parse to fail, but got %v", bad, extractedName)
+	for hostname, expected := range scenarios {
+		if isLoadBalancer := isLoadBalancerHostname(hostname); isLoadBalancer != expected {
+			t.Errorf("Expected %s to be a load balancer: %v, was %v", hostname, expected, isLoadBalancer)
 		}
 	}
 }
@@ -452,6 +1930,12 @@ func TestFinMostSpecificZoneForDomainWithInvalidInput(t *testing.T) {
 		t.Error("Expected error to be raised, but returned", actualZone)
 		return
 	}
+
+	actualZone, err = findMostSpecificZoneForDomain("test.otherdemo.com", zones)
+	if err == nil {
+		t.Error("Expected error to be raised, but returned", actualZone)
+		return
+	}
 }
 
 func TestFindMostSpecificZoneForDomain(t *testing.T) {
@@ -468,6 +1952,7 @@ func TestFindMostSpecificZoneForDomain(t *testing.T) {
 
 	scenarios := map[string]*route53.HostedZone{
 		".demo.com":           &demo,
+		"demo.com":            &demo,
 		"test.demo.com":       &demo,
 		"test.again.demo.com": &demo,
 		"sub.demo.com":        &demoSub,
@@ -481,7 +1966,7 @@ func TestFindMostSpecificZoneForDomain(t *testing.T) {
 			return
 		}
 		if actualZone != expectedZone {
-			t.Errorf("Expected %s to eq %s for domain %s", *actualZone, *expectedZone, domain)
+			t.Errorf("Expected %v to eq %v for domain %s", *actualZone, *expectedZone, domain)
 		}
 	}
 
@@ -504,8 +1989,14 @@ func TestDomainWithTrailingDot(t *testing.T) {
 func TestGetTLD(t *testing.T) {
 	scenarios := map[string]string{
 		".test.com":                            "test.com",
+		"test.com":                             "test.com",
+		"test.com.":                            "test.com",
+		"Hello.Goodbye.IO":                     "goodbye.io",
 		"hello.goodbye.io":                     "goodbye.io",
 		"this.is.really.long.hello.goodbye.io": "goodbye.io",
+		"app.example.co.uk":                    "example.co.uk",
+		"test.example.com.br":                  "example.com.br",
+		"*.example.com.au":                     "example.com.au",
 	}
 
 	for domain, tld := range scenarios {
@@ -518,9 +2009,10 @@ func TestGetTLD(t *testing.T) {
 		}
 	}
 
-	bad := "bad.domain"
-	_, err := getTLD(bad)
-	if err == nil {
-		t.Errorf("%s should cause error", bad)
+	for _, bad := range []string{"", "com", "co.uk", "com.br"} {
+		_, err := getTLD(bad)
+		if err == nil {
+			t.Errorf("%s should cause error", bad)
+		}
 	}
 }
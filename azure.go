@@ -0,0 +1,547 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	azureAPIVersion         = "2018-05-01"
+	azureManagementURL      = "https://management.azure.com"
+	azureActiveDirectoryURL = "https://login.microsoftonline.com"
+	azureIdentityURL        = "http://169.254.169.254/metadata/identity/oauth2/token"
+)
+
+// azureConfig holds the credentials of the daemon, in the format of the
+// azure.json file AKS and acs-engine install on every node.
+type azureConfig struct {
+	TenantID                    string `json:"tenantId"`
+	SubscriptionID              string `json:"subscriptionId"`
+	ResourceGroup               string `json:"resourceGroup"`
+	AADClientID                 string `json:"aadClientId"`
+	AADClientSecret             string `json:"aadClientSecret"`
+	UseManagedIdentityExtension bool   `json:"useManagedIdentityExtension"`
+	UserAssignedIdentityID      string `json:"userAssignedIdentityID"`
+}
+
+type azureZone struct {
+	Name string `json:"name"`
+}
+
+type azureZones struct {
+	Value    []azureZone `json:"value"`
+	NextLink string      `json:"nextLink"`
+}
+
+type azureRecordSet struct {
+	Name       string                   `json:"name,omitempty"`
+	Type       string                   `json:"type,omitempty"`
+	Properties azureRecordSetProperties `json:"properties"`
+}
+
+type azureRecordSets struct {
+	Value    []azureRecordSet `json:"value"`
+	NextLink string           `json:"nextLink"`
+}
+
+type azureRecordSetProperties struct {
+	TTL         int64             `json:"TTL"`
+	ARecords    []azureARecord    `json:"ARecords,omitempty"`
+	AAAARecords []azureAAAARecord `json:"AAAARecords,omitempty"`
+	CNAMERecord *azureCNAMERecord `json:"CNAMERecord,omitempty"`
+	TXTRecords  []azureTXTRecord  `json:"TXTRecords,omitempty"`
+}
+
+type azureARecord struct {
+	IPv4Address string `json:"ipv4Address"`
+}
+
+type azureAAAARecord struct {
+	IPv6Address string `json:"ipv6Address"`
+}
+
+type azureCNAMERecord struct {
+	CNAME string `json:"cname"`
+}
+
+type azureTXTRecord struct {
+	Value []string `json:"value"`
+}
+
+type azureToken struct {
+	AccessToken string       `json:"access_token"`
+	ExpiresIn   azureSeconds `json:"expires_in"`
+}
+
+// azureSeconds is a number of seconds, which Azure AD returns as a string.
+type azureSeconds int64
+
+func (s *azureSeconds) UnmarshalJSON(data []byte) error {
+	seconds, err := strconv.ParseInt(strings.Trim(string(data), "\""), 10, 64)
+	if err != nil {
+		return err
+	}
+
+	*s = azureSeconds(seconds)
+	return nil
+}
+
+// AzureProvider keeps endpoints as record sets in the Azure DNS zones of a
+// resource group, authenticating either as a service principal or with the
+// managed identity of the node.
+type AzureProvider struct {
+	client             *http.Client
+	config             azureConfig
+	managementURL      string
+	activeDirectoryURL string
+	identityURL        string
+	now                func() time.Time
+
+	token          string
+	tokenExpiresAt time.Time
+
+	zones     []azureZone
+	zoneCache zoneCache
+}
+
+func NewAzureProvider() (*AzureProvider, error) {
+	data, err := ioutil.ReadFile(azureConfigFile)
+	if err != nil && !(os.IsNotExist(err) && azureSubscriptionID != "" && azureResourceGroup != "") {
+		return nil, fmt.Errorf("Could not read Azure config: %v", err)
+	}
+
+	config := azureConfig{}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &config); err != nil {
+			return nil, fmt.Errorf("Could not parse Azure config %s: %v", azureConfigFile, err)
+		}
+	}
+
+	if azureSubscriptionID != "" {
+		config.SubscriptionID = azureSubscriptionID
+	}
+	if azureResourceGroup != "" {
+		config.ResourceGroup = azureResourceGroup
+	}
+
+	if config.SubscriptionID == "" || config.ResourceGroup == "" {
+		return nil, fmt.Errorf("Azure subscription and resource group of the DNS zones must be set")
+	}
+
+	return &AzureProvider{
+		client:             &http.Client{Timeout: httpTimeout},
+		config:             config,
+		managementURL:      azureManagementURL,
+		activeDirectoryURL: azureActiveDirectoryURL,
+		identityURL:        azureIdentityURL,
+		now:                time.Now,
+		zoneCache:          zoneCache{ttl: time.Duration(zoneCacheTTL) * time.Second},
+	}, nil
+}
+
+func (p *AzureProvider) GetOwner(dnsName string) (string, bool, error) {
+	zone, err := p.zone(dnsName)
+	if err != nil {
+		return "", false, err
+	}
+
+	records, err := p.endpointRecords(zone, dnsName)
+	if err != nil {
+		return "", false, err
+	}
+
+	exists := false
+	owner := ""
+
+	for _, record := range records {
+		if record.Type == "TXT" {
+			owner = ownerFromTXT(record.Values)
+		} else {
+			exists = true
+		}
+	}
+
+	return owner, exists, nil
+}
+
+// ApplyChanges replaces the record sets stored for the name of each endpoint
+// with the desired ones, one record set at a time.
+func (p *AzureProvider) ApplyChanges(changes []DNSChange) []error {
+	errs := make([]error, len(changes))
+
+	for i, change := range changes {
+		errs[i] = p.applyChange(change)
+	}
+
+	return errs
+}
+
+func (p *AzureProvider) applyChange(change DNSChange) error {
+	dnsName := change.Endpoint.DNSName
+
+	zone, err := p.zone(dnsName)
+	if err != nil {
+		return err
+	}
+
+	current, err := p.endpointRecords(zone, dnsName)
+	if err != nil {
+		return err
+	}
+
+	var desired []DNSRecord
+	if change.Action != "DELETE" {
+		desired, err = endpointRecords(change.Endpoint)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Record sets of other types go first, since Azure refuses a CNAME record
+	// set alongside any other
+	for _, record := range current {
+		if findRecordOfType(desired, record.Type) < 0 {
+			if err := p.deleteRecordSet(zone, record); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, record := range desired {
+		i := findRecordOfType(current, record.Type)
+		if i >= 0 && sameAzureRecord(current[i], record) {
+			continue
+		}
+
+		if err := p.putRecordSet(zone, record); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// sameAzureRecord returns whether the given records only differ by the order of
+// their values, which Azure does not keep.
+func sameAzureRecord(a, b DNSRecord) bool {
+	return a.Name == b.Name && a.Type == b.Type && a.TTL == b.TTL && sameStrings(a.Values, b.Values)
+}
+
+func (p *AzureProvider) putRecordSet(zone azureZone, record DNSRecord) error {
+	if dryRun {
+		log.Printf("DRY RUN: We normally would have set %s record %s to %v in %s\n", record.Type, record.Name, record.Values, zone.Name)
+		return nil
+	}
+
+	recordSet := azureRecordSet{Properties: azureRecordSetPropertiesFromRecord(record)}
+	if err := p.do("PUT", p.recordSetURL(zone, record), recordSet, nil); err != nil {
+		return fmt.Errorf("Could not set %s record %s: %v", record.Type, record.Name, err)
+	}
+
+	return nil
+}
+
+func (p *AzureProvider) deleteRecordSet(zone azureZone, record DNSRecord) error {
+	if dryRun {
+		log.Printf("DRY RUN: We normally would have deleted %s record %s from %s\n", record.Type, record.Name, zone.Name)
+		return nil
+	}
+
+	if err := p.do("DELETE", p.recordSetURL(zone, record), nil, nil); err != nil {
+		return fmt.Errorf("Could not delete %s record %s: %v", record.Type, record.Name, err)
+	}
+
+	return nil
+}
+
+func (p *AzureProvider) ListEndpoints(dnsNames []string) ([]Endpoint, error) {
+	indexes, err := p.zoneCache.zonesOf(dnsNames, p.now(), p.zoneNames)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []DNSRecord
+	for _, i := range indexes {
+		zone := p.zones[i]
+		zoneRecords, err := p.zoneRecords(zone)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, zoneRecords...)
+	}
+
+	return ownedEndpoints(records), nil
+}
+
+// zone returns the most specific DNS zone of the resource group the given name
+// belongs to.
+func (p *AzureProvider) zone(dnsName string) (azureZone, error) {
+	i, err := p.zoneCache.find(dnsName, p.now(), p.zoneNames)
+	if err != nil {
+		return azureZone{}, err
+	}
+
+	if i < 0 {
+		return azureZone{}, fmt.Errorf("No DNS zone matches domain %s", dnsName)
+	}
+
+	return p.zones[i], nil
+}
+
+// zoneNames lists the zones for the zone cache, whose indexes point into
+// p.zones.
+func (p *AzureProvider) zoneNames() ([]string, error) {
+	zones, err := p.listZones()
+	if err != nil {
+		return nil, fmt.Errorf("Could not list DNS zones: %v", err)
+	}
+
+	p.zones = zones
+
+	names := make([]string, len(zones))
+	for i, zone := range zones {
+		names[i] = zone.Name
+	}
+	return names, nil
+}
+
+func (p *AzureProvider) listZones() ([]azureZone, error) {
+	zones := []azureZone{}
+	next := p.resourceGroupURL() + "/providers/Microsoft.Network/dnsZones?api-version=" + azureAPIVersion
+
+	for next != "" {
+		var page azureZones
+		if err := p.do("GET", next, nil, &page); err != nil {
+			return nil, err
+		}
+
+		zones = append(zones, page.Value...)
+		next = page.NextLink
+	}
+
+	return zones, nil
+}
+
+// endpointRecords returns the address record sets stored for the given name,
+// along with its TXT ownership record set.
+func (p *AzureProvider) endpointRecords(zone azureZone, dnsName string) ([]DNSRecord, error) {
+	records, err := p.records(zone, dnsName, addressRecordTypes)
+	if err != nil {
+		return nil, err
+	}
+
+	ownerRecords, err := p.records(zone, ownerRecordName(dnsName), []string{"TXT"})
+	if err != nil {
+		return nil, err
+	}
+
+	return append(records, ownerRecords...), nil
+}
+
+// records returns the record sets of the given types stored for a name,
+// fetching each type on its own since Azure cannot filter record sets by name.
+func (p *AzureProvider) records(zone azureZone, dnsName string, recordTypes []string) ([]DNSRecord, error) {
+	records := []DNSRecord{}
+
+	for _, recordType := range recordTypes {
+		var recordSet azureRecordSet
+		err := p.do("GET", p.recordSetURL(zone, DNSRecord{Name: dnsName, Type: recordType}), nil, &recordSet)
+
+		if statusErr, ok := err.(*httpStatusError); ok && statusErr.statusCode == http.StatusNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Could not get %s record set %s from %s: %v", recordType, dnsName, zone.Name, err)
+		}
+
+		records = append(records, azureRecordFromRecordSet(zone, recordSet))
+	}
+
+	return records, nil
+}
+
+// zoneRecords returns every record set of the given zone.
+func (p *AzureProvider) zoneRecords(zone azureZone) ([]DNSRecord, error) {
+	var records []DNSRecord
+	next := p.zoneURL(zone) + "/recordsets?api-version=" + azureAPIVersion
+
+	for next != "" {
+		var page azureRecordSets
+		if err := p.do("GET", next, nil, &page); err != nil {
+			return nil, fmt.Errorf("Could not list record sets of %s: %v", zone.Name, err)
+		}
+
+		for _, recordSet := range page.Value {
+			records = append(records, azureRecordFromRecordSet(zone, recordSet))
+		}
+		next = page.NextLink
+	}
+
+	return records, nil
+}
+
+func (p *AzureProvider) resourceGroupURL() string {
+	return fmt.Sprintf("%s/subscriptions/%s/resourceGroups/%s", p.managementURL, pathEscape(p.config.SubscriptionID), pathEscape(p.config.ResourceGroup))
+}
+
+func (p *AzureProvider) zoneURL(zone azureZone) string {
+	return fmt.Sprintf("%s/providers/Microsoft.Network/dnsZones/%s", p.resourceGroupURL(), pathEscape(zone.Name))
+}
+
+func (p *AzureProvider) recordSetURL(zone azureZone, record DNSRecord) string {
+	return fmt.Sprintf("%s/%s/%s?api-version=%s", p.zoneURL(zone), record.Type, pathEscape(azureRelativeName(zone, record.Name)), azureAPIVersion)
+}
+
+func (p *AzureProvider) do(method, url string, in, out interface{}) error {
+	token, err := p.accessToken()
+	if err != nil {
+		return fmt.Errorf("Could not get access token: %v", err)
+	}
+
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+token)
+
+	return doJSON(p.client, method, url, header, in, out)
+}
+
+// accessToken returns a token for the Azure management API, renewing it a
+// minute before it expires.
+func (p *AzureProvider) accessToken() (string, error) {
+	if p.token != "" && p.now().Before(p.tokenExpiresAt) {
+		return p.token, nil
+	}
+
+	var token azureToken
+	var err error
+
+	if p.config.UseManagedIdentityExtension {
+		token, err = p.managedIdentityToken()
+	} else {
+		token, err = p.servicePrincipalToken()
+	}
+	if err != nil {
+		return "", err
+	}
+
+	p.token = token.AccessToken
+	p.tokenExpiresAt = p.now().Add(time.Duration(token.ExpiresIn)*time.Second - time.Minute)
+
+	return p.token, nil
+}
+
+func (p *AzureProvider) managedIdentityToken() (azureToken, error) {
+	query := url.Values{}
+	query.Set("api-version", "2018-02-01")
+	query.Set("resource", p.managementURL+"/")
+	if p.config.UserAssignedIdentityID != "" {
+		query.Set("client_id", p.config.UserAssignedIdentityID)
+	}
+
+	var token azureToken
+	err := doJSON(p.client, "GET", p.identityURL+"?"+query.Encode(), http.Header{"Metadata": []string{"true"}}, nil, &token)
+
+	return token, err
+}
+
+func (p *AzureProvider) servicePrincipalToken() (azureToken, error) {
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	form.Set("client_id", p.config.AADClientID)
+	form.Set("client_secret", p.config.AADClientSecret)
+	form.Set("resource", p.managementURL+"/")
+
+	tokenURL := fmt.Sprintf("%s/%s/oauth2/token", p.activeDirectoryURL, pathEscape(p.config.TenantID))
+
+	resp, err := p.client.PostForm(tokenURL, form)
+	if err != nil {
+		return azureToken{}, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return azureToken{}, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return azureToken{}, &httpStatusError{"POST", tokenURL, resp.StatusCode, strings.TrimSpace(string(data))}
+	}
+
+	var token azureToken
+	err = json.Unmarshal(data, &token)
+
+	return token, err
+}
+
+// azureRelativeName returns the name of the given domain relative to the
+// zone, which is "@" for the apex.
+func azureRelativeName(zone azureZone, dnsName string) string {
+	dnsName = strings.ToLower(strings.TrimSuffix(dnsName, "."))
+	zoneName := strings.ToLower(strings.TrimSuffix(zone.Name, "."))
+
+	if dnsName == zoneName {
+		return "@"
+	}
+
+	return strings.TrimSuffix(dnsName, "."+zoneName)
+}
+
+func azureRecordFromRecordSet(zone azureZone, recordSet azureRecordSet) DNSRecord {
+	name := strings.TrimSuffix(zone.Name, ".")
+	if recordSet.Name != "@" {
+		name = recordSet.Name + "." + name
+	}
+
+	properties := recordSet.Properties
+	record := DNSRecord{
+		Name:   name,
+		Type:   recordSet.Type[strings.LastIndex(recordSet.Type, "/")+1:],
+		TTL:    properties.TTL,
+		Values: []string{},
+	}
+
+	for _, a := range properties.ARecords {
+		record.Values = append(record.Values, a.IPv4Address)
+	}
+	for _, aaaa := range properties.AAAARecords {
+		record.Values = append(record.Values, aaaa.IPv6Address)
+	}
+	if properties.CNAMERecord != nil {
+		record.Values = append(record.Values, strings.TrimSuffix(properties.CNAMERecord.CNAME, "."))
+	}
+	for _, txt := range properties.TXTRecords {
+		record.Values = append(record.Values, fmt.Sprintf("%q", strings.Join(txt.Value, "")))
+	}
+
+	return record
+}
+
+func azureRecordSetPropertiesFromRecord(record DNSRecord) azureRecordSetProperties {
+	properties := azureRecordSetProperties{TTL: record.TTL}
+
+	for _, value := range record.Values {
+		switch record.Type {
+		case "A":
+			properties.ARecords = append(properties.ARecords, azureARecord{value})
+		case "AAAA":
+			properties.AAAARecords = append(properties.AAAARecords, azureAAAARecord{value})
+		case "CNAME":
+			properties.CNAMERecord = &azureCNAMERecord{value}
+		case "TXT":
+			if unquoted, err := strconv.Unquote(value); err == nil {
+				value = unquoted
+			}
+			properties.TXTRecords = append(properties.TXTRecords, azureTXTRecord{[]string{value}})
+		}
+	}
+
+	return properties
+}
@@ -0,0 +1,459 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testAzureOwner = "heritage=kubernetes-service-dns-update,cluster=default,service=/service"
+
+// FakeAzureDNS serves the subset of the Azure DNS, Azure AD and instance
+// metadata APIs used by the Azure provider. Record sets are keyed by
+// zone/type/name.
+type FakeAzureDNS struct {
+	t *testing.T
+
+	zones      []string
+	recordSets map[string]azureRecordSetProperties
+	requests   []string
+
+	servicePrincipalTokens int
+	managedIdentityTokens  int
+}
+
+func (f *FakeAzureDNS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/aad/tenant/oauth2/token":
+		f.servicePrincipalTokens++
+		if r.FormValue("client_id") != "client" || r.FormValue("client_secret") != "secret" {
+			http.Error(w, "invalid client", http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"access_token":"token","expires_in":"3600"}`))
+		return
+
+	case "/identity":
+		f.managedIdentityTokens++
+		if r.Header.Get("Metadata") != "true" {
+			http.Error(w, "missing metadata header", http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(`{"access_token":"token","expires_in":"3600"}`))
+		return
+	}
+
+	if r.Header.Get("Authorization") != "Bearer token" {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if r.URL.Query().Get("api-version") != azureAPIVersion {
+		http.Error(w, "missing api version", http.StatusBadRequest)
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/subscriptions/subscription/resourceGroups/group/providers/Microsoft.Network/dnsZones")
+	parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
+
+	switch {
+	case path == "":
+		var zones azureZones
+		for _, zone := range f.zones {
+			zones.Value = append(zones.Value, azureZone{Name: zone})
+		}
+		json.NewEncoder(w).Encode(zones)
+
+	case len(parts) == 2 && parts[1] == "recordsets":
+		var keys []string
+		for key := range f.recordSets {
+			if strings.HasPrefix(key, parts[0]+"/") {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+
+		var recordSets azureRecordSets
+		for _, key := range keys {
+			keyParts := strings.Split(key, "/")
+			recordSets.Value = append(recordSets.Value, azureRecordSet{
+				Name:       keyParts[2],
+				Type:       "Microsoft.Network/dnszones/" + keyParts[1],
+				Properties: f.recordSets[key],
+			})
+		}
+		json.NewEncoder(w).Encode(recordSets)
+
+	case len(parts) == 3:
+		key := strings.Join(parts, "/")
+
+		switch r.Method {
+		case "GET":
+			properties, ok := f.recordSets[key]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			json.NewEncoder(w).Encode(azureRecordSet{
+				Name:       parts[2],
+				Type:       "Microsoft.Network/dnszones/" + parts[1],
+				Properties: properties,
+			})
+
+		case "PUT":
+			var recordSet azureRecordSet
+			if err := json.NewDecoder(r.Body).Decode(&recordSet); err != nil {
+				f.t.Errorf("Could not decode record set: %v", err)
+			}
+			f.recordSets[key] = recordSet.Properties
+			f.requests = append(f.requests, "PUT "+key)
+			json.NewEncoder(w).Encode(recordSet)
+
+		case "DELETE":
+			delete(f.recordSets, key)
+			f.requests = append(f.requests, "DELETE "+key)
+			w.WriteHeader(http.StatusOK)
+		}
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func testAzureProvider(fake *FakeAzureDNS, config azureConfig) (*AzureProvider, func()) {
+	serverURL, client, closeServer := testHTTPServer(fake)
+
+	config.SubscriptionID = "subscription"
+	config.ResourceGroup = "group"
+
+	provider := &AzureProvider{
+		client:             client,
+		config:             config,
+		managementURL:      serverURL,
+		activeDirectoryURL: serverURL + "/aad",
+		identityURL:        serverURL + "/identity",
+		now:                time.Now,
+		zoneCache:          zoneCache{ttl: time.Hour},
+	}
+
+	return provider, closeServer
+}
+
+func testAzureServicePrincipal() azureConfig {
+	return azureConfig{TenantID: "tenant", AADClientID: "client", AADClientSecret: "secret"}
+}
+
+func TestAzureProviderGetOwner(t *testing.T) {
+	scenarios := []struct {
+		dnsName    string
+		recordSets map[string]azureRecordSetProperties
+
+		expectedOwner  string
+		expectedExists bool
+		expectedError  error
+	}{
+		// No zone for the domain
+		{
+			dnsName: "some.example.com",
+
+			expectedError: errors.New("No DNS zone matches domain some.example.com"),
+		},
+
+		// No records for the domain
+		{
+			dnsName: "some.domain.com",
+
+			expectedOwner:  "",
+			expectedExists: false,
+		},
+
+		// Record not owned by anybody
+		{
+			dnsName: "some.domain.com",
+			recordSets: map[string]azureRecordSetProperties{
+				"domain.com/CNAME/some": azureRecordSetProperties{TTL: 300, CNAMERecord: &azureCNAMERecord{"other.domain.com"}},
+			},
+
+			expectedOwner:  "",
+			expectedExists: true,
+		},
+
+		// Apex record owned in the most specific zone
+		{
+			dnsName: "sub.domain.com",
+			recordSets: map[string]azureRecordSetProperties{
+				"sub.domain.com/A/@":        azureRecordSetProperties{TTL: 300, ARecords: []azureARecord{{"203.0.113.10"}}},
+				"sub.domain.com/TXT/_owner": azureRecordSetProperties{TTL: 300, TXTRecords: []azureTXTRecord{{[]string{"v=spf1 -all"}}, {[]string{testAzureOwner}}}},
+			},
+
+			expectedOwner:  testAzureOwner,
+			expectedExists: true,
+		},
+	}
+
+	for _, scenario := range scenarios {
+		fake := &FakeAzureDNS{t: t, zones: []string{"domain.com", "sub.domain.com"}, recordSets: scenario.recordSets}
+		provider, closeServer := testAzureProvider(fake, testAzureServicePrincipal())
+
+		owner, exists, err := provider.GetOwner(scenario.dnsName)
+
+		if !reflect.DeepEqual(err, scenario.expectedError) {
+			t.Errorf("Expected error to be '%v', was '%v'", scenario.expectedError, err)
+		}
+
+		if owner != scenario.expectedOwner || exists != scenario.expectedExists {
+			t.Errorf("Expected owner of %s to be '%s' (%v), was '%s' (%v)", scenario.dnsName, scenario.expectedOwner, scenario.expectedExists, owner, exists)
+		}
+
+		closeServer()
+	}
+}
+
+func TestAzureProviderApplyChanges(t *testing.T) {
+	addressEndpoint := Endpoint{
+		DNSName:    "some.domain.com",
+		RecordType: "A",
+		Targets:    []string{"203.0.113.10"},
+		Owner:      testAzureOwner,
+	}
+
+	hostnameEndpoint := Endpoint{
+		DNSName:    "some.domain.com",
+		RecordType: "CNAME",
+		Targets:    []string{"lb.hostname.cloudapp.azure.com"},
+		Owner:      testAzureOwner,
+	}
+
+	address := azureRecordSetProperties{TTL: 300, ARecords: []azureARecord{{"203.0.113.10"}}}
+	reordered := azureRecordSetProperties{TTL: 300, ARecords: []azureARecord{{"203.0.113.20"}, {"203.0.113.10"}}}
+	hostname := azureRecordSetProperties{TTL: 300, CNAMERecord: &azureCNAMERecord{"lb.hostname.cloudapp.azure.com"}}
+	txt := azureRecordSetProperties{TTL: 300, TXTRecords: []azureTXTRecord{{[]string{testAzureOwner}}}}
+
+	scenarios := []struct {
+		description string
+		dryRun      bool
+		changes     []DNSChange
+		recordSets  map[string]azureRecordSetProperties
+
+		expectedRequests   []string
+		expectedRecordSets map[string]azureRecordSetProperties
+		expectedErrors     []error
+	}{
+		{
+			description: "A records are created",
+			changes:     []DNSChange{DNSChange{Action: "UPSERT", Endpoint: addressEndpoint}},
+			recordSets:  map[string]azureRecordSetProperties{},
+
+			expectedRequests: []string{"PUT domain.com/A/some", "PUT domain.com/TXT/_owner.some"},
+			expectedRecordSets: map[string]azureRecordSetProperties{
+				"domain.com/A/some":          address,
+				"domain.com/TXT/_owner.some": txt,
+			},
+			expectedErrors: []error{nil},
+		},
+		{
+			description: "A records are replaced by CNAME records",
+			changes:     []DNSChange{DNSChange{Action: "UPSERT", Endpoint: hostnameEndpoint}},
+			recordSets: map[string]azureRecordSetProperties{
+				"domain.com/A/some":          address,
+				"domain.com/TXT/_owner.some": txt,
+			},
+
+			expectedRequests: []string{"DELETE domain.com/A/some", "PUT domain.com/CNAME/some"},
+			expectedRecordSets: map[string]azureRecordSetProperties{
+				"domain.com/CNAME/some":      hostname,
+				"domain.com/TXT/_owner.some": txt,
+			},
+			expectedErrors: []error{nil},
+		},
+		{
+			description: "records differing only by the order of their values are left alone",
+			changes: []DNSChange{DNSChange{Action: "UPSERT", Endpoint: Endpoint{
+				DNSName:    "some.domain.com",
+				RecordType: "A",
+				Targets:    []string{"203.0.113.10", "203.0.113.20"},
+				Owner:      testAzureOwner,
+			}}},
+			recordSets: map[string]azureRecordSetProperties{
+				"domain.com/A/some":          reordered,
+				"domain.com/TXT/_owner.some": txt,
+			},
+
+			expectedRecordSets: map[string]azureRecordSetProperties{
+				"domain.com/A/some":          reordered,
+				"domain.com/TXT/_owner.some": txt,
+			},
+			expectedErrors: []error{nil},
+		},
+		{
+			description: "records are deleted",
+			changes:     []DNSChange{DNSChange{Action: "DELETE", Endpoint: hostnameEndpoint}},
+			recordSets: map[string]azureRecordSetProperties{
+				"domain.com/CNAME/some":      hostname,
+				"domain.com/TXT/_owner.some": txt,
+			},
+
+			expectedRequests:   []string{"DELETE domain.com/CNAME/some", "DELETE domain.com/TXT/_owner.some"},
+			expectedRecordSets: map[string]azureRecordSetProperties{},
+			expectedErrors:     []error{nil},
+		},
+		{
+			description: "changes are only logged in dry-run mode",
+			dryRun:      true,
+			changes:     []DNSChange{DNSChange{Action: "UPSERT", Endpoint: addressEndpoint}},
+			recordSets:  map[string]azureRecordSetProperties{},
+
+			expectedRecordSets: map[string]azureRecordSetProperties{},
+			expectedErrors:     []error{nil},
+		},
+		{
+			description: "records outside of any zone fail on their own",
+			changes: []DNSChange{
+				DNSChange{Action: "UPSERT", Endpoint: Endpoint{DNSName: "some.example.com", RecordType: "A", Targets: []string{"203.0.113.10"}}},
+				DNSChange{Action: "UPSERT", Endpoint: addressEndpoint},
+			},
+			recordSets: map[string]azureRecordSetProperties{
+				"domain.com/A/some":          address,
+				"domain.com/TXT/_owner.some": txt,
+			},
+
+			expectedRecordSets: map[string]azureRecordSetProperties{
+				"domain.com/A/some":          address,
+				"domain.com/TXT/_owner.some": txt,
+			},
+			expectedErrors: []error{errors.New("No DNS zone matches domain some.example.com"), nil},
+		},
+		{
+			description: "CNAME records with several hostnames are refused",
+			changes:     []DNSChange{DNSChange{Action: "UPSERT", Endpoint: testSeveralHostnamesEndpoint(testAzureOwner)}},
+			recordSets: map[string]azureRecordSetProperties{
+				"domain.com/A/some":          address,
+				"domain.com/TXT/_owner.some": txt,
+			},
+
+			expectedRecordSets: map[string]azureRecordSetProperties{
+				"domain.com/A/some":          address,
+				"domain.com/TXT/_owner.some": txt,
+			},
+			expectedErrors: []error{testSeveralHostnamesError},
+		},
+	}
+
+	defer func(dryRunValue bool) { dryRun = dryRunValue }(dryRun)
+
+	for _, scenario := range scenarios {
+		dryRun = scenario.dryRun
+
+		fake := &FakeAzureDNS{t: t, zones: []string{"domain.com"}, recordSets: scenario.recordSets}
+		provider, closeServer := testAzureProvider(fake, testAzureServicePrincipal())
+
+		errs := provider.ApplyChanges(scenario.changes)
+
+		if !reflect.DeepEqual(errs, scenario.expectedErrors) {
+			t.Errorf("Expected errors to be '%v' when %s, was '%v'", scenario.expectedErrors, scenario.description, errs)
+		}
+
+		if !reflect.DeepEqual(fake.requests, scenario.expectedRequests) {
+			t.Errorf("Expected requests to be '%v' when %s, was '%v'", scenario.expectedRequests, scenario.description, fake.requests)
+		}
+
+		if !reflect.DeepEqual(fake.recordSets, scenario.expectedRecordSets) {
+			t.Errorf("Expected record sets to be '%v' when %s, was '%v'", scenario.expectedRecordSets, scenario.description, fake.recordSets)
+		}
+
+		closeServer()
+	}
+}
+
+func TestAzureProviderListEndpoints(t *testing.T) {
+	fake := &FakeAzureDNS{t: t, zones: []string{"domain.com", "sub.domain.com"}, recordSets: map[string]azureRecordSetProperties{
+		"domain.com/TXT/@":             azureRecordSetProperties{TTL: 300, TXTRecords: []azureTXTRecord{{[]string{"v=spf1 -all"}}}},
+		"domain.com/CNAME/some":        azureRecordSetProperties{TTL: 300, CNAMERecord: &azureCNAMERecord{"elb.hostname.amazonaws.com"}},
+		"domain.com/TXT/_owner.some":   azureRecordSetProperties{TTL: 300, TXTRecords: []azureTXTRecord{{[]string{testAzureOwner}}}},
+		"domain.com/A/other":           azureRecordSetProperties{TTL: 300, ARecords: []azureARecord{{"203.0.113.20"}}},
+		"sub.domain.com/A/@":           azureRecordSetProperties{TTL: 60, ARecords: []azureARecord{{"203.0.113.10"}}},
+		"sub.domain.com/AAAA/@":        azureRecordSetProperties{TTL: 60, AAAARecords: []azureAAAARecord{{"2001:db8::10"}}},
+		"sub.domain.com/TXT/_owner":    azureRecordSetProperties{TTL: 300, TXTRecords: []azureTXTRecord{{[]string{testAzureOwner}}}},
+		"sub.domain.com/TXT/_owner.x":  azureRecordSetProperties{TTL: 300, TXTRecords: []azureTXTRecord{{[]string{testAzureOwner}}}},
+		"sub.domain.com/CNAME/unowned": azureRecordSetProperties{TTL: 300, CNAMERecord: &azureCNAMERecord{"other.domain.com"}},
+	}}
+	provider, closeServer := testAzureProvider(fake, testAzureServicePrincipal())
+	defer closeServer()
+
+	endpoints, err := provider.ListEndpoints([]string{"some.domain.com", "sub.domain.com"})
+	if err != nil {
+		t.Errorf("Expected no error, was '%v'", err)
+	}
+
+	expected := []Endpoint{
+		Endpoint{DNSName: "some.domain.com", RecordType: "CNAME", Targets: []string{"elb.hostname.amazonaws.com"}, TTL: 300, Owner: testAzureOwner},
+		Endpoint{DNSName: "sub.domain.com", RecordType: "A", Targets: []string{"203.0.113.10", "2001:db8::10"}, TTL: 60, Owner: testAzureOwner},
+	}
+
+	if !reflect.DeepEqual(endpoints, expected) {
+		t.Errorf("Expected endpoints to be '%v', was '%v'", expected, endpoints)
+	}
+}
+
+func TestAzureProviderAccessToken(t *testing.T) {
+	scenarios := []struct {
+		config azureConfig
+
+		expectedServicePrincipalTokens int
+		expectedManagedIdentityTokens  int
+		expectedError                  bool
+	}{
+		{
+			config:                         testAzureServicePrincipal(),
+			expectedServicePrincipalTokens: 1,
+		},
+		{
+			config:                        azureConfig{UseManagedIdentityExtension: true},
+			expectedManagedIdentityTokens: 1,
+		},
+		{
+			config:                         azureConfig{TenantID: "tenant", AADClientID: "client", AADClientSecret: "wrong"},
+			expectedServicePrincipalTokens: 2,
+			expectedError:                  true,
+		},
+	}
+
+	for i, scenario := range scenarios {
+		fake := &FakeAzureDNS{t: t, zones: []string{"domain.com"}}
+		provider, closeServer := testAzureProvider(fake, scenario.config)
+
+		// Tokens are reused until they are about to expire
+		_, _, err1 := provider.GetOwner("domain.com")
+		_, _, err2 := provider.GetOwner("domain.com")
+
+		if (err1 != nil || err2 != nil) != scenario.expectedError {
+			t.Errorf("Expected error to be %v in scenario %d, was '%v'", scenario.expectedError, i, err1)
+		}
+
+		if fake.servicePrincipalTokens != scenario.expectedServicePrincipalTokens || fake.managedIdentityTokens != scenario.expectedManagedIdentityTokens {
+			t.Errorf("Expected %d service principal and %d managed identity tokens in scenario %d, got %d and %d", scenario.expectedServicePrincipalTokens, scenario.expectedManagedIdentityTokens, i, fake.servicePrincipalTokens, fake.managedIdentityTokens)
+		}
+
+		closeServer()
+	}
+}
+
+func TestAzureRelativeName(t *testing.T) {
+	scenarios := map[string]string{
+		"domain.com":           "@",
+		"Domain.com.":          "@",
+		"some.domain.com":      "some",
+		"some.sub.domain.com.": "some.sub",
+	}
+
+	for dnsName, expected := range scenarios {
+		if relativeName := azureRelativeName(azureZone{Name: "domain.com"}, dnsName); relativeName != expected {
+			t.Errorf("Expected relative name of %s to be '%s', was '%s'", dnsName, expected, relativeName)
+		}
+	}
+}
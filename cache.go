@@ -0,0 +1,121 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+// Error code returned by Route53 for changes to a deleted hosted zone
+const noSuchHostedZoneCode = "NoSuchHostedZone"
+
+// CachingAWSClient remembers the hosted zones looked up for domains and load
+// balancers, so they are not listed from AWS again on every sync.
+type CachingAWSClient struct {
+	AWSClient
+
+	zoneTTL         time.Duration
+	loadBalancerTTL time.Duration
+	negativeTTL     time.Duration
+
+	hostedZoneIDs             map[string]cacheEntry
+	loadBalancerHostedZoneIDs map[string]cacheEntry
+
+	now func() time.Time
+}
+
+type cacheEntry struct {
+	value     string
+	err       error
+	expiresAt time.Time
+}
+
+func NewCachingAWSClient(client AWSClient, zoneTTL, loadBalancerTTL, negativeTTL time.Duration) *CachingAWSClient {
+	return &CachingAWSClient{
+		AWSClient: client,
+
+		zoneTTL:         zoneTTL,
+		loadBalancerTTL: loadBalancerTTL,
+		negativeTTL:     negativeTTL,
+
+		hostedZoneIDs:             map[string]cacheEntry{},
+		loadBalancerHostedZoneIDs: map[string]cacheEntry{},
+
+		now: time.Now,
+	}
+}
+
+// GetHostedZoneID returns the cached hosted zone for the domain, if any. Domains
+// without a matching zone are remembered as well, but for negativeTTL only.
+func (c *CachingAWSClient) GetHostedZoneID(domain string) (string, error) {
+	if entry, ok := c.hostedZoneIDs[domain]; ok && c.now().Before(entry.expiresAt) {
+		return entry.value, entry.err
+	}
+
+	hostedZoneID, err := c.AWSClient.GetHostedZoneID(domain)
+
+	if _, notFound := err.(*zoneNotFoundError); notFound {
+		c.hostedZoneIDs[domain] = cacheEntry{err: err, expiresAt: c.now().Add(c.negativeTTL)}
+	} else if err == nil {
+		c.hostedZoneIDs[domain] = cacheEntry{value: hostedZoneID, expiresAt: c.now().Add(c.zoneTTL)}
+	}
+
+	return hostedZoneID, err
+}
+
+func (c *CachingAWSClient) GetLoadBalancerHostedZoneID(hostname string) (string, error) {
+	if entry, ok := c.loadBalancerHostedZoneIDs[hostname]; ok && c.now().Before(entry.expiresAt) {
+		return entry.value, nil
+	}
+
+	hostedZoneID, err := c.AWSClient.GetLoadBalancerHostedZoneID(hostname)
+	if err == nil {
+		c.loadBalancerHostedZoneIDs[hostname] = cacheEntry{value: hostedZoneID, expiresAt: c.now().Add(c.loadBalancerTTL)}
+	}
+
+	return hostedZoneID, err
+}
+
+// ApplyDNSChanges forgets the domains cached for hosted zones that turned out
+// to no longer exist, so they are looked up again in the next sync. The same
+// goes for GetDNSOwner.
+func (c *CachingAWSClient) ApplyDNSChanges(changes []Route53Change) []error {
+	errs := c.AWSClient.ApplyDNSChanges(changes)
+
+	for i, err := range errs {
+		if isNoSuchHostedZone(err) {
+			c.InvalidateHostedZone(changes[i].Record.DomainHostedZoneID)
+		}
+	}
+
+	return errs
+}
+
+func (c *CachingAWSClient) GetDNSOwner(domainName, domainHostedZoneID string) (string, bool, error) {
+	owner, exists, err := c.AWSClient.GetDNSOwner(domainName, domainHostedZoneID)
+	if isNoSuchHostedZone(err) {
+		c.InvalidateHostedZone(domainHostedZoneID)
+	}
+
+	return owner, exists, err
+}
+
+// InvalidateHostedZone forgets every domain cached for the given hosted zone.
+func (c *CachingAWSClient) InvalidateHostedZone(hostedZoneID string) {
+	for domain, entry := range c.hostedZoneIDs {
+		if entry.err == nil && entry.value == hostedZoneID {
+			log.Printf("Forgetting cached hosted zone for %s: hostedZoneID=%s\n", domain, hostedZoneID)
+			delete(c.hostedZoneIDs, domain)
+		}
+	}
+}
+
+func isNoSuchHostedZone(err error) bool {
+	if listErr, ok := err.(*listRecordSetsError); ok {
+		err = listErr.err
+	}
+
+	awsErr, ok := err.(awserr.Error)
+	return ok && awsErr.Code() == noSuchHostedZoneCode
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+type CountingAWSClientDummy struct {
+	hostedZoneIDs             map[string]string
+	hostedZoneIDErrors        map[string]error
+	loadBalancerHostedZoneIDs map[string]string
+	getDNSOwnerError          error
+	applyDNSChangesOutput     []error
+
+	getHostedZoneIDCalls             int
+	getLoadBalancerHostedZoneIDCalls int
+}
+
+func (c *CountingAWSClientDummy) GetHostedZoneID(domain string) (string, error) {
+	c.getHostedZoneIDCalls++
+	return c.hostedZoneIDs[domain], c.hostedZoneIDErrors[domain]
+}
+
+func (c *CountingAWSClientDummy) GetLoadBalancerHostedZoneID(hostname string) (string, error) {
+	c.getLoadBalancerHostedZoneIDCalls++
+	return c.loadBalancerHostedZoneIDs[hostname], nil
+}
+
+func (c *CountingAWSClientDummy) GetDNSOwner(domainName, domainHostedZoneID string) (string, bool, error) {
+	return "", false, c.getDNSOwnerError
+}
+
+func (c *CountingAWSClientDummy) ApplyDNSChanges(changes []Route53Change) []error {
+	return c.applyDNSChangesOutput
+}
+
+func (c *CountingAWSClientDummy) ListDNSRecords(hostedZoneIDs []string) ([]DNSRecord, error) {
+	return nil, nil
+}
+
+func testCachingAWSClient(client AWSClient, now *time.Time) *CachingAWSClient {
+	cachingClient := NewCachingAWSClient(client, time.Hour, time.Hour, time.Minute)
+	cachingClient.now = func() time.Time { return *now }
+	return cachingClient
+}
+
+func TestCachingAWSClientGetHostedZoneID(t *testing.T) {
+	now := time.Now()
+	client := &CountingAWSClientDummy{
+		hostedZoneIDs: map[string]string{"some.domain.com": "DOMAINZONEID"},
+	}
+	cachingClient := testCachingAWSClient(client, &now)
+
+	for i := 0; i < 3; i++ {
+		hostedZoneID, err := cachingClient.GetHostedZoneID("some.domain.com")
+		if err != nil || hostedZoneID != "DOMAINZONEID" {
+			t.Errorf("Expected hosted zone to be 'DOMAINZONEID', was '%s' (%v)", hostedZoneID, err)
+		}
+	}
+
+	if client.getHostedZoneIDCalls != 1 {
+		t.Errorf("Expected 1 lookup, got %d", client.getHostedZoneIDCalls)
+	}
+
+	now = now.Add(time.Hour)
+	cachingClient.GetHostedZoneID("some.domain.com")
+
+	if client.getHostedZoneIDCalls != 2 {
+		t.Errorf("Expected expired entry to be looked up again, got %d lookups", client.getHostedZoneIDCalls)
+	}
+}
+
+func TestCachingAWSClientGetHostedZoneIDErrors(t *testing.T) {
+	now := time.Now()
+	client := &CountingAWSClientDummy{
+		hostedZoneIDErrors: map[string]error{
+			"missing.domain.com": &zoneNotFoundError{"No zone matches domain missing.domain.com."},
+			"broken.domain.com":  errors.New("No zone found for domain.com: error"),
+		},
+	}
+	cachingClient := testCachingAWSClient(client, &now)
+
+	// Domains without a zone are remembered for the negative TTL only
+	for i := 0; i < 2; i++ {
+		_, err := cachingClient.GetHostedZoneID("missing.domain.com")
+		if err == nil || err.Error() != "No zone matches domain missing.domain.com." {
+			t.Errorf("Expected error to be returned, was '%v'", err)
+		}
+	}
+
+	if client.getHostedZoneIDCalls != 1 {
+		t.Errorf("Expected 1 lookup, got %d", client.getHostedZoneIDCalls)
+	}
+
+	now = now.Add(time.Minute)
+	cachingClient.GetHostedZoneID("missing.domain.com")
+
+	if client.getHostedZoneIDCalls != 2 {
+		t.Errorf("Expected expired entry to be looked up again, got %d lookups", client.getHostedZoneIDCalls)
+	}
+
+	// Other errors are not cached at all
+	cachingClient.GetHostedZoneID("broken.domain.com")
+	cachingClient.GetHostedZoneID("broken.domain.com")
+
+	if client.getHostedZoneIDCalls != 4 {
+		t.Errorf("Expected failed lookups not to be cached, got %d lookups", client.getHostedZoneIDCalls)
+	}
+}
+
+func TestCachingAWSClientGetLoadBalancerHostedZoneID(t *testing.T) {
+	now := time.Now()
+	client := &CountingAWSClientDummy{
+		loadBalancerHostedZoneIDs: map[string]string{"elb.hostname": "ELBZONEID"},
+	}
+	cachingClient := testCachingAWSClient(client, &now)
+
+	for i := 0; i < 3; i++ {
+		hostedZoneID, err := cachingClient.GetLoadBalancerHostedZoneID("elb.hostname")
+		if err != nil || hostedZoneID != "ELBZONEID" {
+			t.Errorf("Expected hosted zone to be 'ELBZONEID', was '%s' (%v)", hostedZoneID, err)
+		}
+	}
+
+	if client.getLoadBalancerHostedZoneIDCalls != 1 {
+		t.Errorf("Expected 1 lookup, got %d", client.getLoadBalancerHostedZoneIDCalls)
+	}
+}
+
+func TestCachingAWSClientInvalidation(t *testing.T) {
+	noSuchHostedZone := awserr.New(noSuchHostedZoneCode, "No hosted zone found with ID: DOMAINZONEID", nil)
+
+	scenarios := []struct {
+		description string
+		invalidate  func(c *CachingAWSClient)
+
+		expectedLookups int
+	}{
+		{
+			description: "change failed with an unrelated error",
+			invalidate: func(c *CachingAWSClient) {
+				c.AWSClient.(*CountingAWSClientDummy).applyDNSChangesOutput = []error{errors.New("error")}
+				c.ApplyDNSChanges([]Route53Change{testRoute53Change("UPSERT", "some.domain.com", "DOMAINZONEID")})
+			},
+			expectedLookups: 1,
+		},
+		{
+			description: "change failed for a deleted hosted zone",
+			invalidate: func(c *CachingAWSClient) {
+				c.AWSClient.(*CountingAWSClientDummy).applyDNSChangesOutput = []error{noSuchHostedZone}
+				c.ApplyDNSChanges([]Route53Change{testRoute53Change("UPSERT", "some.domain.com", "DOMAINZONEID")})
+			},
+			expectedLookups: 2,
+		},
+		{
+			description: "record sets could not be listed for a deleted hosted zone",
+			invalidate: func(c *CachingAWSClient) {
+				c.AWSClient.(*CountingAWSClientDummy).getDNSOwnerError = &listRecordSetsError{"DOMAINZONEID", noSuchHostedZone}
+				c.GetDNSOwner("some.domain.com", "DOMAINZONEID")
+			},
+			expectedLookups: 2,
+		},
+	}
+
+	for _, scenario := range scenarios {
+		now := time.Now()
+		client := &CountingAWSClientDummy{
+			hostedZoneIDs: map[string]string{"some.domain.com": "DOMAINZONEID"},
+		}
+		cachingClient := testCachingAWSClient(client, &now)
+
+		cachingClient.GetHostedZoneID("some.domain.com")
+		scenario.invalidate(cachingClient)
+		cachingClient.GetHostedZoneID("some.domain.com")
+
+		if client.getHostedZoneIDCalls != scenario.expectedLookups {
+			t.Errorf("Expected %d lookups when %s, got %d", scenario.expectedLookups, scenario.description, client.getHostedZoneIDCalls)
+		}
+	}
+}
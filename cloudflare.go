@@ -0,0 +1,413 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const cloudflareAPIURL = "https://api.cloudflare.com/client/v4"
+
+// TTL Cloudflare requires for proxied records, meaning "automatic"
+const cloudflareAutomaticTTL = 1
+
+type cloudflareZone struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type cloudflareRecord struct {
+	ID      string `json:"id,omitempty"`
+	Type    string `json:"type"`
+	Name    string `json:"name"`
+	Content string `json:"content"`
+	TTL     int64  `json:"ttl"`
+	Proxied bool   `json:"proxied"`
+}
+
+type cloudflareResultInfo struct {
+	Page       int `json:"page"`
+	TotalPages int `json:"total_pages"`
+}
+
+type cloudflareZones struct {
+	Result     []cloudflareZone     `json:"result"`
+	ResultInfo cloudflareResultInfo `json:"result_info"`
+}
+
+type cloudflareRecords struct {
+	Result     []cloudflareRecord   `json:"result"`
+	ResultInfo cloudflareResultInfo `json:"result_info"`
+}
+
+// CloudflareProvider keeps endpoints as DNS records in the Cloudflare zones
+// reachable with an API token. Names at the apex of a zone can be CNAME
+// records too, as Cloudflare flattens them into the addresses they resolve to.
+type CloudflareProvider struct {
+	client *http.Client
+	apiURL string
+	token  string
+	now    func() time.Time
+
+	zones     []cloudflareZone
+	zoneCache zoneCache
+}
+
+func NewCloudflareProvider() (*CloudflareProvider, error) {
+	token := os.Getenv("CF_API_TOKEN")
+	if token == "" {
+		return nil, errors.New("Cloudflare API token must be set in CF_API_TOKEN")
+	}
+
+	return &CloudflareProvider{
+		client:    &http.Client{Timeout: httpTimeout},
+		apiURL:    cloudflareAPIURL,
+		token:     token,
+		now:       time.Now,
+		zoneCache: zoneCache{ttl: time.Duration(zoneCacheTTL) * time.Second},
+	}, nil
+}
+
+func (p *CloudflareProvider) GetOwner(dnsName string) (string, bool, error) {
+	zone, err := p.zone(dnsName)
+	if err != nil {
+		return "", false, err
+	}
+
+	records, err := p.endpointRecords(zone, dnsName)
+	if err != nil {
+		return "", false, err
+	}
+
+	exists := false
+	var txt []string
+
+	for _, record := range records {
+		if record.Type == "TXT" {
+			txt = append(txt, record.Content)
+		} else {
+			exists = true
+		}
+	}
+
+	return ownerFromTXT(txt), exists, nil
+}
+
+// ApplyChanges brings the records stored for the name of each endpoint in line
+// with the desired ones, updating records in place whenever possible.
+func (p *CloudflareProvider) ApplyChanges(changes []DNSChange) []error {
+	errs := make([]error, len(changes))
+
+	for i, change := range changes {
+		errs[i] = p.applyChange(change)
+	}
+
+	return errs
+}
+
+func (p *CloudflareProvider) applyChange(change DNSChange) error {
+	dnsName := change.Endpoint.DNSName
+
+	zone, err := p.zone(dnsName)
+	if err != nil {
+		return err
+	}
+
+	current, err := p.endpointRecords(zone, dnsName)
+	if err != nil {
+		return err
+	}
+
+	var desired []cloudflareRecord
+	if change.Action != "DELETE" {
+		desired, err = cloudflareRecordsFromEndpoint(change.Endpoint)
+		if err != nil {
+			return err
+		}
+	}
+
+	updates, deletions, creations := cloudflareRecordChanges(current, desired)
+
+	for _, record := range updates {
+		if err := p.writeRecord("PUT", zone, record); err != nil {
+			return err
+		}
+	}
+
+	// Deletions go before creations, since a CNAME record cannot be created
+	// alongside the records it replaces
+	for _, record := range deletions {
+		if err := p.writeRecord("DELETE", zone, record); err != nil {
+			return err
+		}
+	}
+
+	for _, record := range creations {
+		if err := p.writeRecord("POST", zone, record); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (p *CloudflareProvider) writeRecord(method string, zone cloudflareZone, record cloudflareRecord) error {
+	if dryRun {
+		log.Printf("DRY RUN: We normally would have sent %s for %s record %s (%s, proxied=%v) in %s\n", method, record.Type, record.Name, record.Content, record.Proxied, zone.Name)
+		return nil
+	}
+
+	recordURL := p.zoneURL(zone) + "/dns_records"
+	if record.ID != "" {
+		recordURL += "/" + pathEscape(record.ID)
+	}
+
+	var in interface{}
+	if method != "DELETE" {
+		in = record
+	}
+
+	if err := p.do(method, recordURL, in, nil); err != nil {
+		return fmt.Errorf("Could not write %s record %s: %v", record.Type, record.Name, err)
+	}
+
+	return nil
+}
+
+func (p *CloudflareProvider) ListEndpoints(dnsNames []string) ([]Endpoint, error) {
+	indexes, err := p.zoneCache.zonesOf(dnsNames, p.now(), p.zoneNames)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []DNSRecord
+	for _, i := range indexes {
+		zone := p.zones[i]
+		zoneRecords, err := p.listRecords(zone, "")
+		if err != nil {
+			return nil, err
+		}
+
+		for _, record := range zoneRecords {
+			records = append(records, DNSRecord{Name: record.Name, Type: record.Type, TTL: record.TTL, Values: []string{record.Content}})
+		}
+	}
+
+	return ownedEndpoints(records), nil
+}
+
+// zone returns the most specific zone the given name belongs to.
+func (p *CloudflareProvider) zone(dnsName string) (cloudflareZone, error) {
+	i, err := p.zoneCache.find(dnsName, p.now(), p.zoneNames)
+	if err != nil {
+		return cloudflareZone{}, err
+	}
+
+	if i < 0 {
+		return cloudflareZone{}, fmt.Errorf("No zone matches domain %s", dnsName)
+	}
+
+	return p.zones[i], nil
+}
+
+// zoneNames lists the zones for the zone cache, whose indexes point into
+// p.zones.
+func (p *CloudflareProvider) zoneNames() ([]string, error) {
+	zones, err := p.listZones()
+	if err != nil {
+		return nil, fmt.Errorf("Could not list zones: %v", err)
+	}
+
+	p.zones = zones
+
+	names := make([]string, len(zones))
+	for i, zone := range zones {
+		names[i] = zone.Name
+	}
+	return names, nil
+}
+
+func (p *CloudflareProvider) listZones() ([]cloudflareZone, error) {
+	zones := []cloudflareZone{}
+
+	for page := 1; ; page++ {
+		var zonesPage cloudflareZones
+		if err := p.do("GET", fmt.Sprintf("%s/zones?per_page=50&page=%d", p.apiURL, page), nil, &zonesPage); err != nil {
+			return nil, err
+		}
+
+		zones = append(zones, zonesPage.Result...)
+
+		if page >= zonesPage.ResultInfo.TotalPages {
+			return zones, nil
+		}
+	}
+}
+
+// endpointRecords returns the address records stored for the given name,
+// along with its TXT ownership records.
+func (p *CloudflareProvider) endpointRecords(zone cloudflareZone, dnsName string) ([]cloudflareRecord, error) {
+	records, err := p.records(zone, dnsName, addressRecordTypes)
+	if err != nil {
+		return nil, err
+	}
+
+	ownerRecords, err := p.records(zone, ownerRecordName(dnsName), []string{"TXT"})
+	if err != nil {
+		return nil, err
+	}
+
+	return append(records, ownerRecords...), nil
+}
+
+// records returns the records of the given types stored for a name.
+func (p *CloudflareProvider) records(zone cloudflareZone, dnsName string, recordTypes []string) ([]cloudflareRecord, error) {
+	all, err := p.listRecords(zone, dnsName)
+	if err != nil {
+		return nil, err
+	}
+
+	records := []cloudflareRecord{}
+	for _, record := range all {
+		if containsString(recordTypes, record.Type) {
+			records = append(records, record)
+		}
+	}
+
+	return records, nil
+}
+
+// listRecords returns the records stored for a name, or every record of the
+// zone when no name is given.
+func (p *CloudflareProvider) listRecords(zone cloudflareZone, dnsName string) ([]cloudflareRecord, error) {
+	var records []cloudflareRecord
+
+	for page := 1; ; page++ {
+		query := url.Values{}
+		if dnsName != "" {
+			query.Set("name", strings.ToLower(strings.TrimSuffix(dnsName, ".")))
+		}
+		query.Set("per_page", "100")
+		query.Set("page", fmt.Sprint(page))
+
+		var recordsPage cloudflareRecords
+		if err := p.do("GET", p.zoneURL(zone)+"/dns_records?"+query.Encode(), nil, &recordsPage); err != nil {
+			return nil, fmt.Errorf("Could not list records for %s: %v", zone.Name, err)
+		}
+
+		records = append(records, recordsPage.Result...)
+
+		if page >= recordsPage.ResultInfo.TotalPages {
+			return records, nil
+		}
+	}
+}
+
+func (p *CloudflareProvider) zoneURL(zone cloudflareZone) string {
+	return fmt.Sprintf("%s/zones/%s", p.apiURL, pathEscape(zone.ID))
+}
+
+func (p *CloudflareProvider) do(method, url string, in, out interface{}) error {
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+p.token)
+
+	return doJSON(p.client, method, url, header, in, out)
+}
+
+// cloudflareRecordsFromEndpoint returns one Cloudflare record per value of the
+// records of the given endpoint. Only address records are ever proxied.
+func cloudflareRecordsFromEndpoint(endpoint Endpoint) ([]cloudflareRecord, error) {
+	dnsRecords, err := endpointRecords(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []cloudflareRecord
+
+	for _, record := range dnsRecords {
+		proxied := endpoint.Proxied && record.Type != "TXT"
+
+		ttl := record.TTL
+		if proxied {
+			ttl = cloudflareAutomaticTTL
+		}
+
+		for _, value := range record.Values {
+			if record.Type == "TXT" {
+				value = strings.Trim(value, "\"")
+			}
+
+			records = append(records, cloudflareRecord{
+				Type:    record.Type,
+				Name:    record.Name,
+				Content: value,
+				TTL:     ttl,
+				Proxied: proxied,
+			})
+		}
+	}
+
+	return records, nil
+}
+
+// cloudflareRecordChanges compares the current records of a name with the
+// desired ones. Current records are reused for desired ones of the same type,
+// so that updates are made in place; the rest are deleted or created.
+func cloudflareRecordChanges(current, desired []cloudflareRecord) (updates, deletions, creations []cloudflareRecord) {
+	used := make([]bool, len(current))
+	var unmatched []cloudflareRecord
+
+	// Records with the same content first, whether or not they need an update
+	for _, record := range desired {
+		i := findCloudflareRecord(current, used, record, true)
+		if i < 0 {
+			unmatched = append(unmatched, record)
+			continue
+		}
+
+		used[i] = true
+		if current[i].TTL != record.TTL || current[i].Proxied != record.Proxied {
+			record.ID = current[i].ID
+			updates = append(updates, record)
+		}
+	}
+
+	for _, record := range unmatched {
+		i := findCloudflareRecord(current, used, record, false)
+		if i < 0 {
+			creations = append(creations, record)
+			continue
+		}
+
+		used[i] = true
+		record.ID = current[i].ID
+		updates = append(updates, record)
+	}
+
+	for i, record := range current {
+		if !used[i] {
+			deletions = append(deletions, record)
+		}
+	}
+
+	return updates, deletions, creations
+}
+
+func findCloudflareRecord(records []cloudflareRecord, used []bool, record cloudflareRecord, sameContent bool) int {
+	for i, other := range records {
+		if used[i] || other.Type != record.Type || other.Name != record.Name {
+			continue
+		}
+
+		if !sameContent || other.Content == record.Content {
+			return i
+		}
+	}
+
+	return -1
+}
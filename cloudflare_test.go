@@ -0,0 +1,391 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testCloudflareOwner = "heritage=kubernetes-service-dns-update,cluster=default,service=/service"
+
+// FakeCloudflare serves the subset of the Cloudflare API used by the
+// Cloudflare provider, returning zones and records one per page.
+type FakeCloudflare struct {
+	t *testing.T
+
+	zones    []cloudflareZone
+	records  map[string][]cloudflareRecord
+	requests []string
+	nextID   int
+}
+
+func (f *FakeCloudflare) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer token" {
+		http.Error(w, `{"success":false,"errors":[{"code":10000,"message":"Authentication error"}]}`, http.StatusForbidden)
+		return
+	}
+
+	page := 1
+	fmt.Sscan(r.URL.Query().Get("page"), &page)
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	switch {
+	case len(parts) == 1 && parts[0] == "zones":
+		var zones cloudflareZones
+		if page <= len(f.zones) {
+			zones.Result = f.zones[page-1 : page]
+		}
+		zones.ResultInfo = cloudflareResultInfo{Page: page, TotalPages: len(f.zones)}
+		json.NewEncoder(w).Encode(zones)
+
+	case len(parts) == 3 && r.Method == "GET":
+		var matching []cloudflareRecord
+		for _, record := range f.records[parts[1]] {
+			if name := r.URL.Query().Get("name"); name == "" || record.Name == name {
+				matching = append(matching, record)
+			}
+		}
+
+		var records cloudflareRecords
+		if page <= len(matching) {
+			records.Result = matching[page-1 : page]
+		}
+		records.ResultInfo = cloudflareResultInfo{Page: page, TotalPages: len(matching)}
+		json.NewEncoder(w).Encode(records)
+
+	case len(parts) >= 3 && parts[2] == "dns_records":
+		var record cloudflareRecord
+		if r.Method != "DELETE" {
+			if err := json.NewDecoder(r.Body).Decode(&record); err != nil {
+				f.t.Errorf("Could not decode record: %v", err)
+			}
+		}
+
+		zoneID := parts[1]
+		records := f.records[zoneID]
+
+		if r.Method == "POST" {
+			f.nextID++
+			record.ID = fmt.Sprintf("new%d", f.nextID)
+			f.records[zoneID] = append(records, record)
+			f.requests = append(f.requests, fmt.Sprintf("POST %s %s %s", record.Type, record.Name, record.Content))
+			json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "result": record})
+			return
+		}
+
+		for i, current := range records {
+			if len(parts) == 4 && current.ID == parts[3] {
+				if r.Method == "PUT" {
+					record.ID = current.ID
+					records[i] = record
+					f.requests = append(f.requests, fmt.Sprintf("PUT %s %s %s %s", record.ID, record.Type, record.Name, record.Content))
+				} else {
+					f.records[zoneID] = append(records[:i], records[i+1:]...)
+					f.requests = append(f.requests, fmt.Sprintf("DELETE %s", current.ID))
+				}
+				json.NewEncoder(w).Encode(map[string]interface{}{"success": true})
+				return
+			}
+		}
+
+		http.NotFound(w, r)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// cloudflareRecordsByContent sorts Cloudflare records by their content.
+type cloudflareRecordsByContent []cloudflareRecord
+
+func (r cloudflareRecordsByContent) Len() int           { return len(r) }
+func (r cloudflareRecordsByContent) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r cloudflareRecordsByContent) Less(i, j int) bool { return r[i].Content < r[j].Content }
+
+func testCloudflareProvider(fake *FakeCloudflare) (*CloudflareProvider, func()) {
+	serverURL, client, closeServer := testHTTPServer(fake)
+
+	provider := &CloudflareProvider{
+		client:    client,
+		apiURL:    serverURL,
+		token:     "token",
+		now:       time.Now,
+		zoneCache: zoneCache{ttl: time.Hour},
+	}
+
+	return provider, closeServer
+}
+
+func testCloudflareZones() []cloudflareZone {
+	return []cloudflareZone{
+		cloudflareZone{ID: "zone1", Name: "domain.com"},
+		cloudflareZone{ID: "zone2", Name: "sub.domain.com"},
+	}
+}
+
+func TestCloudflareProviderGetOwner(t *testing.T) {
+	scenarios := []struct {
+		dnsName string
+		records map[string][]cloudflareRecord
+
+		expectedOwner  string
+		expectedExists bool
+		expectedError  error
+	}{
+		// No zone for the domain
+		{
+			dnsName: "some.example.com",
+
+			expectedError: errors.New("No zone matches domain some.example.com"),
+		},
+
+		// Record not owned by anybody
+		{
+			dnsName: "some.domain.com",
+			records: map[string][]cloudflareRecord{
+				"zone1": []cloudflareRecord{
+					cloudflareRecord{ID: "1", Type: "CNAME", Name: "some.domain.com", Content: "other.domain.com", TTL: 300},
+					cloudflareRecord{ID: "2", Type: "MX", Name: "some.domain.com", Content: "mail.domain.com", TTL: 300},
+				},
+			},
+
+			expectedOwner:  "",
+			expectedExists: true,
+		},
+
+		// Apex record owned in the most specific zone, across several pages
+		{
+			dnsName: "sub.domain.com",
+			records: map[string][]cloudflareRecord{
+				"zone2": []cloudflareRecord{
+					cloudflareRecord{ID: "1", Type: "CNAME", Name: "sub.domain.com", Content: "lb.hostname.example.net", TTL: 1, Proxied: true},
+					cloudflareRecord{ID: "2", Type: "TXT", Name: "_owner.sub.domain.com", Content: "v=spf1 -all", TTL: 300},
+					cloudflareRecord{ID: "3", Type: "TXT", Name: "_owner.sub.domain.com", Content: testCloudflareOwner, TTL: 300},
+				},
+			},
+
+			expectedOwner:  testCloudflareOwner,
+			expectedExists: true,
+		},
+	}
+
+	for _, scenario := range scenarios {
+		fake := &FakeCloudflare{t: t, zones: testCloudflareZones(), records: scenario.records}
+		provider, closeServer := testCloudflareProvider(fake)
+
+		owner, exists, err := provider.GetOwner(scenario.dnsName)
+
+		if !reflect.DeepEqual(err, scenario.expectedError) {
+			t.Errorf("Expected error to be '%v', was '%v'", scenario.expectedError, err)
+		}
+
+		if owner != scenario.expectedOwner || exists != scenario.expectedExists {
+			t.Errorf("Expected owner of %s to be '%s' (%v), was '%s' (%v)", scenario.dnsName, scenario.expectedOwner, scenario.expectedExists, owner, exists)
+		}
+
+		closeServer()
+	}
+}
+
+func TestCloudflareProviderListEndpoints(t *testing.T) {
+	fake := &FakeCloudflare{t: t, zones: testCloudflareZones(), records: map[string][]cloudflareRecord{
+		"zone1": []cloudflareRecord{
+			cloudflareRecord{ID: "1", Type: "TXT", Name: "domain.com", Content: "v=spf1 -all", TTL: 300},
+			cloudflareRecord{ID: "2", Type: "A", Name: "some.domain.com", Content: "203.0.113.10", TTL: 300},
+			cloudflareRecord{ID: "3", Type: "A", Name: "some.domain.com", Content: "203.0.113.20", TTL: 300},
+			cloudflareRecord{ID: "4", Type: "TXT", Name: "_owner.some.domain.com", Content: testCloudflareOwner, TTL: 300},
+			cloudflareRecord{ID: "5", Type: "CNAME", Name: "other.domain.com", Content: "other.hostname.example.net", TTL: 300},
+		},
+		"zone2": []cloudflareRecord{
+			cloudflareRecord{ID: "1", Type: "CNAME", Name: "sub.domain.com", Content: "lb.hostname.example.net", TTL: 1, Proxied: true},
+			cloudflareRecord{ID: "2", Type: "TXT", Name: "_owner.sub.domain.com", Content: testCloudflareOwner, TTL: 300},
+		},
+	}}
+	provider, closeServer := testCloudflareProvider(fake)
+	defer closeServer()
+
+	endpoints, err := provider.ListEndpoints([]string{"some.domain.com", "sub.domain.com"})
+	if err != nil {
+		t.Errorf("Expected no error, was '%v'", err)
+	}
+
+	expected := []Endpoint{
+		Endpoint{DNSName: "some.domain.com", RecordType: "A", Targets: []string{"203.0.113.10", "203.0.113.20"}, TTL: 300, Owner: testCloudflareOwner},
+		Endpoint{DNSName: "sub.domain.com", RecordType: "CNAME", Targets: []string{"lb.hostname.example.net"}, TTL: 1, Owner: testCloudflareOwner},
+	}
+
+	if !reflect.DeepEqual(endpoints, expected) {
+		t.Errorf("Expected endpoints to be '%v', was '%v'", expected, endpoints)
+	}
+}
+
+func TestCloudflareProviderApplyChanges(t *testing.T) {
+	endpoint := Endpoint{
+		DNSName:    "some.domain.com",
+		RecordType: "A",
+		Targets:    []string{"203.0.113.10"},
+		Owner:      testCloudflareOwner,
+	}
+
+	proxiedEndpoint := endpoint
+	proxiedEndpoint.Proxied = true
+
+	apexEndpoint := Endpoint{
+		DNSName:    "domain.com",
+		RecordType: "CNAME",
+		Targets:    []string{"lb.hostname.example.net"},
+		Owner:      testCloudflareOwner,
+	}
+
+	txt := cloudflareRecord{ID: "txt", Type: "TXT", Name: "_owner.some.domain.com", Content: testCloudflareOwner, TTL: 300}
+
+	scenarios := []struct {
+		description string
+		dryRun      bool
+		changes     []DNSChange
+		records     []cloudflareRecord
+
+		expectedRequests []string
+		expectedErrors   []error
+	}{
+		{
+			description: "records are created",
+			changes:     []DNSChange{DNSChange{Action: "UPSERT", Endpoint: endpoint}},
+
+			expectedRequests: []string{
+				"POST A some.domain.com 203.0.113.10",
+				"POST TXT _owner.some.domain.com " + testCloudflareOwner,
+			},
+			expectedErrors: []error{nil},
+		},
+		{
+			description: "apex CNAME records are created",
+			changes:     []DNSChange{DNSChange{Action: "UPSERT", Endpoint: apexEndpoint}},
+
+			expectedRequests: []string{
+				"POST CNAME domain.com lb.hostname.example.net",
+				"POST TXT _owner.domain.com " + testCloudflareOwner,
+			},
+			expectedErrors: []error{nil},
+		},
+		{
+			description: "records are proxied in place",
+			changes:     []DNSChange{DNSChange{Action: "UPSERT", Endpoint: proxiedEndpoint}},
+			records: []cloudflareRecord{
+				cloudflareRecord{ID: "a", Type: "A", Name: "some.domain.com", Content: "203.0.113.10", TTL: 300},
+				txt,
+			},
+
+			expectedRequests: []string{"PUT a A some.domain.com 203.0.113.10"},
+			expectedErrors:   []error{nil},
+		},
+		{
+			description: "addresses are updated in place",
+			changes:     []DNSChange{DNSChange{Action: "UPSERT", Endpoint: endpoint}},
+			records: []cloudflareRecord{
+				cloudflareRecord{ID: "a", Type: "A", Name: "some.domain.com", Content: "203.0.113.20", TTL: 300},
+				txt,
+			},
+
+			expectedRequests: []string{"PUT a A some.domain.com 203.0.113.10"},
+			expectedErrors:   []error{nil},
+		},
+		{
+			description: "CNAME records are replaced by A records",
+			changes:     []DNSChange{DNSChange{Action: "UPSERT", Endpoint: endpoint}},
+			records: []cloudflareRecord{
+				cloudflareRecord{ID: "cname", Type: "CNAME", Name: "some.domain.com", Content: "lb.hostname.example.net", TTL: 300},
+				txt,
+			},
+
+			expectedRequests: []string{"DELETE cname", "POST A some.domain.com 203.0.113.10"},
+			expectedErrors:   []error{nil},
+		},
+		{
+			description: "records are deleted",
+			changes:     []DNSChange{DNSChange{Action: "DELETE", Endpoint: endpoint}},
+			records: []cloudflareRecord{
+				cloudflareRecord{ID: "a", Type: "A", Name: "some.domain.com", Content: "203.0.113.10", TTL: 300},
+				txt,
+			},
+
+			expectedRequests: []string{"DELETE a", "DELETE txt"},
+			expectedErrors:   []error{nil},
+		},
+		{
+			description: "changes are only logged in dry-run mode",
+			dryRun:      true,
+			changes:     []DNSChange{DNSChange{Action: "UPSERT", Endpoint: endpoint}},
+
+			expectedErrors: []error{nil},
+		},
+		{
+			description: "CNAME records with several hostnames are refused",
+			changes:     []DNSChange{DNSChange{Action: "UPSERT", Endpoint: testSeveralHostnamesEndpoint(testCloudflareOwner)}},
+			records: []cloudflareRecord{
+				cloudflareRecord{ID: "a", Type: "A", Name: "some.domain.com", Content: "203.0.113.10", TTL: 300},
+				txt,
+			},
+
+			expectedErrors: []error{testSeveralHostnamesError},
+		},
+	}
+
+	defer func(dryRunValue bool) { dryRun = dryRunValue }(dryRun)
+
+	for _, scenario := range scenarios {
+		dryRun = scenario.dryRun
+
+		fake := &FakeCloudflare{
+			t:       t,
+			zones:   testCloudflareZones(),
+			records: map[string][]cloudflareRecord{"zone1": scenario.records},
+		}
+		provider, closeServer := testCloudflareProvider(fake)
+
+		errs := provider.ApplyChanges(scenario.changes)
+
+		if !reflect.DeepEqual(errs, scenario.expectedErrors) {
+			t.Errorf("Expected errors to be '%v' when %s, was '%v'", scenario.expectedErrors, scenario.description, errs)
+		}
+
+		if !reflect.DeepEqual(fake.requests, scenario.expectedRequests) {
+			t.Errorf("Expected requests to be '%v' when %s, was '%v'", scenario.expectedRequests, scenario.description, fake.requests)
+		}
+
+		closeServer()
+	}
+}
+
+func TestCloudflareRecordsFromEndpoint(t *testing.T) {
+	endpoint := Endpoint{
+		DNSName:    "Some.Domain.com.",
+		RecordType: "A",
+		Targets:    []string{"203.0.113.20", "203.0.113.10"},
+		Owner:      testCloudflareOwner,
+		Proxied:    true,
+	}
+
+	records, err := cloudflareRecordsFromEndpoint(endpoint)
+	if err != nil {
+		t.Errorf("Expected no error, was '%v'", err)
+	}
+	sort.Sort(cloudflareRecordsByContent(records))
+
+	expected := []cloudflareRecord{
+		cloudflareRecord{Type: "A", Name: "some.domain.com", Content: "203.0.113.10", TTL: cloudflareAutomaticTTL, Proxied: true},
+		cloudflareRecord{Type: "A", Name: "some.domain.com", Content: "203.0.113.20", TTL: cloudflareAutomaticTTL, Proxied: true},
+		cloudflareRecord{Type: "TXT", Name: "_owner.some.domain.com", Content: testCloudflareOwner, TTL: 300},
+	}
+
+	if !reflect.DeepEqual(records, expected) {
+		t.Errorf("Expected records to be '%v', was '%v'", expected, records)
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Record of a name as read by the etcd plugin of CoreDNS (SkyDNS format). The
+// host is either an IP address, served as an A or AAAA record, or a hostname,
+// served as a CNAME record. The text is served as a TXT record of the name.
+type skyDNSService struct {
+	Host string `json:"host"`
+	TTL  int64  `json:"ttl,omitempty"`
+	Text string `json:"text,omitempty"`
+}
+
+type etcdKeyValue struct {
+	Key         []byte `json:"key"`
+	Value       []byte `json:"value,omitempty"`
+	ModRevision int64  `json:"mod_revision,string,omitempty"`
+}
+
+type etcdRangeRequest struct {
+	Key      []byte `json:"key"`
+	RangeEnd []byte `json:"range_end,omitempty"`
+}
+
+type etcdRangeResponse struct {
+	Kvs []etcdKeyValue `json:"kvs"`
+}
+
+type etcdCompare struct {
+	Key            []byte `json:"key"`
+	Target         string `json:"target"`
+	Result         string `json:"result"`
+	ModRevision    int64  `json:"mod_revision,string,omitempty"`
+	CreateRevision int64  `json:"create_revision,string,omitempty"`
+}
+
+type etcdRequestOp struct {
+	RequestPut         *etcdKeyValue     `json:"request_put,omitempty"`
+	RequestDeleteRange *etcdRangeRequest `json:"request_delete_range,omitempty"`
+}
+
+type etcdTxnRequest struct {
+	Compare []etcdCompare   `json:"compare"`
+	Success []etcdRequestOp `json:"success"`
+}
+
+type etcdTxnResponse struct {
+	Succeeded bool `json:"succeeded"`
+}
+
+// CoreDNSProvider keeps endpoints as SkyDNS keys in the etcd cluster read by
+// the etcd plugin of CoreDNS, through the JSON gateway of the etcd v3 API.
+//
+// The records of a name are kept as the children of its key, one per target,
+// i.e. /skydns/com/mydomain/www/1a2b3c4d for www.mydomain.com. The ownership
+// marker is kept in the text of each record, as there is no way to store a TXT
+// record next to a CNAME one.
+type CoreDNSProvider struct {
+	client *http.Client
+	url    string
+	prefix string
+}
+
+func NewCoreDNSProvider() (*CoreDNSProvider, error) {
+	return &CoreDNSProvider{
+		client: &http.Client{Timeout: httpTimeout},
+		url:    strings.TrimSuffix(coreDNSEtcdURL, "/"),
+		prefix: strings.TrimSuffix(coreDNSPrefix, "/"),
+	}, nil
+}
+
+func (p *CoreDNSProvider) GetOwner(dnsName string) (string, bool, error) {
+	records, err := p.records(dnsName)
+	if err != nil {
+		return "", false, err
+	}
+
+	exists := false
+	var txt []string
+
+	for _, record := range records {
+		var service skyDNSService
+		if err := json.Unmarshal(record.Value, &service); err != nil {
+			log.Printf("Ignoring invalid SkyDNS record %s: %v\n", record.Key, err)
+			continue
+		}
+
+		if service.Host != "" {
+			exists = true
+		}
+		txt = append(txt, service.Text)
+	}
+
+	return ownerFromTXT(txt), exists, nil
+}
+
+// ApplyChanges replaces the keys of the name of each endpoint with the desired
+// ones in a single transaction, which fails if any of the keys was changed
+// since they were read.
+func (p *CoreDNSProvider) ApplyChanges(changes []DNSChange) []error {
+	errs := make([]error, len(changes))
+
+	for i, change := range changes {
+		errs[i] = p.applyChange(change)
+	}
+
+	return errs
+}
+
+func (p *CoreDNSProvider) applyChange(change DNSChange) error {
+	dnsName := change.Endpoint.DNSName
+
+	current, err := p.records(dnsName)
+	if err != nil {
+		return err
+	}
+
+	var desired []etcdKeyValue
+	if change.Action != "DELETE" {
+		desired, err = p.recordsFromEndpoint(change.Endpoint)
+		if err != nil {
+			return err
+		}
+	}
+
+	txn := etcdTxnRequest{}
+	currentValues := map[string]string{}
+
+	for _, record := range current {
+		currentValues[string(record.Key)] = string(record.Value)
+		txn.Compare = append(txn.Compare, etcdCompare{Key: record.Key, Target: "MOD", Result: "EQUAL", ModRevision: record.ModRevision})
+	}
+
+	desiredKeys := map[string]bool{}
+	for _, record := range desired {
+		desiredKeys[string(record.Key)] = true
+
+		value, ok := currentValues[string(record.Key)]
+		if !ok {
+			// Keys that did not exist must still not exist
+			txn.Compare = append(txn.Compare, etcdCompare{Key: record.Key, Target: "CREATE", Result: "EQUAL", CreateRevision: 0})
+		}
+
+		if !ok || value != string(record.Value) {
+			put := record
+			txn.Success = append(txn.Success, etcdRequestOp{RequestPut: &put})
+		}
+	}
+
+	for _, record := range current {
+		if !desiredKeys[string(record.Key)] {
+			txn.Success = append(txn.Success, etcdRequestOp{RequestDeleteRange: &etcdRangeRequest{Key: record.Key}})
+		}
+	}
+
+	if len(txn.Success) == 0 {
+		return nil
+	}
+
+	if dryRun {
+		for _, op := range txn.Success {
+			if op.RequestPut != nil {
+				log.Printf("DRY RUN: We normally would have set %s to %s\n", op.RequestPut.Key, op.RequestPut.Value)
+			} else {
+				log.Printf("DRY RUN: We normally would have deleted %s\n", op.RequestDeleteRange.Key)
+			}
+		}
+		return nil
+	}
+
+	var resp etcdTxnResponse
+	if err := doJSON(p.client, "POST", p.url+"/v3/kv/txn", nil, txn, &resp); err != nil {
+		return fmt.Errorf("Could not update records of %s: %v", dnsName, err)
+	}
+
+	if !resp.Succeeded {
+		return fmt.Errorf("Records of %s were changed while being updated", dnsName)
+	}
+
+	return nil
+}
+
+// ListEndpoints reads every key under the prefix, which takes a single request
+// whatever the names. Only the keys written by the daemon carry an ownership
+// marker, and they always are the children of the key of their name.
+func (p *CoreDNSProvider) ListEndpoints(dnsNames []string) ([]Endpoint, error) {
+	req := etcdRangeRequest{Key: []byte(p.prefix + "/"), RangeEnd: []byte(p.prefix + "0")}
+
+	var resp etcdRangeResponse
+	if err := doJSON(p.client, "POST", p.url+"/v3/kv/range", nil, req, &resp); err != nil {
+		return nil, fmt.Errorf("Could not list records under %s: %v", p.prefix, err)
+	}
+
+	var records []DNSRecord
+	for _, record := range resp.Kvs {
+		var service skyDNSService
+		if err := json.Unmarshal(record.Value, &service); err != nil || service.Host == "" {
+			continue
+		}
+
+		key := string(record.Key)
+		name := p.dnsName(key[:strings.LastIndex(key, "/")])
+
+		recordType := ipRecordType(service.Host)
+		if net.ParseIP(service.Host) == nil {
+			recordType = "CNAME"
+		}
+
+		records = append(records,
+			DNSRecord{Name: name, Type: recordType, TTL: service.TTL, Values: []string{service.Host}},
+			DNSRecord{Name: ownerRecordName(name), Type: "TXT", Values: []string{service.Text}},
+		)
+	}
+
+	return ownedEndpoints(records), nil
+}
+
+// records returns the keys of the given name along with their revision: its
+// own key and its direct children. Keys further down belong to subdomains.
+func (p *CoreDNSProvider) records(dnsName string) ([]etcdKeyValue, error) {
+	key := p.key(dnsName)
+
+	// Covers the key itself and all the keys starting with key + "/"
+	req := etcdRangeRequest{Key: []byte(key), RangeEnd: []byte(key + "0")}
+
+	var resp etcdRangeResponse
+	if err := doJSON(p.client, "POST", p.url+"/v3/kv/range", nil, req, &resp); err != nil {
+		return nil, fmt.Errorf("Could not list records of %s: %v", dnsName, err)
+	}
+
+	var records []etcdKeyValue
+	for _, record := range resp.Kvs {
+		name := string(record.Key)
+		if name == key || (strings.HasPrefix(name, key+"/") && !strings.Contains(name[len(key)+1:], "/")) {
+			records = append(records, record)
+		}
+	}
+
+	return records, nil
+}
+
+// recordsFromEndpoint returns one key per target of the given endpoint, named
+// after the hash of the target so they are stable across updates.
+func (p *CoreDNSProvider) recordsFromEndpoint(endpoint Endpoint) ([]etcdKeyValue, error) {
+	key := p.key(endpoint.DNSName)
+
+	dnsRecords, err := endpointRecords(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []etcdKeyValue
+	for _, record := range dnsRecords {
+		if record.Type == "TXT" {
+			continue
+		}
+
+		for _, value := range record.Values {
+			host := strings.TrimSuffix(value, ".")
+
+			data, err := json.Marshal(skyDNSService{Host: host, TTL: record.TTL, Text: endpoint.Owner})
+			if err != nil {
+				return nil, err
+			}
+
+			hash := fnv.New32a()
+			hash.Write([]byte(host))
+
+			records = append(records, etcdKeyValue{
+				Key:   []byte(fmt.Sprintf("%s/%08x", key, hash.Sum32())),
+				Value: data,
+			})
+		}
+	}
+
+	return records, nil
+}
+
+// key returns the SkyDNS key of the given name: its labels in reverse order
+// under the prefix, i.e. /skydns/com/mydomain/www for www.mydomain.com.
+func (p *CoreDNSProvider) key(dnsName string) string {
+	labels := strings.Split(strings.Trim(strings.ToLower(dnsName), "."), ".")
+
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+
+	return p.prefix + "/" + strings.Join(labels, "/")
+}
+
+// dnsName returns the name of the given SkyDNS key, as opposed to key.
+func (p *CoreDNSProvider) dnsName(key string) string {
+	labels := strings.Split(strings.Trim(strings.TrimPrefix(key, p.prefix), "/"), "/")
+
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+
+	return strings.Join(labels, ".")
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+const testCoreDNSOwner = "heritage=kubernetes-service-dns-update,cluster=default,service=/service"
+
+// FakeEtcd is an in-memory stand-in for the JSON gateway of the etcd v3 API,
+// serving ranges and transactions over a flat key space with revisions.
+type FakeEtcd struct {
+	t *testing.T
+
+	values    map[string]string
+	revisions map[string]int64
+	revision  int64
+	txns      int
+
+	beforeTxn func()
+}
+
+func NewFakeEtcd(t *testing.T, values map[string]string) *FakeEtcd {
+	f := &FakeEtcd{t: t, values: map[string]string{}, revisions: map[string]int64{}}
+	for key, value := range values {
+		f.put(key, value)
+	}
+	return f
+}
+
+func (f *FakeEtcd) put(key, value string) {
+	f.revision++
+	f.values[key] = value
+	f.revisions[key] = f.revision
+}
+
+func (f *FakeEtcd) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/v3/kv/range":
+		var req etcdRangeRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			f.t.Errorf("Could not decode range: %v", err)
+		}
+
+		resp := etcdRangeResponse{}
+		for _, key := range f.keys() {
+			if key >= string(req.Key) && key < string(req.RangeEnd) {
+				resp.Kvs = append(resp.Kvs, etcdKeyValue{Key: []byte(key), Value: []byte(f.values[key]), ModRevision: f.revisions[key]})
+			}
+		}
+		json.NewEncoder(w).Encode(resp)
+
+	case "/v3/kv/txn":
+		var req etcdTxnRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			f.t.Errorf("Could not decode transaction: %v", err)
+		}
+
+		f.txns++
+		if f.beforeTxn != nil {
+			f.beforeTxn()
+		}
+
+		for _, compare := range req.Compare {
+			revision := f.revisions[string(compare.Key)]
+			if (compare.Target == "MOD" && revision != compare.ModRevision) || (compare.Target == "CREATE" && revision != compare.CreateRevision) {
+				json.NewEncoder(w).Encode(etcdTxnResponse{Succeeded: false})
+				return
+			}
+		}
+
+		for _, op := range req.Success {
+			if op.RequestPut != nil {
+				f.put(string(op.RequestPut.Key), string(op.RequestPut.Value))
+			} else {
+				delete(f.values, string(op.RequestDeleteRange.Key))
+				delete(f.revisions, string(op.RequestDeleteRange.Key))
+			}
+		}
+
+		json.NewEncoder(w).Encode(etcdTxnResponse{Succeeded: true})
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *FakeEtcd) keys() []string {
+	var keys []string
+	for key := range f.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func testCoreDNSProvider(fake *FakeEtcd) (*CoreDNSProvider, func()) {
+	serverURL, client, closeServer := testHTTPServer(fake)
+
+	provider := &CoreDNSProvider{
+		client: client,
+		url:    serverURL,
+		prefix: "/skydns",
+	}
+
+	return provider, closeServer
+}
+
+func TestCoreDNSProviderGetOwner(t *testing.T) {
+	owned := `{"host":"203.0.113.10","ttl":300,"text":"` + testCoreDNSOwner + `"}`
+
+	scenarios := []struct {
+		dnsName string
+		values  map[string]string
+
+		expectedOwner  string
+		expectedExists bool
+	}{
+		// No records for the name, only for a subdomain and a sibling
+		{
+			dnsName: "some.domain.com",
+			values: map[string]string{
+				"/skydns/com/domain/some/www/1": owned,
+				"/skydns/com/domain/some-other": owned,
+			},
+		},
+
+		// Record not owned by anybody, at the key of the name itself
+		{
+			dnsName: "some.domain.com",
+			values:  map[string]string{"/skydns/com/domain/some": `{"host":"other.domain.com"}`},
+
+			expectedExists: true,
+		},
+
+		// Owned records
+		{
+			dnsName: "Some.Domain.com.",
+			values: map[string]string{
+				"/skydns/com/domain/some/1": owned,
+				"/skydns/com/domain/some/2": `not json`,
+			},
+
+			expectedOwner:  testCoreDNSOwner,
+			expectedExists: true,
+		},
+	}
+
+	for _, scenario := range scenarios {
+		provider, closeServer := testCoreDNSProvider(NewFakeEtcd(t, scenario.values))
+
+		owner, exists, err := provider.GetOwner(scenario.dnsName)
+
+		if err != nil {
+			t.Errorf("Expected no error, was '%v'", err)
+		}
+
+		if owner != scenario.expectedOwner || exists != scenario.expectedExists {
+			t.Errorf("Expected owner of %s to be '%s' (%v), was '%s' (%v)", scenario.dnsName, scenario.expectedOwner, scenario.expectedExists, owner, exists)
+		}
+
+		closeServer()
+	}
+}
+
+func TestCoreDNSProviderApplyChanges(t *testing.T) {
+	endpoint := Endpoint{
+		DNSName:    "some.domain.com",
+		RecordType: "A",
+		Targets:    []string{"203.0.113.10", "203.0.113.20"},
+		Owner:      testCoreDNSOwner,
+	}
+
+	first := `{"host":"203.0.113.10","ttl":300,"text":"` + testCoreDNSOwner + `"}`
+	second := `{"host":"203.0.113.20","ttl":300,"text":"` + testCoreDNSOwner + `"}`
+
+	scenarios := []struct {
+		description string
+		dryRun      bool
+		changes     []DNSChange
+		values      map[string]string
+
+		expectedValues map[string]string
+		expectedTxns   int
+		expectedErrors []error
+	}{
+		{
+			description: "records are created",
+			changes:     []DNSChange{DNSChange{Action: "UPSERT", Endpoint: endpoint}},
+			values:      map[string]string{"/skydns/com/domain/www/1": first},
+
+			expectedValues: map[string]string{
+				"/skydns/com/domain/www/1":         first,
+				"/skydns/com/domain/some/379da846": first,
+				"/skydns/com/domain/some/d19ac91d": second,
+			},
+			expectedTxns:   1,
+			expectedErrors: []error{nil},
+		},
+		{
+			description: "CNAME records are replaced, leaving subdomains alone",
+			changes:     []DNSChange{DNSChange{Action: "UPSERT", Endpoint: endpoint}},
+			values: map[string]string{
+				"/skydns/com/domain/some/1":     `{"host":"lb.hostname.example.net","text":"` + testCoreDNSOwner + `"}`,
+				"/skydns/com/domain/some/www/1": first,
+			},
+
+			expectedValues: map[string]string{
+				"/skydns/com/domain/some/379da846": first,
+				"/skydns/com/domain/some/d19ac91d": second,
+				"/skydns/com/domain/some/www/1":    first,
+			},
+			expectedTxns:   1,
+			expectedErrors: []error{nil},
+		},
+		{
+			description: "records already up to date are left alone",
+			changes:     []DNSChange{DNSChange{Action: "UPSERT", Endpoint: endpoint}},
+			values: map[string]string{
+				"/skydns/com/domain/some/379da846": first,
+				"/skydns/com/domain/some/d19ac91d": second,
+			},
+
+			expectedValues: map[string]string{
+				"/skydns/com/domain/some/379da846": first,
+				"/skydns/com/domain/some/d19ac91d": second,
+			},
+			expectedErrors: []error{nil},
+		},
+		{
+			description: "records are deleted",
+			changes:     []DNSChange{DNSChange{Action: "DELETE", Endpoint: endpoint}},
+			values: map[string]string{
+				"/skydns/com/domain/some/379da846": first,
+				"/skydns/com/domain/some/d19ac91d": second,
+			},
+
+			expectedValues: map[string]string{},
+			expectedTxns:   1,
+			expectedErrors: []error{nil},
+		},
+		{
+			description: "changes are only logged in dry-run mode",
+			dryRun:      true,
+			changes:     []DNSChange{DNSChange{Action: "UPSERT", Endpoint: endpoint}},
+
+			expectedValues: map[string]string{},
+			expectedErrors: []error{nil},
+		},
+		{
+			description: "CNAME records with several hostnames are refused",
+			changes:     []DNSChange{DNSChange{Action: "UPSERT", Endpoint: testSeveralHostnamesEndpoint(testCoreDNSOwner)}},
+			values:      map[string]string{"/skydns/com/domain/some/379da846": first},
+
+			expectedValues: map[string]string{"/skydns/com/domain/some/379da846": first},
+			expectedErrors: []error{testSeveralHostnamesError},
+		},
+	}
+
+	defer func(dryRunValue bool) { dryRun = dryRunValue }(dryRun)
+
+	for _, scenario := range scenarios {
+		dryRun = scenario.dryRun
+
+		fake := NewFakeEtcd(t, scenario.values)
+		provider, closeServer := testCoreDNSProvider(fake)
+
+		errs := provider.ApplyChanges(scenario.changes)
+
+		if !reflect.DeepEqual(errs, scenario.expectedErrors) {
+			t.Errorf("Expected errors to be '%v' when %s, was '%v'", scenario.expectedErrors, scenario.description, errs)
+		}
+
+		if !reflect.DeepEqual(fake.values, scenario.expectedValues) {
+			t.Errorf("Expected keys to be '%v' when %s, was '%v'", scenario.expectedValues, scenario.description, fake.values)
+		}
+
+		if fake.txns != scenario.expectedTxns {
+			t.Errorf("Expected %d transactions when %s, got %d", scenario.expectedTxns, scenario.description, fake.txns)
+		}
+
+		closeServer()
+	}
+}
+
+func TestCoreDNSProviderConcurrentChange(t *testing.T) {
+	fake := NewFakeEtcd(t, map[string]string{"/skydns/com/domain/some/1": `{"host":"203.0.113.30"}`})
+	provider, closeServer := testCoreDNSProvider(fake)
+	defer closeServer()
+
+	// Someone else changes the record between the read and the update
+	fake.beforeTxn = func() { fake.put("/skydns/com/domain/some/1", `{"host":"203.0.113.40"}`) }
+
+	errs := provider.ApplyChanges([]DNSChange{DNSChange{Action: "DELETE", Endpoint: Endpoint{DNSName: "some.domain.com"}}})
+
+	expectedErrors := []error{errors.New("Records of some.domain.com were changed while being updated")}
+	if !reflect.DeepEqual(errs, expectedErrors) {
+		t.Errorf("Expected errors to be '%v', was '%v'", expectedErrors, errs)
+	}
+
+	if value := fake.values["/skydns/com/domain/some/1"]; value != `{"host":"203.0.113.40"}` {
+		t.Errorf("Expected the record changed by someone else to be kept, was '%s'", value)
+	}
+}
+
+func TestCoreDNSProviderListEndpoints(t *testing.T) {
+	provider, closeServer := testCoreDNSProvider(NewFakeEtcd(t, map[string]string{
+		"/skydns/com/domain/some/1":      `{"host":"203.0.113.10","ttl":300,"text":"` + testCoreDNSOwner + `"}`,
+		"/skydns/com/domain/some/2":      `{"host":"2001:db8::10","ttl":300,"text":"` + testCoreDNSOwner + `"}`,
+		"/skydns/com/domain/some/www/1":  `{"host":"elb.hostname.amazonaws.com","ttl":60,"text":"` + testCoreDNSOwner + `"}`,
+		"/skydns/com/domain/other":       `{"host":"other.domain.com"}`,
+		"/skydns/com/domain/invalid/1":   `not json`,
+		"/skydnsother/com/domain/some/1": `{"host":"203.0.113.20","ttl":300,"text":"` + testCoreDNSOwner + `"}`,
+	}))
+	defer closeServer()
+
+	endpoints, err := provider.ListEndpoints(nil)
+	if err != nil {
+		t.Errorf("Expected no error, was '%v'", err)
+	}
+
+	expected := []Endpoint{
+		Endpoint{DNSName: "some.domain.com", RecordType: "A", Targets: []string{"203.0.113.10", "2001:db8::10"}, TTL: 300, Owner: testCoreDNSOwner},
+		Endpoint{DNSName: "www.some.domain.com", RecordType: "CNAME", Targets: []string{"elb.hostname.amazonaws.com"}, TTL: 60, Owner: testCoreDNSOwner},
+	}
+
+	if !reflect.DeepEqual(endpoints, expected) {
+		t.Errorf("Expected endpoints to be '%v', was '%v'", expected, endpoints)
+	}
+}
+
+func TestCoreDNSProviderKey(t *testing.T) {
+	provider := &CoreDNSProvider{prefix: "/skydns"}
+
+	if key := provider.key("WWW.MyDomain.com."); key != "/skydns/com/mydomain/www" {
+		t.Errorf("Expected key to be '/skydns/com/mydomain/www', was '%s'", key)
+	}
+
+	if dnsName := provider.dnsName("/skydns/com/mydomain/www"); dnsName != "www.mydomain.com" {
+		t.Errorf("Expected name to be 'www.mydomain.com', was '%s'", dnsName)
+	}
+}
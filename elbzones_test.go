@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCanonicalLoadBalancerHostedZoneID(t *testing.T) {
+	scenarios := map[string]string{
+		"testpublic-1111111111.us-east-1.elb.amazonaws.com":                "Z35SXDOTRQ7X7K",
+		"internal-my-internal-elb-2222222222.eu-west-1.elb.amazonaws.com":  "Z32O12XQLNTSW2",
+		"My-ALB-4444444444.US-WEST-2.elb.amazonaws.com.":                   "Z1H1FL5HABSF5",
+		"my-nlb-0123456789abcdef.elb.us-east-1.amazonaws.com":              "Z26RNL4JYFTOTI",
+		"my-nlb-0123456789abcdef.elb.ap-southeast-2.amazonaws.com":         "ZCT6FZBF4DROD",
+		"testpublic-1111111111.cn-north-1.elb.amazonaws.com.cn":            "Z1GDH35T77C1KE",
+		"my-nlb-0123456789abcdef.elb.cn-northwest-1.amazonaws.com.cn":      "ZQEIKTCZ8352D",
+		"internal-testinternal-2222222222.us-gov-west-1.elb.amazonaws.com": "Z33AYJ8TM3BH4J",
+		"internal-testinternal-2222222222.sa-east-1.elb.amazonaws.com":     "Z2P70J7HTTTPLU",
+		"internal-my-nlb-0123456789abcdef.elb.eu-central-1.amazonaws.com":  "Z3F0SRJ5LGBH90",
+	}
+
+	for hostname, expectedHostedZoneID := range scenarios {
+		hostedZoneID, ok := canonicalLoadBalancerHostedZoneID(hostname)
+		if !ok || hostedZoneID != expectedHostedZoneID {
+			t.Errorf("Expected hosted zone for %s to be %s, was %s (%v)", hostname, expectedHostedZoneID, hostedZoneID, ok)
+		}
+	}
+
+	unknown := []string{
+		"testpublic-1111111111.xx-unknown-1.elb.amazonaws.com",
+		"my-nlb-0123456789abcdef.elb.xx-unknown-1.amazonaws.com",
+		"testpublic-1111111111.us-east-1.elb.example.com",
+		"lb.example.com",
+		"elb.amazonaws.com",
+	}
+
+	for _, hostname := range unknown {
+		if hostedZoneID, ok := canonicalLoadBalancerHostedZoneID(hostname); ok {
+			t.Errorf("Expected no hosted zone for %s, was %s", hostname, hostedZoneID)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// Maximum number of CNAME records followed within the records served
+const maxCNAMEChain = 8
+
+// EmbeddedProvider serves the records of the endpoints itself, as an
+// authoritative DNS server listening on both UDP and TCP. It is meant for local
+// clusters without any DNS service to keep the records in (i.e. kind or
+// minikube). Records only live in memory, and are served again after a restart
+// once the services are synced.
+type EmbeddedProvider struct {
+	udpServer *dns.Server
+	tcpServer *dns.Server
+
+	mutex   sync.RWMutex
+	records []dns.RR
+}
+
+func NewEmbeddedProvider() (*EmbeddedProvider, error) {
+	return newEmbeddedProvider(embeddedDNSAddr)
+}
+
+func newEmbeddedProvider(addr string) (*EmbeddedProvider, error) {
+	p := &EmbeddedProvider{}
+
+	// Listening here rather than in the servers, so errors are returned now
+	packetConn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("Could not listen on UDP %s: %v", addr, err)
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		packetConn.Close()
+		return nil, fmt.Errorf("Could not listen on TCP %s: %v", addr, err)
+	}
+
+	p.udpServer = &dns.Server{PacketConn: packetConn, Handler: p}
+	p.tcpServer = &dns.Server{Listener: listener, Handler: p}
+
+	for _, server := range []*dns.Server{p.udpServer, p.tcpServer} {
+		started := make(chan struct{})
+		server.NotifyStartedFunc = func() { close(started) }
+
+		go func(server *dns.Server) {
+			if err := server.ActivateAndServe(); err != nil {
+				log.Printf("Embedded DNS server stopped: %v\n", err)
+			}
+		}(server)
+
+		<-started
+	}
+
+	log.Printf("Serving DNS records on %s (UDP and TCP)\n", addr)
+	return p, nil
+}
+
+// Close stops serving records.
+func (p *EmbeddedProvider) Close() {
+	p.udpServer.Shutdown()
+	p.tcpServer.Shutdown()
+}
+
+func (p *EmbeddedProvider) GetOwner(dnsName string) (string, bool, error) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	exists := false
+	var txt []string
+
+	for _, rr := range endpointRRs(p.records, dnsName) {
+		if record, ok := rr.(*dns.TXT); ok {
+			txt = append(txt, strings.Join(record.Txt, ""))
+		} else {
+			exists = true
+		}
+	}
+
+	return ownerFromTXT(txt), exists, nil
+}
+
+// ApplyChanges replaces the records served for the name of each endpoint with
+// the desired ones.
+func (p *EmbeddedProvider) ApplyChanges(changes []DNSChange) []error {
+	errs := make([]error, len(changes))
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for i, change := range changes {
+		var desired []dns.RR
+		if change.Action != "DELETE" {
+			var err error
+			desired, err = rfc2136RecordsFromEndpoint(change.Endpoint)
+			if err != nil {
+				errs[i] = err
+				continue
+			}
+		}
+
+		if dryRun {
+			log.Printf("DRY RUN: We normally would have served %v for %s\n", desired, change.Endpoint.DNSName)
+			continue
+		}
+
+		stale := endpointRRs(p.records, change.Endpoint.DNSName)
+		p.records = append(withoutRRs(p.records, stale), desired...)
+	}
+
+	return errs
+}
+
+// ListEndpoints returns the endpoints served so far, which is none at startup
+// as records only live in memory.
+func (p *EmbeddedProvider) ListEndpoints(dnsNames []string) ([]Endpoint, error) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	return ownedEndpoints(recordsFromRRs(p.records)), nil
+}
+
+// ServeDNS answers queries for the names of the endpoints, following CNAME
+// records among them. Names it has no records for do not exist.
+func (p *EmbeddedProvider) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = true
+
+	if r.Opcode != dns.OpcodeQuery || len(r.Question) != 1 {
+		m.Rcode = dns.RcodeNotImplemented
+		w.WriteMsg(m)
+		return
+	}
+
+	question := r.Question[0]
+
+	p.mutex.RLock()
+	m.Answer, m.Rcode = p.answer(strings.ToLower(question.Name), question.Qtype)
+	p.mutex.RUnlock()
+
+	w.WriteMsg(m)
+}
+
+func (p *EmbeddedProvider) answer(name string, qtype uint16) ([]dns.RR, int) {
+	var answer []dns.RR
+
+	for i := 0; i < maxCNAMEChain; i++ {
+		var records []dns.RR
+		for _, rr := range p.records {
+			if strings.EqualFold(rr.Header().Name, name) {
+				records = append(records, rr)
+			}
+		}
+
+		if len(records) == 0 {
+			if len(answer) > 0 {
+				// The target of a CNAME record is served by someone else
+				return answer, dns.RcodeSuccess
+			}
+			return nil, dns.RcodeNameError
+		}
+
+		var cname *dns.CNAME
+		for _, rr := range records {
+			if rr.Header().Rrtype == qtype || qtype == dns.TypeANY {
+				answer = append(answer, rr)
+			} else if record, ok := rr.(*dns.CNAME); ok {
+				cname = record
+			}
+		}
+
+		if cname == nil || qtype == dns.TypeANY {
+			return answer, dns.RcodeSuccess
+		}
+
+		answer = append(answer, cname)
+		name = strings.ToLower(cname.Target)
+	}
+
+	return answer, dns.RcodeSuccess
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+const testEmbeddedOwner = "heritage=kubernetes-service-dns-update,cluster=default,service=/service"
+
+func testEmbeddedProvider(t *testing.T, endpoints ...Endpoint) *EmbeddedProvider {
+	provider, err := newEmbeddedProvider("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not start embedded DNS server: %v", err)
+	}
+
+	var changes []DNSChange
+	for _, endpoint := range endpoints {
+		changes = append(changes, DNSChange{Action: "UPSERT", Endpoint: endpoint})
+	}
+
+	for _, err := range provider.ApplyChanges(changes) {
+		if err != nil {
+			t.Fatalf("Could not apply changes: %v", err)
+		}
+	}
+
+	return provider
+}
+
+func queryEmbeddedProvider(t *testing.T, provider *EmbeddedProvider, network, name string, qtype uint16) (int, []string) {
+	addr := provider.udpServer.PacketConn.LocalAddr().String()
+	if network == "tcp" {
+		addr = provider.tcpServer.Listener.Addr().String()
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+
+	client := &dns.Client{Net: network}
+	resp, _, err := client.Exchange(m, addr)
+	if err != nil {
+		t.Fatalf("Could not query %s: %v", name, err)
+	}
+
+	if !resp.Authoritative {
+		t.Errorf("Expected answer for %s to be authoritative", name)
+	}
+
+	var answer []string
+	for _, rr := range resp.Answer {
+		answer = append(answer, strings.Replace(rr.String(), "\t", " ", -1))
+	}
+	sort.Strings(answer)
+
+	return resp.Rcode, answer
+}
+
+func TestEmbeddedProviderServeDNS(t *testing.T) {
+	provider := testEmbeddedProvider(t,
+		Endpoint{DNSName: "some.domain.com", RecordType: "A", Targets: []string{"203.0.113.20", "203.0.113.10"}, Owner: testEmbeddedOwner},
+		Endpoint{DNSName: "v6.domain.com", RecordType: "AAAA", Targets: []string{"2001:db8::1"}, Owner: testEmbeddedOwner},
+		Endpoint{DNSName: "www.domain.com", RecordType: "CNAME", Targets: []string{"some.domain.com"}, Owner: testEmbeddedOwner},
+		Endpoint{DNSName: "lb.domain.com", RecordType: "CNAME", Targets: []string{"lb.hostname.example.net"}, Owner: testEmbeddedOwner},
+	)
+	defer provider.Close()
+
+	scenarios := []struct {
+		network string
+		name    string
+		qtype   uint16
+
+		expectedRcode  int
+		expectedAnswer []string
+	}{
+		{
+			network: "udp",
+			name:    "some.domain.com.",
+			qtype:   dns.TypeA,
+
+			expectedRcode: dns.RcodeSuccess,
+			expectedAnswer: []string{
+				"some.domain.com. 300 IN A 203.0.113.10",
+				"some.domain.com. 300 IN A 203.0.113.20",
+			},
+		},
+		{
+			network: "tcp",
+			name:    "V6.Domain.com.",
+			qtype:   dns.TypeAAAA,
+
+			expectedRcode:  dns.RcodeSuccess,
+			expectedAnswer: []string{"v6.domain.com. 300 IN AAAA 2001:db8::1"},
+		},
+		{
+			network: "udp",
+			name:    "www.domain.com.",
+			qtype:   dns.TypeA,
+
+			expectedRcode: dns.RcodeSuccess,
+			expectedAnswer: []string{
+				"some.domain.com. 300 IN A 203.0.113.10",
+				"some.domain.com. 300 IN A 203.0.113.20",
+				"www.domain.com. 300 IN CNAME some.domain.com.",
+			},
+		},
+		{
+			network: "udp",
+			name:    "lb.domain.com.",
+			qtype:   dns.TypeA,
+
+			expectedRcode:  dns.RcodeSuccess,
+			expectedAnswer: []string{"lb.domain.com. 300 IN CNAME lb.hostname.example.net."},
+		},
+		{
+			network: "udp",
+			name:    "_owner.some.domain.com.",
+			qtype:   dns.TypeTXT,
+
+			expectedRcode:  dns.RcodeSuccess,
+			expectedAnswer: []string{`_owner.some.domain.com. 300 IN TXT "` + testEmbeddedOwner + `"`},
+		},
+		{
+			network: "udp",
+			name:    "some.domain.com.",
+			qtype:   dns.TypeMX,
+
+			expectedRcode: dns.RcodeSuccess,
+		},
+		{
+			network: "udp",
+			name:    "other.domain.com.",
+			qtype:   dns.TypeA,
+
+			expectedRcode: dns.RcodeNameError,
+		},
+	}
+
+	for _, scenario := range scenarios {
+		rcode, answer := queryEmbeddedProvider(t, provider, scenario.network, scenario.name, scenario.qtype)
+
+		if rcode != scenario.expectedRcode {
+			t.Errorf("Expected rcode for %s %s to be %s, was %s", dns.TypeToString[scenario.qtype], scenario.name, dns.RcodeToString[scenario.expectedRcode], dns.RcodeToString[rcode])
+		}
+
+		if !reflect.DeepEqual(answer, scenario.expectedAnswer) {
+			t.Errorf("Expected answer for %s %s to be '%v', was '%v'", dns.TypeToString[scenario.qtype], scenario.name, scenario.expectedAnswer, answer)
+		}
+	}
+}
+
+func TestEmbeddedProviderApplyChanges(t *testing.T) {
+	endpoint := Endpoint{DNSName: "some.domain.com", RecordType: "A", Targets: []string{"203.0.113.10"}, Owner: testEmbeddedOwner}
+
+	provider := testEmbeddedProvider(t, endpoint)
+	defer provider.Close()
+
+	owner, exists, err := provider.GetOwner("Some.Domain.com")
+	if owner != testEmbeddedOwner || !exists || err != nil {
+		t.Errorf("Expected owner to be '%s' (true), was '%s' (%v, %v)", testEmbeddedOwner, owner, exists, err)
+	}
+
+	// Replaced by a CNAME record
+	provider.ApplyChanges([]DNSChange{DNSChange{Action: "UPSERT", Endpoint: Endpoint{
+		DNSName:    "some.domain.com",
+		RecordType: "CNAME",
+		Targets:    []string{"lb.hostname.example.net"},
+		Owner:      testEmbeddedOwner,
+	}}})
+
+	_, answer := queryEmbeddedProvider(t, provider, "udp", "some.domain.com.", dns.TypeA)
+	if expected := []string{"some.domain.com. 300 IN CNAME lb.hostname.example.net."}; !reflect.DeepEqual(answer, expected) {
+		t.Errorf("Expected answer to be '%v', was '%v'", expected, answer)
+	}
+
+	// Refused, leaving the CNAME record alone
+	errs := provider.ApplyChanges([]DNSChange{DNSChange{Action: "UPSERT", Endpoint: testSeveralHostnamesEndpoint(testEmbeddedOwner)}})
+	if !reflect.DeepEqual(errs, []error{testSeveralHostnamesError}) {
+		t.Errorf("Expected errors to be '%v', was '%v'", []error{testSeveralHostnamesError}, errs)
+	}
+
+	_, answer = queryEmbeddedProvider(t, provider, "udp", "some.domain.com.", dns.TypeA)
+	if expected := []string{"some.domain.com. 300 IN CNAME lb.hostname.example.net."}; !reflect.DeepEqual(answer, expected) {
+		t.Errorf("Expected answer to be '%v', was '%v'", expected, answer)
+	}
+
+	// Deleted, ownership record included
+	provider.ApplyChanges([]DNSChange{DNSChange{Action: "DELETE", Endpoint: endpoint}})
+
+	if rcode, _ := queryEmbeddedProvider(t, provider, "udp", "_owner.some.domain.com.", dns.TypeTXT); rcode != dns.RcodeNameError {
+		t.Errorf("Expected ownership record to be deleted, got %s", dns.RcodeToString[rcode])
+	}
+
+	owner, exists, err = provider.GetOwner("some.domain.com")
+	if owner != "" || exists || err != nil {
+		t.Errorf("Expected no owner, was '%s' (%v, %v)", owner, exists, err)
+	}
+}
+
+func TestEmbeddedProviderListEndpoints(t *testing.T) {
+	endpoint := Endpoint{DNSName: "some.domain.com", RecordType: "A", Targets: []string{"203.0.113.10", "2001:db8::10"}, TTL: 60, Owner: testEmbeddedOwner}
+
+	provider := testEmbeddedProvider(t, endpoint)
+	defer provider.Close()
+
+	endpoints, err := provider.ListEndpoints(nil)
+	if err != nil {
+		t.Errorf("Expected no error, was '%v'", err)
+	}
+
+	if expected := []Endpoint{endpoint}; !reflect.DeepEqual(endpoints, expected) {
+		t.Errorf("Expected endpoints to be '%v', was '%v'", expected, endpoints)
+	}
+}
+
+func TestEmbeddedProviderDryRun(t *testing.T) {
+	defer func(dryRunValue bool) { dryRun = dryRunValue }(dryRun)
+	dryRun = true
+
+	provider := testEmbeddedProvider(t, Endpoint{DNSName: "some.domain.com", RecordType: "A", Targets: []string{"203.0.113.10"}})
+	defer provider.Close()
+
+	if rcode, _ := queryEmbeddedProvider(t, provider, "udp", "some.domain.com.", dns.TypeA); rcode != dns.RcodeNameError {
+		t.Errorf("Expected no records to be served in dry-run mode, got %s", dns.RcodeToString[rcode])
+	}
+}
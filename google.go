@@ -0,0 +1,433 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"time"
+)
+
+const (
+	googleDNSURL      = "https://dns.googleapis.com/dns/v1"
+	googleMetadataURL = "http://metadata.google.internal/computeMetadata/v1"
+)
+
+type googleManagedZone struct {
+	Name    string `json:"name"`
+	DNSName string `json:"dnsName"`
+}
+
+type googleManagedZones struct {
+	ManagedZones  []googleManagedZone `json:"managedZones"`
+	NextPageToken string              `json:"nextPageToken"`
+}
+
+type googleRecordSet struct {
+	Name    string   `json:"name"`
+	Type    string   `json:"type"`
+	TTL     int64    `json:"ttl"`
+	RRDatas []string `json:"rrdatas"`
+}
+
+type googleRecordSets struct {
+	RRSets        []googleRecordSet `json:"rrsets"`
+	NextPageToken string            `json:"nextPageToken"`
+}
+
+type googleChange struct {
+	Additions []googleRecordSet `json:"additions,omitempty"`
+	Deletions []googleRecordSet `json:"deletions,omitempty"`
+}
+
+type googleToken struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+// GoogleProvider keeps endpoints as record sets in the Cloud DNS managed zones
+// of a Google Cloud project, authenticating with the service account of the
+// instance it runs on.
+type GoogleProvider struct {
+	client      *http.Client
+	apiURL      string
+	metadataURL string
+	project     string
+	now         func() time.Time
+
+	token          string
+	tokenExpiresAt time.Time
+
+	zones     []googleManagedZone
+	zoneCache zoneCache
+}
+
+func NewGoogleProvider() (*GoogleProvider, error) {
+	provider := &GoogleProvider{
+		client:      &http.Client{Timeout: httpTimeout},
+		apiURL:      googleDNSURL,
+		metadataURL: googleMetadataURL,
+		project:     googleProject,
+		now:         time.Now,
+		zoneCache:   zoneCache{ttl: time.Duration(zoneCacheTTL) * time.Second},
+	}
+
+	if provider.project == "" {
+		project, err := provider.metadata("project/project-id")
+		if err != nil {
+			return nil, fmt.Errorf("Could not find Google Cloud project, set it with -google-project: %v", err)
+		}
+		provider.project = project
+	}
+
+	return provider, nil
+}
+
+func (p *GoogleProvider) GetOwner(dnsName string) (string, bool, error) {
+	zone, err := p.managedZone(dnsName)
+	if err != nil {
+		return "", false, err
+	}
+
+	recordSets, err := p.endpointRecordSets(zone, dnsName)
+	if err != nil {
+		return "", false, err
+	}
+
+	exists := false
+	owner := ""
+
+	for _, recordSet := range recordSets {
+		if recordSet.Type == "TXT" {
+			owner = ownerFromTXT(recordSet.RRDatas)
+		} else {
+			exists = true
+		}
+	}
+
+	return owner, exists, nil
+}
+
+// ApplyChanges submits one Cloud DNS change per endpoint, replacing the record
+// sets currently stored for its name with the desired ones.
+func (p *GoogleProvider) ApplyChanges(changes []DNSChange) []error {
+	errs := make([]error, len(changes))
+
+	for i, change := range changes {
+		errs[i] = p.applyChange(change)
+	}
+
+	return errs
+}
+
+func (p *GoogleProvider) applyChange(change DNSChange) error {
+	dnsName := change.Endpoint.DNSName
+
+	zone, err := p.managedZone(dnsName)
+	if err != nil {
+		return err
+	}
+
+	current, err := p.endpointRecordSets(zone, dnsName)
+	if err != nil {
+		return err
+	}
+
+	var desired []googleRecordSet
+	if change.Action != "DELETE" {
+		records, err := endpointRecords(change.Endpoint)
+		if err != nil {
+			return err
+		}
+
+		for _, record := range records {
+			desired = append(desired, googleRecordSetFromRecord(record))
+		}
+	}
+
+	gchange := googleChange{
+		Deletions: googleRecordSetsDifference(current, desired),
+		Additions: googleRecordSetsDifference(desired, current),
+	}
+
+	if len(gchange.Deletions) == 0 && len(gchange.Additions) == 0 {
+		return nil
+	}
+
+	if dryRun {
+		log.Printf("DRY RUN: We normally would have deleted %d and added %d record sets for %s in %s\n", len(gchange.Deletions), len(gchange.Additions), dnsName, zone.Name)
+		return nil
+	}
+
+	return p.do("POST", p.zoneURL(zone)+"/changes", gchange, nil)
+}
+
+func (p *GoogleProvider) ListEndpoints(dnsNames []string) ([]Endpoint, error) {
+	indexes, err := p.zoneCache.zonesOf(dnsNames, p.now(), p.managedZoneNames)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []DNSRecord
+	for _, i := range indexes {
+		recordSets, err := p.listRecordSets(p.zones[i], "")
+		if err != nil {
+			return nil, err
+		}
+
+		for _, recordSet := range recordSets {
+			records = append(records, googleRecordFromRecordSet(recordSet))
+		}
+	}
+
+	return ownedEndpoints(records), nil
+}
+
+// managedZone returns the most specific managed zone the given name belongs
+// to.
+func (p *GoogleProvider) managedZone(dnsName string) (googleManagedZone, error) {
+	i, err := p.zoneCache.find(dnsName, p.now(), p.managedZoneNames)
+	if err != nil {
+		return googleManagedZone{}, err
+	}
+
+	if i < 0 {
+		return googleManagedZone{}, fmt.Errorf("No managed zone matches domain %s", dnsName)
+	}
+
+	return p.zones[i], nil
+}
+
+// managedZoneNames lists the managed zones of the project for the zone cache,
+// whose indexes point into p.zones.
+func (p *GoogleProvider) managedZoneNames() ([]string, error) {
+	zones, err := p.listManagedZones()
+	if err != nil {
+		return nil, fmt.Errorf("Could not list managed zones: %v", err)
+	}
+
+	p.zones = zones
+
+	names := make([]string, len(zones))
+	for i, zone := range zones {
+		names[i] = zone.DNSName
+	}
+	return names, nil
+}
+
+func (p *GoogleProvider) listManagedZones() ([]googleManagedZone, error) {
+	zones := []googleManagedZone{}
+	pageToken := ""
+
+	for {
+		query := url.Values{}
+		if pageToken != "" {
+			query.Set("pageToken", pageToken)
+		}
+
+		var page googleManagedZones
+		if err := p.do("GET", p.projectURL()+"/managedZones?"+query.Encode(), nil, &page); err != nil {
+			return nil, err
+		}
+
+		zones = append(zones, page.ManagedZones...)
+
+		if page.NextPageToken == "" {
+			return zones, nil
+		}
+		pageToken = page.NextPageToken
+	}
+}
+
+// endpointRecordSets returns the address record sets stored for the given
+// name, along with its TXT ownership record set.
+func (p *GoogleProvider) endpointRecordSets(zone googleManagedZone, dnsName string) ([]googleRecordSet, error) {
+	recordSets, err := p.recordSets(zone, dnsName, addressRecordTypes)
+	if err != nil {
+		return nil, err
+	}
+
+	ownerRecordSets, err := p.recordSets(zone, ownerRecordName(dnsName), []string{"TXT"})
+	if err != nil {
+		return nil, err
+	}
+
+	return append(recordSets, ownerRecordSets...), nil
+}
+
+// recordSets returns the record sets of the given types stored for a name.
+func (p *GoogleProvider) recordSets(zone googleManagedZone, dnsName string, recordTypes []string) ([]googleRecordSet, error) {
+	page, err := p.listRecordSets(zone, dnsName)
+	if err != nil {
+		return nil, err
+	}
+
+	recordSets := []googleRecordSet{}
+	for _, recordSet := range page {
+		if containsString(recordTypes, recordSet.Type) {
+			recordSets = append(recordSets, recordSet)
+		}
+	}
+
+	return recordSets, nil
+}
+
+// listRecordSets returns the record sets stored for a name, or every record set
+// of the zone when no name is given.
+func (p *GoogleProvider) listRecordSets(zone googleManagedZone, dnsName string) ([]googleRecordSet, error) {
+	var recordSets []googleRecordSet
+	pageToken := ""
+
+	for {
+		query := url.Values{}
+		if dnsName != "" {
+			query.Set("name", domainWithTrailingDot(strings.ToLower(dnsName)))
+		}
+		if pageToken != "" {
+			query.Set("pageToken", pageToken)
+		}
+
+		var page googleRecordSets
+		if err := p.do("GET", p.zoneURL(zone)+"/rrsets?"+query.Encode(), nil, &page); err != nil {
+			return nil, fmt.Errorf("Could not list record sets for %s: %v", zone.Name, err)
+		}
+
+		recordSets = append(recordSets, page.RRSets...)
+
+		if page.NextPageToken == "" {
+			return recordSets, nil
+		}
+		pageToken = page.NextPageToken
+	}
+}
+
+func (p *GoogleProvider) projectURL() string {
+	return fmt.Sprintf("%s/projects/%s", p.apiURL, pathEscape(p.project))
+}
+
+func (p *GoogleProvider) zoneURL(zone googleManagedZone) string {
+	return fmt.Sprintf("%s/managedZones/%s", p.projectURL(), pathEscape(zone.Name))
+}
+
+func (p *GoogleProvider) do(method, url string, in, out interface{}) error {
+	token, err := p.accessToken()
+	if err != nil {
+		return fmt.Errorf("Could not get access token: %v", err)
+	}
+
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+token)
+
+	return doJSON(p.client, method, url, header, in, out)
+}
+
+// accessToken returns a token of the instance service account, renewing it a
+// minute before it expires.
+func (p *GoogleProvider) accessToken() (string, error) {
+	if p.token != "" && p.now().Before(p.tokenExpiresAt) {
+		return p.token, nil
+	}
+
+	var token googleToken
+	err := doJSON(p.client, "GET", p.metadataURL+"/instance/service-accounts/default/token", metadataHeader(), nil, &token)
+	if err != nil {
+		return "", err
+	}
+
+	p.token = token.AccessToken
+	p.tokenExpiresAt = p.now().Add(time.Duration(token.ExpiresIn)*time.Second - time.Minute)
+
+	return p.token, nil
+}
+
+func (p *GoogleProvider) metadata(path string) (string, error) {
+	req, err := http.NewRequest("GET", p.metadataURL+"/"+path, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header = metadataHeader()
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Metadata server returned status %d for %s", resp.StatusCode, path)
+	}
+
+	value, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(value)), nil
+}
+
+func metadataHeader() http.Header {
+	return http.Header{"Metadata-Flavor": []string{"Google"}}
+}
+
+// googleRecordSetFromRecord converts the given record to the format stored by
+// Cloud DNS, where names and hostnames are fully qualified.
+func googleRecordSetFromRecord(record DNSRecord) googleRecordSet {
+	rrdatas := make([]string, len(record.Values))
+	for i, value := range record.Values {
+		if record.Type == "CNAME" {
+			value = domainWithTrailingDot(value)
+		}
+		rrdatas[i] = value
+	}
+
+	return googleRecordSet{
+		Name:    domainWithTrailingDot(strings.ToLower(record.Name)),
+		Type:    record.Type,
+		TTL:     record.TTL,
+		RRDatas: rrdatas,
+	}
+}
+
+// googleRecordFromRecordSet converts the given Cloud DNS record set back to a
+// record, without the trailing dots of its name and hostnames.
+func googleRecordFromRecordSet(recordSet googleRecordSet) DNSRecord {
+	values := make([]string, len(recordSet.RRDatas))
+	for i, value := range recordSet.RRDatas {
+		if recordSet.Type == "CNAME" {
+			value = strings.TrimSuffix(value, ".")
+		}
+		values[i] = value
+	}
+
+	return DNSRecord{
+		Name:   strings.TrimSuffix(recordSet.Name, "."),
+		Type:   recordSet.Type,
+		TTL:    recordSet.TTL,
+		Values: values,
+	}
+}
+
+// googleRecordSetsDifference returns the record sets of a that are not
+// exactly the same in b.
+func googleRecordSetsDifference(a, b []googleRecordSet) []googleRecordSet {
+	var difference []googleRecordSet
+
+	for _, recordSet := range a {
+		found := false
+		for _, other := range b {
+			if reflect.DeepEqual(recordSet, other) {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			difference = append(difference, recordSet)
+		}
+	}
+
+	return difference
+}
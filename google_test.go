@@ -0,0 +1,363 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testGoogleOwner = "heritage=kubernetes-service-dns-update,cluster=default,service=/service"
+
+// FakeGoogleDNS serves the subset of the Cloud DNS and metadata APIs used by
+// the Google provider, returning managed zones one per page.
+type FakeGoogleDNS struct {
+	t *testing.T
+
+	zones      []googleManagedZone
+	recordSets map[string][]googleRecordSet
+	changes    map[string][]googleChange
+
+	listZonesRequests int
+	tokenRequests     int
+}
+
+func (f *FakeGoogleDNS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/metadata/") {
+		if r.Header.Get("Metadata-Flavor") != "Google" {
+			http.Error(w, "missing metadata flavor", http.StatusForbidden)
+			return
+		}
+
+		switch r.URL.Path {
+		case "/metadata/project/project-id":
+			w.Write([]byte("metadata-project"))
+		case "/metadata/instance/service-accounts/default/token":
+			f.tokenRequests++
+			json.NewEncoder(w).Encode(googleToken{AccessToken: "token", ExpiresIn: 3600})
+		default:
+			http.NotFound(w, r)
+		}
+		return
+	}
+
+	if r.Header.Get("Authorization") != "Bearer token" {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	path := strings.Split(strings.TrimPrefix(r.URL.Path, "/dns/projects/project/"), "/")
+
+	switch {
+	case len(path) == 1 && path[0] == "managedZones":
+		f.listZonesRequests++
+
+		page := googleManagedZones{}
+		i := 0
+		if token := r.URL.Query().Get("pageToken"); token != "" {
+			i = len(token)
+		}
+		if i < len(f.zones) {
+			page.ManagedZones = f.zones[i : i+1]
+		}
+		if i+1 < len(f.zones) {
+			page.NextPageToken = strings.Repeat("x", i+1)
+		}
+		json.NewEncoder(w).Encode(page)
+
+	case len(path) == 3 && path[2] == "rrsets":
+		page := googleRecordSets{}
+		for _, recordSet := range f.recordSets[path[1]] {
+			if name := r.URL.Query().Get("name"); name == "" || recordSet.Name == name {
+				page.RRSets = append(page.RRSets, recordSet)
+			}
+		}
+		json.NewEncoder(w).Encode(page)
+
+	case len(path) == 3 && path[2] == "changes" && r.Method == "POST":
+		var change googleChange
+		if err := json.NewDecoder(r.Body).Decode(&change); err != nil {
+			f.t.Errorf("Could not decode change: %v", err)
+		}
+		f.changes[path[1]] = append(f.changes[path[1]], change)
+		json.NewEncoder(w).Encode(map[string]string{"status": "pending"})
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func testGoogleProvider(fake *FakeGoogleDNS) (*GoogleProvider, func()) {
+	serverURL, client, closeServer := testHTTPServer(fake)
+
+	provider := &GoogleProvider{
+		client:      client,
+		apiURL:      serverURL + "/dns",
+		metadataURL: serverURL + "/metadata",
+		project:     "project",
+		now:         time.Now,
+		zoneCache:   zoneCache{ttl: time.Hour},
+	}
+
+	return provider, closeServer
+}
+
+func testGoogleZones() []googleManagedZone {
+	return []googleManagedZone{
+		googleManagedZone{Name: "domain", DNSName: "domain.com."},
+		googleManagedZone{Name: "sub-domain", DNSName: "sub.domain.com."},
+		googleManagedZone{Name: "otherdomain", DNSName: "otherdomain.com."},
+	}
+}
+
+func TestGoogleProviderGetOwner(t *testing.T) {
+	scenarios := []struct {
+		dnsName    string
+		recordSets map[string][]googleRecordSet
+
+		expectedOwner  string
+		expectedExists bool
+		expectedError  error
+	}{
+		// No managed zone for the domain
+		{
+			dnsName: "some.example.com",
+
+			expectedError: errors.New("No managed zone matches domain some.example.com"),
+		},
+
+		// No records for the domain
+		{
+			dnsName: "some.domain.com",
+
+			expectedOwner:  "",
+			expectedExists: false,
+		},
+
+		// Record not owned by anybody
+		{
+			dnsName: "some.domain.com",
+			recordSets: map[string][]googleRecordSet{
+				"domain": []googleRecordSet{
+					googleRecordSet{Name: "some.domain.com.", Type: "A", TTL: 300, RRDatas: []string{"203.0.113.10"}},
+				},
+			},
+
+			expectedOwner:  "",
+			expectedExists: true,
+		},
+
+		// Record owned in the most specific zone
+		{
+			dnsName: "some.sub.domain.com",
+			recordSets: map[string][]googleRecordSet{
+				"domain": []googleRecordSet{
+					googleRecordSet{Name: "_owner.some.sub.domain.com.", Type: "TXT", TTL: 300, RRDatas: []string{`"heritage=kubernetes-service-dns-update,cluster=other,service=/service"`}},
+				},
+				"sub-domain": []googleRecordSet{
+					googleRecordSet{Name: "some.sub.domain.com.", Type: "A", TTL: 300, RRDatas: []string{"203.0.113.10"}},
+					googleRecordSet{Name: "_owner.some.sub.domain.com.", Type: "TXT", TTL: 300, RRDatas: []string{`"v=spf1 -all"`, `"` + testGoogleOwner + `"`}},
+				},
+			},
+
+			expectedOwner:  testGoogleOwner,
+			expectedExists: true,
+		},
+	}
+
+	for _, scenario := range scenarios {
+		fake := &FakeGoogleDNS{t: t, zones: testGoogleZones(), recordSets: scenario.recordSets}
+		provider, closeServer := testGoogleProvider(fake)
+
+		owner, exists, err := provider.GetOwner(scenario.dnsName)
+
+		if !reflect.DeepEqual(err, scenario.expectedError) {
+			t.Errorf("Expected error to be '%v', was '%v'", scenario.expectedError, err)
+		}
+
+		if owner != scenario.expectedOwner || exists != scenario.expectedExists {
+			t.Errorf("Expected owner of %s to be '%s' (%v), was '%s' (%v)", scenario.dnsName, scenario.expectedOwner, scenario.expectedExists, owner, exists)
+		}
+
+		closeServer()
+	}
+}
+
+func TestGoogleProviderApplyChanges(t *testing.T) {
+	endpoint := Endpoint{
+		DNSName:    "some.domain.com",
+		RecordType: "A",
+		Targets:    []string{"203.0.113.10"},
+		Owner:      testGoogleOwner,
+	}
+
+	address := googleRecordSet{Name: "some.domain.com.", Type: "A", TTL: 300, RRDatas: []string{"203.0.113.10"}}
+	txt := googleRecordSet{Name: "_owner.some.domain.com.", Type: "TXT", TTL: 300, RRDatas: []string{`"` + testGoogleOwner + `"`}}
+	staleAddress := googleRecordSet{Name: "some.domain.com.", Type: "CNAME", TTL: 300, RRDatas: []string{"elb.hostname.amazonaws.com."}}
+
+	scenarios := []struct {
+		description string
+		changes     []DNSChange
+		recordSets  []googleRecordSet
+
+		expectedChanges []googleChange
+		expectedErrors  []error
+	}{
+		{
+			description: "records are created",
+			changes:     []DNSChange{DNSChange{Action: "UPSERT", Endpoint: endpoint}},
+
+			expectedChanges: []googleChange{
+				googleChange{Additions: []googleRecordSet{address, txt}},
+			},
+			expectedErrors: []error{nil},
+		},
+		{
+			description: "records are replaced",
+			changes:     []DNSChange{DNSChange{Action: "UPSERT", Endpoint: endpoint}},
+			recordSets:  []googleRecordSet{staleAddress, txt},
+
+			expectedChanges: []googleChange{
+				googleChange{Additions: []googleRecordSet{address}, Deletions: []googleRecordSet{staleAddress}},
+			},
+			expectedErrors: []error{nil},
+		},
+		{
+			description: "records already up to date are left alone",
+			changes:     []DNSChange{DNSChange{Action: "UPSERT", Endpoint: endpoint}},
+			recordSets:  []googleRecordSet{address, txt},
+
+			expectedErrors: []error{nil},
+		},
+		{
+			description: "records are deleted",
+			changes:     []DNSChange{DNSChange{Action: "DELETE", Endpoint: endpoint}},
+			recordSets:  []googleRecordSet{staleAddress, txt},
+
+			expectedChanges: []googleChange{
+				googleChange{Deletions: []googleRecordSet{staleAddress, txt}},
+			},
+			expectedErrors: []error{nil},
+		},
+		{
+			description: "records outside of any managed zone fail on their own",
+			changes: []DNSChange{
+				DNSChange{Action: "UPSERT", Endpoint: Endpoint{DNSName: "some.example.com", RecordType: "A", Targets: []string{"203.0.113.10"}}},
+				DNSChange{Action: "UPSERT", Endpoint: endpoint},
+			},
+
+			expectedChanges: []googleChange{
+				googleChange{Additions: []googleRecordSet{address, txt}},
+			},
+			expectedErrors: []error{errors.New("No managed zone matches domain some.example.com"), nil},
+		},
+		{
+			description: "CNAME records with several hostnames are refused",
+			changes:     []DNSChange{DNSChange{Action: "UPSERT", Endpoint: testSeveralHostnamesEndpoint(testGoogleOwner)}},
+			recordSets:  []googleRecordSet{address, txt},
+
+			expectedErrors: []error{testSeveralHostnamesError},
+		},
+	}
+
+	for _, scenario := range scenarios {
+		fake := &FakeGoogleDNS{
+			t:          t,
+			zones:      testGoogleZones(),
+			recordSets: map[string][]googleRecordSet{"domain": scenario.recordSets},
+			changes:    map[string][]googleChange{},
+		}
+		provider, closeServer := testGoogleProvider(fake)
+
+		errs := provider.ApplyChanges(scenario.changes)
+
+		if !reflect.DeepEqual(errs, scenario.expectedErrors) {
+			t.Errorf("Expected errors to be '%v' when %s, was '%v'", scenario.expectedErrors, scenario.description, errs)
+		}
+
+		if !reflect.DeepEqual(fake.changes["domain"], scenario.expectedChanges) {
+			t.Errorf("Expected changes to be '%v' when %s, was '%v'", scenario.expectedChanges, scenario.description, fake.changes["domain"])
+		}
+
+		closeServer()
+	}
+}
+
+func TestGoogleProviderListEndpoints(t *testing.T) {
+	fake := &FakeGoogleDNS{t: t, zones: testGoogleZones(), recordSets: map[string][]googleRecordSet{
+		"domain": []googleRecordSet{
+			googleRecordSet{Name: "domain.com.", Type: "TXT", TTL: 300, RRDatas: []string{`"v=spf1 -all"`}},
+			googleRecordSet{Name: "some.domain.com.", Type: "CNAME", TTL: 300, RRDatas: []string{"elb.hostname.amazonaws.com."}},
+			googleRecordSet{Name: "_owner.some.domain.com.", Type: "TXT", TTL: 300, RRDatas: []string{`"` + testGoogleOwner + `"`}},
+			googleRecordSet{Name: "other.domain.com.", Type: "A", TTL: 300, RRDatas: []string{"203.0.113.20"}},
+		},
+		"sub-domain": []googleRecordSet{
+			googleRecordSet{Name: "some.sub.domain.com.", Type: "A", TTL: 60, RRDatas: []string{"203.0.113.10"}},
+			googleRecordSet{Name: "some.sub.domain.com.", Type: "AAAA", TTL: 60, RRDatas: []string{"2001:db8::10"}},
+			googleRecordSet{Name: "_owner.some.sub.domain.com.", Type: "TXT", TTL: 300, RRDatas: []string{`"` + testGoogleOwner + `"`}},
+		},
+		"otherdomain": []googleRecordSet{
+			googleRecordSet{Name: "www.otherdomain.com.", Type: "CNAME", TTL: 300, RRDatas: []string{"elb.hostname.amazonaws.com."}},
+			googleRecordSet{Name: "_owner.www.otherdomain.com.", Type: "TXT", TTL: 300, RRDatas: []string{`"` + testGoogleOwner + `"`}},
+		},
+	}}
+	provider, closeServer := testGoogleProvider(fake)
+	defer closeServer()
+
+	// Only the zones of the given names are listed
+	endpoints, err := provider.ListEndpoints([]string{"some.domain.com", "some.sub.domain.com", "other.domain.com", "missing.example.org"})
+	if err != nil {
+		t.Errorf("Expected no error, was '%v'", err)
+	}
+
+	expected := []Endpoint{
+		Endpoint{DNSName: "some.domain.com", RecordType: "CNAME", Targets: []string{"elb.hostname.amazonaws.com"}, TTL: 300, Owner: testGoogleOwner},
+		Endpoint{DNSName: "some.sub.domain.com", RecordType: "A", Targets: []string{"203.0.113.10", "2001:db8::10"}, TTL: 60, Owner: testGoogleOwner},
+	}
+
+	if !reflect.DeepEqual(endpoints, expected) {
+		t.Errorf("Expected endpoints to be '%v', was '%v'", expected, endpoints)
+	}
+}
+
+func TestGoogleProviderCaching(t *testing.T) {
+	now := time.Now()
+	fake := &FakeGoogleDNS{t: t, zones: testGoogleZones()}
+	provider, closeServer := testGoogleProvider(fake)
+	defer closeServer()
+	provider.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if _, _, err := provider.GetOwner("some.otherdomain.com"); err != nil {
+			t.Errorf("Expected no error, was '%v'", err)
+		}
+	}
+
+	// Zones are listed one page at a time
+	if fake.listZonesRequests != 3 || fake.tokenRequests != 1 {
+		t.Errorf("Expected zones and token to be fetched once, got %d zone requests and %d token requests", fake.listZonesRequests, fake.tokenRequests)
+	}
+
+	now = now.Add(time.Hour)
+	provider.GetOwner("some.otherdomain.com")
+
+	if fake.listZonesRequests != 6 || fake.tokenRequests != 2 {
+		t.Errorf("Expected zones and token to be fetched again, got %d zone requests and %d token requests", fake.listZonesRequests, fake.tokenRequests)
+	}
+}
+
+func TestGoogleProviderMetadata(t *testing.T) {
+	fake := &FakeGoogleDNS{t: t}
+	serverURL, client, closeServer := testHTTPServer(fake)
+	defer closeServer()
+
+	provider := &GoogleProvider{client: client, metadataURL: serverURL + "/metadata"}
+
+	project, err := provider.metadata("project/project-id")
+	if err != nil || project != "metadata-project" {
+		t.Errorf("Expected project to be 'metadata-project', was '%s' (%v)", project, err)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Timeout of every request made to the HTTP APIs of the DNS providers
+const httpTimeout = 30 * time.Second
+
+// httpStatusError is returned for API responses with an unexpected status code.
+type httpStatusError struct {
+	method     string
+	url        string
+	statusCode int
+	body       string
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("%s %s returned status %d: %s", e.method, e.url, e.statusCode, e.body)
+}
+
+// doJSON sends the given value (if any) as the JSON body of a request, and
+// decodes the JSON response into out (if any). Any status other than 2xx is
+// returned as an *httpStatusError.
+func doJSON(client *http.Client, method, url string, header http.Header, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return err
+	}
+
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &httpStatusError{method, url, resp.StatusCode, string(bytes.TrimSpace(data))}
+	}
+
+	if out == nil || len(data) == 0 {
+		return nil
+	}
+
+	return json.Unmarshal(data, out)
+}
+
+// pathEscape escapes the given value so it can be used as a single segment of
+// a URL path, as url.PathEscape does on Go 1.8 and later.
+func pathEscape(value string) string {
+	return strings.Replace(url.QueryEscape(value), "+", "%20", -1)
+}
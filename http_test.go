@@ -0,0 +1,72 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// testHTTPServer starts a server for the handler, returning its URL, a client
+// to reach it with and a function to shut it down.
+func testHTTPServer(handler http.Handler) (string, *http.Client, func()) {
+	server := httptest.NewServer(handler)
+	return server.URL, &http.Client{}, server.Close
+}
+
+func TestDoJSON(t *testing.T) {
+	serverURL, client, closeServer := testHTTPServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			t.Errorf("Expected authorization header to be set, was '%s'", r.Header.Get("Authorization"))
+		}
+
+		switch r.URL.Path {
+		case "/echo":
+			body, _ := ioutil.ReadAll(r.Body)
+			w.Write(body)
+		case "/empty":
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "not found", http.StatusNotFound)
+		}
+	}))
+	defer closeServer()
+
+	header := http.Header{"Authorization": []string{"Bearer token"}}
+
+	in := map[string]string{"name": "some.domain.com"}
+	var out map[string]string
+	if err := doJSON(client, "POST", serverURL+"/echo", header, in, &out); err != nil {
+		t.Errorf("Expected no error, was '%v'", err)
+	}
+	if !reflect.DeepEqual(out, in) {
+		t.Errorf("Expected response to be '%v', was '%v'", in, out)
+	}
+
+	if err := doJSON(client, "DELETE", serverURL+"/empty", header, nil, &out); err != nil {
+		t.Errorf("Expected no error, was '%v'", err)
+	}
+
+	err := doJSON(client, "GET", serverURL+"/missing", header, nil, &out)
+	if statusErr, ok := err.(*httpStatusError); !ok || statusErr.statusCode != http.StatusNotFound || statusErr.body != "not found" {
+		t.Errorf("Expected status error to be returned, was '%v'", err)
+	}
+}
+
+func TestPathEscape(t *testing.T) {
+	scenarios := []struct {
+		value    string
+		expected string
+	}{
+		{"some.domain.com", "some.domain.com"},
+		{"some zone", "some%20zone"},
+		{"a+b/c?d", "a%2Bb%2Fc%3Fd"},
+	}
+
+	for _, scenario := range scenarios {
+		if escaped := pathEscape(scenario.value); escaped != scenario.expected {
+			t.Errorf("Expected '%s' to be escaped as '%s', was '%s'", scenario.value, scenario.expected, escaped)
+		}
+	}
+}
@@ -4,21 +4,34 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"net"
+	"sort"
+	"strconv"
 	"strings"
 
 	"k8s.io/client-go/1.4/kubernetes"
 	"k8s.io/client-go/1.4/pkg/api"
 	"k8s.io/client-go/1.4/pkg/api/v1"
 	"k8s.io/client-go/1.4/pkg/labels"
+	"k8s.io/client-go/1.4/pkg/watch"
 	"k8s.io/client-go/1.4/rest"
 )
 
+// ownerHeritage prefixes every ownership marker written by the daemon.
+const ownerHeritage = "heritage=kubernetes-service-dns-update"
+
 type KubernetesClientImpl struct {
 	clientset *kubernetes.Clientset
 }
 
 type KubernetesClient interface {
 	GetDNSServices(namespace, selector string) ([]v1.Service, error)
+	WatchDNSServices(namespace, selector string) (watch.Interface, error)
+	GetSecret(namespace, name string) (*v1.Secret, error)
+	GetNodes() ([]v1.Node, error)
+	WatchNodes() (watch.Interface, error)
+	GetEndpoints(namespace, name string) (*v1.Endpoints, error)
+	WatchDNSEndpoints(namespace, selector string) (watch.Interface, error)
 }
 
 func NewKubernetesClient() (*KubernetesClientImpl, error) {
@@ -38,34 +51,240 @@ func NewKubernetesClient() (*KubernetesClientImpl, error) {
 }
 
 func (c *KubernetesClientImpl) GetDNSServices(namespace, selector string) ([]v1.Service, error) {
+	services, err := c.clientset.Core().Services(namespace).List(selectorListOptions(selector))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return services.Items, nil
+}
+
+func (c *KubernetesClientImpl) WatchDNSServices(namespace, selector string) (watch.Interface, error) {
+	return c.clientset.Core().Services(namespace).Watch(selectorListOptions(selector))
+}
+
+func (c *KubernetesClientImpl) GetSecret(namespace, name string) (*v1.Secret, error) {
+	return c.clientset.Core().Secrets(namespace).Get(name)
+}
+
+func (c *KubernetesClientImpl) GetNodes() ([]v1.Node, error) {
+	nodes, err := c.clientset.Core().Nodes().List(api.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	return nodes.Items, nil
+}
+
+func (c *KubernetesClientImpl) WatchNodes() (watch.Interface, error) {
+	return c.clientset.Core().Nodes().Watch(api.ListOptions{})
+}
+
+func (c *KubernetesClientImpl) GetEndpoints(namespace, name string) (*v1.Endpoints, error) {
+	return c.clientset.Core().Endpoints(namespace).Get(name)
+}
+
+// WatchDNSEndpoints watches the endpoints of the DNS services, which carry the
+// labels of their service.
+func (c *KubernetesClientImpl) WatchDNSEndpoints(namespace, selector string) (watch.Interface, error) {
+	return c.clientset.Core().Endpoints(namespace).Watch(selectorListOptions(selector))
+}
+
+func selectorListOptions(selector string) api.ListOptions {
 	l, err := labels.Parse(selector)
 	if err != nil {
 		log.Fatalf("Failed to parse selector %q: %v", selector, err)
 	}
-	opts := api.ListOptions{
+
+	return api.ListOptions{
 		LabelSelector: l,
 	}
+}
 
-	services, err := c.clientset.Core().Services(namespace).List(opts)
+// ServiceTargets returns the addresses the given service is reachable at,
+// along with the type of record pointing to them: a CNAME record to the
+// external name of ExternalName services, the records of the nodes of NodePort
+// services (see ServiceNodeTargets), or the records of the load balancer of the
+// others (see ServiceIngressTargets).
+func ServiceTargets(kubernetesClient KubernetesClient, service v1.Service) (string, []string, error) {
+	if service.Spec.Type == v1.ServiceTypeNodePort {
+		return ServiceNodeTargets(kubernetesClient, service)
+	}
 
-	if err != nil {
-		return nil, err
+	if service.Spec.Type != v1.ServiceTypeExternalName {
+		return ServiceIngressTargets(service)
 	}
 
-	return services.Items, nil
+	externalName := strings.ToLower(strings.TrimSuffix(service.Spec.ExternalName, "."))
+	if externalName == "" {
+		return "", nil, errors.New("No external name defined for service")
+	}
+
+	return "CNAME", []string{externalName}, nil
 }
 
-func ServiceIngressHostname(service v1.Service) (string, error) {
+// ServiceIngressTargets returns the addresses the load balancer of the given
+// service is reachable at, along with the type of record pointing to them: a
+// CNAME for load balancers with hostnames (i.e. ELB), an A record for the ones
+// with IP addresses (i.e. GCE or MetalLB), which may include IPv6 ones on
+// dual-stack load balancers. IPv6-only load balancers get an AAAA record.
+func ServiceIngressTargets(service v1.Service) (string, []string, error) {
 	ingress := service.Status.LoadBalancer.Ingress
 	if len(ingress) < 1 {
-		return "", errors.New("No ingress defined for ELB")
+		return "", nil, errors.New("No ingress defined for load balancer")
 	}
-	if len(ingress) > 1 {
-		return "", errors.New("Multiple ingress points found for ELB not supported")
+
+	var hostnames, ips []string
+	for _, point := range ingress {
+		switch {
+		case point.Hostname != "":
+			hostnames = append(hostnames, point.Hostname)
+		case point.IP != "":
+			ip := net.ParseIP(point.IP)
+			if ip == nil {
+				return "", nil, fmt.Errorf("Ingress IP %s is invalid", point.IP)
+			}
+			ips = append(ips, ip.String())
+		default:
+			return "", nil, errors.New("Ingress defines neither a hostname nor an IP")
+		}
+	}
+
+	if len(hostnames) > 0 && len(ips) > 0 {
+		return "", nil, errors.New("Ingress points mixing hostnames and IPs not supported")
 	}
-	return ingress[0].Hostname, nil
+
+	// Sorted, so records do not change when the load balancer reorders them
+	if len(hostnames) > 0 {
+		sort.Strings(hostnames)
+		return "CNAME", hostnames, nil
+	}
+
+	recordType, ips := ipTargets(ips)
+	return recordType, ips, nil
 }
 
+// ServiceNodeTargets returns the IP addresses of the nodes hosting the ready
+// pods of the given NodePort service, or of every node when the service is
+// annotated with 'nodePortAllNodes'. Only ready nodes open to scheduling (i.e.
+// not being drained) are included, by their external IP addresses, or by
+// their internal ones when they have none (i.e. on bare metal).
+func ServiceNodeTargets(kubernetesClient KubernetesClient, service v1.Service) (string, []string, error) {
+	allNodes, err := ServiceNodePortAllNodes(service)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var podNodeNames map[string]bool
+	if !allNodes {
+		podNodeNames, err = servicePodNodeNames(kubernetesClient, service)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+
+	nodes, err := kubernetesClient.GetNodes()
+	if err != nil {
+		return "", nil, fmt.Errorf("Could not list nodes: %v", err)
+	}
+
+	var ips []string
+	for _, node := range nodes {
+		if !nodeAvailable(node) || (!allNodes && !podNodeNames[node.ObjectMeta.Name]) {
+			continue
+		}
+
+		ips = append(ips, nodeIPs(node)...)
+	}
+
+	if len(ips) == 0 {
+		return "", nil, errors.New("No ready node found for NodePort service")
+	}
+
+	recordType, ips := ipTargets(ips)
+	return recordType, ips, nil
+}
+
+// servicePodNodeNames returns the names of the nodes hosting the ready pods of
+// the given service, as listed in its endpoints.
+func servicePodNodeNames(kubernetesClient KubernetesClient, service v1.Service) (map[string]bool, error) {
+	endpoints, err := kubernetesClient.GetEndpoints(service.ObjectMeta.Namespace, service.ObjectMeta.Name)
+	if err != nil {
+		return nil, fmt.Errorf("Could not get endpoints: %v", err)
+	}
+
+	nodeNames := map[string]bool{}
+	for _, subset := range endpoints.Subsets {
+		for _, address := range subset.Addresses {
+			if address.NodeName != nil && *address.NodeName != "" {
+				nodeNames[*address.NodeName] = true
+			}
+		}
+	}
+
+	return nodeNames, nil
+}
+
+// nodeAvailable returns whether the given node is ready and open to
+// scheduling, so it can be published.
+func nodeAvailable(node v1.Node) bool {
+	if node.Spec.Unschedulable {
+		return false
+	}
+
+	for _, condition := range node.Status.Conditions {
+		if condition.Type == v1.NodeReady {
+			return condition.Status == v1.ConditionTrue
+		}
+	}
+
+	return false
+}
+
+// nodeIPs returns the external IP addresses of the given node, or its internal
+// ones if it has none.
+func nodeIPs(node v1.Node) []string {
+	var external, internal []string
+
+	for _, address := range node.Status.Addresses {
+		ip := net.ParseIP(address.Address)
+		if ip == nil {
+			continue
+		}
+
+		switch address.Type {
+		case v1.NodeExternalIP:
+			external = append(external, ip.String())
+		case v1.NodeInternalIP:
+			internal = append(internal, ip.String())
+		}
+	}
+
+	if len(external) > 0 {
+		return external
+	}
+	return internal
+}
+
+// ipTargets returns the given IP addresses sorted, so records do not change
+// when they are listed in another order, along with the type of record
+// pointing to them: AAAA if they are all IPv6 ones, A otherwise.
+func ipTargets(ips []string) (string, []string) {
+	sort.Strings(ips)
+
+	recordType := "AAAA"
+	for _, ip := range ips {
+		if ipRecordType(ip) == "A" {
+			recordType = "A"
+		}
+	}
+
+	return recordType, ips
+}
+
+// ServiceDomainNames returns the names declared by the 'domainNames' annotation
+// of the given service, in the canonical form the providers list them in.
 func ServiceDomainNames(service v1.Service) ([]string, error) {
 	annotation, ok := service.ObjectMeta.Annotations["domainNames"]
 	if !ok {
@@ -74,8 +293,59 @@ func ServiceDomainNames(service v1.Service) ([]string, error) {
 
 	domainNames := strings.Split(annotation, ",")
 	for i, domainName := range domainNames {
-		domainNames[i] = strings.TrimSpace(domainName)
+		domainNames[i] = canonicalDNSName(strings.TrimSpace(domainName))
 	}
 
 	return domainNames, nil
 }
+
+// ServiceProxied returns whether the records of the given service should be
+// served through the Cloudflare proxy, as set by its 'cloudflareProxied'
+// annotation.
+func ServiceProxied(service v1.Service) (bool, error) {
+	annotation, ok := service.ObjectMeta.Annotations["cloudflareProxied"]
+	if !ok {
+		return false, nil
+	}
+
+	proxied, err := strconv.ParseBool(strings.TrimSpace(annotation))
+	if err != nil {
+		return false, fmt.Errorf("Annotation 'cloudflareProxied' of %s must be true or false, was %q", service.ObjectMeta.Name, annotation)
+	}
+
+	return proxied, nil
+}
+
+// ServiceNodePortAllNodes returns whether the records of the given NodePort
+// service should point to every node rather than the ones hosting its pods, as
+// set by its 'nodePortAllNodes' annotation.
+func ServiceNodePortAllNodes(service v1.Service) (bool, error) {
+	annotation, ok := service.ObjectMeta.Annotations["nodePortAllNodes"]
+	if !ok {
+		return false, nil
+	}
+
+	allNodes, err := strconv.ParseBool(strings.TrimSpace(annotation))
+	if err != nil {
+		return false, fmt.Errorf("Annotation 'nodePortAllNodes' of %s must be true or false, was %q", service.ObjectMeta.Name, annotation)
+	}
+
+	return allNodes, nil
+}
+
+// ServiceOwner returns the ownership marker for records created on behalf of
+// the given service in this cluster.
+func ServiceOwner(service v1.Service) string {
+	return fmt.Sprintf("%s,cluster=%s,service=%s", ownerHeritage, clusterID, ServiceKey(service))
+}
+
+// ClusterOwnerPrefix returns the prefix shared by the ownership markers of the
+// records created on behalf of any service in this cluster.
+func ClusterOwnerPrefix() string {
+	return fmt.Sprintf("%s,cluster=%s,", ownerHeritage, clusterID)
+}
+
+// ServiceKey returns the namespace/name key identifying the given service.
+func ServiceKey(service v1.Service) string {
+	return fmt.Sprintf("%s/%s", service.ObjectMeta.Namespace, service.ObjectMeta.Name)
+}
@@ -2,24 +2,92 @@ package main
 
 import (
 	"errors"
+	"reflect"
 	"testing"
 
 	"k8s.io/client-go/1.4/pkg/api/v1"
 )
 
-func TestServiceHostname(t *testing.T) {
+func TestServiceTargets(t *testing.T) {
+	scenarios := []struct {
+		service v1.Service
+
+		expectedRecordType string
+		expectedTargets    []string
+		expectedError      error
+	}{
+		// ExternalName service
+		{
+			service: v1.Service{
+				Spec: v1.ServiceSpec{
+					Type:         v1.ServiceTypeExternalName,
+					ExternalName: "API.saas.example.net.",
+				},
+			},
+
+			expectedRecordType: "CNAME",
+			expectedTargets:    []string{"api.saas.example.net"},
+			expectedError:      nil,
+		},
+
+		// ExternalName service without external name
+		{
+			service: v1.Service{
+				Spec: v1.ServiceSpec{
+					Type: v1.ServiceTypeExternalName,
+				},
+			},
+
+			expectedError: errors.New("No external name defined for service"),
+		},
+
+		// LoadBalancer service
+		{
+			service: v1.Service{
+				Spec: v1.ServiceSpec{
+					Type: v1.ServiceTypeLoadBalancer,
+				},
+				Status: v1.ServiceStatus{
+					LoadBalancer: v1.LoadBalancerStatus{
+						Ingress: []v1.LoadBalancerIngress{
+							v1.LoadBalancerIngress{
+								Hostname: "elb.hostname.amazonaws.com",
+							},
+						},
+					},
+				},
+			},
+
+			expectedRecordType: "CNAME",
+			expectedTargets:    []string{"elb.hostname.amazonaws.com"},
+			expectedError:      nil,
+		},
+	}
+
+	for _, scenario := range scenarios {
+		recordType, targets, err := ServiceTargets(KubernetesClientDummy{t: t}, scenario.service)
+
+		if !reflect.DeepEqual(err, scenario.expectedError) {
+			t.Errorf("Expected error to be '%v', was '%v'", scenario.expectedError, err)
+		} else if recordType != scenario.expectedRecordType || !reflect.DeepEqual(targets, scenario.expectedTargets) {
+			t.Errorf("Expected targets to be %s '%v', was %s '%v'", scenario.expectedRecordType, scenario.expectedTargets, recordType, targets)
+		}
+	}
+}
+
+func TestServiceIngressTargets(t *testing.T) {
 	scenarios := []struct {
 		ingress []v1.LoadBalancerIngress
 
-		expectedHostname string
-		expectedError    error
+		expectedRecordType string
+		expectedTargets    []string
+		expectedError      error
 	}{
-		// No ingress hostnames
+		// No ingress
 		{
 			ingress: []v1.LoadBalancerIngress{},
 
-			expectedHostname: "",
-			expectedError:    errors.New("No ingress defined for ELB"),
+			expectedError: errors.New("No ingress defined for load balancer"),
 		},
 
 		// One ingress hostname
@@ -30,19 +98,101 @@ func TestServiceHostname(t *testing.T) {
 				},
 			},
 
-			expectedHostname: "elb.hostname.amazonaws.com",
-			expectedError:    nil,
+			expectedRecordType: "CNAME",
+			expectedTargets:    []string{"elb.hostname.amazonaws.com"},
+			expectedError:      nil,
 		},
 
-		// Multiple ingress hostnames
+		// One ingress IP
+		{
+			ingress: []v1.LoadBalancerIngress{
+				v1.LoadBalancerIngress{
+					IP: "203.0.113.10",
+				},
+			},
+
+			expectedRecordType: "A",
+			expectedTargets:    []string{"203.0.113.10"},
+			expectedError:      nil,
+		},
+
+		// One ingress IPv6 address
+		{
+			ingress: []v1.LoadBalancerIngress{
+				v1.LoadBalancerIngress{
+					IP: "2001:DB8:0:0::10",
+				},
+			},
+
+			expectedRecordType: "AAAA",
+			expectedTargets:    []string{"2001:db8::10"},
+			expectedError:      nil,
+		},
+
+		// Invalid ingress IP
+		{
+			ingress: []v1.LoadBalancerIngress{
+				v1.LoadBalancerIngress{
+					IP: "203.0.113",
+				},
+			},
+
+			expectedError: errors.New("Ingress IP 203.0.113 is invalid"),
+		},
+
+		// Ingress without hostname nor IP
 		{
 			ingress: []v1.LoadBalancerIngress{
 				v1.LoadBalancerIngress{},
-				v1.LoadBalancerIngress{},
 			},
 
-			expectedHostname: "",
-			expectedError:    errors.New("Multiple ingress points found for ELB not supported"),
+			expectedError: errors.New("Ingress defines neither a hostname nor an IP"),
+		},
+
+		// Multiple ingress hostnames
+		{
+			ingress: []v1.LoadBalancerIngress{
+				v1.LoadBalancerIngress{
+					Hostname: "second.hostname.amazonaws.com",
+				},
+				v1.LoadBalancerIngress{
+					Hostname: "first.hostname.amazonaws.com",
+				},
+			},
+
+			expectedRecordType: "CNAME",
+			expectedTargets:    []string{"first.hostname.amazonaws.com", "second.hostname.amazonaws.com"},
+			expectedError:      nil,
+		},
+
+		// Dual-stack ingress IPs
+		{
+			ingress: []v1.LoadBalancerIngress{
+				v1.LoadBalancerIngress{
+					IP: "2001:db8::10",
+				},
+				v1.LoadBalancerIngress{
+					IP: "203.0.113.10",
+				},
+			},
+
+			expectedRecordType: "A",
+			expectedTargets:    []string{"2001:db8::10", "203.0.113.10"},
+			expectedError:      nil,
+		},
+
+		// Ingress hostnames and IPs mixed together
+		{
+			ingress: []v1.LoadBalancerIngress{
+				v1.LoadBalancerIngress{
+					Hostname: "elb.hostname.amazonaws.com",
+				},
+				v1.LoadBalancerIngress{
+					IP: "203.0.113.10",
+				},
+			},
+
+			expectedError: errors.New("Ingress points mixing hostnames and IPs not supported"),
 		},
 	}
 
@@ -55,12 +205,12 @@ func TestServiceHostname(t *testing.T) {
 			},
 		}
 
-		hostname, err := ServiceIngressHostname(service)
+		recordType, targets, err := ServiceIngressTargets(service)
 
-		if err != nil && err.Error() != scenario.expectedError.Error() {
+		if !reflect.DeepEqual(err, scenario.expectedError) {
 			t.Errorf("Expected error to be '%v', was '%v'", scenario.expectedError, err)
-		} else if hostname != scenario.expectedHostname {
-			t.Errorf("Expected hostname to be '%v', was '%v'", scenario.expectedHostname, hostname)
+		} else if recordType != scenario.expectedRecordType || !reflect.DeepEqual(targets, scenario.expectedTargets) {
+			t.Errorf("Expected targets to be %s '%v', was %s '%v'", scenario.expectedRecordType, scenario.expectedTargets, recordType, targets)
 		}
 	}
 }
@@ -122,3 +272,187 @@ func TestServiceDomainNames(t *testing.T) {
 		}
 	}
 }
+
+func TestServiceProxied(t *testing.T) {
+	scenarios := []struct {
+		annotations map[string]string
+
+		expectedProxied bool
+		expectedError   error
+	}{
+		{
+			annotations: map[string]string{},
+
+			expectedProxied: false,
+		},
+		{
+			annotations: map[string]string{"cloudflareProxied": "true"},
+
+			expectedProxied: true,
+		},
+		{
+			annotations: map[string]string{"cloudflareProxied": "yes"},
+
+			expectedError: errors.New(`Annotation 'cloudflareProxied' of service must be true or false, was "yes"`),
+		},
+	}
+
+	for _, scenario := range scenarios {
+		service := v1.Service{
+			ObjectMeta: v1.ObjectMeta{
+				Name:        "service",
+				Annotations: scenario.annotations,
+			},
+		}
+
+		proxied, err := ServiceProxied(service)
+
+		if !reflect.DeepEqual(err, scenario.expectedError) {
+			t.Errorf("Expected error to be '%v', was '%v'", scenario.expectedError, err)
+		} else if proxied != scenario.expectedProxied {
+			t.Errorf("Expected proxied to be %v, was %v", scenario.expectedProxied, proxied)
+		}
+	}
+}
+
+func testNode(name string, ready, unschedulable bool, addresses ...v1.NodeAddress) v1.Node {
+	status := v1.ConditionFalse
+	if ready {
+		status = v1.ConditionTrue
+	}
+
+	return v1.Node{
+		ObjectMeta: v1.ObjectMeta{Name: name},
+		Spec:       v1.NodeSpec{Unschedulable: unschedulable},
+		Status: v1.NodeStatus{
+			Conditions: []v1.NodeCondition{v1.NodeCondition{Type: v1.NodeReady, Status: status}},
+			Addresses:  addresses,
+		},
+	}
+}
+
+func testNodeName(name string) *string {
+	return &name
+}
+
+func TestServiceNodeTargets(t *testing.T) {
+	nodes := []v1.Node{
+		testNode("node-a", true, false,
+			v1.NodeAddress{Type: v1.NodeInternalIP, Address: "10.0.0.1"},
+			v1.NodeAddress{Type: v1.NodeExternalIP, Address: "203.0.113.1"},
+		),
+		testNode("node-b", true, false, v1.NodeAddress{Type: v1.NodeInternalIP, Address: "10.0.0.2"}),
+		testNode("node-c", false, false, v1.NodeAddress{Type: v1.NodeExternalIP, Address: "203.0.113.3"}),
+		testNode("node-d", true, true, v1.NodeAddress{Type: v1.NodeExternalIP, Address: "203.0.113.4"}),
+		testNode("node-e", true, false, v1.NodeAddress{Type: v1.NodeExternalIP, Address: "2001:db8::5"}),
+	}
+
+	endpoints := &v1.Endpoints{
+		Subsets: []v1.EndpointSubset{
+			v1.EndpointSubset{
+				Addresses: []v1.EndpointAddress{
+					v1.EndpointAddress{IP: "172.16.0.1", NodeName: testNodeName("node-a")},
+					v1.EndpointAddress{IP: "172.16.0.2", NodeName: testNodeName("node-c")},
+					v1.EndpointAddress{IP: "172.16.0.4"},
+				},
+				NotReadyAddresses: []v1.EndpointAddress{
+					v1.EndpointAddress{IP: "172.16.0.3", NodeName: testNodeName("node-b")},
+				},
+			},
+		},
+	}
+
+	scenarios := []struct {
+		annotations        map[string]string
+		getNodesError      error
+		getEndpointsOutput *v1.Endpoints
+
+		expectedRecordType string
+		expectedTargets    []string
+		expectedError      error
+	}{
+		// Nodes hosting ready pods, unless not ready themselves
+		{
+			getEndpointsOutput: endpoints,
+
+			expectedRecordType: "A",
+			expectedTargets:    []string{"203.0.113.1"},
+		},
+
+		// Every ready and schedulable node, by internal IP if they have no external one
+		{
+			annotations:        map[string]string{"nodePortAllNodes": "true"},
+			getEndpointsOutput: endpoints,
+
+			expectedRecordType: "A",
+			expectedTargets:    []string{"10.0.0.2", "2001:db8::5", "203.0.113.1"},
+		},
+
+		// No ready pod
+		{
+			getEndpointsOutput: &v1.Endpoints{},
+
+			expectedError: errors.New("No ready node found for NodePort service"),
+		},
+
+		// Nodes not listed
+		{
+			annotations:   map[string]string{"nodePortAllNodes": "true"},
+			getNodesError: errors.New("error"),
+
+			expectedError: errors.New("Could not list nodes: error"),
+		},
+
+		// Invalid annotation
+		{
+			annotations: map[string]string{"nodePortAllNodes": "yes"},
+
+			expectedError: errors.New(`Annotation 'nodePortAllNodes' of service must be true or false, was "yes"`),
+		},
+	}
+
+	for _, scenario := range scenarios {
+		service := v1.Service{
+			ObjectMeta: v1.ObjectMeta{
+				Name:        "service",
+				Annotations: scenario.annotations,
+			},
+			Spec: v1.ServiceSpec{
+				Type:     v1.ServiceTypeNodePort,
+				Selector: map[string]string{"app": "service"},
+			},
+		}
+
+		kubernetesClient := KubernetesClientDummy{
+			t: t,
+
+			getNodesOutput: nodes,
+			getNodesError:  scenario.getNodesError,
+
+			getEndpointsOutput: scenario.getEndpointsOutput,
+		}
+
+		recordType, targets, err := ServiceNodeTargets(kubernetesClient, service)
+
+		if !reflect.DeepEqual(err, scenario.expectedError) {
+			t.Errorf("Expected error to be '%v', was '%v'", scenario.expectedError, err)
+		} else if recordType != scenario.expectedRecordType || !reflect.DeepEqual(targets, scenario.expectedTargets) {
+			t.Errorf("Expected targets to be %s '%v', was %s '%v'", scenario.expectedRecordType, scenario.expectedTargets, recordType, targets)
+		}
+	}
+}
+
+func TestServiceOwner(t *testing.T) {
+	service := v1.Service{
+		ObjectMeta: v1.ObjectMeta{
+			Name:      "service",
+			Namespace: "default",
+		},
+	}
+
+	expectedOwner := "heritage=kubernetes-service-dns-update,cluster=default,service=default/service"
+
+	if owner := ServiceOwner(service); owner != expectedOwner {
+		t.Errorf("Expected owner to be '%s', was '%s'", expectedOwner, owner)
+	}
+}
@@ -12,13 +12,72 @@ import (
 var (
 	dryRun       = false
 	namespace    = ""
+	clusterID    = "default"
 	syncInterval = 30
+	providerName = "route53"
+	recordTTL    = int64(defaultTTL)
+
+	zoneCacheTTL         = 3600
+	loadBalancerCacheTTL = 3600
+	negativeCacheTTL     = 60
+
+	googleProject = ""
+
+	azureConfigFile     = "/etc/kubernetes/azure.json"
+	azureSubscriptionID = ""
+	azureResourceGroup  = ""
+
+	rfc2136Server         = ""
+	rfc2136TSIGKeyName    = ""
+	rfc2136TSIGAlgorithm  = "hmac-sha256"
+	rfc2136TSIGSecret     = ""
+	rfc2136TSIGSecretFile = ""
+	rfc2136Zones          = ""
+
+	coreDNSEtcdURL = "http://127.0.0.1:2379"
+	coreDNSPrefix  = "/skydns"
+
+	powerDNSURL      = ""
+	powerDNSServerID = "localhost"
+
+	zoneFileDir        = ""
+	zoneFileZones      = ""
+	zoneFileNameserver = ""
+
+	webhookURL = ""
+
+	embeddedDNSAddr = ":5353"
 )
 
 func main() {
 	flag.BoolVar(&dryRun, "dry-run", dryRun, "Don't actually commit the changes to DNS records, just print out what we would have done.")
-	flag.IntVar(&syncInterval, "sync-interval", syncInterval, "Sync interval in seconds.")
+	flag.IntVar(&syncInterval, "sync-interval", syncInterval, "Full resync interval in seconds.")
 	flag.StringVar(&namespace, "namespace", namespace, "Namespace to be monitored.")
+	flag.StringVar(&providerName, "provider", providerName, "DNS provider to keep the records in (route53, google, azure, cloudflare, rfc2136, coredns, pdns, zonefile, webhook, embedded).")
+	flag.Int64Var(&recordTTL, "record-ttl", recordTTL, "TTL of the records pointing to the load balancers, in seconds (Route53 alias records have none).")
+	flag.IntVar(&zoneCacheTTL, "zone-cache-ttl", zoneCacheTTL, "How long to remember the hosted zone of each domain, in seconds.")
+	flag.IntVar(&loadBalancerCacheTTL, "elb-cache-ttl", loadBalancerCacheTTL, "How long to remember the hosted zone of each load balancer, in seconds.")
+	flag.IntVar(&negativeCacheTTL, "negative-cache-ttl", negativeCacheTTL, "How long to remember that no hosted zone matches a domain, in seconds.")
+	flag.StringVar(&googleProject, "google-project", googleProject, "Google Cloud project of the Cloud DNS managed zones (defaults to the project of the instance).")
+	flag.StringVar(&azureConfigFile, "azure-config", azureConfigFile, "Azure credentials file, in the format of the azure.json file of AKS nodes.")
+	flag.StringVar(&azureSubscriptionID, "azure-subscription-id", azureSubscriptionID, "Azure subscription of the DNS zones (defaults to the one in the credentials file).")
+	flag.StringVar(&azureResourceGroup, "azure-resource-group", azureResourceGroup, "Azure resource group of the DNS zones (defaults to the one in the credentials file).")
+	flag.StringVar(&rfc2136Server, "rfc2136-server", rfc2136Server, "Address of the DNS server to send RFC 2136 updates to (host[:port]).")
+	flag.StringVar(&rfc2136TSIGKeyName, "rfc2136-tsig-key-name", rfc2136TSIGKeyName, "Name of the TSIG key signing the updates, if any.")
+	flag.StringVar(&rfc2136TSIGAlgorithm, "rfc2136-tsig-algorithm", rfc2136TSIGAlgorithm, "Algorithm of the TSIG key (hmac-md5, hmac-sha1, hmac-sha256 or hmac-sha512).")
+	flag.StringVar(&rfc2136TSIGSecret, "rfc2136-tsig-secret", rfc2136TSIGSecret, "Kubernetes secret holding the base64 TSIG secret under its 'secret' key, as namespace/name.")
+	flag.StringVar(&rfc2136TSIGSecretFile, "rfc2136-tsig-secret-file", rfc2136TSIGSecretFile, "File holding the base64 TSIG secret (i.e. a mounted secret).")
+	flag.StringVar(&rfc2136Zones, "rfc2136-zones", rfc2136Zones, "Comma-separated list of the zones to transfer (AXFR) at startup, to find the records left by an earlier run.")
+	flag.StringVar(&coreDNSEtcdURL, "coredns-etcd-url", coreDNSEtcdURL, "URL of the etcd cluster read by the etcd plugin of CoreDNS.")
+	flag.StringVar(&coreDNSPrefix, "coredns-prefix", coreDNSPrefix, "Path prefix of the SkyDNS keys, as given to the etcd plugin of CoreDNS.")
+	flag.StringVar(&powerDNSURL, "pdns-url", powerDNSURL, "URL of the HTTP API of the PowerDNS Authoritative server (i.e. http://pdns:8081).")
+	flag.StringVar(&powerDNSServerID, "pdns-server-id", powerDNSServerID, "ID of the PowerDNS server holding the zones, as known to its HTTP API.")
+	flag.StringVar(&zoneFileDir, "zonefile-dir", zoneFileDir, "Directory to write the zone files to.")
+	flag.StringVar(&zoneFileZones, "zonefile-zones", zoneFileZones, "Comma-separated list of the zones to write files for.")
+	flag.StringVar(&zoneFileNameserver, "zonefile-nameserver", zoneFileNameserver, "Primary nameserver of the zones created from scratch (defaults to ns1 in the zone).")
+	flag.StringVar(&webhookURL, "webhook-url", webhookURL, "URL of the webhook keeping the records in a custom DNS backend (i.e. http://localhost:8888).")
+	flag.StringVar(&embeddedDNSAddr, "embedded-dns-addr", embeddedDNSAddr, "Address to serve the records on with the embedded DNS server, over UDP and TCP.")
+	flag.StringVar(&clusterID, "cluster-id", clusterID, "Identifier of this cluster, stored in the ownership marker of every record it manages.")
 
 	flag.Parse()
 
@@ -27,7 +86,7 @@ func main() {
 	doneChan := make(chan struct{})
 	var wg sync.WaitGroup
 
-	log.Printf("Watching services in '%s' namespace (every %d secs).\n", namespace, syncInterval)
+	log.Printf("Watching services in '%s' namespace (full resync every %d secs).\n", namespace, syncInterval)
 	wg.Add(1)
 
 	WatchServices(syncInterval, doneChan, &wg)
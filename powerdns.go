@@ -0,0 +1,330 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+type powerDNSZone struct {
+	ID     string          `json:"id"`
+	Name   string          `json:"name"`
+	RRSets []powerDNSRRSet `json:"rrsets,omitempty"`
+}
+
+type powerDNSRecord struct {
+	Content  string `json:"content"`
+	Disabled bool   `json:"disabled"`
+}
+
+type powerDNSRRSet struct {
+	Name       string           `json:"name"`
+	Type       string           `json:"type"`
+	TTL        int64            `json:"ttl,omitempty"`
+	ChangeType string           `json:"changetype,omitempty"`
+	Records    []powerDNSRecord `json:"records"`
+}
+
+type powerDNSPatch struct {
+	RRSets []powerDNSRRSet `json:"rrsets"`
+}
+
+// PowerDNSProvider keeps endpoints as RRsets in the zones of a PowerDNS
+// Authoritative server, through its HTTP API.
+type PowerDNSProvider struct {
+	client   *http.Client
+	apiURL   string
+	serverID string
+	apiKey   string
+	now      func() time.Time
+
+	zones     []powerDNSZone
+	zoneCache zoneCache
+}
+
+func NewPowerDNSProvider() (*PowerDNSProvider, error) {
+	if powerDNSURL == "" {
+		return nil, errors.New("PowerDNS API URL must be set with -pdns-url")
+	}
+
+	apiKey := os.Getenv("PDNS_API_KEY")
+	if apiKey == "" {
+		return nil, errors.New("PowerDNS API key must be set in PDNS_API_KEY")
+	}
+
+	return &PowerDNSProvider{
+		client:    &http.Client{Timeout: httpTimeout},
+		apiURL:    strings.TrimSuffix(powerDNSURL, "/") + "/api/v1",
+		serverID:  powerDNSServerID,
+		apiKey:    apiKey,
+		now:       time.Now,
+		zoneCache: zoneCache{ttl: time.Duration(zoneCacheTTL) * time.Second},
+	}, nil
+}
+
+func (p *PowerDNSProvider) GetOwner(dnsName string) (string, bool, error) {
+	zone, err := p.zone(dnsName)
+	if err != nil {
+		return "", false, err
+	}
+
+	rrsets, err := p.endpointRRSets(zone, dnsName)
+	if err != nil {
+		return "", false, err
+	}
+
+	exists := false
+	owner := ""
+
+	for _, rrset := range rrsets {
+		if rrset.Type == "TXT" {
+			owner = ownerFromTXT(powerDNSContents(rrset))
+		} else {
+			exists = true
+		}
+	}
+
+	return owner, exists, nil
+}
+
+// ApplyChanges sends one PATCH per endpoint, replacing the RRsets currently
+// stored for its name with the desired ones.
+func (p *PowerDNSProvider) ApplyChanges(changes []DNSChange) []error {
+	errs := make([]error, len(changes))
+
+	for i, change := range changes {
+		errs[i] = p.applyChange(change)
+	}
+
+	return errs
+}
+
+func (p *PowerDNSProvider) applyChange(change DNSChange) error {
+	dnsName := change.Endpoint.DNSName
+
+	zone, err := p.zone(dnsName)
+	if err != nil {
+		return err
+	}
+
+	current, err := p.endpointRRSets(zone, dnsName)
+	if err != nil {
+		return err
+	}
+
+	var desired []powerDNSRRSet
+	if change.Action != "DELETE" {
+		records, err := endpointRecords(change.Endpoint)
+		if err != nil {
+			return err
+		}
+
+		for _, record := range records {
+			desired = append(desired, powerDNSRRSetFromRecord(record))
+		}
+	}
+
+	patch := powerDNSRRSetChanges(current, desired)
+
+	if len(patch.RRSets) == 0 {
+		logRecordUpToDate(dnsName, zone.Name)
+		return nil
+	}
+
+	if dryRun {
+		logDryRunChange(change.Action, dnsName, zone.Name, change.Endpoint.Targets)
+		return nil
+	}
+
+	if err := p.do("PATCH", p.zoneURL(zone), patch, nil); err != nil {
+		return fmt.Errorf("Could not update RRsets of %s: %v", dnsName, err)
+	}
+
+	return nil
+}
+
+func (p *PowerDNSProvider) ListEndpoints(dnsNames []string) ([]Endpoint, error) {
+	indexes, err := p.zoneCache.zonesOf(dnsNames, p.now(), p.zoneNames)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []DNSRecord
+	for _, i := range indexes {
+		zone := p.zones[i]
+		var zoneWithRRSets powerDNSZone
+		if err := p.do("GET", p.zoneURL(zone), nil, &zoneWithRRSets); err != nil {
+			return nil, fmt.Errorf("Could not list RRsets for %s: %v", zone.Name, err)
+		}
+
+		for _, rrset := range zoneWithRRSets.RRSets {
+			values := powerDNSContents(rrset)
+			if rrset.Type == "CNAME" {
+				for i, value := range values {
+					values[i] = strings.TrimSuffix(value, ".")
+				}
+			}
+
+			records = append(records, DNSRecord{Name: rrset.Name, Type: rrset.Type, TTL: rrset.TTL, Values: values})
+		}
+	}
+
+	return ownedEndpoints(records), nil
+}
+
+// zone returns the most specific zone the given name belongs to.
+func (p *PowerDNSProvider) zone(dnsName string) (powerDNSZone, error) {
+	i, err := p.zoneCache.find(dnsName, p.now(), p.zoneNames)
+	if err != nil {
+		return powerDNSZone{}, err
+	}
+
+	if i < 0 {
+		return powerDNSZone{}, fmt.Errorf("No zone matches domain %s", dnsName)
+	}
+
+	return p.zones[i], nil
+}
+
+// zoneNames lists the zones for the zone cache, whose indexes point into
+// p.zones.
+func (p *PowerDNSProvider) zoneNames() ([]string, error) {
+	var zones []powerDNSZone
+	if err := p.do("GET", p.serverURL()+"/zones", nil, &zones); err != nil {
+		return nil, fmt.Errorf("Could not list zones: %v", err)
+	}
+
+	p.zones = zones
+
+	names := make([]string, len(zones))
+	for i, zone := range zones {
+		names[i] = zone.Name
+	}
+	return names, nil
+}
+
+// endpointRRSets returns the address RRsets stored for the given name, along
+// with its TXT ownership RRset.
+func (p *PowerDNSProvider) endpointRRSets(zone powerDNSZone, dnsName string) ([]powerDNSRRSet, error) {
+	rrsets, err := p.rrsets(zone, dnsName, addressRecordTypes)
+	if err != nil {
+		return nil, err
+	}
+
+	ownerRRSets, err := p.rrsets(zone, ownerRecordName(dnsName), []string{"TXT"})
+	if err != nil {
+		return nil, err
+	}
+
+	return append(rrsets, ownerRRSets...), nil
+}
+
+// rrsets returns the RRsets of the given types stored for a name. Servers older
+// than 4.5 ignore the rrset_name filter and return the whole zone, hence the
+// names are checked here too.
+func (p *PowerDNSProvider) rrsets(zone powerDNSZone, dnsName string, recordTypes []string) ([]powerDNSRRSet, error) {
+	name := domainWithTrailingDot(strings.ToLower(dnsName))
+
+	query := url.Values{}
+	query.Set("rrset_name", name)
+
+	var zoneWithRRSets powerDNSZone
+	if err := p.do("GET", p.zoneURL(zone)+"?"+query.Encode(), nil, &zoneWithRRSets); err != nil {
+		return nil, fmt.Errorf("Could not list RRsets for %s: %v", zone.Name, err)
+	}
+
+	rrsets := []powerDNSRRSet{}
+	for _, rrset := range zoneWithRRSets.RRSets {
+		if strings.EqualFold(rrset.Name, name) && containsString(recordTypes, rrset.Type) {
+			rrsets = append(rrsets, rrset)
+		}
+	}
+
+	return rrsets, nil
+}
+
+func (p *PowerDNSProvider) serverURL() string {
+	return fmt.Sprintf("%s/servers/%s", p.apiURL, pathEscape(p.serverID))
+}
+
+func (p *PowerDNSProvider) zoneURL(zone powerDNSZone) string {
+	return fmt.Sprintf("%s/zones/%s", p.serverURL(), pathEscape(zone.ID))
+}
+
+func (p *PowerDNSProvider) do(method, url string, in, out interface{}) error {
+	header := http.Header{}
+	header.Set("X-API-Key", p.apiKey)
+
+	return doJSON(p.client, method, url, header, in, out)
+}
+
+// powerDNSRRSetFromRecord converts the given record to the format stored by
+// PowerDNS, where names and hostnames are fully qualified.
+func powerDNSRRSetFromRecord(record DNSRecord) powerDNSRRSet {
+	records := make([]powerDNSRecord, len(record.Values))
+	for i, value := range record.Values {
+		if record.Type == "CNAME" {
+			value = domainWithTrailingDot(value)
+		}
+		records[i] = powerDNSRecord{Content: value}
+	}
+
+	return powerDNSRRSet{
+		Name:    domainWithTrailingDot(strings.ToLower(record.Name)),
+		Type:    record.Type,
+		TTL:     record.TTL,
+		Records: records,
+	}
+}
+
+// powerDNSRRSetChanges returns the patch turning the current RRsets into the
+// desired ones. Deletions go first, since a CNAME RRset cannot be added
+// alongside the RRsets it replaces.
+func powerDNSRRSetChanges(current, desired []powerDNSRRSet) powerDNSPatch {
+	patch := powerDNSPatch{}
+
+	for _, rrset := range current {
+		if findPowerDNSRRSet(desired, rrset) < 0 {
+			patch.RRSets = append(patch.RRSets, powerDNSRRSet{
+				Name:       rrset.Name,
+				Type:       rrset.Type,
+				ChangeType: "DELETE",
+				Records:    []powerDNSRecord{},
+			})
+		}
+	}
+
+	for _, rrset := range desired {
+		i := findPowerDNSRRSet(current, rrset)
+		if i >= 0 && current[i].TTL == rrset.TTL && sameStrings(powerDNSContents(current[i]), powerDNSContents(rrset)) {
+			continue
+		}
+
+		rrset.ChangeType = "REPLACE"
+		patch.RRSets = append(patch.RRSets, rrset)
+	}
+
+	return patch
+}
+
+func findPowerDNSRRSet(rrsets []powerDNSRRSet, rrset powerDNSRRSet) int {
+	for i, other := range rrsets {
+		if strings.EqualFold(other.Name, rrset.Name) && other.Type == rrset.Type {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func powerDNSContents(rrset powerDNSRRSet) []string {
+	contents := make([]string, len(rrset.Records))
+	for i, record := range rrset.Records {
+		contents[i] = record.Content
+	}
+	return contents
+}
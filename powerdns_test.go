@@ -0,0 +1,308 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testPowerDNSOwner = "heritage=kubernetes-service-dns-update,cluster=default,service=/service"
+
+// FakePowerDNS serves the subset of the PowerDNS HTTP API used by the PowerDNS
+// provider for the server "localhost", recording the patches it receives.
+type FakePowerDNS struct {
+	t *testing.T
+
+	zones   []powerDNSZone
+	patches map[string][]powerDNSPatch
+}
+
+func (f *FakePowerDNS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("X-API-Key") != "key" {
+		http.Error(w, `{"error":"Unauthorized"}`, http.StatusUnauthorized)
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/api/v1/servers/localhost")
+	if path == r.URL.Path {
+		http.NotFound(w, r)
+		return
+	}
+
+	if path == "/zones" && r.Method == "GET" {
+		var zones []powerDNSZone
+		for _, zone := range f.zones {
+			zones = append(zones, powerDNSZone{ID: zone.ID, Name: zone.Name})
+		}
+		json.NewEncoder(w).Encode(zones)
+		return
+	}
+
+	for _, zone := range f.zones {
+		if path != "/zones/"+zone.ID {
+			continue
+		}
+
+		switch r.Method {
+		case "GET":
+			// Like servers older than 4.5, the rrset_name filter is ignored
+			json.NewEncoder(w).Encode(zone)
+		case "PATCH":
+			var patch powerDNSPatch
+			if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+				f.t.Errorf("Could not decode patch: %v", err)
+			}
+			f.patches[zone.ID] = append(f.patches[zone.ID], patch)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, `{"error":"Method not allowed"}`, http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	http.Error(w, `{"error":"Could not find domain"}`, http.StatusNotFound)
+}
+
+func testPowerDNSProvider(fake *FakePowerDNS) (*PowerDNSProvider, func()) {
+	serverURL, client, closeServer := testHTTPServer(fake)
+
+	provider := &PowerDNSProvider{
+		client:    client,
+		apiURL:    serverURL + "/api/v1",
+		serverID:  "localhost",
+		apiKey:    "key",
+		now:       time.Now,
+		zoneCache: zoneCache{ttl: time.Hour},
+	}
+
+	return provider, closeServer
+}
+
+func testPowerDNSZones(rrsets []powerDNSRRSet) []powerDNSZone {
+	return []powerDNSZone{
+		powerDNSZone{ID: "domain.com.", Name: "domain.com.", RRSets: rrsets},
+		powerDNSZone{ID: "sub.domain.com.", Name: "sub.domain.com."},
+	}
+}
+
+func TestPowerDNSProviderGetOwner(t *testing.T) {
+	scenarios := []struct {
+		dnsName string
+		rrsets  []powerDNSRRSet
+
+		expectedOwner  string
+		expectedExists bool
+		expectedError  error
+	}{
+		// No zone for the domain
+		{
+			dnsName: "some.example.com",
+
+			expectedError: errors.New("No zone matches domain some.example.com"),
+		},
+
+		// No records for the name, only for others in the zone
+		{
+			dnsName: "some.domain.com",
+			rrsets: []powerDNSRRSet{
+				powerDNSRRSet{Name: "other.domain.com.", Type: "A", TTL: 300, Records: []powerDNSRecord{powerDNSRecord{Content: "203.0.113.10"}}},
+			},
+		},
+
+		// Record not owned by anybody
+		{
+			dnsName: "some.domain.com",
+			rrsets: []powerDNSRRSet{
+				powerDNSRRSet{Name: "some.domain.com.", Type: "CNAME", TTL: 300, Records: []powerDNSRecord{powerDNSRecord{Content: "other.domain.com."}}},
+				powerDNSRRSet{Name: "some.domain.com.", Type: "MX", TTL: 300, Records: []powerDNSRecord{powerDNSRecord{Content: "10 mail.domain.com."}}},
+			},
+
+			expectedExists: true,
+		},
+
+		// Owned record
+		{
+			dnsName: "Some.Domain.com",
+			rrsets: []powerDNSRRSet{
+				powerDNSRRSet{Name: "some.domain.com.", Type: "A", TTL: 300, Records: []powerDNSRecord{powerDNSRecord{Content: "203.0.113.10"}}},
+				powerDNSRRSet{Name: "_owner.some.domain.com.", Type: "TXT", TTL: 300, Records: []powerDNSRecord{powerDNSRecord{Content: `"` + testPowerDNSOwner + `"`}}},
+			},
+
+			expectedOwner:  testPowerDNSOwner,
+			expectedExists: true,
+		},
+	}
+
+	for _, scenario := range scenarios {
+		fake := &FakePowerDNS{t: t, zones: testPowerDNSZones(scenario.rrsets)}
+		provider, closeServer := testPowerDNSProvider(fake)
+
+		owner, exists, err := provider.GetOwner(scenario.dnsName)
+
+		if !reflect.DeepEqual(err, scenario.expectedError) {
+			t.Errorf("Expected error to be '%v', was '%v'", scenario.expectedError, err)
+		}
+
+		if owner != scenario.expectedOwner || exists != scenario.expectedExists {
+			t.Errorf("Expected owner of %s to be '%s' (%v), was '%s' (%v)", scenario.dnsName, scenario.expectedOwner, scenario.expectedExists, owner, exists)
+		}
+
+		closeServer()
+	}
+}
+
+func TestPowerDNSProviderApplyChanges(t *testing.T) {
+	endpoint := Endpoint{
+		DNSName:    "some.domain.com",
+		RecordType: "A",
+		Targets:    []string{"203.0.113.10"},
+		Owner:      testPowerDNSOwner,
+	}
+
+	address := powerDNSRRSet{Name: "some.domain.com.", Type: "A", TTL: 300, Records: []powerDNSRecord{powerDNSRecord{Content: "203.0.113.10"}}}
+	txt := powerDNSRRSet{Name: "_owner.some.domain.com.", Type: "TXT", TTL: 300, Records: []powerDNSRecord{powerDNSRecord{Content: `"` + testPowerDNSOwner + `"`}}}
+	staleAddress := powerDNSRRSet{Name: "some.domain.com.", Type: "CNAME", TTL: 300, Records: []powerDNSRecord{powerDNSRecord{Content: "lb.hostname.example.net."}}}
+
+	replace := func(rrset powerDNSRRSet) powerDNSRRSet {
+		rrset.ChangeType = "REPLACE"
+		return rrset
+	}
+
+	remove := func(rrset powerDNSRRSet) powerDNSRRSet {
+		return powerDNSRRSet{Name: rrset.Name, Type: rrset.Type, ChangeType: "DELETE", Records: []powerDNSRecord{}}
+	}
+
+	scenarios := []struct {
+		description string
+		dryRun      bool
+		changes     []DNSChange
+		rrsets      []powerDNSRRSet
+
+		expectedPatches []powerDNSPatch
+		expectedErrors  []error
+	}{
+		{
+			description: "records are created",
+			changes:     []DNSChange{DNSChange{Action: "UPSERT", Endpoint: endpoint}},
+
+			expectedPatches: []powerDNSPatch{
+				powerDNSPatch{RRSets: []powerDNSRRSet{replace(address), replace(txt)}},
+			},
+			expectedErrors: []error{nil},
+		},
+		{
+			description: "CNAME records are replaced by A records",
+			changes:     []DNSChange{DNSChange{Action: "UPSERT", Endpoint: endpoint}},
+			rrsets:      []powerDNSRRSet{staleAddress, txt},
+
+			expectedPatches: []powerDNSPatch{
+				powerDNSPatch{RRSets: []powerDNSRRSet{remove(staleAddress), replace(address)}},
+			},
+			expectedErrors: []error{nil},
+		},
+		{
+			description: "records already up to date are left alone",
+			changes:     []DNSChange{DNSChange{Action: "UPSERT", Endpoint: endpoint}},
+			rrsets:      []powerDNSRRSet{address, txt},
+
+			expectedErrors: []error{nil},
+		},
+		{
+			description: "records are deleted",
+			changes:     []DNSChange{DNSChange{Action: "DELETE", Endpoint: endpoint}},
+			rrsets:      []powerDNSRRSet{address, txt},
+
+			expectedPatches: []powerDNSPatch{
+				powerDNSPatch{RRSets: []powerDNSRRSet{remove(address), remove(txt)}},
+			},
+			expectedErrors: []error{nil},
+		},
+		{
+			description: "changes are only logged in dry-run mode",
+			dryRun:      true,
+			changes:     []DNSChange{DNSChange{Action: "UPSERT", Endpoint: endpoint}},
+
+			expectedErrors: []error{nil},
+		},
+		{
+			description: "records outside of any zone fail on their own",
+			changes: []DNSChange{
+				DNSChange{Action: "UPSERT", Endpoint: Endpoint{DNSName: "some.example.com", RecordType: "A", Targets: []string{"203.0.113.10"}}},
+				DNSChange{Action: "UPSERT", Endpoint: endpoint},
+			},
+
+			expectedPatches: []powerDNSPatch{
+				powerDNSPatch{RRSets: []powerDNSRRSet{replace(address), replace(txt)}},
+			},
+			expectedErrors: []error{errors.New("No zone matches domain some.example.com"), nil},
+		},
+		{
+			description: "CNAME records with several hostnames are refused",
+			changes:     []DNSChange{DNSChange{Action: "UPSERT", Endpoint: testSeveralHostnamesEndpoint(testPowerDNSOwner)}},
+			rrsets:      []powerDNSRRSet{address, txt},
+
+			expectedErrors: []error{testSeveralHostnamesError},
+		},
+	}
+
+	defer func(dryRunValue bool) { dryRun = dryRunValue }(dryRun)
+
+	for _, scenario := range scenarios {
+		dryRun = scenario.dryRun
+
+		fake := &FakePowerDNS{t: t, zones: testPowerDNSZones(scenario.rrsets), patches: map[string][]powerDNSPatch{}}
+		provider, closeServer := testPowerDNSProvider(fake)
+
+		errs := provider.ApplyChanges(scenario.changes)
+
+		if !reflect.DeepEqual(errs, scenario.expectedErrors) {
+			t.Errorf("Expected errors to be '%v' when %s, was '%v'", scenario.expectedErrors, scenario.description, errs)
+		}
+
+		if patches := fake.patches["domain.com."]; !reflect.DeepEqual(patches, scenario.expectedPatches) {
+			t.Errorf("Expected patches to be '%v' when %s, was '%v'", scenario.expectedPatches, scenario.description, patches)
+		}
+
+		closeServer()
+	}
+}
+
+func TestPowerDNSProviderListEndpoints(t *testing.T) {
+	fake := &FakePowerDNS{t: t, zones: testPowerDNSZones([]powerDNSRRSet{
+		powerDNSRRSet{Name: "domain.com.", Type: "TXT", TTL: 300, Records: []powerDNSRecord{powerDNSRecord{Content: `"v=spf1 -all"`}}},
+		powerDNSRRSet{Name: "some.domain.com.", Type: "CNAME", TTL: 300, Records: []powerDNSRecord{powerDNSRecord{Content: "elb.hostname.amazonaws.com."}}},
+		powerDNSRRSet{Name: "_owner.some.domain.com.", Type: "TXT", TTL: 300, Records: []powerDNSRecord{powerDNSRecord{Content: `"` + testPowerDNSOwner + `"`}}},
+		powerDNSRRSet{Name: "other.domain.com.", Type: "A", TTL: 300, Records: []powerDNSRecord{powerDNSRecord{Content: "203.0.113.20"}}},
+	})}
+	provider, closeServer := testPowerDNSProvider(fake)
+	defer closeServer()
+
+	endpoints, err := provider.ListEndpoints([]string{"some.domain.com"})
+	if err != nil {
+		t.Errorf("Expected no error, was '%v'", err)
+	}
+
+	expected := []Endpoint{
+		Endpoint{DNSName: "some.domain.com", RecordType: "CNAME", Targets: []string{"elb.hostname.amazonaws.com"}, TTL: 300, Owner: testPowerDNSOwner},
+	}
+
+	if !reflect.DeepEqual(endpoints, expected) {
+		t.Errorf("Expected endpoints to be '%v', was '%v'", expected, endpoints)
+	}
+}
+
+func TestPowerDNSProviderUnauthorized(t *testing.T) {
+	fake := &FakePowerDNS{t: t, zones: testPowerDNSZones(nil)}
+	provider, closeServer := testPowerDNSProvider(fake)
+	defer closeServer()
+
+	provider.apiKey = "wrong"
+
+	if _, _, err := provider.GetOwner("some.domain.com"); err == nil || !strings.Contains(err.Error(), "returned status 401") {
+		t.Errorf("Expected an unauthorized error, was '%v'", err)
+	}
+}
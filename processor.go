@@ -3,10 +3,56 @@ package main
 import (
 	"fmt"
 	"log"
+	"sort"
+	"strings"
 	"sync"
 	"time"
+
+	"k8s.io/client-go/1.4/pkg/api/v1"
+	"k8s.io/client-go/1.4/pkg/watch"
 )
 
+const serviceSelector = "dns=route53"
+
+// Delay before re-establishing a failed watch
+var watchRetryDelay = 5 * time.Second
+
+// DNSChange is an UPSERT or DELETE of the records of an endpoint.
+type DNSChange struct {
+	Action   string
+	Endpoint Endpoint
+}
+
+// DNSPlan collects the changes to be applied in a sync, at most one per domain.
+type DNSPlan struct {
+	Changes []DNSChange
+
+	domainNames map[string]bool
+}
+
+func NewDNSPlan() *DNSPlan {
+	return &DNSPlan{
+		domainNames: map[string]bool{},
+	}
+}
+
+// Add plans the change, returning false if the domain already has one.
+func (p *DNSPlan) Add(change DNSChange) bool {
+	if p.domainNames[change.Endpoint.DNSName] {
+		return false
+	}
+
+	p.domainNames[change.Endpoint.DNSName] = true
+	p.Changes = append(p.Changes, change)
+
+	return true
+}
+
+// Planned returns whether the domain already has a change planned.
+func (p *DNSPlan) Planned(domainName string) bool {
+	return p.domainNames[domainName]
+}
+
 func WatchServices(interval int, done chan struct{}, wg *sync.WaitGroup) {
 	go func() {
 		kubernetesClient, err := NewKubernetesClient()
@@ -14,19 +60,65 @@ func WatchServices(interval int, done chan struct{}, wg *sync.WaitGroup) {
 			panic(err.Error())
 		}
 
-		awsClient, err := NewAWSClient()
+		provider, err := NewProvider(providerName, kubernetesClient)
 		if err != nil {
 			panic(err.Error())
 		}
 
+		queue := NewServiceQueue()
+		go WatchServiceEvents(kubernetesClient, queue, done)
+
+		nodesChanged := make(chan struct{}, 1)
+		go WatchNodeEvents(kubernetesClient, nodesChanged, done)
+		go WatchEndpointsEvents(kubernetesClient, nodesChanged, done)
+
+		// Records created before a restart are found again through their
+		// ownership markers, until the provider could be listed once
+		managedRecords := map[string]Endpoint{}
+		err = RecoverManagedRecords(kubernetesClient, provider, managedRecords)
+		if err != nil {
+			log.Println(err)
+		}
+		recovered := err == nil
+
+		resync := time.NewTicker(time.Duration(interval) * time.Second)
+		defer resync.Stop()
+
 		for {
 			select {
-			case <-time.After(time.Duration(interval) * time.Second):
-				err := SyncRoute53DNSRecords(kubernetesClient, awsClient)
+			case <-queue.Ready():
+				for {
+					item, ok := queue.Pop()
+					if !ok {
+						break
+					}
+
+					if item.Deleted {
+						DeleteServiceDNSRecords(item.Service, provider, managedRecords)
+					} else {
+						SyncServiceDNSRecords(kubernetesClient, item.Service, provider, managedRecords)
+					}
+				}
+			case <-nodesChanged:
+				err := SyncNodePortDNSRecords(kubernetesClient, provider, managedRecords)
+				if err != nil {
+					log.Println(err)
+				}
+			case <-resync.C:
+				if !recovered {
+					err := RecoverManagedRecords(kubernetesClient, provider, managedRecords)
+					if err != nil {
+						log.Println(err)
+					}
+					recovered = err == nil
+				}
+
+				err := SyncDNSRecords(kubernetesClient, provider, managedRecords)
 				if err != nil {
 					log.Println(err)
 				}
 			case <-done:
+				closeProvider(provider)
 				wg.Done()
 				log.Println("Stopped DNS update service.")
 				return
@@ -35,52 +127,392 @@ func WatchServices(interval int, done chan struct{}, wg *sync.WaitGroup) {
 	}()
 }
 
-func SyncRoute53DNSRecords(kubernetesClient KubernetesClient, awsClient AWSClient) error {
-	selector := "dns=route53"
+// WatchServiceEvents enqueues every DNS service that is added, modified or
+// deleted, re-establishing the watch whenever it is closed by the server.
+func WatchServiceEvents(kubernetesClient KubernetesClient, queue *ServiceQueue, done chan struct{}) {
+	watchFunc := func() (watch.Interface, error) {
+		return kubernetesClient.WatchDNSServices(namespace, serviceSelector)
+	}
+
+	watchEvents("services", watchFunc, done, func(event watch.Event) {
+		service, ok := event.Object.(*v1.Service)
+		if !ok {
+			log.Printf("Unexpected %s event from service watch: %v\n", event.Type, event.Object)
+			return
+		}
 
-	services, err := kubernetesClient.GetDNSServices(namespace, selector)
+		switch event.Type {
+		case watch.Added, watch.Modified:
+			queue.Add(*service, false)
+		case watch.Deleted:
+			queue.Add(*service, true)
+		}
+	})
+}
+
+// WatchNodeEvents notifies changed whenever a node is added or deleted, or
+// changes in a way that matters to the records of NodePort services: its
+// readiness, whether it is open to scheduling, or its addresses. Bursts of
+// changes are notified once.
+func WatchNodeEvents(kubernetesClient KubernetesClient, changed chan<- struct{}, done chan struct{}) {
+	// Nodes report their status every few seconds, so only the parts of it
+	// the records depend on are compared
+	nodeStates := map[string]string{}
+
+	watchEvents("nodes", kubernetesClient.WatchNodes, done, func(event watch.Event) {
+		node, ok := event.Object.(*v1.Node)
+		if !ok {
+			log.Printf("Unexpected %s event from node watch: %v\n", event.Type, event.Object)
+			return
+		}
+
+		name := node.ObjectMeta.Name
+		state := fmt.Sprintf("%v %v", nodeAvailable(*node), nodeIPs(*node))
+
+		if event.Type == watch.Deleted {
+			delete(nodeStates, name)
+			notify(changed)
+			return
+		}
+
+		if previous, ok := nodeStates[name]; ok && previous == state {
+			return
+		}
+
+		nodeStates[name] = state
+		notify(changed)
+	})
+}
+
+// WatchEndpointsEvents notifies changed whenever the endpoints of a DNS
+// service change, which happens when its pods move to other nodes.
+func WatchEndpointsEvents(kubernetesClient KubernetesClient, changed chan<- struct{}, done chan struct{}) {
+	watchFunc := func() (watch.Interface, error) {
+		return kubernetesClient.WatchDNSEndpoints(namespace, serviceSelector)
+	}
+
+	watchEvents("endpoints", watchFunc, done, func(event watch.Event) {
+		notify(changed)
+	})
+}
+
+func notify(changed chan<- struct{}) {
+	select {
+	case changed <- struct{}{}:
+	default:
+	}
+}
+
+// watchEvents handles every event of the watches returned by watchFunc until
+// done is closed, re-establishing the watch whenever it is closed by the
+// server or cannot be established.
+func watchEvents(resource string, watchFunc func() (watch.Interface, error), done chan struct{}, handle func(watch.Event)) {
+	for {
+		watcher, err := watchFunc()
+		if err != nil {
+			log.Printf("Failed to watch %s: %v\n", resource, err)
+
+			select {
+			case <-time.After(watchRetryDelay):
+				continue
+			case <-done:
+				return
+			}
+		}
+
+		if !consumeEvents(watcher, done, handle) {
+			return
+		}
+	}
+}
+
+// consumeEvents returns false if the daemon is shutting down, or true if the
+// watch was closed and should be re-established.
+func consumeEvents(watcher watch.Interface, done chan struct{}, handle func(watch.Event)) bool {
+	defer watcher.Stop()
+
+	for {
+		select {
+		case event, ok := <-watcher.ResultChan():
+			if !ok {
+				return true
+			}
+
+			handle(event)
+		case <-done:
+			return false
+		}
+	}
+}
+
+// RecoverManagedRecords adds the records owned by this cluster, as listed by
+// the provider, to the managed ones, so the records of services deleted while
+// the daemon was not running are cleaned up as well. Only the zones holding
+// the domains declared by the services are listed.
+func RecoverManagedRecords(kubernetesClient KubernetesClient, provider Provider, managedRecords map[string]Endpoint) error {
+	services, err := kubernetesClient.GetDNSServices(namespace, serviceSelector)
 	if err != nil {
-		return fmt.Errorf("Failed to list pods: %v", err)
+		return fmt.Errorf("Failed to list services: %v", err)
 	}
 
-	log.Printf("Found %d DNS services with selector %q\n", len(services), selector)
+	var domainNames []string
+	declared := map[string]bool{}
 
 	for _, service := range services {
-		elbHostname, err := ServiceIngressHostname(service)
+		serviceDomainNames, err := ServiceDomainNames(service)
 		if err != nil {
-			log.Printf("Could not find ingress hostname for %s: %s\n", service.Name, err)
 			continue
 		}
 
+		for _, domainName := range serviceDomainNames {
+			if !declared[domainName] {
+				declared[domainName] = true
+				domainNames = append(domainNames, domainName)
+			}
+		}
+	}
+
+	sort.Strings(domainNames)
+
+	endpoints, err := provider.ListEndpoints(domainNames)
+	if err != nil {
+		return fmt.Errorf("Failed to list DNS records: %v", err)
+	}
+
+	prefix := ClusterOwnerPrefix()
+	count := 0
+
+	for _, endpoint := range endpoints {
+		if !strings.HasPrefix(endpoint.Owner, prefix) {
+			continue
+		}
+
+		if _, ok := managedRecords[endpoint.DNSName]; !ok {
+			managedRecords[endpoint.DNSName] = endpoint
+		}
+		count++
+	}
+
+	log.Printf("Found %d DNS record sets owned by cluster %s\n", count, clusterID)
+
+	return nil
+}
+
+func SyncDNSRecords(kubernetesClient KubernetesClient, provider Provider, managedRecords map[string]Endpoint) error {
+	services, err := kubernetesClient.GetDNSServices(namespace, serviceSelector)
+	if err != nil {
+		return fmt.Errorf("Failed to list pods: %v", err)
+	}
+
+	log.Printf("Found %d DNS services with selector %q\n", len(services), serviceSelector)
+
+	// Domains still declared by some service must be kept, even if the
+	// service could not be synced in this cycle
+	declaredDomainNames := map[string]bool{}
+	for _, service := range services {
 		domainNames, err := ServiceDomainNames(service)
 		if err != nil {
-			log.Println(err)
 			continue
 		}
 
-		elbHostedZoneID, err := awsClient.GetLoadBalancerHostedZoneID(elbHostname)
+		for _, domainName := range domainNames {
+			declaredDomainNames[domainName] = true
+		}
+	}
+
+	plan := NewDNSPlan()
+
+	for _, service := range services {
+		planServiceDNSRecords(plan, kubernetesClient, service, provider, managedRecords)
+	}
+
+	for _, record := range sortedManagedRecords(managedRecords) {
+		if !declaredDomainNames[record.DNSName] && !plan.Planned(record.DNSName) {
+			planManagedRecordDeletion(plan, record, provider, managedRecords)
+		}
+	}
+
+	applyDNSPlan(plan, provider, managedRecords)
+
+	return nil
+}
+
+// SyncServiceDNSRecords creates or updates the records declared by the given
+// service, and deletes the ones it created but no longer declares.
+func SyncServiceDNSRecords(kubernetesClient KubernetesClient, service v1.Service, provider Provider, managedRecords map[string]Endpoint) {
+	plan := NewDNSPlan()
+	planServiceDNSRecords(plan, kubernetesClient, service, provider, managedRecords)
+	applyDNSPlan(plan, provider, managedRecords)
+}
+
+// SyncNodePortDNSRecords updates the records of every NodePort DNS service,
+// which follow the nodes hosting their pods.
+func SyncNodePortDNSRecords(kubernetesClient KubernetesClient, provider Provider, managedRecords map[string]Endpoint) error {
+	services, err := kubernetesClient.GetDNSServices(namespace, serviceSelector)
+	if err != nil {
+		return fmt.Errorf("Failed to list services: %v", err)
+	}
+
+	plan := NewDNSPlan()
+
+	for _, service := range services {
+		if service.Spec.Type == v1.ServiceTypeNodePort {
+			planServiceDNSRecords(plan, kubernetesClient, service, provider, managedRecords)
+		}
+	}
+
+	applyDNSPlan(plan, provider, managedRecords)
+
+	return nil
+}
+
+// DeleteServiceDNSRecords deletes every record created for the given service.
+func DeleteServiceDNSRecords(service v1.Service, provider Provider, managedRecords map[string]Endpoint) {
+	owner := ServiceOwner(service)
+	plan := NewDNSPlan()
+
+	for _, record := range sortedManagedRecords(managedRecords) {
+		if record.Owner == owner {
+			planManagedRecordDeletion(plan, record, provider, managedRecords)
+		}
+	}
+
+	applyDNSPlan(plan, provider, managedRecords)
+}
+
+func planServiceDNSRecords(plan *DNSPlan, kubernetesClient KubernetesClient, service v1.Service, provider Provider, managedRecords map[string]Endpoint) {
+	owner := ServiceOwner(service)
+
+	domainNames, err := ServiceDomainNames(service)
+	if err != nil {
+		log.Println(err)
+	}
+
+	declaredDomainNames := map[string]bool{}
+	for _, domainName := range domainNames {
+		declaredDomainNames[domainName] = true
+	}
+
+	for _, record := range sortedManagedRecords(managedRecords) {
+		if record.Owner == owner && !declaredDomainNames[record.DNSName] && !plan.Planned(record.DNSName) {
+			planManagedRecordDeletion(plan, record, provider, managedRecords)
+		}
+	}
+
+	if len(domainNames) == 0 {
+		return
+	}
+
+	recordType, targets, err := ServiceTargets(kubernetesClient, service)
+	if err != nil {
+		log.Printf("Could not find target for %s: %s\n", service.Name, err)
+		return
+	}
+
+	// Only Cloudflare has a proxy in front of the records, so the annotation
+	// is left alone, malformed or not, with the other providers
+	proxied := false
+	if providerName == "cloudflare" {
+		proxied, err = ServiceProxied(service)
 		if err != nil {
-			log.Printf("Could not get zone ID: %s\n", err)
+			log.Println(err)
+			return
+		}
+	}
+
+	for _, domainName := range domainNames {
+		log.Printf("Creating DNS for %s service (%s): %s -> %s\n", service.Name, service.ObjectMeta.Namespace, strings.Join(targets, ","), domainName)
+
+		currentOwner, exists, err := provider.GetOwner(domainName)
+		if err != nil {
+			log.Printf("Could not get record set owner: %v\n", err)
 			continue
 		}
 
-		for _, domainName := range domainNames {
-			log.Printf("Creating DNS for %s service (%s): %s -> %s\n", service.Name, service.ObjectMeta.Namespace, elbHostname, domainName)
+		if currentOwner != owner && (exists || currentOwner != "") {
+			log.Printf("Refusing to update record set not owned by %s service: domainName=%s, owner=%q\n", service.Name, domainName, currentOwner)
+			continue
+		}
+
+		endpoint := Endpoint{
+			DNSName:    domainName,
+			RecordType: recordType,
+			Targets:    targets,
+			TTL:        recordTTL,
+			Owner:      owner,
+			Proxied:    proxied,
+		}
 
-			domainHostedZoneID, err := awsClient.GetHostedZoneID(domainName)
-			if err != nil {
-				log.Printf("Could not find hosted zone: %s\n", err)
+		if !plan.Add(DNSChange{Action: "UPSERT", Endpoint: endpoint}) {
+			log.Printf("Refusing to update record set already claimed by another service: domainName=%s\n", domainName)
+		}
+	}
+}
+
+func planManagedRecordDeletion(plan *DNSPlan, record Endpoint, provider Provider, managedRecords map[string]Endpoint) {
+	domainName := record.DNSName
+
+	log.Printf("Deleting stale DNS record set: domainName=%s\n", domainName)
+
+	currentOwner, _, err := provider.GetOwner(record.DNSName)
+	if err != nil {
+		log.Printf("Could not get record set owner: %v\n", err)
+		return
+	}
+
+	// Someone else took over (or removed) the record, so it is no longer ours
+	if currentOwner != record.Owner {
+		log.Printf("Refusing to delete record set no longer owned by us: domainName=%s, owner=%q\n", domainName, currentOwner)
+		delete(managedRecords, domainName)
+		return
+	}
+
+	plan.Add(DNSChange{Action: "DELETE", Endpoint: record})
+}
+
+// applyDNSPlan submits all planned changes at once, so the provider can batch
+// them, and keeps track of the records that were changed.
+func applyDNSPlan(plan *DNSPlan, provider Provider, managedRecords map[string]Endpoint) {
+	if len(plan.Changes) == 0 {
+		return
+	}
+
+	errs := provider.ApplyChanges(plan.Changes)
+
+	for i, change := range plan.Changes {
+		record := change.Endpoint
+
+		if change.Action == "DELETE" {
+			if errs[i] != nil {
+				log.Printf("Failed to delete record set %s: %v\n", record.DNSName, errs[i])
 				continue
 			}
 
-			if err = awsClient.UpdateDNS(elbHostname, elbHostedZoneID, domainName, domainHostedZoneID); err != nil {
-				log.Printf("Failed to update record set: %v\n", err)
+			delete(managedRecords, record.DNSName)
+			log.Printf("Deleted DNS record set: domainName=%s\n", record.DNSName)
+		} else {
+			if errs[i] != nil {
+				log.Printf("Failed to update record set %s: %v\n", record.DNSName, errs[i])
 				continue
 			}
 
-			log.Printf("Created DNS record set: domainName=%s, hostedZoneID=%s\n", domainName, domainHostedZoneID)
+			managedRecords[record.DNSName] = record
+			log.Printf("Created DNS record set: domainName=%s\n", record.DNSName)
 		}
 	}
+}
 
-	return nil
+func sortedManagedRecords(managedRecords map[string]Endpoint) []Endpoint {
+	domainNames := make([]string, 0, len(managedRecords))
+	for domainName := range managedRecords {
+		domainNames = append(domainNames, domainName)
+	}
+	sort.Strings(domainNames)
+
+	records := make([]Endpoint, len(domainNames))
+	for i, domainName := range domainNames {
+		records[i] = managedRecords[domainName]
+	}
+
+	return records
 }
@@ -2,9 +2,11 @@ package main
 
 import (
 	"errors"
+	"reflect"
 	"testing"
 
 	"k8s.io/client-go/1.4/pkg/api/v1"
+	"k8s.io/client-go/1.4/pkg/watch"
 )
 
 type KubernetesClientDummy struct {
@@ -13,24 +15,40 @@ type KubernetesClientDummy struct {
 	getDNSServicesSelector string
 	getDNSServicesOutput   []v1.Service
 	getDNSServicesError    error
+
+	watchDNSServicesOutput watch.Interface
+	watchDNSServicesError  error
+
+	getSecretOutput *v1.Secret
+	getSecretError  error
+
+	getNodesOutput []v1.Node
+	getNodesError  error
+
+	watchNodesOutput watch.Interface
+	watchNodesError  error
+
+	getEndpointsOutput *v1.Endpoints
+	getEndpointsError  error
+
+	watchDNSEndpointsOutput watch.Interface
+	watchDNSEndpointsError  error
 }
 
-type AWSClientDummy struct {
+type ProviderDummy struct {
 	t *testing.T
 
-	getHostedZoneIDDomain string
-	getHostedZoneIDOutput string
-	getHostedZoneIDError  error
+	getOwnerDNSName string
+	getOwnerOutput  string
+	getOwnerExists  bool
+	getOwnerError   error
 
-	getLoadBalancerHostedZoneIDHostname string
-	getLoadBalancerHostedZoneIDOutput   string
-	getLoadBalancerHostedZoneIDError    error
+	applyChangesInput  []DNSChange
+	applyChangesOutput []error
 
-	updateDNSELBHostname        string
-	updateDNSELBHostedZoneID    string
-	updateDNSDomainName         string
-	updateDNSDomainHostedZoneID string
-	updateDNSError              error
+	listEndpointsDNSNames []string
+	listEndpointsOutput   []Endpoint
+	listEndpointsError    error
 }
 
 func (c KubernetesClientDummy) GetDNSServices(ns, selector string) ([]v1.Service, error) {
@@ -45,61 +63,84 @@ func (c KubernetesClientDummy) GetDNSServices(ns, selector string) ([]v1.Service
 	return c.getDNSServicesOutput, c.getDNSServicesError
 }
 
-func (c AWSClientDummy) GetHostedZoneID(domain string) (string, error) {
-	if domain != c.getHostedZoneIDDomain {
-		c.t.Errorf("Expected domain to be '%s', was '%s'", c.getHostedZoneIDDomain, domain)
+func (c KubernetesClientDummy) WatchDNSServices(ns, selector string) (watch.Interface, error) {
+	if ns != namespace {
+		c.t.Errorf("Expected namespace to be '%s', was '%s'", namespace, ns)
 	}
 
-	return c.getHostedZoneIDOutput, c.getHostedZoneIDError
+	if selector != serviceSelector {
+		c.t.Errorf("Expected selector to be '%s', was '%s'", serviceSelector, selector)
+	}
+
+	return c.watchDNSServicesOutput, c.watchDNSServicesError
 }
 
-func (c AWSClientDummy) GetLoadBalancerHostedZoneID(hostname string) (string, error) {
-	if hostname != c.getLoadBalancerHostedZoneIDHostname {
-		c.t.Errorf("Expected hostname to be '%s', was '%s'", c.getLoadBalancerHostedZoneIDHostname, hostname)
-	}
+func (c KubernetesClientDummy) GetSecret(ns, name string) (*v1.Secret, error) {
+	return c.getSecretOutput, c.getSecretError
+}
 
-	return c.getLoadBalancerHostedZoneIDOutput, c.getLoadBalancerHostedZoneIDError
+func (c KubernetesClientDummy) GetNodes() ([]v1.Node, error) {
+	return c.getNodesOutput, c.getNodesError
 }
 
-func (c AWSClientDummy) UpdateDNS(elbHostname, elbHostedZoneID, domainName, domainHostedZoneID string) error {
-	if elbHostname != c.updateDNSELBHostname {
-		c.t.Errorf("Expected elbHostname to be '%s', was '%s'", c.updateDNSELBHostname, elbHostname)
+func (c KubernetesClientDummy) WatchNodes() (watch.Interface, error) {
+	return c.watchNodesOutput, c.watchNodesError
+}
+
+func (c KubernetesClientDummy) GetEndpoints(ns, name string) (*v1.Endpoints, error) {
+	return c.getEndpointsOutput, c.getEndpointsError
+}
+
+func (c KubernetesClientDummy) WatchDNSEndpoints(ns, selector string) (watch.Interface, error) {
+	if selector != serviceSelector {
+		c.t.Errorf("Expected selector to be '%s', was '%s'", serviceSelector, selector)
 	}
 
-	if elbHostedZoneID != c.updateDNSELBHostedZoneID {
-		c.t.Errorf("Expected elbHostedZoneID to be '%s', was '%s'", c.updateDNSELBHostedZoneID, elbHostedZoneID)
+	return c.watchDNSEndpointsOutput, c.watchDNSEndpointsError
+}
+
+func (c ProviderDummy) GetOwner(dnsName string) (string, bool, error) {
+	if dnsName != c.getOwnerDNSName {
+		c.t.Errorf("Expected dnsName to be '%s', was '%s'", c.getOwnerDNSName, dnsName)
 	}
 
-	if domainName != c.updateDNSDomainName {
-		c.t.Errorf("Expected domainName to be '%s', was '%s'", c.updateDNSDomainName, domainName)
+	return c.getOwnerOutput, c.getOwnerExists, c.getOwnerError
+}
+
+func (c ProviderDummy) ApplyChanges(changes []DNSChange) []error {
+	if !reflect.DeepEqual(changes, c.applyChangesInput) {
+		c.t.Errorf("Expected changes to be '%v', was '%v'", c.applyChangesInput, changes)
 	}
 
-	if domainHostedZoneID != c.updateDNSDomainHostedZoneID {
-		c.t.Errorf("Expected domainHostedZoneID to be '%s', was '%s'", c.updateDNSDomainHostedZoneID, domainHostedZoneID)
+	return c.applyChangesOutput
+}
+
+func (c ProviderDummy) ListEndpoints(dnsNames []string) ([]Endpoint, error) {
+	if !reflect.DeepEqual(dnsNames, c.listEndpointsDNSNames) {
+		c.t.Errorf("Expected dnsNames to be '%v', was '%v'", c.listEndpointsDNSNames, dnsNames)
 	}
 
-	return c.updateDNSError
+	return c.listEndpointsOutput, c.listEndpointsError
 }
 
-func TestSyncRoute53DNSRecords(t *testing.T) {
+func TestSyncDNSRecords(t *testing.T) {
 	scenarios := []struct {
+		providerName string
+
 		getDNSServicesSelector string
 		getDNSServicesOutput   []v1.Service
 		getDNSServicesError    error
 
-		getHostedZoneIDDomain string
-		getHostedZoneIDOutput string
-		getHostedZoneIDError  error
+		getOwnerDNSName string
+		getOwnerOutput  string
+		getOwnerExists  bool
+		getOwnerError   error
 
-		getLoadBalancerHostedZoneIDHostname string
-		getLoadBalancerHostedZoneIDOutput   string
-		getLoadBalancerHostedZoneIDError    error
+		applyChangesInput  []DNSChange
+		applyChangesOutput []error
 
-		updateDNSELBHostname        string
-		updateDNSELBHostedZoneID    string
-		updateDNSDomainName         string
-		updateDNSDomainHostedZoneID string
-		updateDNSError              error
+		managedRecords         map[string]Endpoint
+		expectedManagedRecords map[string]Endpoint
 
 		expectedError error
 	}{
@@ -146,7 +187,7 @@ func TestSyncRoute53DNSRecords(t *testing.T) {
 			expectedError: nil,
 		},
 
-		// Error trying to retrieve load balancer hosted zone ID
+		// Error trying to get record set owner
 		{
 			getDNSServicesSelector: "dns=route53",
 			getDNSServicesOutput: []v1.Service{
@@ -168,13 +209,13 @@ func TestSyncRoute53DNSRecords(t *testing.T) {
 				},
 			},
 
-			getLoadBalancerHostedZoneIDHostname: "elb.hostname.amazonaws.com",
-			getLoadBalancerHostedZoneIDError:    errors.New("error"),
+			getOwnerDNSName: "some.domain.com",
+			getOwnerError:   errors.New("error"),
 
 			expectedError: nil,
 		},
 
-		// Error trying to retrieve custom domain hosted zone ID
+		// Error trying to update DNS records
 		{
 			getDNSServicesSelector: "dns=route53",
 			getDNSServicesOutput: []v1.Service{
@@ -196,16 +237,26 @@ func TestSyncRoute53DNSRecords(t *testing.T) {
 				},
 			},
 
-			getLoadBalancerHostedZoneIDHostname: "elb.hostname.amazonaws.com",
-			getLoadBalancerHostedZoneIDOutput:   "ELBZONEID",
+			getOwnerDNSName: "some.domain.com",
 
-			getHostedZoneIDDomain: "some.domain.com",
-			getHostedZoneIDError:  errors.New("error"),
+			applyChangesInput: []DNSChange{
+				DNSChange{
+					Action: "UPSERT",
+					Endpoint: Endpoint{
+						DNSName:    "some.domain.com",
+						RecordType: "CNAME",
+						Targets:    []string{"elb.hostname.amazonaws.com"},
+						TTL:        300,
+						Owner:      "heritage=kubernetes-service-dns-update,cluster=default,service=/service",
+					},
+				},
+			},
+			applyChangesOutput: []error{errors.New("error")},
 
 			expectedError: nil,
 		},
 
-		// Error trying to update DNS records
+		// Successful update
 		{
 			getDNSServicesSelector: "dns=route53",
 			getDNSServicesOutput: []v1.Service{
@@ -227,22 +278,296 @@ func TestSyncRoute53DNSRecords(t *testing.T) {
 				},
 			},
 
-			getLoadBalancerHostedZoneIDHostname: "elb.hostname.amazonaws.com",
-			getLoadBalancerHostedZoneIDOutput:   "ELBZONEID",
+			getOwnerDNSName: "some.domain.com",
 
-			getHostedZoneIDDomain: "some.domain.com",
-			getHostedZoneIDOutput: "DOMAINZONEID",
+			applyChangesInput: []DNSChange{
+				DNSChange{
+					Action: "UPSERT",
+					Endpoint: Endpoint{
+						DNSName:    "some.domain.com",
+						RecordType: "CNAME",
+						Targets:    []string{"elb.hostname.amazonaws.com"},
+						TTL:        300,
+						Owner:      "heritage=kubernetes-service-dns-update,cluster=default,service=/service",
+					},
+				},
+			},
+			applyChangesOutput: []error{nil},
 
-			updateDNSELBHostname:        "elb.hostname.amazonaws.com",
-			updateDNSELBHostedZoneID:    "ELBZONEID",
-			updateDNSDomainName:         "some.domain.com",
-			updateDNSDomainHostedZoneID: "DOMAINZONEID",
-			updateDNSError:              errors.New("error"),
+			expectedManagedRecords: map[string]Endpoint{
+				"some.domain.com": Endpoint{
+					DNSName:    "some.domain.com",
+					RecordType: "CNAME",
+					Targets:    []string{"elb.hostname.amazonaws.com"},
+					TTL:        300,
+					Owner:      "heritage=kubernetes-service-dns-update,cluster=default,service=/service",
+				},
+			},
 
 			expectedError: nil,
 		},
 
-		// Successful update
+		// Successful update of a proxied service behind an IP
+		{
+			providerName: "cloudflare",
+
+			getDNSServicesSelector: "dns=route53",
+			getDNSServicesOutput: []v1.Service{
+				v1.Service{
+					ObjectMeta: v1.ObjectMeta{
+						Name:        "service",
+						Namespace:   namespace,
+						Annotations: map[string]string{"domainNames": "some.domain.com", "cloudflareProxied": "true"},
+					},
+					Status: v1.ServiceStatus{
+						LoadBalancer: v1.LoadBalancerStatus{
+							Ingress: []v1.LoadBalancerIngress{
+								v1.LoadBalancerIngress{
+									IP: "203.0.113.10",
+								},
+							},
+						},
+					},
+				},
+			},
+
+			getOwnerDNSName: "some.domain.com",
+
+			applyChangesInput: []DNSChange{
+				DNSChange{
+					Action: "UPSERT",
+					Endpoint: Endpoint{
+						DNSName:    "some.domain.com",
+						RecordType: "A",
+						Targets:    []string{"203.0.113.10"},
+						TTL:        300,
+						Owner:      "heritage=kubernetes-service-dns-update,cluster=default,service=/service",
+						Proxied:    true,
+					},
+				},
+			},
+			applyChangesOutput: []error{nil},
+
+			expectedManagedRecords: map[string]Endpoint{
+				"some.domain.com": Endpoint{
+					DNSName:    "some.domain.com",
+					RecordType: "A",
+					Targets:    []string{"203.0.113.10"},
+					TTL:        300,
+					Owner:      "heritage=kubernetes-service-dns-update,cluster=default,service=/service",
+					Proxied:    true,
+				},
+			},
+
+			expectedError: nil,
+		},
+
+		// The proxy annotation is ignored by providers other than Cloudflare
+		{
+			getDNSServicesSelector: "dns=route53",
+			getDNSServicesOutput: []v1.Service{
+				v1.Service{
+					ObjectMeta: v1.ObjectMeta{
+						Name:        "service",
+						Namespace:   namespace,
+						Annotations: map[string]string{"domainNames": "some.domain.com", "cloudflareProxied": "yes"},
+					},
+					Status: v1.ServiceStatus{
+						LoadBalancer: v1.LoadBalancerStatus{
+							Ingress: []v1.LoadBalancerIngress{
+								v1.LoadBalancerIngress{
+									IP: "203.0.113.10",
+								},
+							},
+						},
+					},
+				},
+			},
+
+			getOwnerDNSName: "some.domain.com",
+
+			applyChangesInput: []DNSChange{
+				DNSChange{
+					Action: "UPSERT",
+					Endpoint: Endpoint{
+						DNSName:    "some.domain.com",
+						RecordType: "A",
+						Targets:    []string{"203.0.113.10"},
+						TTL:        300,
+						Owner:      "heritage=kubernetes-service-dns-update,cluster=default,service=/service",
+					},
+				},
+			},
+			applyChangesOutput: []error{nil},
+
+			expectedManagedRecords: map[string]Endpoint{
+				"some.domain.com": Endpoint{
+					DNSName:    "some.domain.com",
+					RecordType: "A",
+					Targets:    []string{"203.0.113.10"},
+					TTL:        300,
+					Owner:      "heritage=kubernetes-service-dns-update,cluster=default,service=/service",
+				},
+			},
+
+			expectedError: nil,
+		},
+
+		// Successful update of an ExternalName service
+		{
+			getDNSServicesSelector: "dns=route53",
+			getDNSServicesOutput: []v1.Service{
+				v1.Service{
+					ObjectMeta: v1.ObjectMeta{
+						Name:        "service",
+						Namespace:   namespace,
+						Annotations: map[string]string{"domainNames": "some.domain.com"},
+					},
+					Spec: v1.ServiceSpec{
+						Type:         v1.ServiceTypeExternalName,
+						ExternalName: "api.saas.example.net",
+					},
+				},
+			},
+
+			getOwnerDNSName: "some.domain.com",
+
+			applyChangesInput: []DNSChange{
+				DNSChange{
+					Action: "UPSERT",
+					Endpoint: Endpoint{
+						DNSName:    "some.domain.com",
+						RecordType: "CNAME",
+						Targets:    []string{"api.saas.example.net"},
+						TTL:        300,
+						Owner:      "heritage=kubernetes-service-dns-update,cluster=default,service=/service",
+					},
+				},
+			},
+			applyChangesOutput: []error{nil},
+
+			expectedManagedRecords: map[string]Endpoint{
+				"some.domain.com": Endpoint{
+					DNSName:    "some.domain.com",
+					RecordType: "CNAME",
+					Targets:    []string{"api.saas.example.net"},
+					TTL:        300,
+					Owner:      "heritage=kubernetes-service-dns-update,cluster=default,service=/service",
+				},
+			},
+
+			expectedError: nil,
+		},
+
+		// Stale record deleted after its service is gone
+		{
+			getDNSServicesSelector: "dns=route53",
+			getDNSServicesOutput:   []v1.Service{},
+
+			getOwnerDNSName: "some.domain.com",
+			getOwnerOutput:  "heritage=kubernetes-service-dns-update,cluster=default,service=/service",
+
+			applyChangesInput: []DNSChange{
+				DNSChange{
+					Action: "DELETE",
+					Endpoint: Endpoint{
+						DNSName:    "some.domain.com",
+						RecordType: "CNAME",
+						Targets:    []string{"elb.hostname.amazonaws.com"},
+						Owner:      "heritage=kubernetes-service-dns-update,cluster=default,service=/service",
+					},
+				},
+			},
+			applyChangesOutput: []error{nil},
+
+			managedRecords: map[string]Endpoint{
+				"some.domain.com": Endpoint{
+					DNSName:    "some.domain.com",
+					RecordType: "CNAME",
+					Targets:    []string{"elb.hostname.amazonaws.com"},
+					Owner:      "heritage=kubernetes-service-dns-update,cluster=default,service=/service",
+				},
+			},
+			expectedManagedRecords: map[string]Endpoint{},
+
+			expectedError: nil,
+		},
+
+		// Error trying to delete stale record keeps it for the next cycle
+		{
+			getDNSServicesSelector: "dns=route53",
+			getDNSServicesOutput:   []v1.Service{},
+
+			getOwnerDNSName: "some.domain.com",
+			getOwnerOutput:  "heritage=kubernetes-service-dns-update,cluster=default,service=/service",
+
+			applyChangesInput: []DNSChange{
+				DNSChange{
+					Action: "DELETE",
+					Endpoint: Endpoint{
+						DNSName:    "some.domain.com",
+						RecordType: "CNAME",
+						Targets:    []string{"elb.hostname.amazonaws.com"},
+						Owner:      "heritage=kubernetes-service-dns-update,cluster=default,service=/service",
+					},
+				},
+			},
+			applyChangesOutput: []error{errors.New("error")},
+
+			managedRecords: map[string]Endpoint{
+				"some.domain.com": Endpoint{
+					DNSName:    "some.domain.com",
+					RecordType: "CNAME",
+					Targets:    []string{"elb.hostname.amazonaws.com"},
+					Owner:      "heritage=kubernetes-service-dns-update,cluster=default,service=/service",
+				},
+			},
+			expectedManagedRecords: map[string]Endpoint{
+				"some.domain.com": Endpoint{
+					DNSName:    "some.domain.com",
+					RecordType: "CNAME",
+					Targets:    []string{"elb.hostname.amazonaws.com"},
+					Owner:      "heritage=kubernetes-service-dns-update,cluster=default,service=/service",
+				},
+			},
+
+			expectedError: nil,
+		},
+
+		// Record still declared by a service without ingress is not deleted
+		{
+			getDNSServicesSelector: "dns=route53",
+			getDNSServicesOutput: []v1.Service{
+				v1.Service{
+					ObjectMeta: v1.ObjectMeta{
+						Name:        "service",
+						Namespace:   namespace,
+						Annotations: map[string]string{"domainNames": "some.domain.com"},
+					},
+				},
+			},
+
+			managedRecords: map[string]Endpoint{
+				"some.domain.com": Endpoint{
+					DNSName:    "some.domain.com",
+					RecordType: "CNAME",
+					Targets:    []string{"elb.hostname.amazonaws.com"},
+					Owner:      "heritage=kubernetes-service-dns-update,cluster=default,service=/service",
+				},
+			},
+			expectedManagedRecords: map[string]Endpoint{
+				"some.domain.com": Endpoint{
+					DNSName:    "some.domain.com",
+					RecordType: "CNAME",
+					Targets:    []string{"elb.hostname.amazonaws.com"},
+					Owner:      "heritage=kubernetes-service-dns-update,cluster=default,service=/service",
+				},
+			},
+
+			expectedError: nil,
+		},
+
+		// Domain declared by two services is only claimed by the first one
 		{
 			getDNSServicesSelector: "dns=route53",
 			getDNSServicesOutput: []v1.Service{
@@ -262,25 +587,143 @@ func TestSyncRoute53DNSRecords(t *testing.T) {
 						},
 					},
 				},
+				v1.Service{
+					ObjectMeta: v1.ObjectMeta{
+						Name:        "other",
+						Namespace:   namespace,
+						Annotations: map[string]string{"domainNames": "some.domain.com"},
+					},
+					Status: v1.ServiceStatus{
+						LoadBalancer: v1.LoadBalancerStatus{
+							Ingress: []v1.LoadBalancerIngress{
+								v1.LoadBalancerIngress{
+									Hostname: "elb.hostname.amazonaws.com",
+								},
+							},
+						},
+					},
+				},
 			},
 
-			getLoadBalancerHostedZoneIDHostname: "elb.hostname.amazonaws.com",
-			getLoadBalancerHostedZoneIDOutput:   "ELBZONEID",
+			getOwnerDNSName: "some.domain.com",
 
-			getHostedZoneIDDomain: "some.domain.com",
-			getHostedZoneIDOutput: "DOMAINZONEID",
+			applyChangesInput: []DNSChange{
+				DNSChange{
+					Action: "UPSERT",
+					Endpoint: Endpoint{
+						DNSName:    "some.domain.com",
+						RecordType: "CNAME",
+						Targets:    []string{"elb.hostname.amazonaws.com"},
+						TTL:        300,
+						Owner:      "heritage=kubernetes-service-dns-update,cluster=default,service=/service",
+					},
+				},
+			},
+			applyChangesOutput: []error{nil},
 
-			updateDNSELBHostname:        "elb.hostname.amazonaws.com",
-			updateDNSELBHostedZoneID:    "ELBZONEID",
-			updateDNSDomainName:         "some.domain.com",
-			updateDNSDomainHostedZoneID: "DOMAINZONEID",
-			updateDNSError:              nil,
+			expectedManagedRecords: map[string]Endpoint{
+				"some.domain.com": Endpoint{
+					DNSName:    "some.domain.com",
+					RecordType: "CNAME",
+					Targets:    []string{"elb.hostname.amazonaws.com"},
+					TTL:        300,
+					Owner:      "heritage=kubernetes-service-dns-update,cluster=default,service=/service",
+				},
+			},
+
+			expectedError: nil,
+		},
+
+		// Record exists but is not owned by the service
+		{
+			getDNSServicesSelector: "dns=route53",
+			getDNSServicesOutput: []v1.Service{
+				v1.Service{
+					ObjectMeta: v1.ObjectMeta{
+						Name:        "service",
+						Namespace:   namespace,
+						Annotations: map[string]string{"domainNames": "some.domain.com"},
+					},
+					Status: v1.ServiceStatus{
+						LoadBalancer: v1.LoadBalancerStatus{
+							Ingress: []v1.LoadBalancerIngress{
+								v1.LoadBalancerIngress{
+									Hostname: "elb.hostname.amazonaws.com",
+								},
+							},
+						},
+					},
+				},
+			},
+
+			getOwnerDNSName: "some.domain.com",
+			getOwnerOutput:  "",
+			getOwnerExists:  true,
+
+			expectedManagedRecords: map[string]Endpoint{},
+
+			expectedError: nil,
+		},
+
+		// Record owned by another service in this cluster
+		{
+			getDNSServicesSelector: "dns=route53",
+			getDNSServicesOutput: []v1.Service{
+				v1.Service{
+					ObjectMeta: v1.ObjectMeta{
+						Name:        "service",
+						Namespace:   namespace,
+						Annotations: map[string]string{"domainNames": "some.domain.com"},
+					},
+					Status: v1.ServiceStatus{
+						LoadBalancer: v1.LoadBalancerStatus{
+							Ingress: []v1.LoadBalancerIngress{
+								v1.LoadBalancerIngress{
+									Hostname: "elb.hostname.amazonaws.com",
+								},
+							},
+						},
+					},
+				},
+			},
+
+			getOwnerDNSName: "some.domain.com",
+			getOwnerOutput:  "heritage=kubernetes-service-dns-update,cluster=default,service=/other",
+			getOwnerExists:  true,
+
+			expectedManagedRecords: map[string]Endpoint{},
+
+			expectedError: nil,
+		},
+
+		// Stale record whose ownership marker is gone is forgotten, not deleted
+		{
+			getDNSServicesSelector: "dns=route53",
+			getDNSServicesOutput:   []v1.Service{},
+
+			getOwnerDNSName: "some.domain.com",
+			getOwnerOutput:  "",
+			getOwnerExists:  true,
+
+			managedRecords: map[string]Endpoint{
+				"some.domain.com": Endpoint{
+					DNSName:    "some.domain.com",
+					RecordType: "CNAME",
+					Targets:    []string{"elb.hostname.amazonaws.com"},
+					Owner:      "heritage=kubernetes-service-dns-update,cluster=default,service=/service",
+				},
+			},
+			expectedManagedRecords: map[string]Endpoint{},
 
 			expectedError: nil,
 		},
 	}
 
+	defer func(providerNameValue string) { providerName = providerNameValue }(providerName)
+
 	for _, scenario := range scenarios {
+		providerName = scenario.providerName
+
 		kubernetesClient := KubernetesClientDummy{
 			t: t,
 
@@ -289,28 +732,482 @@ func TestSyncRoute53DNSRecords(t *testing.T) {
 			getDNSServicesError:    scenario.getDNSServicesError,
 		}
 
-		awsClient := AWSClientDummy{
+		provider := ProviderDummy{
 			t: t,
 
-			getLoadBalancerHostedZoneIDHostname: scenario.getLoadBalancerHostedZoneIDHostname,
-			getLoadBalancerHostedZoneIDOutput:   scenario.getLoadBalancerHostedZoneIDOutput,
-			getLoadBalancerHostedZoneIDError:    scenario.getLoadBalancerHostedZoneIDError,
+			getOwnerDNSName: scenario.getOwnerDNSName,
+			getOwnerOutput:  scenario.getOwnerOutput,
+			getOwnerExists:  scenario.getOwnerExists,
+			getOwnerError:   scenario.getOwnerError,
 
-			getHostedZoneIDDomain: scenario.getHostedZoneIDDomain,
-			getHostedZoneIDOutput: scenario.getHostedZoneIDOutput,
-			getHostedZoneIDError:  scenario.getHostedZoneIDError,
+			applyChangesInput:  scenario.applyChangesInput,
+			applyChangesOutput: scenario.applyChangesOutput,
+		}
 
-			updateDNSELBHostname:        scenario.updateDNSELBHostname,
-			updateDNSELBHostedZoneID:    scenario.updateDNSELBHostedZoneID,
-			updateDNSDomainName:         scenario.updateDNSDomainName,
-			updateDNSDomainHostedZoneID: scenario.updateDNSDomainHostedZoneID,
-			updateDNSError:              scenario.updateDNSError,
+		managedRecords := map[string]Endpoint{}
+		for domainName, record := range scenario.managedRecords {
+			managedRecords[domainName] = record
 		}
 
-		err := SyncRoute53DNSRecords(kubernetesClient, awsClient)
+		err := SyncDNSRecords(kubernetesClient, provider, managedRecords)
 
 		if (err == nil && scenario.expectedError != nil) || (scenario.expectedError != nil && scenario.expectedError.Error() != err.Error()) {
 			t.Errorf("Expected error to be '%v', was '%v'", scenario.expectedError, err)
 		}
+
+		if scenario.expectedManagedRecords != nil && !reflect.DeepEqual(managedRecords, scenario.expectedManagedRecords) {
+			t.Errorf("Expected managed records to be '%v', was '%v'", scenario.expectedManagedRecords, managedRecords)
+		}
+	}
+}
+
+func TestWatchServiceEvents(t *testing.T) {
+	watcher := watch.NewFake()
+
+	kubernetesClient := KubernetesClientDummy{
+		t: t,
+
+		watchDNSServicesOutput: watcher,
+	}
+
+	queue := NewServiceQueue()
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		WatchServiceEvents(kubernetesClient, queue, done)
+		close(stopped)
+	}()
+
+	first := queueTestService("default", "first", "first.domain.com")
+	second := queueTestService("default", "second", "second.domain.com")
+
+	watcher.Add(&first)
+	watcher.Add(&second)
+	watcher.Modify(&first)
+	watcher.Delete(&second)
+
+	close(done)
+	<-stopped
+
+	if !watcher.Stopped {
+		t.Error("Expected watcher to be stopped")
+	}
+
+	scenarios := []struct {
+		expectedKey     string
+		expectedDeleted bool
+	}{
+		{"default/first", false},
+		{"default/second", true},
+	}
+
+	for _, scenario := range scenarios {
+		item, ok := queue.Pop()
+		if !ok {
+			t.Errorf("Expected %s to be queued", scenario.expectedKey)
+			continue
+		}
+
+		if key := ServiceKey(item.Service); key != scenario.expectedKey {
+			t.Errorf("Expected key to be '%s', was '%s'", scenario.expectedKey, key)
+		}
+
+		if item.Deleted != scenario.expectedDeleted {
+			t.Errorf("Expected deleted to be '%v', was '%v'", scenario.expectedDeleted, item.Deleted)
+		}
+	}
+}
+
+func TestWatchNodeEvents(t *testing.T) {
+	watcher := watch.NewFake()
+
+	kubernetesClient := KubernetesClientDummy{
+		t: t,
+
+		watchNodesOutput: watcher,
+	}
+
+	// Large enough for every notification to be counted
+	changed := make(chan struct{}, 10)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		WatchNodeEvents(kubernetesClient, changed, done)
+		close(stopped)
+	}()
+
+	ready := testNode("node-a", true, false, v1.NodeAddress{Type: v1.NodeExternalIP, Address: "203.0.113.1"})
+	heartbeat := testNode("node-a", true, false, v1.NodeAddress{Type: v1.NodeExternalIP, Address: "203.0.113.1"})
+	heartbeat.ObjectMeta.ResourceVersion = "2"
+	notReady := testNode("node-a", false, false, v1.NodeAddress{Type: v1.NodeExternalIP, Address: "203.0.113.1"})
+
+	watcher.Add(&ready)
+	watcher.Modify(&heartbeat)
+	watcher.Modify(&notReady)
+	watcher.Delete(&notReady)
+
+	close(done)
+	<-stopped
+
+	if !watcher.Stopped {
+		t.Error("Expected watcher to be stopped")
+	}
+
+	// Added, no longer ready, and deleted
+	if expected := 3; len(changed) != expected {
+		t.Errorf("Expected %d notifications, was %d", expected, len(changed))
+	}
+}
+
+func TestSyncNodePortDNSRecords(t *testing.T) {
+	owner := "heritage=kubernetes-service-dns-update,cluster=default,service=default/nodeport"
+
+	kubernetesClient := KubernetesClientDummy{
+		t: t,
+
+		getDNSServicesSelector: "dns=route53",
+		getDNSServicesOutput: []v1.Service{
+			v1.Service{
+				ObjectMeta: v1.ObjectMeta{
+					Name:        "nodeport",
+					Namespace:   "default",
+					Annotations: map[string]string{"domainNames": "nodeport.domain.com"},
+				},
+				Spec: v1.ServiceSpec{
+					Type:     v1.ServiceTypeNodePort,
+					Selector: map[string]string{"app": "nodeport"},
+				},
+			},
+			// Load balancers do not follow nodes
+			v1.Service{
+				ObjectMeta: v1.ObjectMeta{
+					Name:        "service",
+					Namespace:   "default",
+					Annotations: map[string]string{"domainNames": "some.domain.com"},
+				},
+				Spec: v1.ServiceSpec{
+					Type: v1.ServiceTypeLoadBalancer,
+				},
+				Status: v1.ServiceStatus{
+					LoadBalancer: v1.LoadBalancerStatus{
+						Ingress: []v1.LoadBalancerIngress{
+							v1.LoadBalancerIngress{
+								Hostname: "elb.hostname.amazonaws.com",
+							},
+						},
+					},
+				},
+			},
+		},
+
+		getNodesOutput: []v1.Node{
+			testNode("node-a", true, false, v1.NodeAddress{Type: v1.NodeExternalIP, Address: "203.0.113.1"}),
+			testNode("node-b", true, false, v1.NodeAddress{Type: v1.NodeExternalIP, Address: "203.0.113.2"}),
+		},
+		getEndpointsOutput: &v1.Endpoints{
+			Subsets: []v1.EndpointSubset{
+				v1.EndpointSubset{
+					Addresses: []v1.EndpointAddress{
+						v1.EndpointAddress{IP: "172.16.0.1", NodeName: testNodeName("node-b")},
+					},
+				},
+			},
+		},
+	}
+
+	record := Endpoint{
+		DNSName:    "nodeport.domain.com",
+		RecordType: "A",
+		Targets:    []string{"203.0.113.2"},
+		TTL:        300,
+		Owner:      owner,
+	}
+
+	provider := ProviderDummy{
+		t: t,
+
+		getOwnerDNSName: "nodeport.domain.com",
+
+		applyChangesInput:  []DNSChange{DNSChange{Action: "UPSERT", Endpoint: record}},
+		applyChangesOutput: []error{nil},
+	}
+
+	managedRecords := map[string]Endpoint{}
+
+	if err := SyncNodePortDNSRecords(kubernetesClient, provider, managedRecords); err != nil {
+		t.Errorf("Expected no error, was '%v'", err)
+	}
+
+	expectedManagedRecords := map[string]Endpoint{
+		"nodeport.domain.com": record,
+	}
+
+	if !reflect.DeepEqual(managedRecords, expectedManagedRecords) {
+		t.Errorf("Expected managed records to be '%v', was '%v'", expectedManagedRecords, managedRecords)
+	}
+}
+
+func TestDeleteServiceDNSRecords(t *testing.T) {
+	service := v1.Service{
+		ObjectMeta: v1.ObjectMeta{
+			Name:        "service",
+			Namespace:   namespace,
+			Annotations: map[string]string{"domainNames": "some.domain.com"},
+		},
+	}
+
+	provider := ProviderDummy{
+		t: t,
+
+		getOwnerDNSName: "some.domain.com",
+		getOwnerOutput:  "heritage=kubernetes-service-dns-update,cluster=default,service=/service",
+
+		applyChangesInput: []DNSChange{
+			DNSChange{
+				Action: "DELETE",
+				Endpoint: Endpoint{
+					DNSName:    "some.domain.com",
+					RecordType: "CNAME",
+					Targets:    []string{"elb.hostname.amazonaws.com"},
+					Owner:      "heritage=kubernetes-service-dns-update,cluster=default,service=/service",
+				},
+			},
+		},
+		applyChangesOutput: []error{nil},
+	}
+
+	otherRecord := Endpoint{
+		DNSName:    "other.domain.com",
+		RecordType: "CNAME",
+		Targets:    []string{"other.hostname.amazonaws.com"},
+		Owner:      "heritage=kubernetes-service-dns-update,cluster=default,service=/other",
+	}
+
+	managedRecords := map[string]Endpoint{
+		"some.domain.com": Endpoint{
+			DNSName:    "some.domain.com",
+			RecordType: "CNAME",
+			Targets:    []string{"elb.hostname.amazonaws.com"},
+			Owner:      "heritage=kubernetes-service-dns-update,cluster=default,service=/service",
+		},
+		"other.domain.com": otherRecord,
+	}
+
+	DeleteServiceDNSRecords(service, provider, managedRecords)
+
+	expectedManagedRecords := map[string]Endpoint{
+		"other.domain.com": otherRecord,
+	}
+
+	if !reflect.DeepEqual(managedRecords, expectedManagedRecords) {
+		t.Errorf("Expected managed records to be '%v', was '%v'", expectedManagedRecords, managedRecords)
+	}
+}
+
+func TestRecoverManagedRecords(t *testing.T) {
+	ownedRecord := Endpoint{
+		DNSName:    "some.domain.com",
+		RecordType: "CNAME",
+		Targets:    []string{"elb.hostname.amazonaws.com"},
+		TTL:        300,
+		Owner:      "heritage=kubernetes-service-dns-update,cluster=default,service=/service",
+	}
+
+	otherClusterRecord := Endpoint{
+		DNSName:    "other.domain.com",
+		RecordType: "A",
+		Targets:    []string{"203.0.113.10"},
+		TTL:        300,
+		Owner:      "heritage=kubernetes-service-dns-update,cluster=other,service=/service",
+	}
+
+	scenarios := []struct {
+		getDNSServicesOutput []v1.Service
+		getDNSServicesError  error
+
+		listEndpointsDNSNames []string
+		listEndpointsOutput   []Endpoint
+		listEndpointsError    error
+
+		managedRecords         map[string]Endpoint
+		expectedManagedRecords map[string]Endpoint
+
+		expectedError error
+	}{
+		// Error while listing the services
+		{
+			getDNSServicesError: errors.New("error"),
+
+			expectedManagedRecords: map[string]Endpoint{},
+
+			expectedError: errors.New("Failed to list services: error"),
+		},
+
+		// Only the zones of the names declared by the services are listed
+		{
+			getDNSServicesOutput: []v1.Service{
+				v1.Service{
+					ObjectMeta: v1.ObjectMeta{
+						Name:        "service",
+						Namespace:   namespace,
+						Annotations: map[string]string{"domainNames": "some.domain.com, Other.Domain.com"},
+					},
+				},
+				v1.Service{
+					ObjectMeta: v1.ObjectMeta{
+						Name:        "other",
+						Namespace:   namespace,
+						Annotations: map[string]string{"domainNames": "some.domain.com"},
+					},
+				},
+				v1.Service{
+					ObjectMeta: v1.ObjectMeta{
+						Name:      "undeclared",
+						Namespace: namespace,
+					},
+				},
+			},
+
+			listEndpointsDNSNames: []string{"other.domain.com", "some.domain.com"},
+			listEndpointsOutput:   []Endpoint{ownedRecord},
+
+			expectedManagedRecords: map[string]Endpoint{
+				"some.domain.com": ownedRecord,
+			},
+		},
+
+		// Error while listing the records of the provider
+		{
+			listEndpointsError: errors.New("error"),
+
+			expectedManagedRecords: map[string]Endpoint{},
+
+			expectedError: errors.New("Failed to list DNS records: error"),
+		},
+
+		// Only the records of this cluster are recovered
+		{
+			listEndpointsOutput: []Endpoint{otherClusterRecord, ownedRecord},
+
+			expectedManagedRecords: map[string]Endpoint{
+				"some.domain.com": ownedRecord,
+			},
+		},
+
+		// Records already managed are kept as they are
+		{
+			listEndpointsOutput: []Endpoint{ownedRecord},
+
+			managedRecords: map[string]Endpoint{
+				"some.domain.com": Endpoint{
+					DNSName:    "some.domain.com",
+					RecordType: "CNAME",
+					Targets:    []string{"new.hostname.amazonaws.com"},
+					Owner:      "heritage=kubernetes-service-dns-update,cluster=default,service=/service",
+				},
+			},
+			expectedManagedRecords: map[string]Endpoint{
+				"some.domain.com": Endpoint{
+					DNSName:    "some.domain.com",
+					RecordType: "CNAME",
+					Targets:    []string{"new.hostname.amazonaws.com"},
+					Owner:      "heritage=kubernetes-service-dns-update,cluster=default,service=/service",
+				},
+			},
+		},
+	}
+
+	for _, scenario := range scenarios {
+		kubernetesClient := KubernetesClientDummy{
+			t: t,
+
+			getDNSServicesSelector: serviceSelector,
+			getDNSServicesOutput:   scenario.getDNSServicesOutput,
+			getDNSServicesError:    scenario.getDNSServicesError,
+		}
+
+		provider := ProviderDummy{
+			t: t,
+
+			listEndpointsDNSNames: scenario.listEndpointsDNSNames,
+			listEndpointsOutput:   scenario.listEndpointsOutput,
+			listEndpointsError:    scenario.listEndpointsError,
+		}
+
+		managedRecords := map[string]Endpoint{}
+		for domainName, record := range scenario.managedRecords {
+			managedRecords[domainName] = record
+		}
+
+		err := RecoverManagedRecords(kubernetesClient, provider, managedRecords)
+
+		if (err == nil && scenario.expectedError != nil) || (scenario.expectedError != nil && scenario.expectedError.Error() != err.Error()) {
+			t.Errorf("Expected error to be '%v', was '%v'", scenario.expectedError, err)
+		}
+
+		if !reflect.DeepEqual(managedRecords, scenario.expectedManagedRecords) {
+			t.Errorf("Expected managed records to be '%v', was '%v'", scenario.expectedManagedRecords, managedRecords)
+		}
+	}
+}
+
+func TestSyncDNSRecordsAfterRestart(t *testing.T) {
+	owner := "heritage=kubernetes-service-dns-update,cluster=default,service=/deleted"
+
+	// The service was deleted while the daemon was not running, so its record
+	// is only known from the provider
+	provider := ProviderDummy{
+		t: t,
+
+		listEndpointsOutput: []Endpoint{
+			Endpoint{
+				DNSName:    "some.domain.com",
+				RecordType: "CNAME",
+				Targets:    []string{"elb.hostname.amazonaws.com"},
+				TTL:        300,
+				Owner:      owner,
+			},
+		},
+
+		getOwnerDNSName: "some.domain.com",
+		getOwnerOutput:  owner,
+		getOwnerExists:  true,
+
+		applyChangesInput: []DNSChange{
+			DNSChange{
+				Action: "DELETE",
+				Endpoint: Endpoint{
+					DNSName:    "some.domain.com",
+					RecordType: "CNAME",
+					Targets:    []string{"elb.hostname.amazonaws.com"},
+					TTL:        300,
+					Owner:      owner,
+				},
+			},
+		},
+		applyChangesOutput: []error{nil},
+	}
+
+	kubernetesClient := KubernetesClientDummy{
+		t: t,
+
+		getDNSServicesSelector: serviceSelector,
+		getDNSServicesOutput:   []v1.Service{},
+	}
+
+	managedRecords := map[string]Endpoint{}
+
+	if err := RecoverManagedRecords(kubernetesClient, provider, managedRecords); err != nil {
+		t.Errorf("Expected no error, was '%v'", err)
+	}
+
+	if err := SyncDNSRecords(kubernetesClient, provider, managedRecords); err != nil {
+		t.Errorf("Expected no error, was '%v'", err)
+	}
+
+	if len(managedRecords) != 0 {
+		t.Errorf("Expected no managed records to be left, was '%v'", managedRecords)
 	}
 }
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// TTL of the records created by the daemon, unless the endpoint sets its own
+const defaultTTL = 300
+
+// Prefix of the name of the TXT record holding the ownership marker of each
+// record, which cannot share its name when it is a CNAME
+const ownerRecordPrefix = "_owner."
+
+// Record types that make a name resolve, any of which counts as an existing
+// record when checking who owns a name
+var addressRecordTypes = []string{"A", "AAAA", "CNAME"}
+
+// Endpoint is a DNS name declared by a service, pointing to the targets the
+// service is reachable at (i.e. the hostname of its load balancer). The targets
+// of A endpoints may include IPv6 addresses as well, for dual-stack load
+// balancers, which are published as AAAA records of the same name.
+type Endpoint struct {
+	DNSName    string
+	RecordType string
+	Targets    []string
+	TTL        int64
+	Owner      string
+
+	// Proxied asks providers with a proxy in front of the records (i.e.
+	// Cloudflare) to serve the name through it
+	Proxied bool
+}
+
+// Provider keeps the records of some DNS service in line with the endpoints
+// declared by Kubernetes services.
+type Provider interface {
+	// GetOwner returns the ownership marker stored for the given name, if any,
+	// and whether an address record already exists for it.
+	GetOwner(dnsName string) (string, bool, error)
+
+	// ApplyChanges ensures the records of every UPSERT change exist and
+	// removes the ones of every DELETE change, returning the outcome of each.
+	ApplyChanges(changes []DNSChange) []error
+
+	// ListEndpoints returns the endpoints of every name holding an ownership
+	// marker written by the daemon, as they are currently published, so the
+	// records left by an earlier run can be found again. Only the zones
+	// holding any of the given names are listed, unless the zones are
+	// configured up front or cheap to read as a whole.
+	ListEndpoints(dnsNames []string) ([]Endpoint, error)
+}
+
+// NewProvider returns the DNS provider with the given name. The Kubernetes
+// client is used by providers reading their credentials from secrets.
+func NewProvider(name string, kubernetesClient KubernetesClient) (Provider, error) {
+	switch name {
+	case "route53":
+		return NewRoute53Provider()
+	case "google":
+		return NewGoogleProvider()
+	case "azure":
+		return NewAzureProvider()
+	case "cloudflare":
+		return NewCloudflareProvider()
+	case "rfc2136":
+		return NewRFC2136Provider(kubernetesClient)
+	case "coredns":
+		return NewCoreDNSProvider()
+	case "pdns":
+		return NewPowerDNSProvider()
+	case "zonefile":
+		return NewZoneFileProvider()
+	case "webhook":
+		return NewWebhookProvider()
+	case "embedded":
+		return NewEmbeddedProvider()
+	default:
+		return nil, fmt.Errorf("Unknown DNS provider %q", name)
+	}
+}
+
+// closeProvider releases the resources of the providers holding any of their
+// own, such as the sockets the embedded provider serves records on.
+func closeProvider(provider Provider) {
+	if closer, ok := provider.(interface {
+		Close()
+	}); ok {
+		closer.Close()
+	}
+}
+
+// containsString returns whether the given value is one of values.
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// sameStrings returns whether both lists hold the same values, in any order.
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	as := append([]string{}, a...)
+	bs := append([]string{}, b...)
+	sort.Strings(as)
+	sort.Strings(bs)
+
+	for i := range as {
+		if as[i] != bs[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// DNSRecord is a record set as most DNS services store them: every value of
+// the given type for the given name, without the trailing dot.
+type DNSRecord struct {
+	Name   string
+	Type   string
+	TTL    int64
+	Values []string
+}
+
+// endpointRecords returns the address records for the endpoint along with
+// their companion TXT ownership record, named after ownerRecordName. IP
+// addresses are split into an A and an AAAA record by family, and CNAME
+// endpoints with several targets are refused, as a CNAME record cannot have
+// more than one.
+func endpointRecords(endpoint Endpoint) ([]DNSRecord, error) {
+	name := canonicalDNSName(endpoint.DNSName)
+
+	ttl := endpoint.TTL
+	if ttl == 0 {
+		ttl = defaultTTL
+	}
+
+	var records []DNSRecord
+
+	switch endpoint.RecordType {
+	case "A", "AAAA":
+		for _, recordType := range []string{"A", "AAAA"} {
+			var values []string
+			for _, target := range endpoint.Targets {
+				if ipRecordType(target) == recordType {
+					values = append(values, target)
+				}
+			}
+
+			if len(values) > 0 {
+				records = append(records, DNSRecord{Name: name, Type: recordType, TTL: ttl, Values: values})
+			}
+		}
+	case "CNAME":
+		if len(endpoint.Targets) > 1 {
+			return nil, fmt.Errorf("CNAME record for %s cannot point to several hostnames, got %s", endpoint.DNSName, strings.Join(endpoint.Targets, ","))
+		}
+		records = append(records, DNSRecord{Name: name, Type: "CNAME", TTL: ttl, Values: endpoint.Targets})
+	default:
+		records = append(records, DNSRecord{Name: name, Type: endpoint.RecordType, TTL: ttl, Values: endpoint.Targets})
+	}
+
+	return append(records, DNSRecord{
+		Name:   ownerRecordName(name),
+		Type:   "TXT",
+		TTL:    defaultTTL,
+		Values: []string{fmt.Sprintf("%q", endpoint.Owner)},
+	}), nil
+}
+
+// ipRecordType returns the type of the address records the given IP address
+// goes in: AAAA for IPv6 addresses, A for anything else.
+func ipRecordType(ip string) string {
+	if parsed := net.ParseIP(ip); parsed != nil && parsed.To4() == nil {
+		return "AAAA"
+	}
+	return "A"
+}
+
+// ownerRecordName returns the name of the TXT record holding the ownership
+// marker of the given name.
+func ownerRecordName(dnsName string) string {
+	return ownerRecordPrefix + canonicalDNSName(dnsName)
+}
+
+// canonicalDNSName returns the given name in lower case, without leading or
+// trailing dots.
+func canonicalDNSName(dnsName string) string {
+	return strings.ToLower(strings.TrimSuffix(strings.TrimLeft(dnsName, "."), "."))
+}
+
+// logRecordUpToDate logs that the records of the given domain name in the
+// given zone need no change.
+func logRecordUpToDate(domainName, zone string) {
+	log.Printf("DNS record set already up to date: domainName=%s, hostedZoneID=%s\n", domainName, zone)
+}
+
+// logDryRunChange logs the change that would have been made to the records
+// of the given domain name in the given zone if dry run was disabled.
+func logDryRunChange(action, domainName, zone string, targets []string) {
+	if action == "DELETE" {
+		log.Printf("DRY RUN: We normally would have deleted %s from %s (%s)\n", domainName, zone, strings.Join(targets, ","))
+	} else {
+		log.Printf("DRY RUN: We normally would have updated %s in %s to point to %s\n", domainName, zone, strings.Join(targets, ","))
+	}
+}
+
+// findRecordOfType returns the index of the record of the given type, or -1
+// if there is none.
+func findRecordOfType(records []DNSRecord, recordType string) int {
+	for i, record := range records {
+		if record.Type == recordType {
+			return i
+		}
+	}
+	return -1
+}
+
+// ownerFromTXT returns the ownership marker among the given TXT values, if any.
+func ownerFromTXT(values []string) string {
+	owner := ""
+
+	for _, value := range values {
+		value = strings.Trim(value, "\"")
+		if strings.HasPrefix(value, ownerHeritage) {
+			owner = value
+		}
+	}
+
+	return owner
+}
+
+// ownedEndpoints returns the endpoints of the names holding an ownership marker
+// among the given records, pointing to the values of their address records.
+// Names left without address records are skipped.
+func ownedEndpoints(records []DNSRecord) []Endpoint {
+	owners := map[string]string{}
+	for _, record := range records {
+		owner := ownerFromTXT(record.Values)
+		if record.Type != "TXT" || owner == "" {
+			continue
+		}
+
+		// Earlier versions kept the marker on the name itself, which only
+		// counts when there is none under the _owner prefix
+		name := canonicalDNSName(record.Name)
+		if strings.HasPrefix(name, ownerRecordPrefix) {
+			owners[strings.TrimPrefix(name, ownerRecordPrefix)] = owner
+		} else if _, ok := owners[name]; !ok {
+			owners[name] = owner
+		}
+	}
+
+	endpoints := map[string]*Endpoint{}
+	var names []string
+
+	for _, record := range records {
+		name := canonicalDNSName(record.Name)
+		owner, ok := owners[name]
+		if !ok || !containsString(addressRecordTypes, record.Type) {
+			continue
+		}
+
+		endpoint, ok := endpoints[name]
+		if !ok {
+			endpoint = &Endpoint{DNSName: name, RecordType: "A", TTL: record.TTL, Owner: owner}
+			endpoints[name] = endpoint
+			names = append(names, name)
+		}
+
+		if record.Type == "CNAME" {
+			endpoint.RecordType = "CNAME"
+		}
+		endpoint.Targets = append(endpoint.Targets, record.Values...)
+	}
+
+	sort.Strings(names)
+
+	result := make([]Endpoint, len(names))
+	for i, name := range names {
+		result[i] = *endpoints[name]
+	}
+
+	return result
+}
+
+// mostSpecificZone returns the index of the longest zone name the domain
+// belongs to, or -1 if there is none. Names are compared with trailing dots.
+func mostSpecificZone(domain string, zoneNames []string) int {
+	domain = domainWithTrailingDot(strings.ToLower(domain))
+
+	mostSpecific := -1
+	curLen := 0
+
+	for i, zoneName := range zoneNames {
+		zoneName = domainWithTrailingDot(strings.ToLower(zoneName))
+
+		if (domain == zoneName || strings.HasSuffix(domain, "."+zoneName)) && curLen < len(zoneName) {
+			curLen = len(zoneName)
+			mostSpecific = i
+		}
+	}
+
+	return mostSpecific
+}
+
+// zoneCache remembers the names of the zones of a provider for ttl, so the
+// zone of each name can be found without listing them every time.
+type zoneCache struct {
+	ttl time.Duration
+
+	names     []string
+	expiresAt time.Time
+}
+
+// find returns the index of the most specific zone the given name belongs to,
+// or -1 if there is none. The zones are listed again through list once the
+// ones we know of are older than ttl.
+func (c *zoneCache) find(dnsName string, now time.Time, list func() ([]string, error)) (int, error) {
+	if c.expiresAt.IsZero() || !now.Before(c.expiresAt) {
+		names, err := list()
+		if err != nil {
+			return -1, err
+		}
+
+		c.names = names
+		c.expiresAt = now.Add(c.ttl)
+	}
+
+	return mostSpecificZone(dnsName, c.names), nil
+}
+
+// zonesOf returns the indexes of the zones holding any of the given names, in
+// the order they were listed.
+func (c *zoneCache) zonesOf(dnsNames []string, now time.Time, list func() ([]string, error)) ([]int, error) {
+	held := map[int]bool{}
+	var indexes []int
+
+	for _, dnsName := range dnsNames {
+		i, err := c.find(dnsName, now, list)
+		if err != nil {
+			return nil, err
+		}
+
+		if i >= 0 && !held[i] {
+			held[i] = true
+			indexes = append(indexes, i)
+		}
+	}
+
+	sort.Ints(indexes)
+
+	return indexes, nil
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNewProviderUnknown(t *testing.T) {
+	provider, err := NewProvider("unknown", nil)
+	if err == nil {
+		t.Errorf("Expected error to be raised, but returned %v", provider)
+	}
+
+	if expected := `Unknown DNS provider "unknown"`; err != nil && err.Error() != expected {
+		t.Errorf("Expected error to be '%s', was '%v'", expected, err)
+	}
+}
+
+// testSeveralHostnamesError is the error CNAME endpoints with several targets
+// are refused with by the providers writing plain CNAME records.
+var testSeveralHostnamesError = errors.New("CNAME record for some.domain.com cannot point to several hostnames, got first.hostname.example.net,second.hostname.example.net")
+
+func testSeveralHostnamesEndpoint(owner string) Endpoint {
+	return Endpoint{
+		DNSName:    "some.domain.com",
+		RecordType: "CNAME",
+		Targets:    []string{"first.hostname.example.net", "second.hostname.example.net"},
+		Owner:      owner,
+	}
+}
+
+type ClosingProviderDummy struct {
+	ProviderDummy
+
+	closed bool
+}
+
+func (p *ClosingProviderDummy) Close() {
+	p.closed = true
+}
+
+func TestCloseProvider(t *testing.T) {
+	provider := &ClosingProviderDummy{ProviderDummy: ProviderDummy{t: t}}
+	closeProvider(provider)
+
+	if !provider.closed {
+		t.Errorf("Expected provider to be closed")
+	}
+
+	// Providers with nothing to release are left alone
+	closeProvider(ProviderDummy{t: t})
+}
+
+func TestEndpointRecords(t *testing.T) {
+	owner := "heritage=kubernetes-service-dns-update,cluster=default,service=/service"
+	ownerRecord := DNSRecord{Name: "_owner.some.domain.com", Type: "TXT", TTL: 300, Values: []string{`"` + owner + `"`}}
+
+	scenarios := []struct {
+		endpoint Endpoint
+
+		expectedRecords []DNSRecord
+		expectedError   error
+	}{
+		{
+			endpoint: Endpoint{DNSName: "some.domain.com.", RecordType: "A", Targets: []string{"203.0.113.10"}, Owner: owner},
+
+			expectedRecords: []DNSRecord{
+				DNSRecord{Name: "some.domain.com", Type: "A", TTL: 300, Values: []string{"203.0.113.10"}},
+				ownerRecord,
+			},
+		},
+		{
+			endpoint: Endpoint{DNSName: "some.domain.com", RecordType: "A", Targets: []string{"2001:db8::10", "203.0.113.10", "203.0.113.20"}, TTL: 60, Owner: owner},
+
+			expectedRecords: []DNSRecord{
+				DNSRecord{Name: "some.domain.com", Type: "A", TTL: 60, Values: []string{"203.0.113.10", "203.0.113.20"}},
+				DNSRecord{Name: "some.domain.com", Type: "AAAA", TTL: 60, Values: []string{"2001:db8::10"}},
+				ownerRecord,
+			},
+		},
+		{
+			endpoint: Endpoint{DNSName: "some.domain.com", RecordType: "CNAME", Targets: []string{"hostname.example.net"}, Owner: owner},
+
+			expectedRecords: []DNSRecord{
+				DNSRecord{Name: "some.domain.com", Type: "CNAME", TTL: 300, Values: []string{"hostname.example.net"}},
+				ownerRecord,
+			},
+		},
+		{
+			endpoint: testSeveralHostnamesEndpoint(owner),
+
+			expectedError: testSeveralHostnamesError,
+		},
+	}
+
+	for _, scenario := range scenarios {
+		records, err := endpointRecords(scenario.endpoint)
+
+		if !reflect.DeepEqual(err, scenario.expectedError) {
+			t.Errorf("Expected error to be '%v', was '%v'", scenario.expectedError, err)
+		}
+
+		if !reflect.DeepEqual(records, scenario.expectedRecords) {
+			t.Errorf("Expected records to be '%v', was '%v'", scenario.expectedRecords, records)
+		}
+	}
+}
+
+func TestOwnerFromTXT(t *testing.T) {
+	scenarios := []struct {
+		values []string
+
+		expectedOwner string
+	}{
+		{
+			values:        []string{`"v=spf1 -all"`},
+			expectedOwner: "",
+		},
+		{
+			values:        []string{`"v=spf1 -all"`, `"heritage=kubernetes-service-dns-update,cluster=default,service=/service"`},
+			expectedOwner: "heritage=kubernetes-service-dns-update,cluster=default,service=/service",
+		},
+	}
+
+	for _, scenario := range scenarios {
+		if owner := ownerFromTXT(scenario.values); owner != scenario.expectedOwner {
+			t.Errorf("Expected owner to be '%s', was '%s'", scenario.expectedOwner, owner)
+		}
+	}
+}
+
+func TestOwnedEndpoints(t *testing.T) {
+	owner := "heritage=kubernetes-service-dns-update,cluster=default,service=default/test"
+	legacyOwner := "heritage=kubernetes-service-dns-update,cluster=default,service=default/legacy"
+
+	records := []DNSRecord{
+		DNSRecord{Name: "some.domain.com.", Type: "AAAA", TTL: 60, Values: []string{"2001:db8::10"}},
+		DNSRecord{Name: "Some.Domain.com", Type: "A", TTL: 60, Values: []string{"203.0.113.10"}},
+		DNSRecord{Name: "some.domain.com", Type: "TXT", TTL: 300, Values: []string{`"` + legacyOwner + `"`}},
+		DNSRecord{Name: "_owner.some.domain.com", Type: "TXT", TTL: 300, Values: []string{`"` + owner + `"`}},
+		DNSRecord{Name: "legacy.domain.com", Type: "CNAME", TTL: 300, Values: []string{"some.hostname.example.net"}},
+		DNSRecord{Name: "legacy.domain.com", Type: "TXT", TTL: 300, Values: []string{`"` + legacyOwner + `"`}},
+		DNSRecord{Name: "unowned.domain.com", Type: "A", TTL: 300, Values: []string{"203.0.113.20"}},
+		DNSRecord{Name: "_owner.orphan.domain.com", Type: "TXT", TTL: 300, Values: []string{`"` + owner + `"`}},
+		DNSRecord{Name: "domain.com", Type: "TXT", TTL: 300, Values: []string{`"v=spf1 -all"`}},
+	}
+
+	expected := []Endpoint{
+		Endpoint{DNSName: "legacy.domain.com", RecordType: "CNAME", Targets: []string{"some.hostname.example.net"}, TTL: 300, Owner: legacyOwner},
+		Endpoint{DNSName: "some.domain.com", RecordType: "A", Targets: []string{"2001:db8::10", "203.0.113.10"}, TTL: 60, Owner: owner},
+	}
+
+	if endpoints := ownedEndpoints(records); !reflect.DeepEqual(endpoints, expected) {
+		t.Errorf("Expected endpoints to be '%v', was '%v'", expected, endpoints)
+	}
+}
+
+func TestZoneCache(t *testing.T) {
+	now := time.Now()
+	cache := &zoneCache{ttl: time.Hour}
+
+	lists := 0
+	list := func() ([]string, error) {
+		lists++
+		return []string{"domain.com", "sub.domain.com."}, nil
+	}
+
+	scenarios := []struct {
+		dnsName string
+		now     time.Time
+
+		expectedZone  int
+		expectedLists int
+	}{
+		{dnsName: "some.sub.domain.com", now: now, expectedZone: 1, expectedLists: 1},
+		{dnsName: "some.domain.com", now: now.Add(time.Minute), expectedZone: 0, expectedLists: 1},
+		{dnsName: "some.otherdomain.com", now: now.Add(time.Minute), expectedZone: -1, expectedLists: 1},
+		{dnsName: "some.domain.com", now: now.Add(time.Hour), expectedZone: 0, expectedLists: 2},
+	}
+
+	for _, scenario := range scenarios {
+		zone, err := cache.find(scenario.dnsName, scenario.now, list)
+		if err != nil {
+			t.Errorf("Expected no error, was '%v'", err)
+		}
+
+		if zone != scenario.expectedZone {
+			t.Errorf("Expected zone of %s to be %d, was %d", scenario.dnsName, scenario.expectedZone, zone)
+		}
+
+		if lists != scenario.expectedLists {
+			t.Errorf("Expected zones to be listed %d times, were %d", scenario.expectedLists, lists)
+		}
+	}
+
+	// Zones that could not be listed are listed again next time
+	cache = &zoneCache{ttl: time.Hour}
+	if _, err := cache.find("some.domain.com", now, func() ([]string, error) { return nil, errors.New("error") }); err == nil {
+		t.Error("Expected error to be returned")
+	}
+
+	if zone, err := cache.find("some.domain.com", now, list); err != nil || zone != 0 {
+		t.Errorf("Expected zone to be 0, was %d (%v)", zone, err)
+	}
+}
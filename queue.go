@@ -0,0 +1,79 @@
+package main
+
+import (
+	"sync"
+
+	"k8s.io/client-go/1.4/pkg/api/v1"
+)
+
+// QueuedService is the latest known state of a service waiting to be synced.
+type QueuedService struct {
+	Service v1.Service
+	Deleted bool
+}
+
+// ServiceQueue holds services waiting to be synced, keyed by namespace/name.
+// Adding a service that is already queued just replaces its state, so a burst
+// of events for the same service results in a single sync.
+type ServiceQueue struct {
+	mutex sync.Mutex
+	keys  []string
+	items map[string]QueuedService
+	ready chan struct{}
+}
+
+func NewServiceQueue() *ServiceQueue {
+	return &ServiceQueue{
+		items: map[string]QueuedService{},
+		ready: make(chan struct{}, 1),
+	}
+}
+
+func (q *ServiceQueue) Add(service v1.Service, deleted bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	key := ServiceKey(service)
+	if _, ok := q.items[key]; !ok {
+		q.keys = append(q.keys, key)
+	}
+	q.items[key] = QueuedService{
+		Service: service,
+		Deleted: deleted,
+	}
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Ready returns a channel that receives a value whenever items are added.
+func (q *ServiceQueue) Ready() <-chan struct{} {
+	return q.ready
+}
+
+// Pop removes the oldest queued service, returning false if the queue is empty.
+func (q *ServiceQueue) Pop() (QueuedService, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if len(q.keys) == 0 {
+		return QueuedService{}, false
+	}
+
+	key := q.keys[0]
+	q.keys = q.keys[1:]
+
+	item := q.items[key]
+	delete(q.items, key)
+
+	return item, true
+}
+
+func (q *ServiceQueue) Len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return len(q.keys)
+}
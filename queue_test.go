@@ -0,0 +1,72 @@
+package main
+
+import (
+	"testing"
+
+	"k8s.io/client-go/1.4/pkg/api/v1"
+)
+
+func queueTestService(namespace, name, domainNames string) v1.Service {
+	return v1.Service{
+		ObjectMeta: v1.ObjectMeta{
+			Name:        name,
+			Namespace:   namespace,
+			Annotations: map[string]string{"domainNames": domainNames},
+		},
+	}
+}
+
+func TestServiceQueue(t *testing.T) {
+	queue := NewServiceQueue()
+
+	if _, ok := queue.Pop(); ok {
+		t.Error("Expected empty queue to return nothing")
+	}
+
+	queue.Add(queueTestService("default", "first", "first.domain.com"), false)
+	queue.Add(queueTestService("default", "second", "second.domain.com"), false)
+	queue.Add(queueTestService("default", "first", "other.domain.com"), true)
+
+	select {
+	case <-queue.Ready():
+	default:
+		t.Error("Expected queue to be ready")
+	}
+
+	if queue.Len() != 2 {
+		t.Errorf("Expected queue to contain 2 items, contains %d", queue.Len())
+	}
+
+	scenarios := []struct {
+		expectedKey         string
+		expectedDomainNames string
+		expectedDeleted     bool
+	}{
+		{"default/first", "other.domain.com", true},
+		{"default/second", "second.domain.com", false},
+	}
+
+	for _, scenario := range scenarios {
+		item, ok := queue.Pop()
+		if !ok {
+			t.Errorf("Expected %s to be queued", scenario.expectedKey)
+			continue
+		}
+
+		if key := ServiceKey(item.Service); key != scenario.expectedKey {
+			t.Errorf("Expected key to be '%s', was '%s'", scenario.expectedKey, key)
+		}
+
+		if domainNames := item.Service.ObjectMeta.Annotations["domainNames"]; domainNames != scenario.expectedDomainNames {
+			t.Errorf("Expected domain names to be '%s', was '%s'", scenario.expectedDomainNames, domainNames)
+		}
+
+		if item.Deleted != scenario.expectedDeleted {
+			t.Errorf("Expected deleted to be '%v', was '%v'", scenario.expectedDeleted, item.Deleted)
+		}
+	}
+
+	if _, ok := queue.Pop(); ok {
+		t.Error("Expected queue to be drained")
+	}
+}
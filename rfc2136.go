@@ -0,0 +1,452 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// tsigAlgorithms maps the names accepted by -rfc2136-tsig-algorithm to the
+// algorithm names used on the wire.
+var tsigAlgorithms = map[string]string{
+	"hmac-md5":    dns.HmacMD5,
+	"hmac-sha1":   dns.HmacSHA1,
+	"hmac-sha256": dns.HmacSHA256,
+	"hmac-sha512": dns.HmacSHA512,
+}
+
+type rfc2136ZoneEntry struct {
+	zone      string
+	expiresAt time.Time
+}
+
+// RFC2136Provider keeps endpoints in the zones of an authoritative DNS server
+// (i.e. BIND) through RFC 2136 dynamic updates, optionally signed with TSIG.
+// Every update carries the ownership marker it expects to find as a
+// prerequisite, so records changed by someone else in the meantime are left
+// alone.
+type RFC2136Provider struct {
+	client  *dns.Client
+	server  string
+	keyName string
+	keyAlgo string
+	zoneTTL time.Duration
+	now     func() time.Time
+
+	zones map[string]rfc2136ZoneEntry
+
+	// Zones transferred to find the records left by an earlier run, as the
+	// ones holding records are otherwise only known once they are synced
+	transferZones []string
+}
+
+func NewRFC2136Provider(kubernetesClient KubernetesClient) (*RFC2136Provider, error) {
+	if rfc2136Server == "" {
+		return nil, errors.New("DNS server to send updates to must be set with -rfc2136-server")
+	}
+
+	server := rfc2136Server
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+
+	secret, err := loadTSIGSecret(kubernetesClient)
+	if err != nil {
+		return nil, err
+	}
+
+	provider, err := newRFC2136Provider(server, rfc2136TSIGKeyName, rfc2136TSIGAlgorithm, secret)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, zone := range strings.Split(rfc2136Zones, ",") {
+		if zone = strings.TrimSpace(zone); zone != "" {
+			provider.transferZones = append(provider.transferZones, dns.Fqdn(strings.ToLower(zone)))
+		}
+	}
+
+	return provider, nil
+}
+
+func newRFC2136Provider(server, keyName, keyAlgo, secret string) (*RFC2136Provider, error) {
+	provider := &RFC2136Provider{
+		client:  &dns.Client{Net: "tcp", Timeout: httpTimeout},
+		server:  server,
+		zoneTTL: time.Duration(zoneCacheTTL) * time.Second,
+		now:     time.Now,
+		zones:   map[string]rfc2136ZoneEntry{},
+	}
+
+	algorithm, ok := tsigAlgorithms[strings.ToLower(keyAlgo)]
+	if !ok {
+		return nil, fmt.Errorf("Unknown TSIG algorithm %q", keyAlgo)
+	}
+
+	if keyName == "" && secret == "" {
+		return provider, nil
+	}
+
+	if keyName == "" || secret == "" {
+		return nil, errors.New("TSIG key name and secret must be set together")
+	}
+
+	if _, err := base64.StdEncoding.DecodeString(secret); err != nil {
+		return nil, fmt.Errorf("TSIG secret of %s is not valid base64: %v", keyName, err)
+	}
+
+	provider.keyName = dns.Fqdn(strings.ToLower(keyName))
+	provider.keyAlgo = algorithm
+	provider.client.TsigSecret = map[string]string{provider.keyName: secret}
+
+	return provider, nil
+}
+
+// loadTSIGSecret returns the TSIG secret from the file given by
+// -rfc2136-tsig-secret-file, or from the 'secret' key of the Kubernetes secret
+// given by -rfc2136-tsig-secret.
+func loadTSIGSecret(kubernetesClient KubernetesClient) (string, error) {
+	if rfc2136TSIGSecretFile != "" {
+		data, err := ioutil.ReadFile(rfc2136TSIGSecretFile)
+		if err != nil {
+			return "", fmt.Errorf("Could not read TSIG secret: %v", err)
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+
+	if rfc2136TSIGSecret != "" {
+		parts := strings.SplitN(rfc2136TSIGSecret, "/", 2)
+		if len(parts) != 2 {
+			return "", fmt.Errorf("TSIG secret %q should be given as namespace/name", rfc2136TSIGSecret)
+		}
+
+		secret, err := kubernetesClient.GetSecret(parts[0], parts[1])
+		if err != nil {
+			return "", fmt.Errorf("Could not get TSIG secret %s: %v", rfc2136TSIGSecret, err)
+		}
+
+		value, ok := secret.Data["secret"]
+		if !ok {
+			return "", fmt.Errorf("Secret %s has no 'secret' key", rfc2136TSIGSecret)
+		}
+		return strings.TrimSpace(string(value)), nil
+	}
+
+	return "", nil
+}
+
+func (p *RFC2136Provider) GetOwner(dnsName string) (string, bool, error) {
+	records, err := p.endpointRecords(dnsName)
+	if err != nil {
+		return "", false, err
+	}
+
+	exists := false
+	var txt []string
+
+	for _, rr := range records {
+		if record, ok := rr.(*dns.TXT); ok {
+			txt = append(txt, strings.Join(record.Txt, ""))
+		} else {
+			exists = true
+		}
+	}
+
+	return ownerFromTXT(txt), exists, nil
+}
+
+// ApplyChanges sends one dynamic update per endpoint, replacing its records
+// with the desired ones at once.
+func (p *RFC2136Provider) ApplyChanges(changes []DNSChange) []error {
+	errs := make([]error, len(changes))
+
+	for i, change := range changes {
+		errs[i] = p.applyChange(change)
+	}
+
+	return errs
+}
+
+func (p *RFC2136Provider) applyChange(change DNSChange) error {
+	dnsName := dns.Fqdn(strings.ToLower(change.Endpoint.DNSName))
+	ownerName := dns.Fqdn(ownerRecordName(dnsName))
+
+	zone, err := p.zone(dnsName)
+	if err != nil {
+		return err
+	}
+
+	current, err := p.endpointRecords(dnsName)
+	if err != nil {
+		return err
+	}
+
+	var desired []dns.RR
+	if change.Action != "DELETE" {
+		desired, err = rfc2136RecordsFromEndpoint(change.Endpoint)
+		if err != nil {
+			return err
+		}
+	}
+
+	if sameRecords(current, desired) {
+		return nil
+	}
+
+	m := new(dns.Msg)
+	m.SetUpdate(zone)
+
+	// The records must still be owned as they were when they were looked up,
+	// or not exist at all if they were not there
+	var currentOwner []dns.RR
+	for _, rr := range current {
+		if rr.Header().Rrtype == dns.TypeTXT {
+			rr = dns.Copy(rr)
+			rr.Header().Ttl = 0
+			currentOwner = append(currentOwner, rr)
+		}
+	}
+
+	if len(currentOwner) > 0 {
+		m.Used(currentOwner)
+	} else {
+		m.RRsetNotUsed(rrsetHeaders(ownerName, dns.TypeTXT))
+		m.RRsetNotUsed(rrsetHeaders(dnsName, dns.TypeA, dns.TypeAAAA, dns.TypeCNAME))
+	}
+
+	m.RemoveRRset(rrsetHeaders(dnsName, dns.TypeA, dns.TypeAAAA, dns.TypeCNAME))
+	m.RemoveRRset(rrsetHeaders(ownerName, dns.TypeTXT))
+	if len(desired) > 0 {
+		m.Insert(desired)
+	}
+
+	if dryRun {
+		log.Printf("DRY RUN: We normally would have sent an update to %s replacing the records of %s with %v\n", p.server, dnsName, desired)
+		return nil
+	}
+
+	resp, err := p.exchange(m)
+	if err != nil {
+		return fmt.Errorf("Could not update %s: %v", dnsName, err)
+	}
+
+	if resp.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("Update of %s refused by %s: %s", dnsName, p.server, dns.RcodeToString[resp.Rcode])
+	}
+
+	return nil
+}
+
+// ListEndpoints transfers the zones given by -rfc2136-zones, if any, whatever
+// the names, which the server must allow with the TSIG key of the updates.
+func (p *RFC2136Provider) ListEndpoints(dnsNames []string) ([]Endpoint, error) {
+	var records []DNSRecord
+
+	for _, zone := range p.transferZones {
+		m := new(dns.Msg)
+		m.SetAxfr(zone)
+		if p.keyName != "" {
+			m.SetTsig(p.keyName, p.keyAlgo, 300, p.now().Unix())
+		}
+
+		transfer := &dns.Transfer{DialTimeout: httpTimeout, ReadTimeout: httpTimeout, TsigSecret: p.client.TsigSecret}
+		envelopes, err := transfer.In(m, p.server)
+		if err != nil {
+			return nil, fmt.Errorf("Could not transfer zone %s: %v", zone, err)
+		}
+
+		// The channel must be drained for the transfer to finish
+		var transferErr error
+		for envelope := range envelopes {
+			if envelope.Error != nil {
+				transferErr = envelope.Error
+				continue
+			}
+			records = append(records, recordsFromRRs(envelope.RR)...)
+		}
+
+		if transferErr != nil {
+			return nil, fmt.Errorf("Could not transfer zone %s: %v", zone, transferErr)
+		}
+	}
+
+	return ownedEndpoints(records), nil
+}
+
+// zone returns the zone the given name belongs to, as given by the SOA record
+// returned for its ownership record. Zones are cached for the zone cache TTL.
+func (p *RFC2136Provider) zone(dnsName string) (string, error) {
+	dnsName = dns.Fqdn(strings.ToLower(dnsName))
+
+	if entry, ok := p.zones[dnsName]; ok && p.now().Before(entry.expiresAt) {
+		return entry.zone, nil
+	}
+
+	// The ownership record never is a CNAME, which would hide the SOA record
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(ownerRecordName(dnsName)), dns.TypeSOA)
+	m.RecursionDesired = false
+
+	resp, err := p.exchange(m)
+	if err != nil {
+		return "", fmt.Errorf("Could not find zone of %s: %v", dnsName, err)
+	}
+
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		return "", fmt.Errorf("Could not find zone of %s: %s", dnsName, dns.RcodeToString[resp.Rcode])
+	}
+
+	for _, rr := range append(resp.Answer, resp.Ns...) {
+		if soa, ok := rr.(*dns.SOA); ok {
+			zone := strings.ToLower(soa.Hdr.Name)
+			p.zones[dnsName] = rfc2136ZoneEntry{zone, p.now().Add(p.zoneTTL)}
+			return zone, nil
+		}
+	}
+
+	return "", fmt.Errorf("No zone found for %s on %s (%s)", dnsName, p.server, dns.RcodeToString[resp.Rcode])
+}
+
+// endpointRecords returns the address records stored for the given name,
+// along with its TXT ownership records.
+func (p *RFC2136Provider) endpointRecords(dnsName string) ([]dns.RR, error) {
+	dnsName = dns.Fqdn(strings.ToLower(dnsName))
+
+	var records []dns.RR
+	for _, recordType := range []uint16{dns.TypeA, dns.TypeAAAA, dns.TypeCNAME} {
+		rrs, err := p.records(dnsName, recordType)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, rrs...)
+	}
+
+	rrs, err := p.records(dns.Fqdn(ownerRecordName(dnsName)), dns.TypeTXT)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(records, rrs...), nil
+}
+
+// records returns the records of the given type stored for a name, leaving
+// out the ones a CNAME record would lead to.
+func (p *RFC2136Provider) records(dnsName string, recordType uint16) ([]dns.RR, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(dnsName, recordType)
+	m.RecursionDesired = false
+
+	resp, err := p.exchange(m)
+	if err != nil {
+		return nil, fmt.Errorf("Could not query %s records of %s: %v", dns.TypeToString[recordType], dnsName, err)
+	}
+
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		return nil, fmt.Errorf("Could not query %s records of %s: %s", dns.TypeToString[recordType], dnsName, dns.RcodeToString[resp.Rcode])
+	}
+
+	var records []dns.RR
+	for _, rr := range resp.Answer {
+		if rr.Header().Rrtype == recordType && strings.EqualFold(rr.Header().Name, dnsName) {
+			records = append(records, rr)
+		}
+	}
+
+	return records, nil
+}
+
+func (p *RFC2136Provider) exchange(m *dns.Msg) (*dns.Msg, error) {
+	if p.keyName != "" {
+		m.SetTsig(p.keyName, p.keyAlgo, 300, p.now().Unix())
+	}
+
+	resp, _, err := p.client.Exchange(m, p.server)
+	return resp, err
+}
+
+// rfc2136RecordsFromEndpoint returns the records of the given endpoint, with
+// fully qualified names and targets.
+func rfc2136RecordsFromEndpoint(endpoint Endpoint) ([]dns.RR, error) {
+	dnsRecords, err := endpointRecords(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []dns.RR
+
+	for _, record := range dnsRecords {
+		for _, value := range record.Values {
+			if record.Type == "CNAME" {
+				value = dns.Fqdn(value)
+			}
+
+			rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", dns.Fqdn(record.Name), record.TTL, record.Type, value))
+			if err != nil {
+				return nil, fmt.Errorf("Invalid %s record for %s: %v", record.Type, record.Name, err)
+			}
+			records = append(records, rr)
+		}
+	}
+
+	return records, nil
+}
+
+// recordsFromRRs returns the address and TXT records among the given ones, as
+// opposed to rfc2136RecordsFromEndpoint.
+func recordsFromRRs(rrs []dns.RR) []DNSRecord {
+	var records []DNSRecord
+
+	for _, rr := range rrs {
+		header := rr.Header()
+		record := DNSRecord{Name: strings.TrimSuffix(header.Name, "."), Type: dns.TypeToString[header.Rrtype], TTL: int64(header.Ttl)}
+
+		switch rr := rr.(type) {
+		case *dns.A:
+			record.Values = []string{rr.A.String()}
+		case *dns.AAAA:
+			record.Values = []string{rr.AAAA.String()}
+		case *dns.CNAME:
+			record.Values = []string{strings.TrimSuffix(rr.Target, ".")}
+		case *dns.TXT:
+			record.Values = []string{strings.Join(rr.Txt, "")}
+		default:
+			continue
+		}
+
+		records = append(records, record)
+	}
+
+	return records
+}
+
+// rrsetHeaders returns placeholder records naming the given record sets, as
+// expected by the prerequisites and deletions of dynamic updates.
+func rrsetHeaders(dnsName string, recordTypes ...uint16) []dns.RR {
+	var records []dns.RR
+	for _, recordType := range recordTypes {
+		records = append(records, &dns.ANY{Hdr: dns.RR_Header{Name: dnsName, Rrtype: recordType, Class: dns.ClassINET}})
+	}
+	return records
+}
+
+// sameRecords returns whether both lists hold the same records, in any order.
+func sameRecords(a, b []dns.RR) bool {
+	as := make([]string, len(a))
+	for i := range a {
+		as[i] = a[i].String()
+	}
+
+	bs := make([]string, len(b))
+	for i := range b {
+		bs[i] = b[i].String()
+	}
+
+	return sameStrings(as, bs)
+}
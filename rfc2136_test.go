@@ -0,0 +1,514 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+)
+
+const (
+	testTSIGKeyName  = "update-key."
+	testTSIGSecret   = "c2VjcmV0LXNlY3JldC1zZWNyZXQ="
+	testRFC2136Owner = "heritage=kubernetes-service-dns-update,cluster=default,service=/service"
+)
+
+// FakeAuthoritativeServer is an in-process authoritative server for a few
+// zones, answering queries and applying dynamic updates (prerequisites
+// included) signed with the test TSIG key.
+type FakeAuthoritativeServer struct {
+	t *testing.T
+
+	zones   []string
+	records []dns.RR
+	updates int
+
+	server *dns.Server
+}
+
+func NewFakeAuthoritativeServer(t *testing.T, zones []string, records ...string) *FakeAuthoritativeServer {
+	f := &FakeAuthoritativeServer{t: t, zones: zones}
+
+	for _, zone := range zones {
+		f.records = append(f.records, testRR(t, zone+" 3600 IN SOA ns.domain.com. admin.domain.com. 1 3600 600 86400 60"))
+	}
+	for _, record := range records {
+		f.records = append(f.records, testRR(t, record))
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+
+	started := make(chan struct{})
+	f.server = &dns.Server{
+		Listener:          listener,
+		Handler:           f,
+		TsigSecret:        map[string]string{testTSIGKeyName: testTSIGSecret},
+		NotifyStartedFunc: func() { close(started) },
+	}
+
+	go f.server.ActivateAndServe()
+	<-started
+
+	return f
+}
+
+func (f *FakeAuthoritativeServer) Addr() string {
+	return f.server.Listener.Addr().String()
+}
+
+func (f *FakeAuthoritativeServer) Close() {
+	f.server.Shutdown()
+}
+
+// Records returns the records other than SOA held by the server, sorted.
+func (f *FakeAuthoritativeServer) Records() []string {
+	var records []string
+	for _, rr := range f.records {
+		if rr.Header().Rrtype != dns.TypeSOA {
+			records = append(records, strings.Replace(rr.String(), "\t", " ", -1))
+		}
+	}
+	sort.Strings(records)
+	return records
+}
+
+func (f *FakeAuthoritativeServer) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = true
+
+	if r.IsTsig() != nil {
+		if w.TsigStatus() != nil {
+			m.Rcode = dns.RcodeNotAuth
+			w.WriteMsg(m)
+			return
+		}
+		m.SetTsig(testTSIGKeyName, r.IsTsig().Algorithm, 300, time.Now().Unix())
+	}
+
+	question := r.Question[0]
+	zone := f.zone(question.Name)
+
+	switch {
+	case zone == "":
+		m.Rcode = dns.RcodeRefused
+	case r.Opcode == dns.OpcodeUpdate:
+		if r.IsTsig() == nil {
+			m.Rcode = dns.RcodeRefused
+		} else {
+			m.Rcode = f.update(r)
+		}
+	case question.Qtype == dns.TypeAXFR:
+		if r.IsTsig() == nil {
+			m.Rcode = dns.RcodeRefused
+			break
+		}
+
+		// The whole zone fits in one message, between two copies of its SOA
+		soa := f.lookup(zone, dns.TypeSOA)
+		m.Answer = append(m.Answer, soa...)
+		for _, rr := range f.records {
+			if rr.Header().Rrtype != dns.TypeSOA && f.zone(rr.Header().Name) == zone {
+				m.Answer = append(m.Answer, rr)
+			}
+		}
+		m.Answer = append(m.Answer, soa...)
+	default:
+		m.Answer = f.lookup(question.Name, question.Qtype)
+		if len(m.Answer) == 0 {
+			if len(f.lookup(question.Name, dns.TypeANY)) == 0 {
+				m.Rcode = dns.RcodeNameError
+			}
+			m.Ns = f.lookup(zone, dns.TypeSOA)
+		}
+	}
+
+	w.WriteMsg(m)
+}
+
+func (f *FakeAuthoritativeServer) zone(name string) string {
+	zone := ""
+	for _, z := range f.zones {
+		if dns.IsSubDomain(z, name) && len(z) > len(zone) {
+			zone = z
+		}
+	}
+	return zone
+}
+
+func (f *FakeAuthoritativeServer) lookup(name string, rrtype uint16) []dns.RR {
+	var records []dns.RR
+	for _, rr := range f.records {
+		if strings.EqualFold(rr.Header().Name, name) && (rrtype == dns.TypeANY || rr.Header().Rrtype == rrtype) {
+			records = append(records, rr)
+		}
+	}
+	return records
+}
+
+func (f *FakeAuthoritativeServer) update(r *dns.Msg) int {
+	// Value dependent prerequisites must match whole record sets
+	expected := map[[2]interface{}][]string{}
+
+	for _, rr := range r.Answer {
+		header := rr.Header()
+		existing := f.lookup(header.Name, header.Rrtype)
+
+		switch {
+		case header.Class == dns.ClassANY && header.Rrtype == dns.TypeANY:
+			if len(f.lookup(header.Name, dns.TypeANY)) == 0 {
+				return dns.RcodeNameError
+			}
+		case header.Class == dns.ClassNONE && header.Rrtype == dns.TypeANY:
+			if len(f.lookup(header.Name, dns.TypeANY)) > 0 {
+				return dns.RcodeYXDomain
+			}
+		case header.Class == dns.ClassANY:
+			if len(existing) == 0 {
+				return dns.RcodeNXRrset
+			}
+		case header.Class == dns.ClassNONE:
+			if len(existing) > 0 {
+				return dns.RcodeYXRrset
+			}
+		default:
+			key := [2]interface{}{strings.ToLower(header.Name), header.Rrtype}
+			expected[key] = append(expected[key], rdata(rr))
+		}
+	}
+
+	for key, values := range expected {
+		var actual []string
+		for _, rr := range f.lookup(key[0].(string), key[1].(uint16)) {
+			actual = append(actual, rdata(rr))
+		}
+		sort.Strings(values)
+		sort.Strings(actual)
+		if !reflect.DeepEqual(values, actual) {
+			return dns.RcodeNXRrset
+		}
+	}
+
+	for _, rr := range r.Ns {
+		header := rr.Header()
+
+		switch header.Class {
+		case dns.ClassANY:
+			f.remove(func(other dns.RR) bool {
+				return strings.EqualFold(other.Header().Name, header.Name) && other.Header().Rrtype != dns.TypeSOA &&
+					(header.Rrtype == dns.TypeANY || other.Header().Rrtype == header.Rrtype)
+			})
+		case dns.ClassNONE:
+			f.remove(func(other dns.RR) bool {
+				return strings.EqualFold(other.Header().Name, header.Name) && other.Header().Rrtype == header.Rrtype && rdata(other) == rdata(rr)
+			})
+		default:
+			f.records = append(f.records, dns.Copy(rr))
+		}
+	}
+
+	f.updates++
+	return dns.RcodeSuccess
+}
+
+func (f *FakeAuthoritativeServer) remove(match func(dns.RR) bool) {
+	var records []dns.RR
+	for _, rr := range f.records {
+		if !match(rr) {
+			records = append(records, rr)
+		}
+	}
+	f.records = records
+}
+
+func rdata(rr dns.RR) string {
+	return strings.TrimPrefix(rr.String(), rr.Header().String())
+}
+
+func testRR(t *testing.T, s string) dns.RR {
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatalf("Invalid record %q: %v", s, err)
+	}
+	return rr
+}
+
+func testRFC2136Provider(t *testing.T, server *FakeAuthoritativeServer, secret string) *RFC2136Provider {
+	provider, err := newRFC2136Provider(server.Addr(), "update-key", "hmac-sha256", secret)
+	if err != nil {
+		t.Fatalf("Could not create provider: %v", err)
+	}
+	return provider
+}
+
+func TestRFC2136ProviderGetOwner(t *testing.T) {
+	scenarios := []struct {
+		dnsName string
+		records []string
+
+		expectedOwner  string
+		expectedExists bool
+	}{
+		// No records for the name
+		{
+			dnsName: "some.domain.com",
+		},
+
+		// Record not owned by anybody
+		{
+			dnsName: "some.domain.com",
+			records: []string{`some.domain.com. 300 IN CNAME other.domain.com.`},
+
+			expectedExists: true,
+		},
+
+		// Record owned in the most specific zone
+		{
+			dnsName: "some.sub.domain.com",
+			records: []string{
+				`some.sub.domain.com. 300 IN A 203.0.113.10`,
+				`_owner.some.sub.domain.com. 300 IN TXT "v=spf1 -all"`,
+				`_owner.some.sub.domain.com. 300 IN TXT "` + testRFC2136Owner + `"`,
+			},
+
+			expectedOwner:  testRFC2136Owner,
+			expectedExists: true,
+		},
+	}
+
+	for _, scenario := range scenarios {
+		server := NewFakeAuthoritativeServer(t, []string{"domain.com.", "sub.domain.com."}, scenario.records...)
+		provider := testRFC2136Provider(t, server, testTSIGSecret)
+
+		owner, exists, err := provider.GetOwner(scenario.dnsName)
+
+		if err != nil {
+			t.Errorf("Expected no error, was '%v'", err)
+		}
+
+		if owner != scenario.expectedOwner || exists != scenario.expectedExists {
+			t.Errorf("Expected owner of %s to be '%s' (%v), was '%s' (%v)", scenario.dnsName, scenario.expectedOwner, scenario.expectedExists, owner, exists)
+		}
+
+		server.Close()
+	}
+}
+
+func TestRFC2136ProviderApplyChanges(t *testing.T) {
+	endpoint := Endpoint{
+		DNSName:    "some.sub.domain.com",
+		RecordType: "A",
+		Targets:    []string{"203.0.113.10"},
+		Owner:      testRFC2136Owner,
+	}
+
+	owned := `_owner.some.sub.domain.com. 300 IN TXT "` + testRFC2136Owner + `"`
+
+	scenarios := []struct {
+		description string
+		changes     []DNSChange
+		records     []string
+		secret      string
+
+		expectedRecords []string
+		expectedUpdates int
+		expectedErrors  []error
+	}{
+		{
+			description: "records are created in the most specific zone",
+			changes:     []DNSChange{DNSChange{Action: "UPSERT", Endpoint: endpoint}},
+
+			expectedRecords: []string{owned, "some.sub.domain.com. 300 IN A 203.0.113.10"},
+			expectedUpdates: 1,
+			expectedErrors:  []error{nil},
+		},
+		{
+			description: "CNAME records are replaced by A records",
+			changes:     []DNSChange{DNSChange{Action: "UPSERT", Endpoint: endpoint}},
+			records:     []string{owned, "some.sub.domain.com. 300 IN CNAME lb.hostname.example.net."},
+
+			expectedRecords: []string{owned, "some.sub.domain.com. 300 IN A 203.0.113.10"},
+			expectedUpdates: 1,
+			expectedErrors:  []error{nil},
+		},
+		{
+			description: "records already up to date are left alone",
+			changes:     []DNSChange{DNSChange{Action: "UPSERT", Endpoint: endpoint}},
+			records:     []string{owned, "some.sub.domain.com. 300 IN A 203.0.113.10"},
+
+			expectedRecords: []string{owned, "some.sub.domain.com. 300 IN A 203.0.113.10"},
+			expectedErrors:  []error{nil},
+		},
+		{
+			description: "records are deleted",
+			changes:     []DNSChange{DNSChange{Action: "DELETE", Endpoint: endpoint}},
+			records:     []string{owned, "some.sub.domain.com. 300 IN A 203.0.113.10"},
+
+			expectedUpdates: 1,
+			expectedErrors:  []error{nil},
+		},
+		{
+			description: "unowned records are not clobbered",
+			changes:     []DNSChange{DNSChange{Action: "UPSERT", Endpoint: endpoint}},
+			records:     []string{"some.sub.domain.com. 300 IN A 198.51.100.1"},
+
+			expectedRecords: []string{"some.sub.domain.com. 300 IN A 198.51.100.1"},
+			expectedErrors:  []error{errors.New("Update of some.sub.domain.com. refused by SERVER: YXRRSET")},
+		},
+		{
+			description: "updates signed with the wrong key are refused",
+			changes:     []DNSChange{DNSChange{Action: "UPSERT", Endpoint: endpoint}},
+			secret:      "d3Jvbmc=",
+
+			expectedErrors: []error{errors.New("Could not find zone of some.sub.domain.com.: NOTAUTH")},
+		},
+		{
+			description: "CNAME records with several hostnames are refused",
+			changes:     []DNSChange{DNSChange{Action: "UPSERT", Endpoint: testSeveralHostnamesEndpoint(testRFC2136Owner)}},
+			records:     []string{"some.domain.com. 300 IN A 203.0.113.10"},
+
+			expectedRecords: []string{"some.domain.com. 300 IN A 203.0.113.10"},
+			expectedErrors:  []error{testSeveralHostnamesError},
+		},
+	}
+
+	for _, scenario := range scenarios {
+		server := NewFakeAuthoritativeServer(t, []string{"domain.com.", "sub.domain.com."}, scenario.records...)
+
+		secret := testTSIGSecret
+		if scenario.secret != "" {
+			secret = scenario.secret
+		}
+		provider := testRFC2136Provider(t, server, secret)
+
+		errs := provider.ApplyChanges(scenario.changes)
+
+		for i, err := range errs {
+			if err != nil {
+				errs[i] = errors.New(strings.Replace(err.Error(), server.Addr(), "SERVER", -1))
+			}
+		}
+
+		if !reflect.DeepEqual(errs, scenario.expectedErrors) {
+			t.Errorf("Expected errors to be '%v' when %s, was '%v'", scenario.expectedErrors, scenario.description, errs)
+		}
+
+		var expectedRecords []string
+		for _, record := range scenario.expectedRecords {
+			expectedRecords = append(expectedRecords, strings.Replace(testRR(t, record).String(), "\t", " ", -1))
+		}
+		sort.Strings(expectedRecords)
+
+		if records := server.Records(); !reflect.DeepEqual(records, expectedRecords) {
+			t.Errorf("Expected records to be '%v' when %s, was '%v'", expectedRecords, scenario.description, records)
+		}
+
+		if server.updates != scenario.expectedUpdates {
+			t.Errorf("Expected %d updates when %s, got %d", scenario.expectedUpdates, scenario.description, server.updates)
+		}
+
+		server.Close()
+	}
+}
+
+func TestRFC2136ProviderTSIGAlgorithms(t *testing.T) {
+	endpoint := Endpoint{
+		DNSName:    "some.domain.com",
+		RecordType: "A",
+		Targets:    []string{"203.0.113.10"},
+		Owner:      testRFC2136Owner,
+	}
+
+	for _, algorithm := range []string{"hmac-md5", "hmac-sha1", "hmac-sha256", "HMAC-SHA512"} {
+		server := NewFakeAuthoritativeServer(t, []string{"domain.com."})
+
+		provider, err := newRFC2136Provider(server.Addr(), "update-key", algorithm, testTSIGSecret)
+		if err != nil {
+			t.Fatalf("Could not create provider with %s: %v", algorithm, err)
+		}
+
+		errs := provider.ApplyChanges([]DNSChange{DNSChange{Action: "UPSERT", Endpoint: endpoint}})
+		if !reflect.DeepEqual(errs, []error{nil}) {
+			t.Errorf("Expected update signed with %s to be applied, got '%v'", algorithm, errs)
+		}
+
+		if server.updates != 1 {
+			t.Errorf("Expected 1 update signed with %s, got %d", algorithm, server.updates)
+		}
+
+		server.Close()
+	}
+
+	expectedError := errors.New(`Unknown TSIG algorithm "hmac-sha384"`)
+	if _, err := newRFC2136Provider("127.0.0.1:53", "update-key", "hmac-sha384", testTSIGSecret); !reflect.DeepEqual(err, expectedError) {
+		t.Errorf("Expected error to be '%v', was '%v'", expectedError, err)
+	}
+}
+
+func TestRFC2136ProviderListEndpoints(t *testing.T) {
+	server := NewFakeAuthoritativeServer(t, []string{"domain.com.", "sub.domain.com."},
+		`domain.com. 300 IN TXT "v=spf1 -all"`,
+		`some.domain.com. 300 IN CNAME elb.hostname.amazonaws.com.`,
+		`_owner.some.domain.com. 300 IN TXT "`+testRFC2136Owner+`"`,
+		`other.domain.com. 300 IN A 203.0.113.20`,
+		`some.sub.domain.com. 60 IN A 203.0.113.10`,
+		`_owner.some.sub.domain.com. 300 IN TXT "`+testRFC2136Owner+`"`,
+	)
+	defer server.Close()
+
+	provider := testRFC2136Provider(t, server, testTSIGSecret)
+
+	// Without zones to transfer, none of the records can be found
+	endpoints, err := provider.ListEndpoints(nil)
+	if err != nil || len(endpoints) != 0 {
+		t.Errorf("Expected no endpoints, was '%v' (%v)", endpoints, err)
+	}
+
+	provider.transferZones = []string{"domain.com."}
+
+	endpoints, err = provider.ListEndpoints(nil)
+	if err != nil {
+		t.Errorf("Expected no error, was '%v'", err)
+	}
+
+	expected := []Endpoint{
+		Endpoint{DNSName: "some.domain.com", RecordType: "CNAME", Targets: []string{"elb.hostname.amazonaws.com"}, TTL: 300, Owner: testRFC2136Owner},
+	}
+
+	if !reflect.DeepEqual(endpoints, expected) {
+		t.Errorf("Expected endpoints to be '%v', was '%v'", expected, endpoints)
+	}
+}
+
+func TestLoadTSIGSecret(t *testing.T) {
+	defer func(value string) { rfc2136TSIGSecret = value }(rfc2136TSIGSecret)
+	rfc2136TSIGSecret = "kube-system/tsig"
+
+	client := KubernetesClientDummy{
+		t: t,
+		getSecretOutput: &v1.Secret{
+			Data: map[string][]byte{"secret": []byte(testTSIGSecret + "\n")},
+		},
+	}
+
+	secret, err := loadTSIGSecret(client)
+	if err != nil || secret != testTSIGSecret {
+		t.Errorf("Expected secret to be '%s', was '%s' (%v)", testTSIGSecret, secret, err)
+	}
+
+	client.getSecretOutput = &v1.Secret{Data: map[string][]byte{}}
+
+	expectedError := errors.New("Secret kube-system/tsig has no 'secret' key")
+	if _, err := loadTSIGSecret(client); !reflect.DeepEqual(err, expectedError) {
+		t.Errorf("Expected error to be '%v', was '%v'", expectedError, err)
+	}
+}
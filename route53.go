@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Route53Provider keeps endpoints as Route53 alias records to the load
+// balancers they point to, as plain A/AAAA records to the IP addresses of the
+// load balancers that have no hostname, or as CNAME records to any other
+// hostname.
+type Route53Provider struct {
+	awsClient AWSClient
+}
+
+func NewRoute53Provider() (*Route53Provider, error) {
+	awsClientImpl, err := NewAWSClient()
+	if err != nil {
+		return nil, err
+	}
+
+	awsClient := NewCachingAWSClient(awsClientImpl,
+		time.Duration(zoneCacheTTL)*time.Second,
+		time.Duration(loadBalancerCacheTTL)*time.Second,
+		time.Duration(negativeCacheTTL)*time.Second)
+
+	return &Route53Provider{
+		awsClient: awsClient,
+	}, nil
+}
+
+func (p *Route53Provider) GetOwner(dnsName string) (string, bool, error) {
+	hostedZoneID, err := p.awsClient.GetHostedZoneID(dnsName)
+	if err != nil {
+		return "", false, fmt.Errorf("Could not find hosted zone: %v", err)
+	}
+
+	return p.awsClient.GetDNSOwner(dnsName, hostedZoneID)
+}
+
+// ListEndpoints lists the hosted zones of the given names, leaving out the
+// names without one.
+func (p *Route53Provider) ListEndpoints(dnsNames []string) ([]Endpoint, error) {
+	var hostedZoneIDs []string
+	listed := map[string]bool{}
+
+	for _, dnsName := range dnsNames {
+		hostedZoneID, err := p.awsClient.GetHostedZoneID(dnsName)
+		if _, notFound := err.(*zoneNotFoundError); notFound {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Could not find hosted zone: %v", err)
+		}
+
+		if !listed[hostedZoneID] {
+			listed[hostedZoneID] = true
+			hostedZoneIDs = append(hostedZoneIDs, hostedZoneID)
+		}
+	}
+
+	records, err := p.awsClient.ListDNSRecords(hostedZoneIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	return ownedEndpoints(records), nil
+}
+
+// ApplyChanges looks up the hosted zones of each endpoint and its load
+// balancer, and submits all changes that could be resolved at once.
+func (p *Route53Provider) ApplyChanges(changes []DNSChange) []error {
+	errs := make([]error, len(changes))
+
+	var route53Changes []Route53Change
+	var indexes []int
+
+	for i, change := range changes {
+		record, err := p.route53Record(change)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+
+		route53Changes = append(route53Changes, Route53Change{Action: change.Action, Record: record})
+		indexes = append(indexes, i)
+	}
+
+	if len(route53Changes) == 0 {
+		return errs
+	}
+
+	for j, err := range p.awsClient.ApplyDNSChanges(route53Changes) {
+		errs[indexes[j]] = err
+	}
+
+	return errs
+}
+
+func (p *Route53Provider) route53Record(change DNSChange) (Route53Record, error) {
+	endpoint := change.Endpoint
+
+	if endpoint.RecordType != "CNAME" && endpoint.RecordType != "A" && endpoint.RecordType != "AAAA" {
+		return Route53Record{}, fmt.Errorf("Only load balancer hostnames and IP addresses are supported by Route53, got %s record for %s", endpoint.RecordType, endpoint.DNSName)
+	}
+
+	if len(endpoint.Targets) == 0 {
+		return Route53Record{}, fmt.Errorf("No load balancer found for %s", endpoint.DNSName)
+	}
+
+	// Only load balancers get aliases, so any other hostname needs a CNAME
+	// record, which cannot point to more than one of them
+	if endpoint.RecordType == "CNAME" && len(endpoint.Targets) > 1 && !allLoadBalancerHostnames(endpoint.Targets) {
+		return Route53Record{}, fmt.Errorf("CNAME record for %s cannot point to several hostnames that are not all load balancers, got %s", endpoint.DNSName, strings.Join(endpoint.Targets, ","))
+	}
+
+	domainHostedZoneID, err := p.awsClient.GetHostedZoneID(endpoint.DNSName)
+	if err != nil {
+		return Route53Record{}, fmt.Errorf("Could not find hosted zone: %v", err)
+	}
+
+	record := Route53Record{
+		DomainName:         endpoint.DNSName,
+		DomainHostedZoneID: domainHostedZoneID,
+		Owner:              endpoint.Owner,
+	}
+
+	// Load balancers with IP addresses get plain records instead of aliases
+	if endpoint.RecordType != "CNAME" {
+		record.IPs = endpoint.Targets
+		record.TTL = endpoint.TTL
+		return record, nil
+	}
+
+	// Other hostnames (i.e. the external name of a service) get a CNAME record
+	if !allLoadBalancerHostnames(endpoint.Targets) {
+		record.CNAME = endpoint.Targets[0]
+		record.TTL = endpoint.TTL
+		return record, nil
+	}
+
+	for _, hostname := range endpoint.Targets {
+		loadBalancer := Route53LoadBalancer{Hostname: hostname}
+
+		// Records are deleted as they currently are, so the load balancer
+		// (which might be gone already) does not need to be looked up
+		if change.Action != "DELETE" {
+			loadBalancer.HostedZoneID, err = p.awsClient.GetLoadBalancerHostedZoneID(hostname)
+			if err != nil {
+				return Route53Record{}, fmt.Errorf("Could not get zone ID: %v", err)
+			}
+		}
+
+		record.LoadBalancers = append(record.LoadBalancers, loadBalancer)
+	}
+
+	return record, nil
+}
+
+// allLoadBalancerHostnames returns whether every given hostname is the one of
+// an AWS load balancer.
+func allLoadBalancerHostnames(hostnames []string) bool {
+	for _, hostname := range hostnames {
+		if !isLoadBalancerHostname(hostname) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+type AWSClientDummy struct {
+	t *testing.T
+
+	getHostedZoneIDDomain string
+	getHostedZoneIDs      map[string]string
+	getHostedZoneIDOutput string
+	getHostedZoneIDError  error
+
+	getLoadBalancerHostedZoneIDHostname string
+	getLoadBalancerHostedZoneIDOutput   string
+	getLoadBalancerHostedZoneIDError    error
+
+	getDNSOwnerDomainName         string
+	getDNSOwnerDomainHostedZoneID string
+	getDNSOwnerOutput             string
+	getDNSOwnerExists             bool
+	getDNSOwnerError              error
+
+	applyDNSChangesInput  []Route53Change
+	applyDNSChangesOutput []error
+
+	listDNSRecordsHostedZoneIDs []string
+	listDNSRecordsOutput        []DNSRecord
+	listDNSRecordsError         error
+}
+
+func (c AWSClientDummy) GetHostedZoneID(domain string) (string, error) {
+	if c.getHostedZoneIDs != nil {
+		if hostedZoneID, ok := c.getHostedZoneIDs[domain]; ok {
+			return hostedZoneID, nil
+		}
+		return "", &zoneNotFoundError{fmt.Sprintf("No zone matches domain %s", domain)}
+	}
+
+	if domain != c.getHostedZoneIDDomain {
+		c.t.Errorf("Expected domain to be '%s', was '%s'", c.getHostedZoneIDDomain, domain)
+	}
+
+	return c.getHostedZoneIDOutput, c.getHostedZoneIDError
+}
+
+func (c AWSClientDummy) GetLoadBalancerHostedZoneID(hostname string) (string, error) {
+	if hostname != c.getLoadBalancerHostedZoneIDHostname {
+		c.t.Errorf("Expected hostname to be '%s', was '%s'", c.getLoadBalancerHostedZoneIDHostname, hostname)
+	}
+
+	return c.getLoadBalancerHostedZoneIDOutput, c.getLoadBalancerHostedZoneIDError
+}
+
+func (c AWSClientDummy) GetDNSOwner(domainName, domainHostedZoneID string) (string, bool, error) {
+	if domainName != c.getDNSOwnerDomainName {
+		c.t.Errorf("Expected domainName to be '%s', was '%s'", c.getDNSOwnerDomainName, domainName)
+	}
+
+	if domainHostedZoneID != c.getDNSOwnerDomainHostedZoneID {
+		c.t.Errorf("Expected domainHostedZoneID to be '%s', was '%s'", c.getDNSOwnerDomainHostedZoneID, domainHostedZoneID)
+	}
+
+	return c.getDNSOwnerOutput, c.getDNSOwnerExists, c.getDNSOwnerError
+}
+
+func (c AWSClientDummy) ApplyDNSChanges(changes []Route53Change) []error {
+	if !reflect.DeepEqual(changes, c.applyDNSChangesInput) {
+		c.t.Errorf("Expected changes to be '%v', was '%v'", c.applyDNSChangesInput, changes)
+	}
+
+	return c.applyDNSChangesOutput
+}
+
+func (c AWSClientDummy) ListDNSRecords(hostedZoneIDs []string) ([]DNSRecord, error) {
+	if !reflect.DeepEqual(hostedZoneIDs, c.listDNSRecordsHostedZoneIDs) {
+		c.t.Errorf("Expected hostedZoneIDs to be '%v', was '%v'", c.listDNSRecordsHostedZoneIDs, hostedZoneIDs)
+	}
+
+	return c.listDNSRecordsOutput, c.listDNSRecordsError
+}
+
+func testEndpoint(dnsName, target string) Endpoint {
+	return Endpoint{
+		DNSName:    dnsName,
+		RecordType: "CNAME",
+		Targets:    []string{target},
+		Owner:      "heritage=kubernetes-service-dns-update,cluster=default,service=/service",
+	}
+}
+
+func TestRoute53ProviderGetOwner(t *testing.T) {
+	scenarios := []struct {
+		getHostedZoneIDOutput string
+		getHostedZoneIDError  error
+
+		getDNSOwnerOutput string
+		getDNSOwnerExists bool
+
+		expectedOwner  string
+		expectedExists bool
+		expectedError  error
+	}{
+		// Error trying to retrieve custom domain hosted zone ID
+		{
+			getHostedZoneIDError: errors.New("error"),
+
+			expectedError: errors.New("Could not find hosted zone: error"),
+		},
+
+		// Owner found in the hosted zone
+		{
+			getHostedZoneIDOutput: "DOMAINZONEID",
+
+			getDNSOwnerOutput: "heritage=kubernetes-service-dns-update,cluster=default,service=/service",
+			getDNSOwnerExists: true,
+
+			expectedOwner:  "heritage=kubernetes-service-dns-update,cluster=default,service=/service",
+			expectedExists: true,
+		},
+	}
+
+	for _, scenario := range scenarios {
+		provider := &Route53Provider{
+			awsClient: AWSClientDummy{
+				t: t,
+
+				getHostedZoneIDDomain: "some.domain.com",
+				getHostedZoneIDOutput: scenario.getHostedZoneIDOutput,
+				getHostedZoneIDError:  scenario.getHostedZoneIDError,
+
+				getDNSOwnerDomainName:         "some.domain.com",
+				getDNSOwnerDomainHostedZoneID: "DOMAINZONEID",
+				getDNSOwnerOutput:             scenario.getDNSOwnerOutput,
+				getDNSOwnerExists:             scenario.getDNSOwnerExists,
+			},
+		}
+
+		owner, exists, err := provider.GetOwner("some.domain.com")
+
+		if !reflect.DeepEqual(err, scenario.expectedError) {
+			t.Errorf("Expected error to be '%v', was '%v'", scenario.expectedError, err)
+		}
+
+		if owner != scenario.expectedOwner || exists != scenario.expectedExists {
+			t.Errorf("Expected owner to be '%s' (%v), was '%s' (%v)", scenario.expectedOwner, scenario.expectedExists, owner, exists)
+		}
+	}
+}
+
+func TestRoute53ProviderListEndpoints(t *testing.T) {
+	owner := "heritage=kubernetes-service-dns-update,cluster=default,service=/service"
+
+	provider := &Route53Provider{
+		awsClient: AWSClientDummy{
+			t: t,
+
+			getHostedZoneIDs: map[string]string{
+				"some.domain.com":  "DOMAINZONEID",
+				"other.domain.com": "DOMAINZONEID",
+			},
+
+			listDNSRecordsHostedZoneIDs: []string{"DOMAINZONEID"},
+			listDNSRecordsOutput: []DNSRecord{
+				DNSRecord{Name: "some.domain.com", Type: "CNAME", Values: []string{"elb1.hostname.amazonaws.com"}},
+				DNSRecord{Name: "some.domain.com", Type: "CNAME", Values: []string{"elb2.hostname.amazonaws.com"}},
+				DNSRecord{Name: "_owner.some.domain.com", Type: "TXT", TTL: 300, Values: []string{`"` + owner + `"`}},
+				DNSRecord{Name: "other.domain.com", Type: "A", TTL: 300, Values: []string{"203.0.113.10"}},
+			},
+		},
+	}
+
+	endpoints, err := provider.ListEndpoints([]string{"some.domain.com", "other.domain.com", "missing.example.org"})
+	if err != nil {
+		t.Errorf("Expected no error, was '%v'", err)
+	}
+
+	expected := []Endpoint{
+		Endpoint{DNSName: "some.domain.com", RecordType: "CNAME", Targets: []string{"elb1.hostname.amazonaws.com", "elb2.hostname.amazonaws.com"}, Owner: owner},
+	}
+
+	if !reflect.DeepEqual(endpoints, expected) {
+		t.Errorf("Expected endpoints to be '%v', was '%v'", expected, endpoints)
+	}
+
+	provider.awsClient = AWSClientDummy{t: t, listDNSRecordsError: errors.New("error")}
+
+	if _, err := provider.ListEndpoints(nil); !reflect.DeepEqual(err, errors.New("error")) {
+		t.Errorf("Expected error to be 'error', was '%v'", err)
+	}
+}
+
+func TestRoute53ProviderApplyChanges(t *testing.T) {
+	record := Route53Record{
+		DomainName:         "some.domain.com",
+		DomainHostedZoneID: "DOMAINZONEID",
+		LoadBalancers: []Route53LoadBalancer{
+			Route53LoadBalancer{Hostname: "testpublic-1111111111.us-east-1.elb.amazonaws.com", HostedZoneID: "ELBZONEID"},
+		},
+		Owner: "heritage=kubernetes-service-dns-update,cluster=default,service=/service",
+	}
+
+	deletedRecord := record
+	deletedRecord.LoadBalancers = []Route53LoadBalancer{
+		Route53LoadBalancer{Hostname: "testpublic-1111111111.us-east-1.elb.amazonaws.com"},
+	}
+
+	scenarios := []struct {
+		changes []DNSChange
+
+		getHostedZoneIDOutput string
+		getHostedZoneIDError  error
+
+		getLoadBalancerHostedZoneIDOutput string
+		getLoadBalancerHostedZoneIDError  error
+
+		applyDNSChangesInput  []Route53Change
+		applyDNSChangesOutput []error
+
+		expectedErrors []error
+	}{
+		// Error trying to retrieve custom domain hosted zone ID
+		{
+			changes: []DNSChange{
+				DNSChange{Action: "UPSERT", Endpoint: testEndpoint("some.domain.com", "testpublic-1111111111.us-east-1.elb.amazonaws.com")},
+			},
+
+			getHostedZoneIDError: errors.New("error"),
+
+			expectedErrors: []error{errors.New("Could not find hosted zone: error")},
+		},
+
+		// Error trying to retrieve load balancer hosted zone ID
+		{
+			changes: []DNSChange{
+				DNSChange{Action: "UPSERT", Endpoint: testEndpoint("some.domain.com", "testpublic-1111111111.us-east-1.elb.amazonaws.com")},
+			},
+
+			getHostedZoneIDOutput:            "DOMAINZONEID",
+			getLoadBalancerHostedZoneIDError: errors.New("error"),
+
+			expectedErrors: []error{errors.New("Could not get zone ID: error")},
+		},
+
+		// Endpoint without any load balancer
+		{
+			changes: []DNSChange{
+				DNSChange{Action: "UPSERT", Endpoint: Endpoint{DNSName: "some.domain.com", RecordType: "CNAME"}},
+			},
+
+			expectedErrors: []error{errors.New("No load balancer found for some.domain.com")},
+		},
+
+		// Endpoint of a record type Route53 cannot alias
+		{
+			changes: []DNSChange{
+				DNSChange{Action: "UPSERT", Endpoint: Endpoint{DNSName: "some.domain.com", RecordType: "MX", Targets: []string{"mail.domain.com"}}},
+			},
+
+			expectedErrors: []error{errors.New("Only load balancer hostnames and IP addresses are supported by Route53, got MX record for some.domain.com")},
+		},
+
+		// Several hostnames that are not all load balancers
+		{
+			changes: []DNSChange{
+				DNSChange{Action: "UPSERT", Endpoint: Endpoint{
+					DNSName:    "some.domain.com",
+					RecordType: "CNAME",
+					Targets:    []string{"testpublic-1111111111.us-east-1.elb.amazonaws.com", "api.saas.example.net"},
+				}},
+			},
+
+			expectedErrors: []error{errors.New("CNAME record for some.domain.com cannot point to several hostnames that are not all load balancers, got testpublic-1111111111.us-east-1.elb.amazonaws.com,api.saas.example.net")},
+		},
+
+		// Endpoint pointing to IP addresses does not need the load balancer
+		{
+			changes: []DNSChange{
+				DNSChange{Action: "UPSERT", Endpoint: Endpoint{DNSName: "some.domain.com", RecordType: "A", Targets: []string{"2001:db8::10", "203.0.113.10"}, TTL: 60, Owner: "owner"}},
+			},
+
+			getHostedZoneIDOutput:            "DOMAINZONEID",
+			getLoadBalancerHostedZoneIDError: errors.New("error"),
+
+			applyDNSChangesInput: []Route53Change{Route53Change{Action: "UPSERT", Record: Route53Record{
+				DomainName:         "some.domain.com",
+				DomainHostedZoneID: "DOMAINZONEID",
+				IPs:                []string{"2001:db8::10", "203.0.113.10"},
+				TTL:                60,
+				Owner:              "owner",
+			}}},
+			applyDNSChangesOutput: []error{nil},
+
+			expectedErrors: []error{nil},
+		},
+
+		// Successful update
+		{
+			changes: []DNSChange{
+				DNSChange{Action: "UPSERT", Endpoint: testEndpoint("some.domain.com", "testpublic-1111111111.us-east-1.elb.amazonaws.com")},
+			},
+
+			getHostedZoneIDOutput:             "DOMAINZONEID",
+			getLoadBalancerHostedZoneIDOutput: "ELBZONEID",
+
+			applyDNSChangesInput:  []Route53Change{Route53Change{Action: "UPSERT", Record: record}},
+			applyDNSChangesOutput: []error{errors.New("error")},
+
+			expectedErrors: []error{errors.New("error")},
+		},
+
+		// Hostname other than a load balancer gets a CNAME record
+		{
+			changes: []DNSChange{
+				DNSChange{Action: "UPSERT", Endpoint: testEndpoint("some.domain.com", "api.saas.example.net")},
+			},
+
+			getHostedZoneIDOutput:            "DOMAINZONEID",
+			getLoadBalancerHostedZoneIDError: errors.New("error"),
+
+			applyDNSChangesInput: []Route53Change{Route53Change{Action: "UPSERT", Record: Route53Record{
+				DomainName:         "some.domain.com",
+				DomainHostedZoneID: "DOMAINZONEID",
+				CNAME:              "api.saas.example.net",
+				Owner:              "heritage=kubernetes-service-dns-update,cluster=default,service=/service",
+			}}},
+			applyDNSChangesOutput: []error{nil},
+
+			expectedErrors: []error{nil},
+		},
+
+		// Deletion does not need the load balancer
+		{
+			changes: []DNSChange{
+				DNSChange{Action: "DELETE", Endpoint: testEndpoint("some.domain.com", "testpublic-1111111111.us-east-1.elb.amazonaws.com")},
+			},
+
+			getHostedZoneIDOutput:            "DOMAINZONEID",
+			getLoadBalancerHostedZoneIDError: errors.New("error"),
+
+			applyDNSChangesInput:  []Route53Change{Route53Change{Action: "DELETE", Record: deletedRecord}},
+			applyDNSChangesOutput: []error{nil},
+
+			expectedErrors: []error{nil},
+		},
+	}
+
+	for _, scenario := range scenarios {
+		provider := &Route53Provider{
+			awsClient: AWSClientDummy{
+				t: t,
+
+				getHostedZoneIDDomain: "some.domain.com",
+				getHostedZoneIDOutput: scenario.getHostedZoneIDOutput,
+				getHostedZoneIDError:  scenario.getHostedZoneIDError,
+
+				getLoadBalancerHostedZoneIDHostname: "testpublic-1111111111.us-east-1.elb.amazonaws.com",
+				getLoadBalancerHostedZoneIDOutput:   scenario.getLoadBalancerHostedZoneIDOutput,
+				getLoadBalancerHostedZoneIDError:    scenario.getLoadBalancerHostedZoneIDError,
+
+				applyDNSChangesInput:  scenario.applyDNSChangesInput,
+				applyDNSChangesOutput: scenario.applyDNSChangesOutput,
+			},
+		}
+
+		errs := provider.ApplyChanges(scenario.changes)
+
+		if !reflect.DeepEqual(errs, scenario.expectedErrors) {
+			t.Errorf("Expected errors to be '%v', was '%v'", scenario.expectedErrors, errs)
+		}
+	}
+}
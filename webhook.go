@@ -0,0 +1,335 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Record set as exchanged with webhooks: every value of the given type for the
+// given name. Names have no trailing dot, and TXT values have no quotes.
+type webhookRecordSet struct {
+	Name   string   `json:"name"`
+	Type   string   `json:"type"`
+	TTL    int64    `json:"ttl"`
+	Values []string `json:"values"`
+}
+
+type webhookZones struct {
+	Zones []string `json:"zones"`
+}
+
+type webhookRecordSets struct {
+	RecordSets []webhookRecordSet `json:"recordSets"`
+}
+
+// Change of the record sets of a zone: the deletions are applied before the
+// additions, and either all of them are applied or none.
+type webhookChange struct {
+	Zone      string             `json:"zone"`
+	Deletions []webhookRecordSet `json:"deletions,omitempty"`
+	Additions []webhookRecordSet `json:"additions,omitempty"`
+}
+
+type webhookChanges struct {
+	Changes []webhookChange `json:"changes"`
+}
+
+// Outcome of each change, in the same order: an empty string for the changes
+// that were applied, the reason they were not otherwise.
+type webhookChangeErrors struct {
+	Errors []string `json:"errors"`
+}
+
+// WebhookProvider keeps endpoints in any DNS backend through an external HTTP
+// service (i.e. a sidecar adapter) implementing the following JSON contract:
+//
+//	GET  /zones                        -> {"zones": ["mydomain.com"]}
+//	GET  /recordsets?zone=..&name=..   -> {"recordSets": [<record set>]}
+//	GET  /recordsets?zone=..           -> {"recordSets": [<record set>]}
+//	POST /changes {"changes": [...]}   -> {"errors": ["", "reason"]}
+//
+// Record sets look like {"name": "www.mydomain.com", "type": "A", "ttl": 300,
+// "values": ["203.0.113.10"]}. Without a name, every record set of the zone is
+// listed, which is only done at startup. Ownership markers are TXT record sets
+// like any other, stored under the _owner prefix.
+type WebhookProvider struct {
+	client *http.Client
+	url    string
+	token  string
+	now    func() time.Time
+
+	zoneCache zoneCache
+}
+
+func NewWebhookProvider() (*WebhookProvider, error) {
+	if webhookURL == "" {
+		return nil, errors.New("URL of the webhook must be set with -webhook-url")
+	}
+
+	return &WebhookProvider{
+		client:    &http.Client{Timeout: httpTimeout},
+		url:       strings.TrimSuffix(webhookURL, "/"),
+		token:     os.Getenv("WEBHOOK_TOKEN"),
+		now:       time.Now,
+		zoneCache: zoneCache{ttl: time.Duration(zoneCacheTTL) * time.Second},
+	}, nil
+}
+
+func (p *WebhookProvider) GetOwner(dnsName string) (string, bool, error) {
+	zone, err := p.zone(dnsName)
+	if err != nil {
+		return "", false, err
+	}
+
+	recordSets, err := p.endpointRecordSets(zone, dnsName)
+	if err != nil {
+		return "", false, err
+	}
+
+	exists := false
+	owner := ""
+
+	for _, recordSet := range recordSets {
+		if recordSet.Type == "TXT" {
+			owner = ownerFromTXT(recordSet.Values)
+		} else {
+			exists = true
+		}
+	}
+
+	return owner, exists, nil
+}
+
+// ApplyChanges sends all the changes to the webhook at once, one per endpoint,
+// replacing the record sets currently stored for its name with the desired
+// ones.
+func (p *WebhookProvider) ApplyChanges(changes []DNSChange) []error {
+	errs := make([]error, len(changes))
+
+	var indexes []int
+	var wchanges []webhookChange
+
+	for i, change := range changes {
+		wchange, err := p.webhookChange(change)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+
+		if len(wchange.Deletions) == 0 && len(wchange.Additions) == 0 {
+			continue
+		}
+
+		indexes = append(indexes, i)
+		wchanges = append(wchanges, wchange)
+	}
+
+	if len(wchanges) == 0 {
+		return errs
+	}
+
+	if dryRun {
+		for _, wchange := range wchanges {
+			log.Printf("DRY RUN: We normally would have deleted %v and added %v in %s\n", wchange.Deletions, wchange.Additions, wchange.Zone)
+		}
+		return errs
+	}
+
+	var resp webhookChangeErrors
+	err := p.do("POST", p.url+"/changes", webhookChanges{wchanges}, &resp)
+	if err == nil && len(resp.Errors) != len(wchanges) {
+		err = fmt.Errorf("Webhook returned %d errors for %d changes", len(resp.Errors), len(wchanges))
+	}
+
+	for j, i := range indexes {
+		switch {
+		case err != nil:
+			errs[i] = fmt.Errorf("Could not apply changes: %v", err)
+		case resp.Errors[j] != "":
+			errs[i] = errors.New(resp.Errors[j])
+		}
+	}
+
+	return errs
+}
+
+func (p *WebhookProvider) webhookChange(change DNSChange) (webhookChange, error) {
+	dnsName := change.Endpoint.DNSName
+
+	zone, err := p.zone(dnsName)
+	if err != nil {
+		return webhookChange{}, err
+	}
+
+	current, err := p.endpointRecordSets(zone, dnsName)
+	if err != nil {
+		return webhookChange{}, err
+	}
+
+	var desired []webhookRecordSet
+	if change.Action != "DELETE" {
+		records, err := endpointRecords(change.Endpoint)
+		if err != nil {
+			return webhookChange{}, err
+		}
+
+		for _, record := range records {
+			desired = append(desired, webhookRecordSetFromRecord(record))
+		}
+	}
+
+	return webhookChange{
+		Zone:      zone,
+		Deletions: webhookRecordSetsDifference(current, desired),
+		Additions: webhookRecordSetsDifference(desired, current),
+	}, nil
+}
+
+func (p *WebhookProvider) ListEndpoints(dnsNames []string) ([]Endpoint, error) {
+	indexes, err := p.zoneCache.zonesOf(dnsNames, p.now(), p.zoneNames)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []DNSRecord
+	for _, i := range indexes {
+		zone := p.zoneCache.names[i]
+		recordSets, err := p.listRecordSets(zone, "")
+		if err != nil {
+			return nil, err
+		}
+
+		for _, recordSet := range recordSets {
+			records = append(records, DNSRecord{Name: recordSet.Name, Type: recordSet.Type, TTL: recordSet.TTL, Values: recordSet.Values})
+		}
+	}
+
+	return ownedEndpoints(records), nil
+}
+
+// zone returns the most specific zone the given name belongs to.
+func (p *WebhookProvider) zone(dnsName string) (string, error) {
+	i, err := p.zoneCache.find(dnsName, p.now(), p.zoneNames)
+	if err != nil {
+		return "", err
+	}
+
+	if i < 0 {
+		return "", fmt.Errorf("No zone matches domain %s", dnsName)
+	}
+
+	return p.zoneCache.names[i], nil
+}
+
+// zoneNames lists the zones for the zone cache.
+func (p *WebhookProvider) zoneNames() ([]string, error) {
+	var zones webhookZones
+	if err := p.do("GET", p.url+"/zones", nil, &zones); err != nil {
+		return nil, fmt.Errorf("Could not list zones: %v", err)
+	}
+	return zones.Zones, nil
+}
+
+// endpointRecordSets returns the address record sets stored for the given
+// name, along with its TXT ownership record set.
+func (p *WebhookProvider) endpointRecordSets(zone, dnsName string) ([]webhookRecordSet, error) {
+	recordSets, err := p.recordSets(zone, dnsName, addressRecordTypes)
+	if err != nil {
+		return nil, err
+	}
+
+	ownerRecordSets, err := p.recordSets(zone, ownerRecordName(dnsName), []string{"TXT"})
+	if err != nil {
+		return nil, err
+	}
+
+	return append(recordSets, ownerRecordSets...), nil
+}
+
+// recordSets returns the record sets of the given types stored for a name.
+func (p *WebhookProvider) recordSets(zone, dnsName string, recordTypes []string) ([]webhookRecordSet, error) {
+	all, err := p.listRecordSets(zone, dnsName)
+	if err != nil {
+		return nil, err
+	}
+
+	recordSets := []webhookRecordSet{}
+	for _, recordSet := range all {
+		if containsString(recordTypes, recordSet.Type) {
+			recordSets = append(recordSets, recordSet)
+		}
+	}
+
+	return recordSets, nil
+}
+
+// listRecordSets returns the record sets stored for a name, or every record
+// set of the zone when no name is given.
+func (p *WebhookProvider) listRecordSets(zone, dnsName string) ([]webhookRecordSet, error) {
+	query := url.Values{}
+	query.Set("zone", zone)
+	if dnsName != "" {
+		query.Set("name", strings.ToLower(strings.TrimSuffix(dnsName, ".")))
+	}
+
+	var resp webhookRecordSets
+	if err := p.do("GET", p.url+"/recordsets?"+query.Encode(), nil, &resp); err != nil {
+		return nil, fmt.Errorf("Could not list record sets for %s: %v", zone, err)
+	}
+
+	return resp.RecordSets, nil
+}
+
+func (p *WebhookProvider) do(method, url string, in, out interface{}) error {
+	header := http.Header{}
+	if p.token != "" {
+		header.Set("Authorization", "Bearer "+p.token)
+	}
+
+	return doJSON(p.client, method, url, header, in, out)
+}
+
+func webhookRecordSetFromRecord(record DNSRecord) webhookRecordSet {
+	values := make([]string, len(record.Values))
+	for i, value := range record.Values {
+		if record.Type == "TXT" {
+			value = strings.Trim(value, "\"")
+		}
+		values[i] = value
+	}
+
+	return webhookRecordSet{
+		Name:   record.Name,
+		Type:   record.Type,
+		TTL:    record.TTL,
+		Values: values,
+	}
+}
+
+// webhookRecordSetsDifference returns the record sets of a that are not
+// exactly the same in b, regardless of the order of their values.
+func webhookRecordSetsDifference(a, b []webhookRecordSet) []webhookRecordSet {
+	var difference []webhookRecordSet
+
+	for _, recordSet := range a {
+		found := false
+		for _, other := range b {
+			if strings.EqualFold(recordSet.Name, other.Name) && recordSet.Type == other.Type && recordSet.TTL == other.TTL && sameStrings(recordSet.Values, other.Values) {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			difference = append(difference, recordSet)
+		}
+	}
+
+	return difference
+}
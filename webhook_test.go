@@ -0,0 +1,394 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testWebhookOwner = "heritage=kubernetes-service-dns-update,cluster=default,service=/service"
+
+// ReferenceWebhookServer is an in-memory implementation of the webhook contract
+// of WebhookProvider, to be used as a reference when writing adapters for other
+// DNS backends. Each change is applied atomically: it is refused as a whole if
+// any of its deletions does not match the stored record sets exactly, or if it
+// would leave a CNAME record set next to others of the same name.
+type ReferenceWebhookServer struct {
+	token      string
+	zones      []string
+	recordSets map[string][]webhookRecordSet
+	changes    []webhookChange
+}
+
+func (s *ReferenceWebhookServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.token != "" && r.Header.Get("Authorization") != "Bearer "+s.token {
+		http.Error(w, `{"error":"unauthorized"}`, http.StatusUnauthorized)
+		return
+	}
+
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/zones":
+		json.NewEncoder(w).Encode(webhookZones{Zones: s.zones})
+
+	case r.Method == "GET" && r.URL.Path == "/recordsets":
+		zone := r.URL.Query().Get("zone")
+		name := r.URL.Query().Get("name")
+
+		resp := webhookRecordSets{RecordSets: []webhookRecordSet{}}
+		for _, recordSet := range s.recordSets[zone] {
+			if name == "" || recordSet.Name == name {
+				resp.RecordSets = append(resp.RecordSets, recordSet)
+			}
+		}
+		json.NewEncoder(w).Encode(resp)
+
+	case r.Method == "POST" && r.URL.Path == "/changes":
+		var req webhookChanges
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf(`{"error":%q}`, err), http.StatusBadRequest)
+			return
+		}
+
+		resp := webhookChangeErrors{Errors: []string{}}
+		for _, change := range req.Changes {
+			s.changes = append(s.changes, change)
+			resp.Errors = append(resp.Errors, s.apply(change))
+		}
+		json.NewEncoder(w).Encode(resp)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *ReferenceWebhookServer) apply(change webhookChange) string {
+	if !containsString(s.zones, change.Zone) {
+		return fmt.Sprintf("Unknown zone %s", change.Zone)
+	}
+
+	recordSets := append([]webhookRecordSet{}, s.recordSets[change.Zone]...)
+
+	for _, deletion := range change.Deletions {
+		i := s.find(recordSets, deletion)
+		if i < 0 || !reflect.DeepEqual(recordSets[i], deletion) {
+			return fmt.Sprintf("Record set %s %s does not match", deletion.Type, deletion.Name)
+		}
+		recordSets = append(recordSets[:i], recordSets[i+1:]...)
+	}
+
+	for _, addition := range change.Additions {
+		if s.find(recordSets, addition) >= 0 {
+			return fmt.Sprintf("Record set %s %s already exists", addition.Type, addition.Name)
+		}
+
+		for _, other := range recordSets {
+			if other.Name == addition.Name && (other.Type == "CNAME" || addition.Type == "CNAME") {
+				return fmt.Sprintf("Record set %s %s conflicts with %s record set", addition.Type, addition.Name, other.Type)
+			}
+		}
+
+		recordSets = append(recordSets, addition)
+	}
+
+	s.recordSets[change.Zone] = recordSets
+	return ""
+}
+
+func (s *ReferenceWebhookServer) find(recordSets []webhookRecordSet, recordSet webhookRecordSet) int {
+	for i, other := range recordSets {
+		if other.Name == recordSet.Name && other.Type == recordSet.Type {
+			return i
+		}
+	}
+	return -1
+}
+
+// webhookRecordSetsByType sorts webhook record sets by their type.
+type webhookRecordSetsByType []webhookRecordSet
+
+func (r webhookRecordSetsByType) Len() int           { return len(r) }
+func (r webhookRecordSetsByType) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r webhookRecordSetsByType) Less(i, j int) bool { return r[i].Type < r[j].Type }
+
+func testWebhookProvider(server *ReferenceWebhookServer) (*WebhookProvider, func()) {
+	serverURL, client, closeServer := testHTTPServer(server)
+
+	provider := &WebhookProvider{
+		client:    client,
+		url:       serverURL,
+		token:     "token",
+		now:       time.Now,
+		zoneCache: zoneCache{ttl: time.Hour},
+	}
+
+	return provider, closeServer
+}
+
+func testWebhookServer(recordSets []webhookRecordSet) *ReferenceWebhookServer {
+	return &ReferenceWebhookServer{
+		token:      "token",
+		zones:      []string{"domain.com", "sub.domain.com"},
+		recordSets: map[string][]webhookRecordSet{"domain.com": recordSets},
+	}
+}
+
+func TestWebhookProviderGetOwner(t *testing.T) {
+	scenarios := []struct {
+		dnsName    string
+		recordSets []webhookRecordSet
+
+		expectedOwner  string
+		expectedExists bool
+		expectedError  error
+	}{
+		// No zone for the domain
+		{
+			dnsName: "some.example.com",
+
+			expectedError: errors.New("No zone matches domain some.example.com"),
+		},
+
+		// Record not owned by anybody
+		{
+			dnsName: "some.domain.com",
+			recordSets: []webhookRecordSet{
+				webhookRecordSet{Name: "some.domain.com", Type: "CNAME", TTL: 300, Values: []string{"other.domain.com"}},
+				webhookRecordSet{Name: "some.domain.com", Type: "MX", TTL: 300, Values: []string{"10 mail.domain.com"}},
+			},
+
+			expectedExists: true,
+		},
+
+		// Owned record
+		{
+			dnsName: "Some.Domain.com.",
+			recordSets: []webhookRecordSet{
+				webhookRecordSet{Name: "some.domain.com", Type: "A", TTL: 300, Values: []string{"203.0.113.10"}},
+				webhookRecordSet{Name: "_owner.some.domain.com", Type: "TXT", TTL: 300, Values: []string{"v=spf1 -all", testWebhookOwner}},
+			},
+
+			expectedOwner:  testWebhookOwner,
+			expectedExists: true,
+		},
+	}
+
+	for _, scenario := range scenarios {
+		provider, closeServer := testWebhookProvider(testWebhookServer(scenario.recordSets))
+
+		owner, exists, err := provider.GetOwner(scenario.dnsName)
+
+		if !reflect.DeepEqual(err, scenario.expectedError) {
+			t.Errorf("Expected error to be '%v', was '%v'", scenario.expectedError, err)
+		}
+
+		if owner != scenario.expectedOwner || exists != scenario.expectedExists {
+			t.Errorf("Expected owner of %s to be '%s' (%v), was '%s' (%v)", scenario.dnsName, scenario.expectedOwner, scenario.expectedExists, owner, exists)
+		}
+
+		closeServer()
+	}
+}
+
+func TestWebhookProviderApplyChanges(t *testing.T) {
+	endpoint := Endpoint{
+		DNSName:    "some.domain.com",
+		RecordType: "A",
+		Targets:    []string{"203.0.113.10", "203.0.113.20"},
+		Owner:      testWebhookOwner,
+	}
+
+	address := webhookRecordSet{Name: "some.domain.com", Type: "A", TTL: 300, Values: []string{"203.0.113.10", "203.0.113.20"}}
+	reordered := webhookRecordSet{Name: "some.domain.com", Type: "A", TTL: 300, Values: []string{"203.0.113.20", "203.0.113.10"}}
+	txt := webhookRecordSet{Name: "_owner.some.domain.com", Type: "TXT", TTL: 300, Values: []string{testWebhookOwner}}
+	staleAddress := webhookRecordSet{Name: "some.domain.com", Type: "CNAME", TTL: 300, Values: []string{"lb.hostname.example.net"}}
+	mx := webhookRecordSet{Name: "other.domain.com", Type: "MX", TTL: 300, Values: []string{"10 mail.domain.com"}}
+
+	scenarios := []struct {
+		description string
+		dryRun      bool
+		changes     []DNSChange
+		recordSets  []webhookRecordSet
+
+		expectedRecordSets []webhookRecordSet
+		expectedChanges    []webhookChange
+		expectedErrors     []error
+	}{
+		{
+			description: "records are created",
+			changes:     []DNSChange{DNSChange{Action: "UPSERT", Endpoint: endpoint}},
+
+			expectedRecordSets: []webhookRecordSet{address, txt},
+			expectedChanges: []webhookChange{
+				webhookChange{Zone: "domain.com", Additions: []webhookRecordSet{address, txt}},
+			},
+			expectedErrors: []error{nil},
+		},
+		{
+			description: "records are replaced",
+			changes:     []DNSChange{DNSChange{Action: "UPSERT", Endpoint: endpoint}},
+			recordSets:  []webhookRecordSet{staleAddress, txt},
+
+			expectedRecordSets: []webhookRecordSet{txt, address},
+			expectedChanges: []webhookChange{
+				webhookChange{Zone: "domain.com", Deletions: []webhookRecordSet{staleAddress}, Additions: []webhookRecordSet{address}},
+			},
+			expectedErrors: []error{nil},
+		},
+		{
+			description: "records already up to date are left alone",
+			changes:     []DNSChange{DNSChange{Action: "UPSERT", Endpoint: endpoint}},
+			recordSets:  []webhookRecordSet{reordered, txt},
+
+			expectedRecordSets: []webhookRecordSet{reordered, txt},
+			expectedErrors:     []error{nil},
+		},
+		{
+			description: "records are deleted",
+			changes:     []DNSChange{DNSChange{Action: "DELETE", Endpoint: endpoint}},
+			recordSets:  []webhookRecordSet{address, txt},
+
+			expectedRecordSets: []webhookRecordSet{},
+			expectedChanges: []webhookChange{
+				webhookChange{Zone: "domain.com", Deletions: []webhookRecordSet{address, txt}},
+			},
+			expectedErrors: []error{nil},
+		},
+		{
+			description: "changes are only logged in dry-run mode",
+			dryRun:      true,
+			changes:     []DNSChange{DNSChange{Action: "UPSERT", Endpoint: endpoint}},
+
+			expectedErrors: []error{nil},
+		},
+		{
+			description: "changes refused by the webhook fail on their own",
+			changes: []DNSChange{
+				DNSChange{Action: "UPSERT", Endpoint: Endpoint{DNSName: "some.example.com", RecordType: "A", Targets: []string{"203.0.113.10"}}},
+				DNSChange{Action: "UPSERT", Endpoint: Endpoint{DNSName: "other.domain.com", RecordType: "CNAME", Targets: []string{"lb.hostname.example.net"}, Owner: testWebhookOwner}},
+				DNSChange{Action: "UPSERT", Endpoint: endpoint},
+			},
+			recordSets: []webhookRecordSet{mx},
+
+			expectedRecordSets: []webhookRecordSet{mx, address, txt},
+			expectedChanges: []webhookChange{
+				webhookChange{Zone: "domain.com", Additions: []webhookRecordSet{
+					webhookRecordSet{Name: "other.domain.com", Type: "CNAME", TTL: 300, Values: []string{"lb.hostname.example.net"}},
+					webhookRecordSet{Name: "_owner.other.domain.com", Type: "TXT", TTL: 300, Values: []string{testWebhookOwner}},
+				}},
+				webhookChange{Zone: "domain.com", Additions: []webhookRecordSet{address, txt}},
+			},
+			expectedErrors: []error{
+				errors.New("No zone matches domain some.example.com"),
+				errors.New("Record set CNAME other.domain.com conflicts with MX record set"),
+				nil,
+			},
+		},
+		{
+			description: "CNAME records with several hostnames are refused",
+			changes:     []DNSChange{DNSChange{Action: "UPSERT", Endpoint: testSeveralHostnamesEndpoint(testWebhookOwner)}},
+			recordSets:  []webhookRecordSet{address, txt},
+
+			expectedRecordSets: []webhookRecordSet{address, txt},
+			expectedErrors:     []error{testSeveralHostnamesError},
+		},
+	}
+
+	defer func(dryRunValue bool) { dryRun = dryRunValue }(dryRun)
+
+	for _, scenario := range scenarios {
+		dryRun = scenario.dryRun
+
+		server := testWebhookServer(scenario.recordSets)
+		provider, closeServer := testWebhookProvider(server)
+
+		errs := provider.ApplyChanges(scenario.changes)
+
+		if !reflect.DeepEqual(errs, scenario.expectedErrors) {
+			t.Errorf("Expected errors to be '%v' when %s, was '%v'", scenario.expectedErrors, scenario.description, errs)
+		}
+
+		if !reflect.DeepEqual(server.changes, scenario.expectedChanges) {
+			t.Errorf("Expected changes to be '%v' when %s, was '%v'", scenario.expectedChanges, scenario.description, server.changes)
+		}
+
+		if recordSets := server.recordSets["domain.com"]; len(recordSets) > 0 || len(scenario.expectedRecordSets) > 0 {
+			if !reflect.DeepEqual(recordSets, scenario.expectedRecordSets) {
+				t.Errorf("Expected record sets to be '%v' when %s, was '%v'", scenario.expectedRecordSets, scenario.description, recordSets)
+			}
+		}
+
+		closeServer()
+	}
+}
+
+func TestWebhookProviderListEndpoints(t *testing.T) {
+	provider, closeServer := testWebhookProvider(testWebhookServer([]webhookRecordSet{
+		webhookRecordSet{Name: "domain.com", Type: "TXT", TTL: 300, Values: []string{"v=spf1 -all"}},
+		webhookRecordSet{Name: "some.domain.com", Type: "A", TTL: 300, Values: []string{"203.0.113.10", "203.0.113.20"}},
+		webhookRecordSet{Name: "_owner.some.domain.com", Type: "TXT", TTL: 300, Values: []string{testWebhookOwner}},
+		webhookRecordSet{Name: "other.domain.com", Type: "CNAME", TTL: 300, Values: []string{"other.hostname.example.net"}},
+	}))
+	defer closeServer()
+
+	endpoints, err := provider.ListEndpoints([]string{"some.domain.com"})
+	if err != nil {
+		t.Errorf("Expected no error, was '%v'", err)
+	}
+
+	expected := []Endpoint{
+		Endpoint{DNSName: "some.domain.com", RecordType: "A", Targets: []string{"203.0.113.10", "203.0.113.20"}, TTL: 300, Owner: testWebhookOwner},
+	}
+
+	if !reflect.DeepEqual(endpoints, expected) {
+		t.Errorf("Expected endpoints to be '%v', was '%v'", expected, endpoints)
+	}
+}
+
+func TestWebhookProviderUnreachable(t *testing.T) {
+	server := testWebhookServer(nil)
+	provider, closeServer := testWebhookProvider(server)
+	defer closeServer()
+
+	// The zones are cached, so only the change itself fails
+	provider.GetOwner("some.domain.com")
+	server.token = "other"
+
+	errs := provider.ApplyChanges([]DNSChange{DNSChange{Action: "DELETE", Endpoint: Endpoint{DNSName: "some.domain.com"}}})
+
+	if len(errs) != 1 || errs[0] == nil || !strings.Contains(errs[0].Error(), "returned status 401") {
+		t.Errorf("Expected an unauthorized error, was '%v'", errs)
+	}
+}
+
+func TestWebhookRecordSetFromRecord(t *testing.T) {
+	records, err := endpointRecords(Endpoint{
+		DNSName:    "Some.Domain.com.",
+		RecordType: "A",
+		Targets:    []string{"203.0.113.20", "203.0.113.10"},
+		Owner:      testWebhookOwner,
+	})
+	if err != nil {
+		t.Errorf("Expected no error, was '%v'", err)
+	}
+
+	var recordSets []webhookRecordSet
+	for _, record := range records {
+		recordSets = append(recordSets, webhookRecordSetFromRecord(record))
+	}
+	sort.Sort(webhookRecordSetsByType(recordSets))
+
+	expected := []webhookRecordSet{
+		webhookRecordSet{Name: "some.domain.com", Type: "A", TTL: 300, Values: []string{"203.0.113.20", "203.0.113.10"}},
+		webhookRecordSet{Name: "_owner.some.domain.com", Type: "TXT", TTL: 300, Values: []string{testWebhookOwner}},
+	}
+
+	if !reflect.DeepEqual(recordSets, expected) {
+		t.Errorf("Expected record sets to be '%v', was '%v'", expected, recordSets)
+	}
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// ZoneFileProvider keeps endpoints in RFC 1035 zone files, one per zone, for
+// another process to publish (i.e. a GitOps pipeline committing them). It never
+// talks to any DNS server: the zone files themselves are the state it reads the
+// current records and their owners from.
+//
+// Records other than the ones of the endpoints are kept as they are, but the
+// files are rewritten as a whole, so comments and directives other than $ORIGIN
+// are lost. The serial of the zone is bumped every time its file changes.
+type ZoneFileProvider struct {
+	dir        string
+	zones      []string
+	nameserver string
+	now        func() time.Time
+}
+
+func NewZoneFileProvider() (*ZoneFileProvider, error) {
+	if zoneFileDir == "" {
+		return nil, errors.New("Directory of the zone files must be set with -zonefile-dir")
+	}
+
+	var zones []string
+	for _, zone := range strings.Split(zoneFileZones, ",") {
+		if zone = strings.TrimSpace(zone); zone != "" {
+			zones = append(zones, dns.Fqdn(strings.ToLower(zone)))
+		}
+	}
+
+	if len(zones) == 0 {
+		return nil, errors.New("Zones to write files for must be set with -zonefile-zones")
+	}
+
+	return &ZoneFileProvider{
+		dir:        zoneFileDir,
+		zones:      zones,
+		nameserver: zoneFileNameserver,
+		now:        time.Now,
+	}, nil
+}
+
+func (p *ZoneFileProvider) GetOwner(dnsName string) (string, bool, error) {
+	zone, err := p.zone(dnsName)
+	if err != nil {
+		return "", false, err
+	}
+
+	records, err := p.readZone(zone)
+	if err != nil {
+		return "", false, err
+	}
+
+	exists := false
+	var txt []string
+
+	for _, rr := range endpointRRs(records, dnsName) {
+		if record, ok := rr.(*dns.TXT); ok {
+			txt = append(txt, strings.Join(record.Txt, ""))
+		} else {
+			exists = true
+		}
+	}
+
+	return ownerFromTXT(txt), exists, nil
+}
+
+// ApplyChanges rewrites the file of each zone the changes belong to once, with
+// all of its changes applied.
+func (p *ZoneFileProvider) ApplyChanges(changes []DNSChange) []error {
+	errs := make([]error, len(changes))
+
+	var zones []string
+	zoneChanges := map[string][]int{}
+
+	for i, change := range changes {
+		zone, err := p.zone(change.Endpoint.DNSName)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+
+		if _, ok := zoneChanges[zone]; !ok {
+			zones = append(zones, zone)
+		}
+		zoneChanges[zone] = append(zoneChanges[zone], i)
+	}
+
+	for _, zone := range zones {
+		indexes := zoneChanges[zone]
+
+		if err := p.applyZoneChanges(zone, changes, indexes, errs); err != nil {
+			for _, i := range indexes {
+				if errs[i] == nil {
+					errs[i] = err
+				}
+			}
+		}
+	}
+
+	return errs
+}
+
+func (p *ZoneFileProvider) applyZoneChanges(zone string, changes []DNSChange, indexes []int, errs []error) error {
+	current, err := p.readZone(zone)
+	if err != nil {
+		return err
+	}
+
+	records := current
+	for _, i := range indexes {
+		change := changes[i]
+
+		var desired []dns.RR
+		if change.Action != "DELETE" {
+			desired, err = rfc2136RecordsFromEndpoint(change.Endpoint)
+			if err != nil {
+				errs[i] = err
+				continue
+			}
+		}
+
+		stale := endpointRRs(records, change.Endpoint.DNSName)
+		records = append(withoutRRs(records, stale), desired...)
+	}
+
+	if sameRecords(current, records) {
+		return nil
+	}
+
+	records = p.bumpSerial(zone, records)
+	path := p.path(zone)
+
+	if dryRun {
+		log.Printf("DRY RUN: We normally would have written %d records to %s\n", len(records), path)
+		return nil
+	}
+
+	if err := writeZoneFile(path, zone, records); err != nil {
+		return fmt.Errorf("Could not write zone file of %s: %v", zone, err)
+	}
+
+	log.Printf("Wrote %d records to %s\n", len(records), path)
+	return nil
+}
+
+// ListEndpoints reads the files of every configured zone, whatever the names.
+func (p *ZoneFileProvider) ListEndpoints(dnsNames []string) ([]Endpoint, error) {
+	var records []DNSRecord
+
+	for _, zone := range p.zones {
+		zoneRecords, err := p.readZone(zone)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, recordsFromRRs(zoneRecords)...)
+	}
+
+	return ownedEndpoints(records), nil
+}
+
+// zone returns the most specific of the configured zones the given name
+// belongs to.
+func (p *ZoneFileProvider) zone(dnsName string) (string, error) {
+	i := mostSpecificZone(dnsName, p.zones)
+	if i < 0 {
+		return "", fmt.Errorf("No zone matches domain %s", dnsName)
+	}
+
+	return p.zones[i], nil
+}
+
+func (p *ZoneFileProvider) path(zone string) string {
+	return filepath.Join(p.dir, strings.TrimSuffix(zone, ".")+".zone")
+}
+
+// readZone returns the records of the file of the given zone. Zones without a
+// file yet start with a SOA and an NS record for the configured nameserver.
+func (p *ZoneFileProvider) readZone(zone string) ([]dns.RR, error) {
+	file, err := os.Open(p.path(zone))
+	if os.IsNotExist(err) {
+		return p.newZone(zone)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Could not read zone file of %s: %v", zone, err)
+	}
+	defer file.Close()
+
+	var records []dns.RR
+	var parseErr error
+
+	// The channel must be drained for the parser to finish
+	for token := range dns.ParseZone(file, zone, file.Name()) {
+		if token.Error != nil {
+			parseErr = token.Error
+			continue
+		}
+		records = append(records, token.RR)
+	}
+
+	if parseErr != nil {
+		return nil, fmt.Errorf("Could not parse zone file of %s: %v", zone, parseErr)
+	}
+
+	return records, nil
+}
+
+func (p *ZoneFileProvider) newZone(zone string) ([]dns.RR, error) {
+	nameserver := p.nameserver
+	if nameserver == "" {
+		nameserver = "ns1." + zone
+	}
+	nameserver = dns.Fqdn(nameserver)
+
+	soa, err := dns.NewRR(fmt.Sprintf("%s 3600 IN SOA %s hostmaster.%s 0 3600 600 604800 60", zone, nameserver, zone))
+	if err != nil {
+		return nil, err
+	}
+
+	ns, err := dns.NewRR(fmt.Sprintf("%s 3600 IN NS %s", zone, nameserver))
+	if err != nil {
+		return nil, err
+	}
+
+	return []dns.RR{soa, ns}, nil
+}
+
+// bumpSerial returns the records with the serial of the SOA record increased,
+// following the YYYYMMDDnn convention as long as the current serial allows.
+func (p *ZoneFileProvider) bumpSerial(zone string, records []dns.RR) []dns.RR {
+	bumped := make([]dns.RR, len(records))
+
+	for i, rr := range records {
+		if soa, ok := rr.(*dns.SOA); ok && strings.EqualFold(soa.Hdr.Name, zone) {
+			soa = dns.Copy(soa).(*dns.SOA)
+			soa.Serial = nextSerial(soa.Serial, p.now())
+			rr = soa
+		}
+		bumped[i] = rr
+	}
+
+	return bumped
+}
+
+// nextSerial returns the serial following the given one: the first one of the
+// given day if it is still ahead, the next one otherwise.
+func nextSerial(serial uint32, now time.Time) uint32 {
+	date, _ := strconv.ParseUint(now.UTC().Format("20060102"), 10, 32)
+
+	if daySerial := uint32(date * 100); daySerial > serial {
+		return daySerial
+	}
+
+	return serial + 1
+}
+
+// zoneFileRecords sorts the records of a zone in the order they are written to
+// its zone file.
+type zoneFileRecords struct {
+	records []dns.RR
+	zone    string
+}
+
+func (r zoneFileRecords) Len() int      { return len(r.records) }
+func (r zoneFileRecords) Swap(i, j int) { r.records[i], r.records[j] = r.records[j], r.records[i] }
+func (r zoneFileRecords) Less(i, j int) bool {
+	return zoneFileOrder(r.records[i], r.zone) < zoneFileOrder(r.records[j], r.zone)
+}
+
+// writeZoneFile replaces the given file with the records, SOA and NS records of
+// the apex first. The file is replaced at once, so it is never seen half
+// written.
+func writeZoneFile(path, zone string, records []dns.RR) error {
+	sorted := append([]dns.RR{}, records...)
+	sort.Stable(zoneFileRecords{records: sorted, zone: zone})
+
+	var lines []string
+	lines = append(lines, "; Generated by kubernetes-service-dns-update", "$ORIGIN "+zone)
+	for _, rr := range sorted {
+		lines = append(lines, rr.String())
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.WriteString(strings.Join(lines, "\n") + "\n"); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// zoneFileOrder returns the sort key of a record in a zone file: SOA and NS
+// records of the apex first, then the rest by name and type.
+func zoneFileOrder(rr dns.RR, zone string) string {
+	header := rr.Header()
+	name := strings.ToLower(header.Name)
+
+	if name == zone && header.Rrtype == dns.TypeSOA {
+		return "0"
+	}
+	if name == zone && header.Rrtype == dns.TypeNS {
+		return "1"
+	}
+
+	// Names are compared from the apex down, so subdomains follow their parent
+	labels := dns.SplitDomainName(name)
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+
+	return fmt.Sprintf("2 %s %05d", strings.Join(labels, " "), header.Rrtype)
+}
+
+// endpointRRs returns the address records of the given name among the given
+// records, along with its TXT ownership records.
+func endpointRRs(records []dns.RR, dnsName string) []dns.RR {
+	dnsName = dns.Fqdn(strings.ToLower(dnsName))
+	ownerName := dns.Fqdn(ownerRecordName(dnsName))
+
+	var matching []dns.RR
+	for _, rr := range records {
+		header := rr.Header()
+		name := strings.ToLower(header.Name)
+
+		isAddress := name == dnsName && containsString(addressRecordTypes, dns.TypeToString[header.Rrtype])
+		isOwner := name == ownerName && header.Rrtype == dns.TypeTXT
+
+		if isAddress || isOwner {
+			matching = append(matching, rr)
+		}
+	}
+
+	return matching
+}
+
+// withoutRRs returns the records that are not in the given list.
+func withoutRRs(records, removed []dns.RR) []dns.RR {
+	var kept []dns.RR
+	for _, rr := range records {
+		found := false
+		for _, other := range removed {
+			if rr == other {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			kept = append(kept, rr)
+		}
+	}
+
+	return kept
+}
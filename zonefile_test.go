@@ -0,0 +1,304 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testZoneFileOwner = "heritage=kubernetes-service-dns-update,cluster=default,service=/service"
+
+func testZoneFileProvider(t *testing.T, files map[string]string) (*ZoneFileProvider, func()) {
+	dir, err := ioutil.TempDir("", "zonefile")
+	if err != nil {
+		t.Fatalf("Could not create directory: %v", err)
+	}
+
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("Could not write %s: %v", name, err)
+		}
+	}
+
+	provider := &ZoneFileProvider{
+		dir:   dir,
+		zones: []string{"domain.com.", "sub.domain.com."},
+		now:   func() time.Time { return time.Date(2017, 11, 25, 12, 0, 0, 0, time.UTC) },
+	}
+
+	return provider, func() { os.RemoveAll(dir) }
+}
+
+func readZoneFile(t *testing.T, provider *ZoneFileProvider, name string) string {
+	content, err := ioutil.ReadFile(filepath.Join(provider.dir, name))
+	if os.IsNotExist(err) {
+		return ""
+	}
+	if err != nil {
+		t.Fatalf("Could not read %s: %v", name, err)
+	}
+
+	return strings.Replace(string(content), "\t", " ", -1)
+}
+
+const testZoneFile = `$ORIGIN domain.com.
+$TTL 3600
+@ IN SOA ns1 hostmaster 2017112507 3600 600 604800 60
+@ IN NS ns1
+ns1 IN A 198.51.100.1
+some 300 IN CNAME lb.hostname.example.net.
+_owner.some 300 IN TXT "` + testZoneFileOwner + `"
+`
+
+func TestZoneFileProviderGetOwner(t *testing.T) {
+	scenarios := []struct {
+		dnsName string
+		files   map[string]string
+
+		expectedOwner  string
+		expectedExists bool
+		expectedError  error
+	}{
+		// No zone for the domain
+		{
+			dnsName: "some.example.com",
+
+			expectedError: errors.New("No zone matches domain some.example.com"),
+		},
+
+		// No zone file yet
+		{
+			dnsName: "some.domain.com",
+		},
+
+		// Record not owned by anybody
+		{
+			dnsName: "ns1.domain.com",
+			files:   map[string]string{"domain.com.zone": testZoneFile},
+
+			expectedExists: true,
+		},
+
+		// Owned record
+		{
+			dnsName: "Some.Domain.com",
+			files:   map[string]string{"domain.com.zone": testZoneFile},
+
+			expectedOwner:  testZoneFileOwner,
+			expectedExists: true,
+		},
+	}
+
+	for _, scenario := range scenarios {
+		provider, cleanup := testZoneFileProvider(t, scenario.files)
+
+		owner, exists, err := provider.GetOwner(scenario.dnsName)
+
+		if !reflect.DeepEqual(err, scenario.expectedError) {
+			t.Errorf("Expected error to be '%v', was '%v'", scenario.expectedError, err)
+		}
+
+		if owner != scenario.expectedOwner || exists != scenario.expectedExists {
+			t.Errorf("Expected owner of %s to be '%s' (%v), was '%s' (%v)", scenario.dnsName, scenario.expectedOwner, scenario.expectedExists, owner, exists)
+		}
+
+		cleanup()
+	}
+}
+
+func TestZoneFileProviderListEndpoints(t *testing.T) {
+	// The file of sub.domain.com does not exist yet
+	provider, cleanup := testZoneFileProvider(t, map[string]string{"domain.com.zone": testZoneFile})
+	defer cleanup()
+
+	endpoints, err := provider.ListEndpoints(nil)
+	if err != nil {
+		t.Errorf("Expected no error, was '%v'", err)
+	}
+
+	expected := []Endpoint{
+		Endpoint{DNSName: "some.domain.com", RecordType: "CNAME", Targets: []string{"lb.hostname.example.net"}, TTL: 300, Owner: testZoneFileOwner},
+	}
+
+	if !reflect.DeepEqual(endpoints, expected) {
+		t.Errorf("Expected endpoints to be '%v', was '%v'", expected, endpoints)
+	}
+}
+
+func TestZoneFileProviderApplyChanges(t *testing.T) {
+	endpoint := Endpoint{
+		DNSName:    "some.domain.com",
+		RecordType: "A",
+		Targets:    []string{"203.0.113.10"},
+		Owner:      testZoneFileOwner,
+	}
+
+	otherEndpoint := Endpoint{
+		DNSName:    "other.domain.com",
+		RecordType: "CNAME",
+		Targets:    []string{"lb.hostname.example.net"},
+		Owner:      testZoneFileOwner,
+	}
+
+	scenarios := []struct {
+		description string
+		dryRun      bool
+		changes     []DNSChange
+		files       map[string]string
+
+		expectedFile   string
+		expectedErrors []error
+	}{
+		{
+			description: "zone files are created",
+			changes:     []DNSChange{DNSChange{Action: "UPSERT", Endpoint: endpoint}},
+
+			expectedFile: `; Generated by kubernetes-service-dns-update
+$ORIGIN domain.com.
+domain.com. 3600 IN SOA ns1.domain.com. hostmaster.domain.com. 2017112500 3600 600 604800 60
+domain.com. 3600 IN NS ns1.domain.com.
+some.domain.com. 300 IN A 203.0.113.10
+_owner.some.domain.com. 300 IN TXT "` + testZoneFileOwner + `"
+`,
+			expectedErrors: []error{nil},
+		},
+		{
+			description: "records are replaced and added at once, bumping the serial",
+			changes: []DNSChange{
+				DNSChange{Action: "UPSERT", Endpoint: endpoint},
+				DNSChange{Action: "UPSERT", Endpoint: otherEndpoint},
+			},
+			files: map[string]string{"domain.com.zone": testZoneFile},
+
+			expectedFile: `; Generated by kubernetes-service-dns-update
+$ORIGIN domain.com.
+domain.com. 3600 IN SOA ns1.domain.com. hostmaster.domain.com. 2017112508 3600 600 604800 60
+domain.com. 3600 IN NS ns1.domain.com.
+ns1.domain.com. 3600 IN A 198.51.100.1
+other.domain.com. 300 IN CNAME lb.hostname.example.net.
+_owner.other.domain.com. 300 IN TXT "` + testZoneFileOwner + `"
+some.domain.com. 300 IN A 203.0.113.10
+_owner.some.domain.com. 300 IN TXT "` + testZoneFileOwner + `"
+`,
+			expectedErrors: []error{nil, nil},
+		},
+		{
+			description: "zone files already up to date are left alone",
+			changes: []DNSChange{DNSChange{Action: "UPSERT", Endpoint: Endpoint{
+				DNSName:    "some.domain.com",
+				RecordType: "CNAME",
+				Targets:    []string{"lb.hostname.example.net"},
+				Owner:      testZoneFileOwner,
+			}}},
+			files: map[string]string{"domain.com.zone": testZoneFile},
+
+			expectedFile:   testZoneFile,
+			expectedErrors: []error{nil},
+		},
+		{
+			description: "records are deleted",
+			changes:     []DNSChange{DNSChange{Action: "DELETE", Endpoint: endpoint}},
+			files:       map[string]string{"domain.com.zone": testZoneFile},
+
+			expectedFile: `; Generated by kubernetes-service-dns-update
+$ORIGIN domain.com.
+domain.com. 3600 IN SOA ns1.domain.com. hostmaster.domain.com. 2017112508 3600 600 604800 60
+domain.com. 3600 IN NS ns1.domain.com.
+ns1.domain.com. 3600 IN A 198.51.100.1
+`,
+			expectedErrors: []error{nil},
+		},
+		{
+			description: "changes are only logged in dry-run mode",
+			dryRun:      true,
+			changes:     []DNSChange{DNSChange{Action: "UPSERT", Endpoint: endpoint}},
+
+			expectedErrors: []error{nil},
+		},
+		{
+			description: "records outside of any zone fail on their own",
+			changes: []DNSChange{
+				DNSChange{Action: "UPSERT", Endpoint: Endpoint{DNSName: "some.example.com", RecordType: "A", Targets: []string{"203.0.113.10"}}},
+				DNSChange{Action: "DELETE", Endpoint: endpoint},
+			},
+			files: map[string]string{"domain.com.zone": testZoneFile},
+
+			expectedFile: `; Generated by kubernetes-service-dns-update
+$ORIGIN domain.com.
+domain.com. 3600 IN SOA ns1.domain.com. hostmaster.domain.com. 2017112508 3600 600 604800 60
+domain.com. 3600 IN NS ns1.domain.com.
+ns1.domain.com. 3600 IN A 198.51.100.1
+`,
+			expectedErrors: []error{errors.New("No zone matches domain some.example.com"), nil},
+		},
+		{
+			description: "CNAME records with several hostnames are refused",
+			changes:     []DNSChange{DNSChange{Action: "UPSERT", Endpoint: testSeveralHostnamesEndpoint(testZoneFileOwner)}},
+			files:       map[string]string{"domain.com.zone": testZoneFile},
+
+			expectedFile:   testZoneFile,
+			expectedErrors: []error{testSeveralHostnamesError},
+		},
+		{
+			description: "invalid zone files are not overwritten",
+			changes:     []DNSChange{DNSChange{Action: "UPSERT", Endpoint: endpoint}},
+			files:       map[string]string{"domain.com.zone": "some IN A not-an-ip\n"},
+
+			expectedFile:   "some IN A not-an-ip\n",
+			expectedErrors: []error{errors.New(`Could not parse zone file of domain.com.: ZONEFILE/domain.com.zone: dns: bad A A: "not-an-ip" at line: 1:19`)},
+		},
+	}
+
+	defer func(dryRunValue bool) { dryRun = dryRunValue }(dryRun)
+
+	for _, scenario := range scenarios {
+		dryRun = scenario.dryRun
+
+		provider, cleanup := testZoneFileProvider(t, scenario.files)
+
+		errs := provider.ApplyChanges(scenario.changes)
+
+		for i, err := range errs {
+			if err != nil {
+				errs[i] = errors.New(strings.Replace(err.Error(), provider.dir, "ZONEFILE", -1))
+			}
+		}
+
+		if !reflect.DeepEqual(errs, scenario.expectedErrors) {
+			t.Errorf("Expected errors to be '%v' when %s, was '%v'", scenario.expectedErrors, scenario.description, errs)
+		}
+
+		if file := readZoneFile(t, provider, "domain.com.zone"); file != scenario.expectedFile {
+			t.Errorf("Expected zone file to be\n%s\nwhen %s, was\n%s", scenario.expectedFile, scenario.description, file)
+		}
+
+		cleanup()
+	}
+}
+
+func TestNextSerial(t *testing.T) {
+	now := time.Date(2017, 11, 25, 12, 0, 0, 0, time.UTC)
+
+	scenarios := []struct {
+		serial   uint32
+		expected uint32
+	}{
+		{0, 2017112500},
+		{1, 2017112500},
+		{2017112412, 2017112500},
+		{2017112500, 2017112501},
+		{2017112599, 2017112600},
+		{4000000000, 4000000001},
+	}
+
+	for _, scenario := range scenarios {
+		if serial := nextSerial(scenario.serial, now); serial != scenario.expected {
+			t.Errorf("Expected serial after %d to be %d, was %d", scenario.serial, scenario.expected, serial)
+		}
+	}
+}